@@ -378,3 +378,188 @@ func (a AuthRSASHA256TLSSecret) GoString() string {
 	s += "}"
 	return s
 }
+
+// Reference: https://github.com/torproject/torspec/blob/8aaa36d1a062b20ca263b6ac613b77a3ba1eb113/tor-spec.txt#L776-L810
+//
+//	4.4.2. Link authentication type 3: Ed25519-SHA256-RFC5705.
+//
+//	   If AuthType is 3, meaning "Ed25519-SHA256-RFC5705", the
+//	   Authentication field of the AuthType cell is as below:
+//
+//	   Modified values and new fields below are marked with asterisks.
+//
+//	       TYPE: The characters "AUTH0003" [8 octets]
+//	       CID: A SHA256 hash of the initiator's RSA1024 identity key [32 octets]
+//	       SID: A SHA256 hash of the responder's RSA1024 identity key [32 octets]
+//	       CID_ED: The initiator's Ed25519 identity key [32 octets]
+//	       SID_ED: The responder's Ed25519 identity key, or all-zero. [32 octets]
+//	       SLOG: A SHA256 hash of all bytes sent from the responder to the
+//	         initiator as part of the negotiation up to and including the
+//	         AUTH_CHALLENGE cell; that is, the VERSIONS cell, the CERTS cell,
+//	         the AUTH_CHALLENGE cell, and any padding cells.  [32 octets]
+//	       CLOG: A SHA256 hash of all bytes sent from the initiator to the
+//	         responder as part of the negotiation so far; that is, the
+//	         VERSIONS cell and the CERTS cell and any padding cells. [32
+//	         octets]
+//	       SCERT: A SHA256 hash of the responder's TLS link certificate. [32
+//	         octets]
+//	       TLSSECRETS: The output of an RFC5705 Exporter function on the
+//	         TLS session, using as its inputs:
+//	          - The label string "EXPORTER FOR TOR TLS CLIENT BINDING AUTH0003"
+//	          - The context value equal to the initiator's Ed25519 identity key.
+//	          - The length 32.
+//	         [32 octets]
+//	       RAND: A 24 byte value, randomly chosen by the initiator. [24 octets]
+//	       SIG: A signature of all previous fields using the initiator's
+//	          Ed25519 authentication key (as in the cert with CertType 6).
+//	          [variable length]
+//
+
+// authEd25519ExporterLabel is the RFC 5705 exporter label for AUTH0003.
+const authEd25519ExporterLabel = "EXPORTER FOR TOR TLS CLIENT BINDING AUTH0003"
+
+// KeyingMaterialExporter exports keying material from a TLS session, as
+// described in RFC 5705.
+type KeyingMaterialExporter interface {
+	ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error)
+}
+
+type AuthEd25519SHA256RFC5705Payload []byte
+
+func NewAuthEd25519SHA256RFC5705Payload(b []byte) (AuthEd25519SHA256RFC5705Payload, error) {
+	p := AuthEd25519SHA256RFC5705Payload(b)
+	if len(b) < 288+torcrypto.Ed25519SignatureSize {
+		return p, errors.New("payload too short")
+	}
+	return p, nil
+}
+
+func (p AuthEd25519SHA256RFC5705Payload) Body() []byte {
+	return p[:264]
+}
+
+func (p AuthEd25519SHA256RFC5705Payload) Random() []byte {
+	return p[264:288]
+}
+
+func (p AuthEd25519SHA256RFC5705Payload) ToBeSigned() []byte {
+	return p[:288]
+}
+
+func (p AuthEd25519SHA256RFC5705Payload) Signature() []byte {
+	return p[288 : 288+torcrypto.Ed25519SignatureSize]
+}
+
+type AuthEd25519SHA256RFC5705 struct {
+	AuthKey               *torcrypto.Ed25519KeyPair
+	ClientIdentityKey     *rsa.PublicKey
+	ServerIdentityKey     *rsa.PublicKey
+	ClientEd25519Identity []byte
+	ServerEd25519Identity []byte
+	ServerLogHash         []byte
+	ClientLogHash         []byte
+	ServerLinkCert        []byte
+	TLS                   KeyingMaterialExporter
+}
+
+func (a AuthEd25519SHA256RFC5705) CID() ([]byte, error) {
+	return torcrypto.Fingerprint256(a.ClientIdentityKey)
+}
+
+func (a AuthEd25519SHA256RFC5705) SID() ([]byte, error) {
+	return torcrypto.Fingerprint256(a.ServerIdentityKey)
+}
+
+func (a AuthEd25519SHA256RFC5705) CIDEd() ([]byte, error) {
+	if len(a.ClientEd25519Identity) != torcrypto.Ed25519PublicKeySize {
+		return nil, errors.New("missing client ed25519 identity")
+	}
+	return a.ClientEd25519Identity, nil
+}
+
+// SIDEd returns the responder Ed25519 identity, or zeros if it has none.
+func (a AuthEd25519SHA256RFC5705) SIDEd() ([]byte, error) {
+	if a.ServerEd25519Identity == nil {
+		return make([]byte, torcrypto.Ed25519PublicKeySize), nil
+	}
+	if len(a.ServerEd25519Identity) != torcrypto.Ed25519PublicKeySize {
+		return nil, errors.New("bad server ed25519 identity")
+	}
+	return a.ServerEd25519Identity, nil
+}
+
+func (a AuthEd25519SHA256RFC5705) SCERT() [32]byte {
+	return sha256.Sum256(a.ServerLinkCert)
+}
+
+func (a AuthEd25519SHA256RFC5705) TLSSecrets() ([]byte, error) {
+	cid, err := a.CIDEd()
+	if err != nil {
+		return nil, err
+	}
+	return a.TLS.ExportKeyingMaterial(authEd25519ExporterLabel, cid, 32)
+}
+
+func (a AuthEd25519SHA256RFC5705) Body() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write([]byte("AUTH0003"))
+
+	for _, field := range []func() ([]byte, error){a.CID, a.SID, a.CIDEd, a.SIDEd} {
+		b, err := field()
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+
+	buf.Write(a.ServerLogHash)
+
+	buf.Write(a.ClientLogHash)
+
+	scert := a.SCERT()
+	buf.Write(scert[:])
+
+	secrets, err := a.TLSSecrets()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to export tls secrets")
+	}
+	buf.Write(secrets)
+
+	return buf.Bytes(), nil
+}
+
+func (a AuthEd25519SHA256RFC5705) SignedBody() ([]byte, error) {
+	var buf bytes.Buffer
+
+	body, err := a.Body()
+	if err != nil {
+		return nil, err
+	}
+	buf.Write(body)
+
+	_, err = io.CopyN(&buf, cryptorand.Reader, 24)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read enough random bytes")
+	}
+
+	if a.AuthKey == nil {
+		return nil, errors.New("cannot sign without auth key")
+	}
+
+	buf.Write(a.AuthKey.Sign(buf.Bytes()))
+
+	return buf.Bytes(), nil
+}
+
+func (a AuthEd25519SHA256RFC5705) Cell() (Cell, error) {
+	body, err := a.SignedBody()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &AuthenticateCell{
+		Method:         AuthMethodEd25519SHA256RFC5705,
+		Authentication: body,
+	}
+	return c.Cell()
+}
@@ -1,6 +1,8 @@
 package pearl
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"testing"
 
 	"github.com/mmcloughlin/pearl/torcrypto"
@@ -154,3 +156,54 @@ func TestAuthRSASHA256TLSSecret(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, expect, body)
 }
+
+// fixedExporter is a KeyingMaterialExporter that derives output from its
+// inputs, for testing.
+type fixedExporter struct{}
+
+func (fixedExporter) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	h := sha256.New()
+	h.Write([]byte(label))
+	h.Write(context)
+	return h.Sum(nil)[:length], nil
+}
+
+func TestAuthEd25519SHA256RFC5705(t *testing.T) {
+	clientID, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	serverID, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	authKey, err := torcrypto.GenerateEd25519KeyPair()
+	require.NoError(t, err)
+
+	a := AuthEd25519SHA256RFC5705{
+		AuthKey:               authKey,
+		ClientIdentityKey:     &clientID.PublicKey,
+		ServerIdentityKey:     &serverID.PublicKey,
+		ClientEd25519Identity: bytes.Repeat([]byte{1}, 32),
+		ServerLogHash:         bytes.Repeat([]byte{2}, 32),
+		ClientLogHash:         bytes.Repeat([]byte{3}, 32),
+		ServerLinkCert:        []byte("cert"),
+		TLS:                   fixedExporter{},
+	}
+
+	body, err := a.Body()
+	require.NoError(t, err)
+	require.Len(t, body, 264)
+	assert.Equal(t, []byte("AUTH0003"), body[:8])
+	assert.Equal(t, make([]byte, 32), body[104:136], "SID_ED should be zero")
+
+	signed, err := a.SignedBody()
+	require.NoError(t, err)
+
+	p, err := NewAuthEd25519SHA256RFC5705Payload(signed)
+	require.NoError(t, err)
+	assert.Equal(t, body, []byte(p.Body()))
+	assert.Len(t, p.Random(), 24)
+	assert.True(t, torcrypto.VerifyEd25519(authKey.Public, p.ToBeSigned(), p.Signature()))
+}
+
+func TestAuthEd25519SHA256RFC5705PayloadShort(t *testing.T) {
+	_, err := NewAuthEd25519SHA256RFC5705Payload(make([]byte, 351))
+	assert.Error(t, err)
+}
@@ -0,0 +1,192 @@
+package bwhistory
+
+import (
+	"sync"
+	"time"
+)
+
+// Parameters of bandwidth history, matching tor.
+const (
+	// RollingPeriod is the period over which throughput is averaged when
+	// measuring observed bandwidth.
+	RollingPeriod = 10 * time.Second
+
+	// Interval is the length of each history bucket.
+	Interval = 15 * time.Minute
+
+	// NumIntervals is the number of history buckets kept, covering one day.
+	NumIntervals = 96
+)
+
+const rollingSeconds = int(RollingPeriod / time.Second)
+
+// Array records bandwidth in one direction. It tracks the total bytes in each
+// Interval, and the highest RollingPeriod throughput within each interval.
+type Array struct {
+	mu  sync.Mutex
+	now func() time.Time
+
+	// Rolling window of bytes per second.
+	second time.Time // start of the current second
+	cur    int64     // bytes in the current second
+	window [rollingSeconds]int64
+	idx    int
+	sum    int64 // total of window
+
+	// Current interval.
+	end   time.Time
+	total int64
+	max   int64 // highest window sum
+
+	// Completed intervals, oldest first.
+	totals []int64
+	maxima []int64
+}
+
+// NewArray builds an empty bandwidth array.
+func NewArray() *Array {
+	return newArrayAt(time.Now)
+}
+
+func newArrayAt(now func() time.Time) *Array {
+	t := now().Truncate(time.Second)
+	return &Array{
+		now:    now,
+		second: t,
+		end:    t.Truncate(Interval).Add(Interval),
+	}
+}
+
+// Inc records n bytes transferred now. This allows an Array to be used as a
+// tally.Counter.
+func (a *Array) Inc(n int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.advance(a.now())
+	a.cur += n
+	a.total += n
+}
+
+// Max returns the highest throughput in bytes per second, averaged over
+// RollingPeriod, seen in the last day.
+func (a *Array) Max() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.advance(a.now())
+
+	max := a.max
+	for _, m := range a.maxima {
+		if m > max {
+			max = m
+		}
+	}
+	return max / int64(rollingSeconds)
+}
+
+// History returns totals for the completed intervals, oldest first, and the
+// end time of the most recent.
+func (a *Array) History() (time.Time, []int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.advance(a.now())
+	return a.end.Add(-Interval), append([]int64(nil), a.totals...)
+}
+
+// advance moves the array forward to now, completing seconds and intervals
+// that have passed. The caller must hold mu.
+func (a *Array) advance(now time.Time) {
+	now = now.Truncate(time.Second)
+
+	// After a long gap the history is simply empty.
+	if now.Sub(a.end) > NumIntervals*Interval {
+		a.reset(now)
+	}
+
+	for steps := 0; a.second.Before(now); steps++ {
+		// Once the rolling window is empty, skip directly to now.
+		if steps > rollingSeconds && a.sum == 0 {
+			for !now.Before(a.end) {
+				a.completeInterval()
+			}
+			a.second = now
+			break
+		}
+
+		a.completeSecond()
+		a.second = a.second.Add(time.Second)
+		if !a.second.Before(a.end) {
+			a.completeInterval()
+		}
+	}
+}
+
+func (a *Array) completeSecond() {
+	a.sum += a.cur - a.window[a.idx]
+	a.window[a.idx] = a.cur
+	a.idx = (a.idx + 1) % rollingSeconds
+	a.cur = 0
+	if a.sum > a.max {
+		a.max = a.sum
+	}
+}
+
+func (a *Array) completeInterval() {
+	a.totals = appendBounded(a.totals, a.total)
+	a.maxima = appendBounded(a.maxima, a.max)
+	a.total = 0
+	a.max = 0
+	a.end = a.end.Add(Interval)
+}
+
+func (a *Array) reset(now time.Time) {
+	a.second = now
+	a.cur = 0
+	a.window = [rollingSeconds]int64{}
+	a.idx = 0
+	a.sum = 0
+	a.end = now.Truncate(Interval).Add(Interval)
+	a.total = 0
+	a.max = 0
+	a.totals = nil
+	a.maxima = nil
+}
+
+// restore replaces the completed intervals, where the most recent ended at
+// end. Maxima are given in bytes per second.
+func (a *Array) restore(end time.Time, totals, maxima []int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.reset(end)
+	a.end = end.Add(Interval)
+	for i := range totals {
+		a.totals = appendBounded(a.totals, totals[i])
+		var m int64
+		if i < len(maxima) {
+			m = maxima[i] * int64(rollingSeconds)
+		}
+		a.maxima = appendBounded(a.maxima, m)
+	}
+}
+
+// snapshot returns the completed intervals as for restore.
+func (a *Array) snapshot() (time.Time, []int64, []int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.advance(a.now())
+
+	maxima := make([]int64, len(a.maxima))
+	for i, m := range a.maxima {
+		maxima[i] = m / int64(rollingSeconds)
+	}
+	return a.end.Add(-Interval), append([]int64(nil), a.totals...), maxima
+}
+
+// appendBounded appends v to s, keeping at most NumIntervals values.
+func appendBounded(s []int64, v int64) []int64 {
+	s = append(s, v)
+	if len(s) > NumIntervals {
+		s = s[len(s)-NumIntervals:]
+	}
+	return s
+}
@@ -0,0 +1,92 @@
+package bwhistory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time          { return c.t }
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func TestArrayMaxSustained(t *testing.T) {
+	clk := newFakeClock()
+	a := newArrayAt(clk.Now)
+
+	// 1000 bytes per second for 20 seconds.
+	for i := 0; i < 20; i++ {
+		a.Inc(1000)
+		clk.Advance(time.Second)
+	}
+	assert.Equal(t, int64(1000), a.Max())
+}
+
+func TestArrayMaxShortBurst(t *testing.T) {
+	clk := newFakeClock()
+	a := newArrayAt(clk.Now)
+
+	// A single burst is averaged over the rolling period.
+	a.Inc(50000)
+	clk.Advance(time.Minute)
+	assert.Equal(t, int64(5000), a.Max())
+}
+
+func TestArrayMaxExpires(t *testing.T) {
+	clk := newFakeClock()
+	a := newArrayAt(clk.Now)
+
+	a.Inc(10000)
+	clk.Advance(time.Minute)
+	assert.Equal(t, int64(1000), a.Max())
+
+	clk.Advance(NumIntervals*Interval + Interval)
+	assert.Equal(t, int64(0), a.Max())
+}
+
+func TestArrayHistory(t *testing.T) {
+	clk := newFakeClock()
+	a := newArrayAt(clk.Now)
+
+	a.Inc(100)
+	clk.Advance(Interval)
+	a.Inc(200)
+	clk.Advance(2 * Interval)
+
+	end, totals := a.History()
+	assert.Equal(t, []int64{100, 200, 0}, totals)
+	assert.Equal(t, clk.Now(), end)
+}
+
+func TestArrayHistoryBounded(t *testing.T) {
+	clk := newFakeClock()
+	a := newArrayAt(clk.Now)
+
+	for i := 0; i < 2*NumIntervals; i++ {
+		a.Inc(1)
+		clk.Advance(Interval)
+	}
+
+	_, totals := a.History()
+	assert.Len(t, totals, NumIntervals)
+}
+
+func TestArrayLongIdle(t *testing.T) {
+	clk := newFakeClock()
+	a := newArrayAt(clk.Now)
+
+	a.Inc(100)
+	clk.Advance(10 * 365 * 24 * time.Hour)
+	a.Inc(100)
+
+	_, totals := a.History()
+	assert.Empty(t, totals)
+}
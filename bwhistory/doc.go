@@ -0,0 +1,3 @@
+// Package bwhistory records bandwidth history, for reporting observed
+// bandwidth in server descriptors and traffic totals in extra-info documents.
+package bwhistory
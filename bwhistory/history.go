@@ -0,0 +1,151 @@
+package bwhistory
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TimeFormat is the format of timestamps in the state file.
+const TimeFormat = "2006-01-02 15:04:05"
+
+// History records read and write bandwidth for a relay.
+type History struct {
+	Read  *Array
+	Write *Array
+}
+
+// NewHistory builds an empty bandwidth history.
+func NewHistory() *History {
+	return newHistoryAt(time.Now)
+}
+
+func newHistoryAt(now func() time.Time) *History {
+	return &History{
+		Read:  newArrayAt(now),
+		Write: newArrayAt(now),
+	}
+}
+
+// Observed returns the observed bandwidth in bytes per second, suitable for
+// publishing in a server descriptor. This is the lesser of the highest
+// sustained read and write throughput over the past day.
+func (h *History) Observed() int {
+	r, w := h.Read.Max(), h.Write.Max()
+	if w < r {
+		r = w
+	}
+	return int(r)
+}
+
+// MarshalText encodes the history in the format of tor's state file.
+func (h *History) MarshalText() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, d := range h.directions() {
+		end, totals, maxima := d.array.snapshot()
+		fmt.Fprintf(buf, "BWHistory%sEnds %s\n", d.name, end.UTC().Format(TimeFormat))
+		fmt.Fprintf(buf, "BWHistory%sInterval %d\n", d.name, int(Interval/time.Second))
+		fmt.Fprintf(buf, "BWHistory%sValues %s\n", d.name, joinInts(totals))
+		fmt.Fprintf(buf, "BWHistory%sMaxima %s\n", d.name, joinInts(maxima))
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalText restores history from tor state file format. Unrecognized
+// lines are ignored.
+func (h *History) UnmarshalText(text []byte) error {
+	type state struct {
+		end            time.Time
+		totals, maxima []int64
+	}
+	states := map[string]*state{}
+	for _, d := range h.directions() {
+		states[d.name] = &state{}
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(text))
+	for s.Scan() {
+		parts := strings.SplitN(strings.TrimSpace(s.Text()), " ", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "BWHistory") {
+			continue
+		}
+		key, value := strings.TrimPrefix(parts[0], "BWHistory"), parts[1]
+
+		for name, st := range states {
+			if !strings.HasPrefix(key, name) {
+				continue
+			}
+			var err error
+			switch strings.TrimPrefix(key, name) {
+			case "Ends":
+				st.end, err = time.ParseInLocation(TimeFormat, value, time.UTC)
+			case "Interval":
+				var secs int
+				secs, err = strconv.Atoi(value)
+				if err == nil && time.Duration(secs)*time.Second != Interval {
+					err = errors.Errorf("unsupported interval %d", secs)
+				}
+			case "Values":
+				st.totals, err = parseInts(value)
+			case "Maxima":
+				st.maxima, err = parseInts(value)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "invalid %s", parts[0])
+			}
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+
+	for _, d := range h.directions() {
+		st := states[d.name]
+		if st.end.IsZero() {
+			continue
+		}
+		d.array.restore(st.end, st.totals, st.maxima)
+	}
+	return nil
+}
+
+type direction struct {
+	name  string
+	array *Array
+}
+
+func (h *History) directions() []direction {
+	return []direction{
+		{"Read", h.Read},
+		{"Write", h.Write},
+	}
+}
+
+func joinInts(xs []int64) string {
+	s := make([]string, len(xs))
+	for i, x := range xs {
+		s[i] = strconv.FormatInt(x, 10)
+	}
+	return strings.Join(s, ",")
+}
+
+func parseInts(s string) ([]int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	xs := make([]int64, len(parts))
+	for i, p := range parts {
+		x, err := strconv.ParseInt(p, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		xs[i] = x
+	}
+	return xs, nil
+}
@@ -0,0 +1,81 @@
+package bwhistory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistoryObserved(t *testing.T) {
+	clk := newFakeClock()
+	h := newHistoryAt(clk.Now)
+
+	for i := 0; i < 20; i++ {
+		h.Read.Inc(2000)
+		h.Write.Inc(1000)
+		clk.Advance(time.Second)
+	}
+	assert.Equal(t, 1000, h.Observed())
+}
+
+func TestHistoryMarshalText(t *testing.T) {
+	clk := newFakeClock()
+	h := newHistoryAt(clk.Now)
+
+	h.Read.Inc(10000)
+	h.Write.Inc(20000)
+	clk.Advance(Interval)
+	h.Read.Inc(30000)
+	clk.Advance(Interval)
+
+	text, err := h.MarshalText()
+	require.NoError(t, err)
+	expect := "BWHistoryReadEnds 2017-06-01 12:30:00\n" +
+		"BWHistoryReadInterval 900\n" +
+		"BWHistoryReadValues 10000,30000\n" +
+		"BWHistoryReadMaxima 1000,3000\n" +
+		"BWHistoryWriteEnds 2017-06-01 12:30:00\n" +
+		"BWHistoryWriteInterval 900\n" +
+		"BWHistoryWriteValues 20000,0\n" +
+		"BWHistoryWriteMaxima 2000,0\n"
+	assert.Equal(t, expect, string(text))
+}
+
+func TestHistoryRoundTrip(t *testing.T) {
+	clk := newFakeClock()
+	h := newHistoryAt(clk.Now)
+	h.Read.Inc(10000)
+	h.Write.Inc(40000)
+	clk.Advance(Interval)
+
+	text, err := h.MarshalText()
+	require.NoError(t, err)
+
+	clk.Advance(time.Hour)
+	restored := newHistoryAt(clk.Now)
+	require.NoError(t, restored.UnmarshalText(text))
+
+	assert.Equal(t, 1000, restored.Observed())
+	_, totals := restored.Write.History()
+	assert.Equal(t, []int64{40000, 0, 0, 0, 0}, totals)
+}
+
+func TestHistoryUnmarshalTextIgnoresUnknown(t *testing.T) {
+	h := NewHistory()
+	err := h.UnmarshalText([]byte("TorVersion Tor 0.3.0.7\nLastWritten 2017-06-01 12:00:00\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 0, h.Observed())
+}
+
+func TestHistoryUnmarshalTextErrors(t *testing.T) {
+	cases := []string{
+		"BWHistoryReadEnds yesterday\n",
+		"BWHistoryReadInterval 3600\n",
+		"BWHistoryWriteValues 1,two,3\n",
+	}
+	for _, c := range cases {
+		assert.Error(t, NewHistory().UnmarshalText([]byte(c)), c)
+	}
+}
@@ -87,8 +87,10 @@ func (ch *CellChan) ReceiveCell() (Cell, error) {
 
 type CircuitLink interface {
 	CircID() CircID
+	LinkVersion() LinkProtocolVersion
 	CellReceiverSender
 	Destroy(CircuitErrorCode) error
+	Release() error
 }
 
 type circLink struct {
@@ -111,13 +113,22 @@ func (c circLink) Destroy(reason CircuitErrorCode) error {
 	// XXX sync.Once ?
 	d := NewDestroyCell(c.CircID(), reason)
 	return multierr.Combine(
-		c.conn.circuits.Remove(c.CircID()),
+		c.conn.removeCircuit(c.CircID()),
 		c.SendCell(d.Cell()),
 	)
 }
 
+// Release frees the circuit ID without notifying the other side. It is used
+// when the other side has already destroyed the circuit.
+func (c circLink) Release() error {
+	return c.conn.removeCircuit(c.CircID())
+}
+
 func (c circLink) CircID() CircID { return c.id }
 
+// LinkVersion returns the link protocol version of the underlying connection.
+func (c circLink) LinkVersion() LinkProtocolVersion { return c.conn.linkVersion }
+
 // SenderManager manages a collection of cell senders.
 type SenderManager struct {
 	senders  map[CircID]CellSenderCloser
@@ -195,6 +206,13 @@ func (m *SenderManager) Sender(id CircID) (CellSender, bool) {
 	return sc, ok
 }
 
+// Len returns the number of registered senders.
+func (m *SenderManager) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.senders)
+}
+
 func (m *SenderManager) Remove(id CircID) error {
 	m.Lock()
 	defer m.Unlock()
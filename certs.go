@@ -2,6 +2,7 @@ package pearl
 
 import (
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/binary"
 	"time"
@@ -148,6 +149,42 @@ func (c *CertsCell) LookupPublicKey(t CertType) (*rsa.PublicKey, error) {
 	return torcrypto.ParseRSAPublicKeyFromCertificateDER(der)
 }
 
+// LookupEd25519Certificate is like Lookup but parses the certificate as an
+// Ed25519 certificate of the expected type, certifying a key of type k.
+func (c *CertsCell) LookupEd25519Certificate(t CertType, k torcrypto.CertKeyType) (*torcrypto.Ed25519Certificate, error) {
+	b, err := c.Lookup(t)
+	if err != nil {
+		return nil, err
+	}
+	crt, err := torcrypto.ParseEd25519Certificate(b)
+	if err != nil {
+		return nil, err
+	}
+	if byte(crt.Type) != byte(t) {
+		return nil, errors.New("certificate type does not match cell entry")
+	}
+	if crt.KeyType != k {
+		return nil, errors.New("unexpected certified key type")
+	}
+	return crt, nil
+}
+
+// LookupRSACrossCert is like Lookup but parses the RSA->Ed25519
+// cross-certificate.
+func (c *CertsCell) LookupRSACrossCert() (*torcrypto.RSACrossCert, error) {
+	b, err := c.Lookup(CertTypeEd25519Identity)
+	if err != nil {
+		return nil, err
+	}
+	return torcrypto.ParseRSACrossCert(b)
+}
+
+// HasEd25519 reports whether the cell claims an Ed25519 identity, by way of
+// an RSA->Ed25519 cross-certificate.
+func (c *CertsCell) HasEd25519() bool {
+	return c.CountType(CertTypeEd25519Identity) > 0
+}
+
 // Cell builds the cell.
 func (c CertsCell) Cell() (Cell, error) {
 	// Reference: https://github.com/torproject/torspec/blob/master/tor-spec.txt#L549-L553
@@ -317,6 +354,160 @@ func (c *CertsCell) ValidateInitiatorRSAOnly() error {
 	return nil
 }
 
+// ValidateResponderEd25519 checks whether the certificate cell authenticates
+// a responder with an Ed25519 identity, in addition to checks for the RSA
+// identity. Returns the Ed25519 identity key.
+func (c *CertsCell) ValidateResponderEd25519(peerCerts []*x509.Certificate, now time.Time) ([]byte, error) {
+	// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/tor-spec.txt#L650-L676
+	//
+	//	   To authenticate the responder as having a given Ed25519,RSA identity key
+	//	   combination, the initiator MUST check the following:
+	//	     * The CERTS cell contains exactly one CertType 2 "ID" certificate.
+	//	     * The CERTS cell contains exactly one CertType 4 Ed25519
+	//	       "Id->Signing" cert.
+	//	     * The CERTS cell contains exactly one CertType 5 Ed25519
+	//	       "Signing->link" certificate.
+	//	     * The CERTS cell contains exactly one CertType 7 "RSA->Ed25519"
+	//	       cross-certificate.
+	//	     * All X.509 certificates above have validAfter and validUntil dates;
+	//	       no X.509 or Ed25519 certificates are expired.
+	//	     * All certificates are correctly signed.
+	//	     * The certified key in the Signing->Link certificate matches the
+	//	       SHA256 digest of the certificate that was used to
+	//	       authenticate the TLS connection.
+	//	     * The identity key listed in the ID->Signing cert was used to
+	//	       sign the ID->Signing Cert. (see 5.1 in cert-spec.txt)
+	//	     * The Signing->Link cert was signed with the Signing key listed
+	//	       in the ID->Signing cert.
+	//	     * The RSA->Ed25519 cross-certificate certifies the Ed25519
+	//	       identity, and is signed with the RSA identity listed in the
+	//	       "ID" certificate.
+	//	     * The certified key in the ID certificate is a 1024-bit RSA key.
+	//	     * The RSA ID certificate is correctly self-signed.
+	//
+
+	identity, signing, err := c.validateEd25519Identity(now)
+	if err != nil {
+		return nil, err
+	}
+
+	link, err := c.LookupEd25519Certificate(CertTypeEd25519Link, torcrypto.CertKeyTypeSHA256X509)
+	if err != nil {
+		return nil, errors.Wrap(err, "link certificate")
+	}
+
+	if err := link.Verify(signing.CertifiedKey, now); err != nil {
+		return nil, errors.Wrap(err, "link certificate")
+	}
+
+	if len(peerCerts) != 1 {
+		return nil, errors.New("expecting 1 TLS peer certificate")
+	}
+
+	if link.CertifiedKey != sha256.Sum256(peerCerts[0].Raw) {
+		return nil, errors.New("link certificate does not match TLS certificate")
+	}
+
+	return identity, nil
+}
+
+// ValidateInitiatorEd25519 checks whether the certificate cell authenticates
+// an initiator with an Ed25519 identity. Returns the Ed25519 identity key and
+// the authentication key that must sign the AUTHENTICATE cell.
+func (c *CertsCell) ValidateInitiatorEd25519(now time.Time) ([]byte, [32]byte, error) {
+	// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/tor-spec.txt#L695-L718
+	//
+	//	   To authenticate the initiator with an Ed25519 key, the responder MUST
+	//	   check the following:
+	//	     * The CERTS cell contains exactly one CertType 2 "ID" certificate.
+	//	     * The CERTS cell contains exactly one CertType 4 Ed25519
+	//	       "Id->Signing" certificate.
+	//	     * The CERTS cell contains exactly one CertType 6 Ed25519
+	//	       "Signing->auth" certificate.
+	//	     * The CERTS cell contains exactly one CertType 7 "RSA->Ed25519"
+	//	       cross-certificate.
+	//	     * All X.509 certificates above have validAfter and validUntil dates;
+	//	       no X.509 or Ed25519 certificates are expired.
+	//	     * All certificates are correctly signed.
+	//	     * The identity key listed in the ID->Signing cert was used to
+	//	       sign the ID->Signing Cert. (see 5.1 in cert-spec.txt)
+	//	     * The Signing->AUTH cert was signed with the Signing key listed
+	//	       in the ID->Signing cert.
+	//	     * The RSA->Ed25519 cross-certificate certifies the Ed25519
+	//	       identity, and is signed with the RSA identity listed in the
+	//	       "ID" certificate.
+	//	     * The certified key in the ID certificate is a 1024-bit RSA key.
+	//	     * The RSA ID certificate is correctly self-signed.
+	//
+
+	var authKey [32]byte
+
+	identity, signing, err := c.validateEd25519Identity(now)
+	if err != nil {
+		return nil, authKey, err
+	}
+
+	auth, err := c.LookupEd25519Certificate(CertTypeEd25519Auth, torcrypto.CertKeyTypeEd25519)
+	if err != nil {
+		return nil, authKey, errors.Wrap(err, "auth certificate")
+	}
+
+	if err := auth.Verify(signing.CertifiedKey, now); err != nil {
+		return nil, authKey, errors.Wrap(err, "auth certificate")
+	}
+
+	return identity, auth.CertifiedKey, nil
+}
+
+// validateEd25519Identity performs the checks common to initiator and
+// responder Ed25519 authentication. It verifies the RSA identity certificate,
+// the RSA->Ed25519 cross-certificate and the Ed25519 signing key certificate.
+// Returns the Ed25519 identity key and the signing key certificate.
+func (c *CertsCell) validateEd25519Identity(now time.Time) ([]byte, *torcrypto.Ed25519Certificate, error) {
+	ident, err := c.LookupX509(CertTypeIdentity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := certificateChecks(ident, ident, now, true); err != nil {
+		return nil, nil, err
+	}
+
+	idKey, err := torcrypto.ExtractRSAPublicKeyFromCertificate(ident)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cross, err := c.LookupRSACrossCert()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cross certificate")
+	}
+
+	if err := cross.Verify(idKey, now); err != nil {
+		return nil, nil, errors.Wrap(err, "cross certificate")
+	}
+
+	signing, err := c.LookupEd25519Certificate(CertTypeEd25519Signing, torcrypto.CertKeyTypeEd25519)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "signing certificate")
+	}
+
+	// The signing key certificate must carry the signed-with-key extension,
+	// and it must name the identity from the cross-certificate.
+	if k, ok := signing.SigningKey(); !ok || k != cross.Ed25519Key {
+		return nil, nil, errors.New("signing certificate not signed by ed25519 identity")
+	}
+
+	if err := signing.Verify(cross.Ed25519Key, now); err != nil {
+		return nil, nil, errors.Wrap(err, "signing certificate")
+	}
+
+	identity := make([]byte, len(cross.Ed25519Key))
+	copy(identity, cross.Ed25519Key[:])
+
+	return identity, signing, nil
+}
+
 func certificateChecks(crt *x509.Certificate, parent *x509.Certificate, t time.Time, require1024 bool) error {
 	if !validCertificateDates(crt, t) {
 		return errors.New("outside certificate validity period")
@@ -0,0 +1,108 @@
+package pearl
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEd25519TLSContext(t *testing.T) (*TLSContext, *torconfig.Keys) {
+	k, err := torconfig.GenerateKeys()
+	require.NoError(t, err)
+	ctx, err := NewTLSContextFromKeys(k)
+	require.NoError(t, err)
+	return ctx, k
+}
+
+func responderCertsCell(ctx *TLSContext) *CertsCell {
+	h := &Handshake{TLSContext: ctx}
+	c := &CertsCell{}
+	c.AddCert(CertTypeLink, ctx.LinkCert)
+	c.AddCert(CertTypeIdentity, ctx.IDCert)
+	h.addEd25519Certs(c, CertTypeEd25519Link, ctx.Ed25519LinkCert)
+	return c
+}
+
+func initiatorCertsCell(ctx *TLSContext) *CertsCell {
+	h := &Handshake{TLSContext: ctx}
+	c := &CertsCell{}
+	c.AddCert(CertTypeIdentity, ctx.IDCert)
+	c.AddCert(CertTypeAuth, ctx.AuthCert)
+	h.addEd25519Certs(c, CertTypeEd25519Auth, ctx.Ed25519AuthCert)
+	return c
+}
+
+func TestNewTLSContextWithoutEd25519(t *testing.T) {
+	k, err := torconfig.GenerateKeys()
+	require.NoError(t, err)
+	k.Ed25519Identity = nil
+	ctx, err := NewTLSContextFromKeys(k)
+	require.NoError(t, err)
+	assert.Nil(t, ctx.Ed25519Identity())
+	assert.False(t, responderCertsCell(ctx).HasEd25519())
+}
+
+func TestValidateResponderEd25519(t *testing.T) {
+	ctx, k := newTestEd25519TLSContext(t)
+	c := responderCertsCell(ctx)
+	require.True(t, c.HasEd25519())
+
+	id, err := c.ValidateResponderEd25519([]*x509.Certificate{ctx.LinkCert}, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, k.Ed25519Identity.Public[:], id)
+}
+
+func TestValidateResponderEd25519WrongTLSCert(t *testing.T) {
+	ctx, _ := newTestEd25519TLSContext(t)
+	other, _ := newTestEd25519TLSContext(t)
+	c := responderCertsCell(ctx)
+	_, err := c.ValidateResponderEd25519([]*x509.Certificate{other.LinkCert}, time.Now())
+	assert.Error(t, err)
+}
+
+func TestValidateResponderEd25519Expired(t *testing.T) {
+	ctx, _ := newTestEd25519TLSContext(t)
+	c := responderCertsCell(ctx)
+	later := time.Now().Add(ed25519LinkCertLifetime + time.Hour)
+	_, err := c.ValidateResponderEd25519([]*x509.Certificate{ctx.LinkCert}, later)
+	assert.Error(t, err)
+}
+
+func TestValidateInitiatorEd25519(t *testing.T) {
+	ctx, k := newTestEd25519TLSContext(t)
+	c := initiatorCertsCell(ctx)
+
+	id, authKey, err := c.ValidateInitiatorEd25519(time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, k.Ed25519Identity.Public[:], id)
+	assert.Equal(t, ctx.Ed25519AuthKey.Public, authKey)
+}
+
+func TestValidateInitiatorEd25519MismatchedCrossCert(t *testing.T) {
+	ctx, _ := newTestEd25519TLSContext(t)
+	other, _ := newTestEd25519TLSContext(t)
+
+	// Substitute the cross-certificate from another relay. It is validly
+	// signed by that relay's RSA identity, which does not match the ID cert.
+	c := &CertsCell{}
+	for _, e := range initiatorCertsCell(ctx).Certs {
+		if e.Type == CertTypeEd25519Identity {
+			e.CertDER = other.RSACrossCert.Encode()
+		}
+		c.AddCertDER(e.Type, e.CertDER)
+	}
+
+	_, _, err := c.ValidateInitiatorEd25519(time.Now())
+	assert.Error(t, err)
+}
+
+func TestValidateInitiatorEd25519MissingAuth(t *testing.T) {
+	ctx, _ := newTestEd25519TLSContext(t)
+	c := responderCertsCell(ctx)
+	_, _, err := c.ValidateInitiatorEd25519(time.Now())
+	assert.Error(t, err)
+}
@@ -1,12 +1,15 @@
 package pearl
 
 import (
+	"bytes"
 	"crypto/cipher"
 	"encoding"
 	"encoding/binary"
 	"io"
 	"sync"
+	"time"
 
+	"github.com/pkg/errors"
 	"go.uber.org/multierr"
 
 	"github.com/mmcloughlin/pearl/check"
@@ -17,6 +20,17 @@ import (
 
 const (
 	defaultCircuitChannelBuffer = 16
+
+	// MaxRelayEarly is the maximum number of RELAY_EARLY cells accepted on a
+	// circuit.
+	//
+	// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/tor-spec.txt#L1280-L1284
+	//
+	//	   If a node ever receives more than 8 RELAY_EARLY cells on a given
+	//	   outbound circuit, it SHOULD close the circuit. If it receives any
+	//	   inbound RELAY_EARLY cells, it MUST close the circuit immediately.
+	//
+	MaxRelayEarly = 8
 )
 
 // GenerateCircID generates a 4-byte circuit ID with the given most significant bit.
@@ -97,14 +111,29 @@ type TransverseCircuit struct {
 	Forward  *CircuitCryptoState
 	Backward *CircuitCryptoState
 
-	Prev   CircuitLink
-	Next   CircuitLink
-	pch    *CellChan
-	nch    *CellChan
-	done   chan struct{}
-	reason CircuitErrorCode
-	once   sync.Once
-	wg     sync.WaitGroup
+	Prev    CircuitLink
+	Next    CircuitLink
+	pch     *CellChan
+	nch     *CellChan
+	och     chan originatedCell
+	streams map[uint16]*exitStream
+	done    chan struct{}
+	reason  CircuitErrorCode
+	once    sync.Once
+	wg      sync.WaitGroup
+
+	relayEarly int
+
+	// Extend state, only accessed from the circuit goroutine.
+	extending *pendingExtend
+	ech       chan extendConnection
+
+	// Flow control state. All but the package window are only accessed from
+	// the circuit goroutine.
+	packageWindow *packageWindow
+	deliverWindow int
+	packaged      int
+	sendmeDigests [][]byte
 
 	logger log.Logger
 }
@@ -121,12 +150,18 @@ func NewTransverseCircuit(conn *Connection, id CircID, fwd, back *CircuitCryptoS
 		Forward:  fwd,
 		Backward: back,
 
-		Prev:   NewCircuitLink(conn, id, pch),
-		Next:   nil,
-		pch:    pch,
-		nch:    nch,
-		done:   done,
-		reason: CircuitErrorNone,
+		Prev:    NewCircuitLink(conn, id, pch),
+		Next:    nil,
+		pch:     pch,
+		nch:     nch,
+		och:     make(chan originatedCell, defaultCircuitChannelBuffer),
+		ech:     make(chan extendConnection),
+		streams: make(map[uint16]*exitStream),
+		done:    done,
+		reason:  CircuitErrorNone,
+
+		packageWindow: newPackageWindow(CircuitWindowStart),
+		deliverWindow: CircuitWindowStart,
 
 		logger: log.ForComponent(l, "transverse_circuit").With("circid", id),
 	}
@@ -179,34 +214,80 @@ func (t *TransverseCircuit) oneCell() error {
 
 	var cell Cell
 	var handler func(Cell) error
-	var other CircuitLink
+	var destroy func(Cell) error
+	var forward bool
 
 	select {
 	case <-t.done:
 		return io.EOF
 	case cell = <-t.pch.C:
 		handler = t.handleForwardRelay
-		other = t.Next
+		destroy = t.handleDestroy
+		forward = true
 	case cell = <-t.nch.C:
+		if t.Next == nil {
+			t.logger.Debug("dropping cell from truncated next hop")
+			return nil
+		}
+		if t.extending != nil {
+			return t.handleCreated(cell)
+		}
 		handler = t.handleBackwardRelay
-		other = t.Prev
+		destroy = t.handleNextDestroy
+	case o := <-t.och:
+		return t.handleOriginatedCell(o)
+	case c := <-t.ech:
+		return t.handleExtendConnection(c)
+	case <-t.extendTimeout():
+		return t.handleExtendTimeout()
 	}
 
 	switch cell.Command() {
-	case CommandRelay, CommandRelayEarly:
-		// TODO(mbm): count relay early cells
+	case CommandRelayEarly:
+		if err := t.countRelayEarly(forward); err != nil {
+			return err
+		}
+		return handler(cell)
+	case CommandRelay:
 		return handler(cell)
 	case CommandDestroy:
-		return t.handleDestroy(cell, other)
+		return destroy(cell)
 	default:
 		t.logger.Error("unrecognized cell")
 		return t.destroy(CircuitErrorProtocol)
 	}
 }
 
+// countRelayEarly records a RELAY_EARLY cell, destroying the circuit if too
+// many have been received or it was travelling towards the origin.
+func (t *TransverseCircuit) countRelayEarly(forward bool) error {
+	t.Metrics.RelayEarly.Inc(1)
+
+	if !forward {
+		t.logger.Warn("relay early cell in inbound direction")
+		t.Metrics.RelayEarlyViolations.Inc(1)
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	t.relayEarly++
+	if t.relayEarly > MaxRelayEarly {
+		t.logger.Warn("too many relay early cells")
+		t.Metrics.RelayEarlyViolations.Inc(1)
+		return t.destroy(CircuitErrorProtocol)
+	}
+	return nil
+}
+
 func (t *TransverseCircuit) cleanup() error {
 	var result error
 
+	for id, s := range t.streams {
+		if err := s.Close(); err != nil {
+			result = multierr.Append(result, err)
+		}
+		delete(t.streams, id)
+	}
+
 	for _, c := range []CircuitLink{t.Prev, t.Next} {
 		if c == nil {
 			continue
@@ -258,10 +339,35 @@ func (t *TransverseCircuit) handleForwardRelay(c Cell) error {
 	}
 
 	switch r.RelayCommand() {
-	case RelayExtend:
-		return t.handleRelayExtend(r)
-	case RelayExtend2:
+	case RelayExtend, RelayExtend2:
+		// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/tor-spec.txt#L1290-L1291
+		//
+		//	   [Starting with Tor 0.2.3.11-alpha, relays should reject any
+		//	   EXTEND or EXTEND2 cell not received in a RELAY_EARLY cell.]
+		//
+		if c.Command() != CommandRelayEarly {
+			logger.Warn("extend cell not in relay early cell")
+			t.Metrics.RelayEarlyViolations.Inc(1)
+			return t.destroy(CircuitErrorProtocol)
+		}
+		if r.RelayCommand() == RelayExtend {
+			return t.handleRelayExtend(r)
+		}
 		return t.handleRelayExtend2(r)
+	case RelayBegin:
+		return t.handleRelayBegin(r)
+	case RelayBeginDir:
+		return t.handleRelayBeginDir(r)
+	case RelayResolve:
+		return t.handleRelayResolve(r)
+	case RelayData:
+		return t.handleRelayData(r)
+	case RelayEnd:
+		return t.handleRelayEnd(r)
+	case RelaySendme:
+		return t.handleRelaySendme(r)
+	case RelayTruncate:
+		return t.handleRelayTruncate(r)
 	default:
 		logger.Error("no handler registered")
 	}
@@ -271,7 +377,7 @@ func (t *TransverseCircuit) handleForwardRelay(c Cell) error {
 
 // handleUnrecognizedCell passes an unrecognized cell onto the next hop.
 func (t *TransverseCircuit) handleUnrecognizedCell(c Cell) error {
-	if t.Next == nil {
+	if t.Next == nil || t.extending != nil {
 		t.logger.Warn("no next hop")
 		return t.destroy(CircuitErrorProtocol)
 	}
@@ -279,9 +385,10 @@ func (t *TransverseCircuit) handleUnrecognizedCell(c Cell) error {
 	// Clone the cell but swap out the circuit ID.
 	// TODO(mbm): forwarding relay cell should not require a copy, rather just
 	// a modification of the incoming cell
-	f := NewFixedCell(t.Next.CircID(), c.Command())
+	f := NewFixedCell(t.Next.CircID(), relayForwardCommand(c.Command(), t.Next.LinkVersion()))
 	copy(f.Payload(), c.Payload())
 
+	t.chargeRelayed(f)
 	err := t.Next.SendCell(f)
 	if err != nil {
 		t.logger.Warn("could not forward cell")
@@ -293,6 +400,23 @@ func (t *TransverseCircuit) handleUnrecognizedCell(c Cell) error {
 	return nil
 }
 
+// relayForwardCommand returns the command used to pass a relay cell received
+// with cmd onto a connection speaking link protocol version v.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/tor-spec.txt#L1275-L1278
+//
+//	   A RELAY_EARLY cell is designed to limit the length any circuit can reach.
+//	   When an OR receives a RELAY_EARLY cell, and the next node in the circuit
+//	   is speaking v2 of the link protocol or later, the OR relays the cell as a
+//	   RELAY_EARLY cell. Otherwise, older Tors will relay it as a RELAY cell.
+//
+func relayForwardCommand(cmd Command, v LinkProtocolVersion) Command {
+	if cmd == CommandRelayEarly && v < LinkProtocolRelayEarly {
+		return CommandRelay
+	}
+	return cmd
+}
+
 type extendRequest interface {
 	encoding.BinaryUnmarshaler
 	ConnectionHint
@@ -304,6 +428,22 @@ type createdReply interface {
 	Payloaded
 }
 
+// pendingExtend records the state of an extend in progress.
+type pendingExtend struct {
+	req         extendRequest
+	createCmd   Command
+	created     createdReply
+	extendedCmd RelayCommand
+	timer       *time.Timer
+}
+
+// extendConnection is the result of obtaining a connection for an extend.
+type extendConnection struct {
+	extend *pendingExtend
+	conn   *Connection
+	err    error
+}
+
 func (t *TransverseCircuit) handleRelayExtend(r RelayCell) error {
 	return t.extendCircuit(
 		r,
@@ -338,7 +478,7 @@ func (t *TransverseCircuit) extendCircuit(r RelayCell, ext extendRequest,
 	//	   circIDs based on lexicographic order of nicknames.)
 	//
 
-	if t.Next != nil {
+	if t.Next != nil || t.extending != nil {
 		t.logger.Warn("extend cell on circuit that already has next hop")
 		return t.destroy(CircuitErrorProtocol)
 	}
@@ -355,52 +495,118 @@ func (t *TransverseCircuit) extendCircuit(r RelayCell, ext extendRequest,
 		return t.destroy(CircuitErrorProtocol)
 	}
 
-	// Obtain connection to referenced node.
-	nextConn, err := t.Router.Connection(ext)
+	// From this point on failures only affect the circuit beyond this hop, so
+	// they are reported back to the origin with RELAY_TRUNCATED.
+
+	addrs, err := ext.Addresses()
 	if err != nil {
-		log.Err(t.logger, err, "could not obtain connection to extend node")
-		return t.destroy(CircuitErrorConnectfailed)
+		log.Err(t.logger, err, "bad extend addresses")
+		return t.truncate(CircuitErrorProtocol)
+	}
+	// There is no reason code for a policy refusal, and the request itself was
+	// well formed, so the origin is told the next hop could not be reached.
+	for _, addr := range addrs {
+		if !t.Router.extendAllowed(addr) {
+			t.Router.metrics.ExtendPrivateRefused.Inc(1)
+			t.logger.With("addr", addr).With("refusal", "private_address").Warn("refusing to extend to private address")
+			return t.truncate(CircuitErrorConnectfailed)
+		}
+	}
+
+	// The extend proceeds asynchronously so the circuit continues to handle
+	// cells in the meantime.
+	e := &pendingExtend{
+		req:         ext,
+		createCmd:   createCmd,
+		created:     created,
+		extendedCmd: extendedCmd,
+		timer:       time.NewTimer(t.Router.extendTimeout()),
+	}
+	t.extending = e
+
+	go t.connect(e)
+
+	return nil
+}
+
+// connect obtains a connection to the node referenced by the extend request
+// and passes it back to the circuit goroutine.
+func (t *TransverseCircuit) connect(e *pendingExtend) {
+	conn, err := t.Router.Connection(e.req)
+	select {
+	case <-t.done:
+	case t.ech <- extendConnection{extend: e, conn: conn, err: err}:
+	}
+}
+
+// extendTimeout returns a channel that fires when the in-progress extend
+// times out, or nil if there is no extend in progress.
+func (t *TransverseCircuit) extendTimeout() <-chan time.Time {
+	if t.extending == nil {
+		return nil
+	}
+	return t.extending.timer.C
+}
+
+func (t *TransverseCircuit) handleExtendConnection(c extendConnection) error {
+	e := c.extend
+	if e != t.extending {
+		t.logger.Debug("ignoring connection for abandoned extend")
+		return nil
+	}
+
+	if errors.Cause(c.err) == ErrIdentityMismatch {
+		log.Err(t.logger, c.err, "extend node has unexpected identity")
+		return t.failExtend(CircuitErrorOrIdentity)
+	}
+	if c.err != nil {
+		log.Err(t.logger, c.err, "could not obtain connection to extend node")
+		return t.failExtend(CircuitErrorConnectfailed)
 	}
 
 	// Initialize circuit on the next connection
-	nextID, err := nextConn.circuits.Add(t.BackwardSender())
+	nextConn := c.conn
+	nextID, err := nextConn.addCircuit(t.BackwardSender())
 	if err != nil {
 		log.Err(t.logger, err, "could not register circuit with next connection")
-		return t.destroy(CircuitErrorOrConnClosed)
+		return t.failExtend(CircuitErrorOrConnClosed)
 	}
 	t.Next = NewCircuitLink(nextConn, nextID, t.nch)
 
 	// Send CREATE2 cell
-	cell := NewFixedCell(t.Next.CircID(), createCmd)
-	copy(cell.Payload(), ext.Handshake()) // BUG(mbm): overflow risk
+	cell := NewFixedCell(t.Next.CircID(), e.createCmd)
+	copy(cell.Payload(), e.req.Handshake()) // BUG(mbm): overflow risk
 
 	err = t.Next.SendCell(cell)
 	if err != nil {
 		log.Err(t.logger, err, "failed to send create cell")
-		return t.destroy(CircuitErrorConnectfailed)
+		return t.failExtend(CircuitErrorConnectfailed)
 	}
 
-	// Wait for CREATED2 cell
 	t.logger.Debug("waiting for CREATED2")
-	cell, err = t.Next.ReceiveCell()
-	if err != nil {
-		log.Err(t.logger, err, "failed to receive cell")
-		return t.destroy(CircuitErrorConnectfailed)
+
+	return nil
+}
+
+// handleCreated processes the reply from the next hop to our CREATE cell.
+func (t *TransverseCircuit) handleCreated(cell Cell) error {
+	e := t.extending
+
+	if cell.Command() == CommandDestroy {
+		t.finishExtend()
+		return t.handleNextDestroy(cell)
 	}
 
-	err = created.UnmarshalCell(cell)
+	err := e.created.UnmarshalCell(cell)
 	if err != nil {
 		log.Err(t.logger, err, "failed to parse created cell")
-		return t.destroy(CircuitErrorProtocol)
+		return t.failExtend(CircuitErrorProtocol)
 	}
 
-	// Reply with EXTENDED2
-	cell = NewFixedCell(t.Prev.CircID(), CommandRelay)
-	extended := NewRelayCell(extendedCmd, 0, created.Payload())
-	copy(cell.Payload(), extended.Bytes())
-	t.Backward.EncryptOrigin(cell.Payload())
+	t.finishExtend()
 
-	err = t.Prev.SendCell(cell)
+	// Reply with EXTENDED2
+	err = t.sendRelayCell(NewRelayCell(e.extendedCmd, 0, e.created.Payload()))
 	if err != nil {
 		log.Err(t.logger, err, "failed to send relay extended cell")
 		return t.destroy(CircuitErrorConnectfailed)
@@ -410,7 +616,446 @@ func (t *TransverseCircuit) extendCircuit(r RelayCell, ext extendRequest,
 
 	return nil
 }
-func (t *TransverseCircuit) handleDestroy(c Cell, other CircuitLink) error {
+
+func (t *TransverseCircuit) handleExtendTimeout() error {
+	t.logger.Warn("extend timed out")
+	return t.failExtend(CircuitErrorTimeout)
+}
+
+// failExtend abandons the in-progress extend and truncates the circuit.
+func (t *TransverseCircuit) failExtend(reason CircuitErrorCode) error {
+	t.finishExtend()
+	return t.truncate(reason)
+}
+
+// finishExtend clears the in-progress extend state.
+func (t *TransverseCircuit) finishExtend() {
+	if t.extending == nil {
+		return
+	}
+	t.extending.timer.Stop()
+	t.extending = nil
+}
+
+// sendRelayCell sends a relay cell originating at this hop back towards the
+// client.
+func (t *TransverseCircuit) sendRelayCell(r RelayCell) error {
+	cell := NewFixedCell(t.Prev.CircID(), CommandRelay)
+	copy(cell.Payload(), r.Bytes())
+	t.Backward.EncryptOrigin(cell.Payload())
+	return t.Prev.SendCell(cell)
+}
+
+func (t *TransverseCircuit) handleRelayBegin(r RelayCell) error {
+	logger := RelayCellLogger(t.logger, r)
+
+	// Reference: https://github.com/torproject/torspec/blob/0fd44031bfd6c6c822bfb194e54a05118c9625e2/tor-spec.txt#L1419-L1425
+	//
+	//	   Upon receiving this cell, the exit node resolves the address as
+	//	   necessary, and opens a new TCP connection to the target port.  If the
+	//	   address cannot be resolved, or a connection can't be established, the
+	//	   exit node replies with a RELAY_END cell.  (See 6.4 below.)
+	//	   Otherwise, the exit node replies with a RELAY_CONNECTED cell, whose
+	//	   payload is in one of the following formats:
+	//
+
+	id := r.StreamID()
+	if id == 0 {
+		logger.Warn("begin cell with zero stream id")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	if _, exists := t.streams[id]; exists {
+		logger.Warn("begin cell for existing stream")
+		return nil
+	}
+
+	if t.Next != nil {
+		logger.Warn("begin cell on circuit with next hop")
+		return t.sendRelayCell(NewRelayCell(RelayEnd, id, EndPayload(StreamCloseReasonTorprotocol)))
+	}
+
+	if t.Router.ExitPolicy().RejectsAll() {
+		logger.Info("begin cell on relay that does not allow exits")
+		return t.sendRelayCell(NewRelayCell(RelayEnd, id, EndPayload(StreamCloseReasonExitpolicy)))
+	}
+
+	d, err := r.RelayData()
+	if err != nil {
+		log.Err(logger, err, "could not extract relay data")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	begin := BeginPayload{}
+	err = begin.UnmarshalBinary(d)
+	if err != nil {
+		log.Err(logger, err, "bad begin payload")
+		return t.sendRelayCell(NewRelayCell(RelayEnd, id, EndPayload(StreamCloseReasonTorprotocol)))
+	}
+
+	t.startStream(newExitStream(t, id, begin))
+
+	return nil
+}
+
+// handleRelayBeginDir opens a stream to the router's directory handler.
+//
+// Reference: https://github.com/torproject/torspec/blob/0fd44031bfd6c6c822bfb194e54a05118c9625e2/tor-spec.txt#L1462-L1469
+//
+//	   When a client wants to connect to the directory port of the relay
+//	   (or bridge) at the end of a circuit, it sends a RELAY_BEGIN_DIR cell.
+//	   The payload of this cell is ignored; it SHOULD be empty.
+//
+func (t *TransverseCircuit) handleRelayBeginDir(r RelayCell) error {
+	logger := RelayCellLogger(t.logger, r)
+
+	id := r.StreamID()
+	if id == 0 {
+		logger.Warn("begin dir cell with zero stream id")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	if _, exists := t.streams[id]; exists {
+		logger.Warn("begin dir cell for existing stream")
+		return nil
+	}
+
+	s := newExitStream(t, id, BeginPayload{})
+	s.dir = true
+	t.startStream(s)
+
+	return nil
+}
+
+// handleRelayResolve starts a hostname lookup, answered asynchronously with a
+// RELAY_RESOLVED cell.
+//
+// Reference: https://github.com/torproject/torspec/blob/0fd44031bfd6c6c822bfb194e54a05118c9625e2/tor-spec.txt#L1696-L1698
+//
+//	    The RELAY_RESOLVE cell must use a nonzero, distinct streamID; the
+//	    corresponding RELAY_RESOLVED cell must use the same streamID.  No stream
+//	    is actually created by the OR when resolving the name.
+//
+func (t *TransverseCircuit) handleRelayResolve(r RelayCell) error {
+	logger := RelayCellLogger(t.logger, r)
+
+	id := r.StreamID()
+	if id == 0 {
+		logger.Warn("resolve cell with zero stream id")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	if _, exists := t.streams[id]; exists {
+		logger.Warn("resolve cell for existing stream")
+		return nil
+	}
+
+	if t.Next != nil {
+		logger.Warn("resolve cell on circuit with next hop")
+		return t.sendRelayCell(NewRelayCell(RelayEnd, id, EndPayload(StreamCloseReasonTorprotocol)))
+	}
+
+	// Relays that do not allow exits must not act as open resolvers.
+	if t.Router.ExitPolicy().RejectsAll() {
+		logger.Info("resolve cell on relay that does not allow exits")
+		return t.sendRelayCell(NewRelayCell(RelayEnd, id, EndPayload(StreamCloseReasonExitpolicy)))
+	}
+
+	d, err := r.RelayData()
+	if err != nil {
+		log.Err(logger, err, "could not extract relay data")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	host := string(d)
+	if i := bytes.IndexByte(d, 0); i >= 0 {
+		host = string(d[:i])
+	}
+
+	s := newExitStream(t, id, BeginPayload{Host: host})
+	s.resolveOnly = true
+	t.startStream(s)
+
+	return nil
+}
+
+// startStream registers s with the circuit and starts it.
+func (t *TransverseCircuit) startStream(s *exitStream) {
+	t.streams[s.id] = s
+	t.Metrics.Streams.Alloc()
+	t.wg.Add(1)
+	go s.run()
+}
+
+func (t *TransverseCircuit) handleRelayData(r RelayCell) error {
+	if err := t.deliverCircuitData(); err != nil {
+		return err
+	}
+
+	s, ok := t.streams[r.StreamID()]
+	if !ok {
+		RelayCellLogger(t.logger, r).Debug("data for unknown stream")
+		return nil
+	}
+
+	s.deliverWindow--
+	if s.deliverWindow < 0 {
+		s.logger.Warn("stream deliver window exceeded")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	d, err := r.RelayData()
+	if err != nil {
+		log.Err(t.logger, err, "could not extract relay data")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	// The cell buffer is reused, so the data must be copied.
+	data := make([]byte, len(d))
+	copy(data, d)
+
+	if err := s.Write(data); err != nil {
+		s.logger.Debug("data for closed stream")
+	}
+
+	return nil
+}
+
+func (t *TransverseCircuit) handleRelayEnd(r RelayCell) error {
+	id := r.StreamID()
+	s, ok := t.streams[id]
+	if !ok {
+		return nil
+	}
+
+	d, err := r.RelayData()
+	if err != nil {
+		log.Err(t.logger, err, "could not extract relay data")
+		return t.destroy(CircuitErrorProtocol)
+	}
+	s.logger.With("reason", ParseEndPayload(d)).Info("client ended stream")
+
+	delete(t.streams, id)
+	check.Close(s.logger, s)
+
+	return nil
+}
+
+// deliverCircuitData accounts for a RELAY_DATA cell delivered at this hop,
+// sending an authenticated SENDME when the deliver window requires it.
+func (t *TransverseCircuit) deliverCircuitData() error {
+	t.deliverWindow--
+	if t.deliverWindow < 0 {
+		t.logger.Warn("circuit deliver window exceeded")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	if t.deliverWindow > CircuitWindowStart-CircuitWindowIncrement {
+		return nil
+	}
+
+	// Reference: https://github.com/torproject/torspec/blob/0fd44031bfd6c6c822bfb194e54a05118c9625e2/proposals/289-authenticated-sendmes.txt#L87-L91
+	//
+	//	   The DIGEST is the rolling digest of the last cell sent by the
+	//	   other side before the SENDME. That is, the 100th cell (or
+	//	   multiple thereof) of the window.
+	//
+	sendme := NewSendmeV1Payload(t.Forward.Sum())
+	p, err := sendme.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	err = t.sendRelayCell(NewRelayCell(RelaySendme, 0, p))
+	if err != nil {
+		log.Err(t.logger, err, "failed to send sendme cell")
+		return t.destroy(CircuitErrorConnectfailed)
+	}
+	t.deliverWindow += CircuitWindowIncrement
+
+	return nil
+}
+
+func (t *TransverseCircuit) handleRelaySendme(r RelayCell) error {
+	logger := RelayCellLogger(t.logger, r)
+
+	d, err := r.RelayData()
+	if err != nil {
+		log.Err(logger, err, "could not extract relay data")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	// Stream-level SENDMEs carry no payload.
+	if id := r.StreamID(); id != 0 {
+		s, ok := t.streams[id]
+		if !ok {
+			return nil
+		}
+		if err := s.packageWindow.Give(StreamWindowIncrement); err != nil {
+			log.Err(logger, err, "unexpected stream sendme")
+			return t.destroy(CircuitErrorProtocol)
+		}
+		return nil
+	}
+
+	sendme := &SendmePayload{}
+	if err := sendme.UnmarshalBinary(d); err != nil {
+		log.Err(logger, err, "bad sendme payload")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	var expect []byte
+	if len(t.sendmeDigests) > 0 {
+		expect = t.sendmeDigests[0]
+		t.sendmeDigests = t.sendmeDigests[1:]
+	}
+	if !sendme.Authenticates(expect) {
+		logger.Warn("sendme digest mismatch")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	if err := t.packageWindow.Give(CircuitWindowIncrement); err != nil {
+		log.Err(logger, err, "unexpected circuit sendme")
+		return t.destroy(CircuitErrorProtocol)
+	}
+
+	return nil
+}
+
+// handleOriginatedCell sends a cell originated by one of the circuit's
+// streams, provided the stream is still open.
+func (t *TransverseCircuit) handleOriginatedCell(o originatedCell) error {
+	id := o.cell.StreamID()
+	cmd := o.cell.RelayCommand()
+	if t.streams[id] != o.stream {
+		// Return the window taken for the dropped cell.
+		if cmd == RelayData {
+			_ = t.packageWindow.Give(1)
+		}
+		return nil
+	}
+
+	switch cmd {
+	case RelayEnd, RelayResolved:
+		delete(t.streams, id)
+	case RelaySendme:
+		o.stream.deliverWindow += StreamWindowIncrement
+	}
+
+	err := t.sendRelayCell(o.cell)
+	if err != nil {
+		log.Err(t.logger, err, "failed to send stream cell")
+		return t.destroy(CircuitErrorConnectfailed)
+	}
+
+	// Reference: https://github.com/torproject/torspec/blob/0fd44031bfd6c6c822bfb194e54a05118c9625e2/proposals/289-authenticated-sendmes.txt#L128-L132
+	//
+	//	   The edge then remembers the digest of every 100th cell it sends
+	//	   (the last cell of each window increment), so that it can verify
+	//	   the DIGEST field of the SENDME cell it expects in response.
+	//
+	if cmd == RelayData {
+		t.packaged++
+		if t.packaged%CircuitWindowIncrement == 0 {
+			t.sendmeDigests = append(t.sendmeDigests, t.Backward.Sum())
+		}
+	}
+
+	return nil
+}
+
+// handleRelayTruncate tears down the circuit beyond this hop.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/tor-spec.txt#L1308-L1317
+//
+//	   To tear down part of a circuit, the OP may send a RELAY_TRUNCATE cell
+//	   signaling a given OR (Stream ID zero).  That OR sends a DESTROY
+//	   cell to the next node in the circuit, and replies to the OP with a
+//	   RELAY_TRUNCATED cell.
+//
+//	   [Note: If an OR receives a TRUNCATE cell and it has any RELAY cells
+//	   still queued on the circuit for the next node it will drop them
+//	   without sending them.  This is not considered conformant behavior,
+//	   but it probably won't get fixed until a later version of Tor.  Thus,
+//	   clients SHOULD NOT send a TRUNCATE cell to a node running any current
+//	   version of Tor if a) they have sent relay cells through that node,
+//	   and b) they aren't sure whether those cells have been sent on yet.]
+//
+func (t *TransverseCircuit) handleRelayTruncate(r RelayCell) error {
+	reason := CircuitErrorNone
+	d, err := r.RelayData()
+	if err == nil && len(d) > 0 {
+		reason = CircuitErrorCode(d[0])
+	}
+
+	// An extend may be in progress, possibly with a circuit already
+	// registered on the next connection. Abandon it so the circuit can be
+	// extended again.
+	t.finishExtend()
+	t.dropNext(reason)
+	return t.sendTruncated(CircuitErrorRequested)
+}
+
+// handleNextDestroy handles a DESTROY cell from the next hop by reporting
+// the truncation back to the origin, leaving the rest of the circuit intact.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/tor-spec.txt#L1319-L1322
+//
+//	   When an unrecoverable error occurs along one connection in a
+//	   circuit, the nodes on either side of the connection should, if they
+//	   are able, act as follows:  the node closer to the OP should send a
+//	   RELAY_TRUNCATED cell towards the OP;
+//
+func (t *TransverseCircuit) handleNextDestroy(c Cell) error {
+	reason := CircuitErrorNone
+	d, err := ParseDestroyCell(c)
+	if err != nil {
+		log.Err(t.logger, err, "failed to parse destroy cell")
+	} else {
+		reason = d.Reason
+	}
+	t.logger.With("reason", reason).Info("next hop destroyed circuit")
+
+	if t.Next != nil {
+		if err := t.Next.Release(); err != nil {
+			log.Err(t.logger, err, "failed to release next hop")
+		}
+		t.Next = nil
+	}
+
+	return t.sendTruncated(reason)
+}
+
+// truncate drops the circuit beyond this hop and reports reason back to the
+// origin.
+func (t *TransverseCircuit) truncate(reason CircuitErrorCode) error {
+	t.dropNext(reason)
+	return t.sendTruncated(reason)
+}
+
+// dropNext destroys the circuit on the next hop, if there is one.
+func (t *TransverseCircuit) dropNext(reason CircuitErrorCode) {
+	if t.Next == nil {
+		return
+	}
+	if err := t.Next.Destroy(reason); err != nil {
+		log.Err(t.logger, err, "failed to destroy next hop")
+	}
+	t.Next = nil
+}
+
+// sendTruncated sends a RELAY_TRUNCATED cell with the given reason towards
+// the origin.
+func (t *TransverseCircuit) sendTruncated(reason CircuitErrorCode) error {
+	t.logger.With("reason", reason).Info("circuit truncated")
+	err := t.sendRelayCell(NewRelayCell(RelayTruncated, 0, []byte{byte(reason)}))
+	if err != nil {
+		log.Err(t.logger, err, "failed to send relay truncated cell")
+		return t.destroy(CircuitErrorConnectfailed)
+	}
+	return nil
+}
+func (t *TransverseCircuit) handleDestroy(c Cell) error {
 	var reason CircuitErrorCode
 	d, err := ParseDestroyCell(c)
 	if err != nil {
@@ -435,6 +1080,7 @@ func (t *TransverseCircuit) handleBackwardRelay(c Cell) error {
 	f := NewFixedCell(t.Prev.CircID(), c.Command())
 	copy(f.Payload(), c.Payload())
 
+	t.chargeRelayed(f)
 	err := t.Prev.SendCell(f)
 	if err != nil {
 		t.logger.Warn("could not forward cell")
@@ -446,6 +1092,13 @@ func (t *TransverseCircuit) handleBackwardRelay(c Cell) error {
 	return nil
 }
 
+// chargeRelayed accounts for a forwarded cell against the relay bandwidth
+// limit, which covers both its arrival and departure.
+func (t *TransverseCircuit) chargeRelayed(c Cell) {
+	n := len(c.Bytes())
+	t.Router.relayBandwidth.Charge(n, n)
+}
+
 func relayCellIsRecogized(r RelayCell, cs *CircuitCryptoState) bool {
 	// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/tor-spec.txt#L1446-L1452
 	//
@@ -458,12 +1111,7 @@ func relayCellIsRecogized(r RelayCell, cs *CircuitCryptoState) bool {
 	//	   field set to zero).
 	//
 
-	if r.Recognized() != 0 {
-		return false
-	}
-
-	digest := cs.Digest()
-	if digest != r.Digest() {
+	if r.Recognized() != 0 || cs.Digest() != r.Digest() {
 		cs.RewindDigest()
 		return false
 	}
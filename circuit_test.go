@@ -3,10 +3,16 @@ package pearl
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+
+	"github.com/mmcloughlin/pearl/check"
+	"github.com/mmcloughlin/pearl/torexitpolicy"
 )
 
 func TestGenerateCircID4(t *testing.T) {
@@ -63,3 +69,221 @@ func TestCircuitCryptoStateDigestRoundTrip(t *testing.T) {
 	assert.Equal(t, r.Digest(), s1.Digest())
 	assert.Equal(t, s1.Digest(), s2.Digest())
 }
+
+// receiveTruncated waits for a RELAY_TRUNCATED cell from the given hop,
+// returning the reason.
+func receiveTruncated(t *testing.T, c *OriginCircuit, hop int) CircuitErrorCode {
+	reply, err := c.receiveRelayCellTimeout(10 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, hop, reply.Hop)
+	require.Equal(t, RelayTruncated, reply.Cell.RelayCommand())
+	d, err := reply.Cell.RelayData()
+	require.NoError(t, err)
+	require.Len(t, d, 1)
+	return CircuitErrorCode(d[0])
+}
+
+func TestCircuitTruncateDuringExtend(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	middle, stopMiddle := startTestRelay(t, newTestRouter(t, torexitpolicy.RejectAllPolicy))
+	defer stopMiddle()
+	exit, stopExit := startTestRelay(t, newTestRouter(t, torexitpolicy.RejectAllPolicy))
+	defer stopExit()
+
+	// A relay that accepts connections but never completes the handshake, so
+	// an extend to it stays in progress.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = ln.Close() }()
+	stalled := &HopSpec{
+		Identity: exit.Identity,
+		Addrs:    []*net.TCPAddr{ln.Addr().(*net.TCPAddr)},
+	}
+	stalled.Identity[0] ^= 0xff
+
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	c, err := client.BuildCircuit([]*HopSpec{middle})
+	require.NoError(t, err)
+	defer check.Close(client.logger, c)
+
+	ext := NewExtend2Payload(stalled.LinkSpecs(), HandshakeTypeNTOR, make([]byte, 84))
+	p, err := ext.MarshalBinary()
+	require.NoError(t, err)
+	require.NoError(t, c.sendRelayCell(0, CommandRelayEarly, NewRelayCell(RelayExtend2, 0, p)))
+
+	require.NoError(t, c.SendRelayCell(0, NewRelayCell(RelayTruncate, 0, nil)))
+	assert.Equal(t, CircuitErrorRequested, receiveTruncated(t, c, 0))
+
+	// The abandoned extend does not prevent extending again.
+	require.NoError(t, c.Extend(exit))
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestCircuitExtendPrivateAddressRefused(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	r := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	r.config.ExtendAllowPrivateAddresses = false
+	scope := tally.NewTestScope("", nil)
+	r.metrics.ExtendPrivateRefused = scope.Counter("refused")
+	middle, stopMiddle := startTestRelay(t, r)
+	defer stopMiddle()
+	exit, stopExit := startTestRelay(t, newTestRouter(t, torexitpolicy.RejectAllPolicy))
+	defer stopExit()
+
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	c, err := client.BuildCircuit([]*HopSpec{middle})
+	require.NoError(t, err)
+	defer check.Close(client.logger, c)
+
+	err = c.Extend(exit)
+	assert.Equal(t, CircuitTruncatedError{Reason: CircuitErrorConnectfailed}, err)
+	assert.EqualValues(t, 1, scope.Snapshot().Counters()["refused+"].Value())
+}
+
+// dropHops forgets the hops of c beyond the first n, as after the circuit is
+// truncated.
+func dropHops(c *OriginCircuit, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hops = c.hops[:n]
+}
+
+// buildTestCircuit starts a middle and exit relay and builds a circuit through
+// them. The returned function stops the relays.
+func buildTestCircuit(t *testing.T) (*OriginCircuit, *HopSpec, func()) {
+	middle, stopMiddle := startTestRelay(t, newTestRouter(t, torexitpolicy.RejectAllPolicy))
+	exit, stopExit := startTestRelay(t, newTestRouter(t, torexitpolicy.RejectAllPolicy))
+
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	c, err := client.BuildCircuit([]*HopSpec{middle, exit})
+	require.NoError(t, err)
+	return c, exit, func() {
+		check.Close(client.logger, c)
+		stopMiddle()
+		stopExit()
+	}
+}
+
+func TestCircuitTruncate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	c, exit, cleanup := buildTestCircuit(t)
+	defer cleanup()
+
+	require.NoError(t, c.SendRelayCell(0, NewRelayCell(RelayTruncate, 0, nil)))
+	assert.Equal(t, CircuitErrorRequested, receiveTruncated(t, c, 0))
+	assert.False(t, c.Closed())
+
+	// The truncated circuit accepts a fresh extend.
+	dropHops(c, 1)
+	require.NoError(t, c.Extend(exit))
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestCircuitNextHopDestroyed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	c, exit, cleanup := buildTestCircuit(t)
+	defer cleanup()
+
+	// A BEGIN cell with a zero stream ID is a protocol violation, so the exit
+	// destroys its circuit and the middle relay reports the truncation.
+	require.NoError(t, c.SendRelayCell(1, NewRelayCell(RelayBegin, 0, nil)))
+	assert.Equal(t, CircuitErrorProtocol, receiveTruncated(t, c, 0))
+	assert.False(t, c.Closed())
+
+	dropHops(c, 1)
+	require.NoError(t, c.Extend(exit))
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestRelayForwardCommand(t *testing.T) {
+	assert.Equal(t, CommandRelayEarly, relayForwardCommand(CommandRelayEarly, 4))
+	assert.Equal(t, CommandRelayEarly, relayForwardCommand(CommandRelayEarly, LinkProtocolRelayEarly))
+	assert.Equal(t, CommandRelay, relayForwardCommand(CommandRelayEarly, 1))
+	assert.Equal(t, CommandRelay, relayForwardCommand(CommandRelay, 4))
+}
+
+func TestCircuitForwardRelayEarly(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	// The EXTEND2 cell for the last hop only succeeds if the first hop
+	// forwards it as RELAY_EARLY.
+	var path []*HopSpec
+	for i := 0; i < 3; i++ {
+		hop, stop := startTestRelay(t, newTestRouter(t, torexitpolicy.RejectAllPolicy))
+		defer stop()
+		path = append(path, hop)
+	}
+
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	c, err := client.BuildCircuit(path)
+	require.NoError(t, err)
+	defer check.Close(client.logger, c)
+	assert.Equal(t, 3, c.Len())
+}
+
+func TestCircuitRelayEarlyLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	c, _, cleanup := buildTestCircuit(t)
+	defer cleanup()
+
+	// Lift the client's own limit. The middle relay has already counted the
+	// RELAY_EARLY cell carrying the extend to the exit.
+	c.mu.Lock()
+	c.relayEarly = 0
+	c.mu.Unlock()
+
+	early := func() {
+		require.NoError(t, c.sendRelayCell(1, CommandRelayEarly, NewRelayCell(RelayDrop, 0, nil)))
+	}
+
+	// Forwarded cells count towards the limit too.
+	for i := 1; i < MaxRelayEarly; i++ {
+		early()
+	}
+	require.NoError(t, c.SendRelayCell(1, NewRelayCell(RelayTruncate, 0, nil)))
+	assert.Equal(t, CircuitErrorRequested, receiveTruncated(t, c, 1))
+
+	early()
+	_, err := c.receiveRelayCellTimeout(10 * time.Second)
+	assert.Equal(t, ErrCircuitClosed, err)
+}
+
+func TestCircuitExtendNotRelayEarly(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	c, exit, cleanup := buildTestCircuit(t)
+	defer cleanup()
+
+	ext := NewExtend2Payload(exit.LinkSpecs(), HandshakeTypeNTOR, make([]byte, 84))
+	p, err := ext.MarshalBinary()
+	require.NoError(t, err)
+
+	// The exit rejects the extend, and the middle relay reports the circuit
+	// truncated.
+	require.NoError(t, c.sendRelayCell(1, CommandRelay, NewRelayCell(RelayExtend2, 0, p)))
+	assert.Equal(t, CircuitErrorProtocol, receiveTruncated(t, c, 0))
+
+	// The middle relay destroys the whole circuit.
+	require.NoError(t, c.sendRelayCell(0, CommandRelay, NewRelayCell(RelayExtend2, 0, p)))
+	_, err = c.receiveRelayCellTimeout(10 * time.Second)
+	assert.Equal(t, ErrCircuitClosed, err)
+}
@@ -2,16 +2,19 @@ package cmd
 
 import (
 	"net"
+	"time"
 
 	"github.com/mmcloughlin/pearl/meta"
 	"github.com/mmcloughlin/pearl/torconfig"
 	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/mmcloughlin/pearl/torexitpolicy"
 	"github.com/spf13/pflag"
 )
 
 // Defined argument sets.
 var (
 	cfg         = new(Config)
+	proxyCfg    = new(ProxyConfig)
 	relayData   = new(RelayData)
 	authorities = new(DirectoryAuthorities)
 )
@@ -32,25 +35,55 @@ type Config struct {
 	nickname string
 	ip       net.IP
 	port     int
+	orports  []string
+	socks    int
+	dirPort  int
 	contact  string
 	bwAvg    int
 	bwBurst  int
+	rbwAvg   int
+	rbwBurst int
+	exit     bool
+	policy   string
+	extendTO time.Duration
+	private  bool
 	data     RelayData
 }
 
 func (c *Config) Attach(f *pflag.FlagSet) {
 	f.StringVarP(&c.nickname, "nickname", "n", "pearl", "nickname")
-	f.IPVar(&c.ip, "ip", net.IPv4(127, 0, 0, 1), "relay ip")
+	f.IPVar(&c.ip, "ip", nil, "relay public ip (learned from peers if unset, defaulting to 127.0.0.1 unless --public)")
 	f.IntVarP(&c.port, "port", "p", 9111, "relay port")
+	f.StringArrayVar(&c.orports, "orport", nil, "additional ORPort in torrc syntax, for example \"[2001:db8::1]:9001 NoListen\" (repeatable)")
+	f.IntVar(&c.socks, "socks-port", 9050, "client socks port")
+	f.IntVar(&c.dirPort, "dir-port", 0, "directory port, zero to disable")
 	f.StringVar(&c.contact, "contact", "https://github.com/mmcloughlin/pearl", "contact information")
 	f.IntVar(&c.bwAvg, "bandwidth-average", 75<<10, "bandwidth average (bytes per second)")
 	f.IntVar(&c.bwBurst, "bandwidth-burst", 150<<10, "bandwidth burst (bytes per second)")
+	f.IntVar(&c.rbwAvg, "relay-bandwidth-average", 0, "relayed traffic bandwidth average, zero for no separate limit (bytes per second)")
+	f.IntVar(&c.rbwBurst, "relay-bandwidth-burst", 0, "relayed traffic bandwidth burst (bytes per second)")
+	f.BoolVar(&c.exit, "exit", false, "allow exit traffic to any public address")
+	f.StringVar(&c.policy, "exit-policy", "", "exit policy in torrc ExitPolicy syntax (overrides --exit)")
+	f.DurationVar(&c.extendTO, "extend-timeout", torconfig.DefaultExtendTimeout, "maximum time to wait for a circuit extend")
+	f.BoolVar(&c.private, "extend-allow-private-addresses", false, "allow circuits to be extended to private addresses")
 	Register(f, &c.data)
 }
 
 func (c *Config) Config() (*torconfig.Config, error) {
 	d := c.data.Data()
-	k, err := d.Keys()
+	k, err := c.data.Keys()
+	if err != nil {
+		return nil, err
+	}
+	var orports []torconfig.ORPortConfig
+	for _, arg := range c.orports {
+		p, err := torconfig.ParseORPort(arg)
+		if err != nil {
+			return nil, err
+		}
+		orports = append(orports, p)
+	}
+	policy, err := c.exitPolicy(orports)
 	if err != nil {
 		return nil, err
 	}
@@ -58,15 +91,55 @@ func (c *Config) Config() (*torconfig.Config, error) {
 		Nickname:         c.nickname,
 		IP:               c.ip,
 		ORPort:           uint16(c.port),
+		ORPorts:          orports,
+		SOCKSPort:        uint16(c.socks),
+		DirPort:          uint16(c.dirPort),
 		Platform:         meta.Platform.String(),
 		Contact:          c.contact,
 		BandwidthAverage: c.bwAvg,
 		BandwidthBurst:   c.bwBurst,
+		ExitPolicy:       policy,
+		ExtendTimeout:    c.extendTO,
 		Keys:             k,
 		Data:             d,
+
+		RelayBandwidthAverage:       c.rbwAvg,
+		RelayBandwidthBurst:         c.rbwBurst,
+		ExtendAllowPrivateAddresses: c.private,
+		ExitPolicyRejectPrivate:     true,
 	}, nil
 }
 
+// exitPolicy builds the exit policy. Exits reject traffic to private networks
+// and the relay's own addresses before applying their rules.
+func (c *Config) exitPolicy(orports []torconfig.ORPortConfig) (*torexitpolicy.Policy, error) {
+	var opts torexitpolicy.TorrcOptions
+	if c.exit {
+		opts.Rules = []torexitpolicy.Rule{{Action: torexitpolicy.Accept, Pattern: torexitpolicy.AllPattern}}
+	}
+	if c.policy != "" {
+		rules, err := torexitpolicy.ParseTorrcRules(c.policy)
+		if err != nil {
+			return nil, err
+		}
+		opts.Rules = rules
+	}
+	if len(opts.Rules) == 0 {
+		return torexitpolicy.RejectAllPolicy, nil
+	}
+
+	opts.RejectPrivate = true
+	if c.ip != nil {
+		opts.Addresses = append(opts.Addresses, c.ip)
+	}
+	for _, p := range orports {
+		if p.IP != nil && !p.IP.IsUnspecified() {
+			opts.Addresses = append(opts.Addresses, p.IP)
+		}
+	}
+	return opts.Policy(), nil
+}
+
 // RelayData configures relay data directory.
 type RelayData struct {
 	dir string
@@ -80,6 +153,49 @@ func (d *RelayData) Data() torconfig.Data {
 	return torconfig.NewDataDirectory(d.dir)
 }
 
+// Keys loads relay keys from the data directory, adding Ed25519 keys if they
+// are missing.
+func (d *RelayData) Keys() (*torconfig.Keys, error) {
+	data := d.Data()
+	k, err := data.Keys()
+	if err != nil {
+		return nil, err
+	}
+	changed, err := k.EnsureEd25519(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		if err := data.SetKeys(k); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// ProxyConfig configures a client-only router for the SOCKS proxy.
+type ProxyConfig struct {
+	socks int
+	data  RelayData
+}
+
+func (c *ProxyConfig) Attach(f *pflag.FlagSet) {
+	f.IntVar(&c.socks, "socks-port", 9050, "client socks port")
+	Register(f, &c.data)
+}
+
+func (c *ProxyConfig) Config() (*torconfig.Config, error) {
+	k, err := c.data.Keys()
+	if err != nil {
+		return nil, err
+	}
+	return &torconfig.Config{
+		SOCKSPort: uint16(c.socks),
+		Keys:      k,
+		Data:      c.data.Data(),
+	}, nil
+}
+
 // DirectoryAuthorities configures which directory authorities to publish to.
 type DirectoryAuthorities struct {
 	public bool
@@ -92,6 +208,42 @@ func (a *DirectoryAuthorities) Attach(f *pflag.FlagSet) {
 	f.StringSliceVar(&a.addrs, "authorities", []string{"127.0.0.1:7000"}, "directory authorities to publish to")
 }
 
+// ORAddresses returns the OR addresses of the public directory authorities, if
+// publishing to them.
+func (a *DirectoryAuthorities) ORAddresses() ([]string, error) {
+	if !a.public {
+		return nil, nil
+	}
+	var addrs []string
+	for _, auth := range tordir.DefaultAuthorities {
+		addr, err := auth.ORAddress()
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// FallbackIP returns the relay address to use if none is configured or
+// discovered. Relays publishing to the public authorities have none.
+func (a *DirectoryAuthorities) FallbackIP() net.IP {
+	if a.public {
+		return nil
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// Pinned returns the public directory authorities, if publishing to them.
+// Configured authorities have no known v3 identities, so documents fetched
+// from them could not be verified.
+func (a *DirectoryAuthorities) Pinned() []*tordir.Authority {
+	if !a.public {
+		return nil
+	}
+	return tordir.DefaultAuthorities
+}
+
 // Addresses returns configured directory authority addresses.
 func (a *DirectoryAuthorities) Addresses() []string {
 	if a.public {
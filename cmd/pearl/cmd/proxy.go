@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"strings"
+
+	"github.com/mmcloughlin/pearl"
+	"github.com/mmcloughlin/pearl/check"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// proxyCmd represents the proxy command
+var proxyCmd = &cobra.Command{
+	Use:   "proxy",
+	Short: "Start a SOCKS proxy",
+	Long: `Start a SOCKS proxy carrying connections over circuits built through the
+given hops. Hops are specified as FINGERPRINT@HOST:PORT[,NTORKEY] where the
+fingerprint is hex and the ntor key is base64. The ntor key is required for all
+hops after the first.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return proxy()
+	},
+}
+
+var hops []string
+
+func init() {
+	proxyCmd.Flags().StringArrayVar(&hops, "hop", nil, "circuit hop (may be repeated)")
+	proxyCmd.Flags().StringVarP(&logfile, "logfile", "l", "pearl.json", "log file")
+
+	Register(proxyCmd.Flags(), proxyCfg)
+
+	rootCmd.AddCommand(proxyCmd)
+}
+
+func proxy() error {
+	l, err := logger(logfile)
+	if err != nil {
+		return err
+	}
+
+	scope, closer := metrics(l)
+	defer check.Close(l, closer)
+
+	var path pearl.StaticPath
+	for _, s := range hops {
+		h, err := parseHopSpec(s)
+		if err != nil {
+			return errors.Wrapf(err, "invalid hop %q", s)
+		}
+		path = append(path, h)
+	}
+
+	config, err := proxyCfg.Config()
+	if err != nil {
+		return err
+	}
+
+	r, err := pearl.NewRouter(config, scope, l)
+	if err != nil {
+		return err
+	}
+
+	p := pearl.NewProxy(r, path, l)
+	defer check.Close(l, p)
+
+	return p.ListenAndServe(config.SOCKSBindAddr())
+}
+
+// parseHopSpec parses a hop in the form FINGERPRINT@HOST:PORT[,NTORKEY].
+func parseHopSpec(s string) (*pearl.HopSpec, error) {
+	parts := strings.SplitN(s, "@", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("expected fingerprint@address")
+	}
+
+	h := &pearl.HopSpec{}
+	fp, err := hex.DecodeString(parts[0])
+	if err != nil || len(fp) != len(h.Identity) {
+		return nil, errors.New("bad fingerprint")
+	}
+	copy(h.Identity[:], fp)
+
+	parts = strings.SplitN(parts[1], ",", 2)
+	addr, err := net.ResolveTCPAddr("tcp", parts[0])
+	if err != nil {
+		return nil, err
+	}
+	h.Addrs = []*net.TCPAddr{addr}
+
+	if len(parts) == 2 {
+		k, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err != nil || len(k) != len(h.NtorKey) {
+			return nil, errors.New("bad ntor key")
+		}
+		copy(h.NtorKey[:], k)
+	}
+
+	return h, nil
+}
@@ -80,11 +80,26 @@ func serve() error {
 		return err
 	}
 
+	// Without a configured address, learn it from the authorities. Local
+	// networks fall back to loopback until an address is discovered.
+	var probes []string
+	if config.IP == nil {
+		probes, err = authorities.ORAddresses()
+		if err != nil {
+			return err
+		}
+		config.FallbackIP = authorities.FallbackIP()
+	}
+
 	r, err := pearl.NewRouter(config, scope, l)
 	if err != nil {
 		return err
 	}
 
+	if len(probes) > 0 {
+		go r.DiscoverAddress(probes)
+	}
+
 	// Start telemetry server.
 	go telemetry.Serve(telemetryAddr, l)
 
@@ -98,14 +113,32 @@ func serve() error {
 		}
 	}()
 
+	// Persist bandwidth history
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			if err := r.SaveState(); err != nil {
+				log.Err(l, err, "failed to save state")
+			}
+		}
+	}()
+
 	// Publish to directory authorities
 	p := &pearl.Publisher{
 		Router:      r,
-		Interval:    16 * time.Hour,
 		Authorities: authorities.Addresses(),
 		Logger:      l,
 	}
 	go p.Start()
 
+	// Cache the consensus and authority certificates to serve them.
+	if pinned := authorities.Pinned(); len(pinned) > 0 {
+		f := &pearl.DirectoryFetcher{
+			Router:      r,
+			Authorities: pinned,
+			Logger:      l,
+		}
+		go f.Start()
+	}
+
 	select {}
 }
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"io"
 	"net"
+	"sync"
 
 	"go.uber.org/multierr"
 
@@ -26,8 +27,15 @@ type Connection struct {
 	tlsConn     *tls.Conn
 	connID      ConnID
 	fingerprint []byte
+	edIdentity  []byte
+	linkVersion LinkProtocolVersion
+	outbound    bool
+	observed    net.IP // our address as reported by the peer, if outbound
 
-	circuits *SenderManager
+	circuits  *SenderManager
+	activity  *activityWriter
+	padding   *channelPadding
+	paddingMu sync.Mutex // serializes padding updates
 
 	r io.Reader
 	w io.Writer
@@ -39,7 +47,7 @@ type Connection struct {
 
 // NewServer constructs a server connection.
 func NewServer(r *Router, conn net.Conn, logger log.Logger) (*Connection, error) {
-	tlsCtx, err := NewTLSContext(r.IdentityKey())
+	tlsCtx, err := NewTLSContextFromKeys(r.config.Keys)
 	if err != nil {
 		return nil, err
 	}
@@ -50,7 +58,7 @@ func NewServer(r *Router, conn net.Conn, logger log.Logger) (*Connection, error)
 
 // NewClient constructs a client-side connection.
 func NewClient(r *Router, conn net.Conn, logger log.Logger) (*Connection, error) {
-	tlsCtx, err := NewTLSContext(r.IdentityKey())
+	tlsCtx, err := NewTLSContextFromKeys(r.config.Keys)
 	if err != nil {
 		return nil, err
 	}
@@ -61,8 +69,14 @@ func NewClient(r *Router, conn net.Conn, logger log.Logger) (*Connection, error)
 
 func newConnection(r *Router, tlsCtx *TLSContext, tlsConn *tls.Conn, outbound bool, logger log.Logger) *Connection {
 	connID := NewConnID()
-	rd := bufio.NewReaderSize(r.metrics.Inbound.WrapReader(tlsConn), defaultReadBufferSize)
-	wr := r.metrics.Outbound.WrapWriter(tlsConn) // TODO(mbm): use bufio
+	// The bandwidth limit pauses reads and writes on the TLS connection,
+	// rather than dropping cells. Relayed traffic is additionally charged to
+	// the relay limit where it is forwarded.
+	lr := r.bandwidth.WrapReader(tlsConn)
+	lw := r.bandwidth.WrapWriter(tlsConn)
+
+	rd := bufio.NewReaderSize(r.metrics.Inbound.WrapReader(lr), defaultReadBufferSize)
+	wr := newActivityWriter(r.metrics.Outbound.WrapWriter(lw)) // TODO(mbm): use bufio
 	r.metrics.Connections.Alloc()
 	return &Connection{
 		router:      r,
@@ -70,8 +84,10 @@ func newConnection(r *Router, tlsCtx *TLSContext, tlsConn *tls.Conn, outbound bo
 		tlsConn:     tlsConn,
 		connID:      connID,
 		fingerprint: nil,
+		outbound:    outbound,
 
 		circuits: NewSenderManager(outbound),
+		activity: wr,
 
 		r:            rd,
 		w:            wr,
@@ -88,6 +104,7 @@ func (c *Connection) newHandshake() *Handshake {
 		Link:        NewHandshakeLink(c.r, c.w, c.logger),
 		TLSContext:  c.tlsCtx,
 		IdentityKey: &c.router.IdentityKey().PublicKey,
+		Addresses:   c.router.Addresses(),
 		logger:      c.logger,
 	}
 }
@@ -108,6 +125,18 @@ func (c *Connection) Fingerprint() (Fingerprint, error) {
 	return NewFingerprintFromBytes(c.fingerprint)
 }
 
+// Ed25519Identity returns the Ed25519 identity key of the connected peer, or
+// nil if the peer did not authenticate with one.
+func (c *Connection) Ed25519Identity() []byte {
+	return c.edIdentity
+}
+
+// Close closes the underlying connection. Remaining cleanup happens when the
+// connection loop exits.
+func (c *Connection) Close() error {
+	return c.tlsConn.Close()
+}
+
 func (c *Connection) Serve() error {
 	c.logger.Info("serving new connection")
 
@@ -118,7 +147,11 @@ func (c *Connection) Serve() error {
 		return nil
 	}
 	c.fingerprint = h.PeerFingerprint
+	c.edIdentity = h.PeerEd25519Identity
+	c.linkVersion = h.LinkVersion
 	c.logger.Info("handshake complete")
+	c.router.observeNetInfo(c, h.PeerNetInfo, false)
+	c.startPadding()
 
 	if c.PeerAuthenticated() {
 		if err := c.router.connections.AddConnection(c); err != nil {
@@ -137,7 +170,11 @@ func (c *Connection) StartClient() error {
 		return errors.Wrap(err, "client handshake failed")
 	}
 	c.fingerprint = h.PeerFingerprint
+	c.edIdentity = h.PeerEd25519Identity
+	c.linkVersion = h.LinkVersion
 	c.logger.Info("handshake complete")
+	c.router.observeNetInfo(c, h.PeerNetInfo, true)
+	c.startPadding()
 
 	if err := c.router.connections.AddConnection(c); err != nil {
 		return err
@@ -192,7 +229,7 @@ func (c *Connection) oneCell() error {
 			log.Err(logger, err, "failed to handle create2")
 		}
 		// Cells related to a circuit
-	case CommandCreated, CommandCreated2, CommandRelay, CommandRelayEarly, CommandDestroy:
+	case CommandCreated, CommandCreated2, CommandCreatedFast, CommandRelay, CommandRelayEarly, CommandDestroy:
 		logger.Trace("directing cell to circuit channel")
 		s, ok := c.circuits.Sender(cell.CircID())
 		if !ok {
@@ -204,8 +241,15 @@ func (c *Connection) oneCell() error {
 		if err != nil {
 			logger.Error("failed to send cell to circuit")
 		}
+	case CommandPaddingNegotiate:
+		c.router.metrics.PaddingNegotiate.Inc(1)
+		err = c.negotiatePadding(cell)
+		if err != nil {
+			log.Err(logger, err, "failed to handle padding negotiate")
+		}
 	// Cells to be ignored
 	case CommandPadding, CommandVpadding:
+		c.router.metrics.PaddingReceived.Inc(1)
 		logger.Debug("skipping padding cell")
 	// Something which shouldn't happen
 	default:
@@ -214,11 +258,70 @@ func (c *Connection) oneCell() error {
 	return nil
 }
 
+// startPadding prepares channel padding, if the link protocol supports it.
+// Padding is only sent once the connection is in use; see updatePadding.
+func (c *Connection) startPadding() {
+	if c.linkVersion < LinkProtocolPadding {
+		return
+	}
+	c.padding = newChannelPadding(c, c.activity)
+	go c.padding.Run()
+}
+
+// updatePadding activates padding while the connection carries circuits, and
+// deactivates it when the connection goes idle. As in padding-spec, only
+// connections we initiated are padded, and only once they are in use.
+func (c *Connection) updatePadding() {
+	if c.padding == nil || !c.outbound {
+		return
+	}
+	c.paddingMu.Lock()
+	defer c.paddingMu.Unlock()
+	c.padding.SetActive(c.circuits.Len() > 0)
+}
+
+// addCircuit registers a circuit on the connection, allocating its ID.
+func (c *Connection) addCircuit(sc CellSenderCloser) (CircID, error) {
+	id, err := c.circuits.Add(sc)
+	if err != nil {
+		return 0, err
+	}
+	c.updatePadding()
+	return id, nil
+}
+
+// removeCircuit unregisters a circuit from the connection.
+func (c *Connection) removeCircuit(id CircID) error {
+	err := c.circuits.Remove(id)
+	c.updatePadding()
+	return err
+}
+
+// negotiatePadding processes a PADDING_NEGOTIATE cell.
+func (c *Connection) negotiatePadding(cell Cell) error {
+	if c.padding == nil {
+		return errors.New("padding not supported on this connection")
+	}
+	n, err := ParsePaddingNegotiateCell(cell)
+	if err != nil {
+		return err
+	}
+	c.logger.With("command", n.Command).
+		With("low", n.TimeoutLow).
+		With("high", n.TimeoutHigh).
+		Debug("received padding negotiate")
+	return c.padding.Negotiate(n)
+}
+
 // cleanup cleans up resources related to the connection.
 func (c *Connection) cleanup() error {
 	c.logger.Info("cleanup connection")
 	c.router.metrics.Connections.Free()
 
+	if c.padding != nil {
+		c.padding.Stop()
+	}
+
 	var result error
 	for _, circ := range c.circuits.Empty() {
 		if err := circ.Close(); err != nil {
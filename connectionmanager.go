@@ -24,9 +24,17 @@ func NewConnID() ConnID {
 	return ConnID(atomic.AddUint64(&globalConnID, 1))
 }
 
+// pendingConnection is a connection attempt in progress.
+type pendingConnection struct {
+	done chan struct{}
+	conn *Connection
+	err  error
+}
+
 // ConnectionManager manages a collection of Connections.
 type ConnectionManager struct {
 	connections map[Fingerprint]map[ConnID]*Connection
+	pending     map[Fingerprint]*pendingConnection
 
 	sync.RWMutex
 }
@@ -34,6 +42,7 @@ type ConnectionManager struct {
 func NewConnectionManager() *ConnectionManager {
 	return &ConnectionManager{
 		connections: make(map[Fingerprint]map[ConnID]*Connection),
+		pending:     make(map[Fingerprint]*pendingConnection),
 	}
 }
 
@@ -55,6 +64,10 @@ func (m *ConnectionManager) AddConnection(c *Connection) error {
 func (m *ConnectionManager) Connection(fp Fingerprint) (*Connection, bool) {
 	m.RLock()
 	defer m.RUnlock()
+	return m.connection(fp)
+}
+
+func (m *ConnectionManager) connection(fp Fingerprint) (*Connection, bool) {
 	conns, ok := m.connections[fp]
 	if !ok {
 		return nil, false
@@ -66,6 +79,36 @@ func (m *ConnectionManager) Connection(fp Fingerprint) (*Connection, bool) {
 	panic("unreachable")
 }
 
+// Dial returns an existing connection to fp, if there is one. Otherwise it
+// calls dial to open a new connection. Concurrent calls for the same
+// fingerprint wait on a single call to dial.
+func (m *ConnectionManager) Dial(fp Fingerprint, dial func() (*Connection, error)) (*Connection, error) {
+	m.Lock()
+	if conn, ok := m.connection(fp); ok {
+		m.Unlock()
+		return conn, nil
+	}
+
+	if p, ok := m.pending[fp]; ok {
+		m.Unlock()
+		<-p.done
+		return p.conn, p.err
+	}
+
+	p := &pendingConnection{done: make(chan struct{})}
+	m.pending[fp] = p
+	m.Unlock()
+
+	p.conn, p.err = dial()
+
+	m.Lock()
+	delete(m.pending, fp)
+	m.Unlock()
+	close(p.done)
+
+	return p.conn, p.err
+}
+
 func (m *ConnectionManager) RemoveConnection(c *Connection) error {
 	m.Lock()
 	defer m.Unlock()
@@ -0,0 +1,72 @@
+package pearl
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionManagerDialCoalesces(t *testing.T) {
+	m := NewConnectionManager()
+	fp := Fingerprint{1, 2, 3}
+	expect := &Connection{}
+
+	var calls int32
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	dial := func() (*Connection, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(entered)
+		}
+		<-release
+		return expect, nil
+	}
+
+	n := 8
+	var wg sync.WaitGroup
+	results := make([]*Connection, n)
+	run := func(i int) {
+		defer wg.Done()
+		conn, err := m.Dial(fp, dial)
+		assert.NoError(t, err)
+		results[i] = conn
+	}
+
+	// Start one dial, and once it is in progress start the rest.
+	wg.Add(n)
+	go run(0)
+	<-entered
+	for i := 1; i < n; i++ {
+		go run(i)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	for _, conn := range results {
+		assert.Equal(t, expect, conn)
+	}
+	assert.Len(t, m.pending, 0)
+}
+
+func TestConnectionManagerDialError(t *testing.T) {
+	m := NewConnectionManager()
+	expect := errors.New("boom")
+	_, err := m.Dial(Fingerprint{}, func() (*Connection, error) {
+		return nil, expect
+	})
+	assert.Equal(t, expect, err)
+
+	// Failed attempts are not cached.
+	conn := &Connection{}
+	got, err := m.Dial(Fingerprint{}, func() (*Connection, error) {
+		return conn, nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, conn, got)
+}
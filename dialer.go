@@ -0,0 +1,386 @@
+package pearl
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/pkg/errors"
+)
+
+// IsolationKey identifies streams that may share a circuit. Streams with
+// different keys are never carried on the same circuit.
+type IsolationKey string
+
+type isolationKeyContextKey struct{}
+
+// WithIsolationKey returns a context that causes dials to use circuits
+// isolated by key.
+func WithIsolationKey(ctx context.Context, key IsolationKey) context.Context {
+	return context.WithValue(ctx, isolationKeyContextKey{}, key)
+}
+
+// IsolationKeyFromContext returns the isolation key associated with ctx. The
+// zero key is returned if none is set.
+func IsolationKeyFromContext(ctx context.Context) IsolationKey {
+	key, _ := ctx.Value(isolationKeyContextKey{}).(IsolationKey)
+	return key
+}
+
+// Circuit lifetime parameters.
+const (
+	// DefaultMaxCircuitDirtiness is how long after its first stream a circuit
+	// may be used for new streams. This matches tor's MaxCircuitDirtiness.
+	DefaultMaxCircuitDirtiness = 10 * time.Minute
+
+	// DefaultCircuitIdleTimeout is how long a circuit may go without streams
+	// before it is closed.
+	DefaultCircuitIdleTimeout = time.Hour
+
+	// dialerExpireInterval is how often the dialer closes expired circuits.
+	dialerExpireInterval = 30 * time.Second
+)
+
+// DialerOptions configures a Dialer.
+type DialerOptions struct {
+	// Paths selects the hops for new circuits.
+	Paths PathProvider
+
+	// MaxCircuitDirtiness is how long after its first stream a circuit may be
+	// used for new streams. Once exceeded, new streams get a fresh circuit and
+	// the old one is closed when its streams end. Defaults to
+	// DefaultMaxCircuitDirtiness.
+	MaxCircuitDirtiness time.Duration
+
+	// CircuitIdleTimeout is how long a circuit may go without streams before
+	// it is closed. Defaults to DefaultCircuitIdleTimeout.
+	CircuitIdleTimeout time.Duration
+
+	// Logger for dialer events. Defaults to the router's logger.
+	Logger log.Logger
+}
+
+// isolatedCircuit is the circuit used by one isolation key. The mutex is held
+// while building, so concurrent dials wait for a single circuit.
+type isolatedCircuit struct {
+	mu      sync.Mutex
+	circ    *OriginCircuit
+	dirty   time.Time // when the circuit was first used for a stream
+	used    time.Time // when the circuit was last seen in use
+	evicted bool      // removed from the dialer
+}
+
+// Dialer opens connections over circuits built by a router.
+type Dialer struct {
+	router      *Router
+	paths       PathProvider
+	dirtiness   time.Duration
+	idleTimeout time.Duration
+
+	mu       sync.Mutex
+	circuits map[IsolationKey]*isolatedCircuit
+	retired  []*OriginCircuit // too dirty for new streams
+	done     chan struct{}
+
+	logger log.Logger
+
+	// Overridden in tests.
+	now func() time.Time
+}
+
+// NewDialer builds a dialer using circuits from r. Expired circuits are
+// closed in the background until the dialer is closed.
+func NewDialer(r *Router, opts DialerOptions) *Dialer {
+	l := opts.Logger
+	if l == nil {
+		l = r.logger
+	}
+	d := &Dialer{
+		router:      r,
+		paths:       opts.Paths,
+		dirtiness:   opts.MaxCircuitDirtiness,
+		idleTimeout: opts.CircuitIdleTimeout,
+		circuits:    make(map[IsolationKey]*isolatedCircuit),
+		done:        make(chan struct{}),
+		logger:      log.ForComponent(l, "dialer"),
+	}
+	if d.dirtiness == 0 {
+		d.dirtiness = DefaultMaxCircuitDirtiness
+	}
+	if d.idleTimeout == 0 {
+		d.idleTimeout = DefaultCircuitIdleTimeout
+	}
+	go d.expireLoop()
+	return d
+}
+
+// Dial connects to addr over a circuit.
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr over a circuit. The network must be one of
+// "tcp", "tcp4" or "tcp6"; hostnames are resolved by the exit. The circuit is
+// chosen by the isolation key in ctx, if any.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var flags BeginFlags
+	switch network {
+	case "tcp":
+		flags = BeginFlagIPv6Okay
+	case "tcp4":
+	case "tcp6":
+		flags = BeginFlagIPv6Okay | BeginFlagIPv4NotOkay | BeginFlagIPv6Preferred
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+
+	c, err := d.circuit(ctx, IsolationKeyFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := c.OpenStreamContext(ctx, addr, flags)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes all circuits built by the dialer.
+func (d *Dialer) Close() error {
+	d.mu.Lock()
+	select {
+	case <-d.done:
+	default:
+		close(d.done)
+	}
+	entries := d.circuits
+	retired := d.retired
+	d.circuits = make(map[IsolationKey]*isolatedCircuit)
+	d.retired = nil
+	d.mu.Unlock()
+
+	var result error
+	for _, ic := range entries {
+		ic.mu.Lock()
+		if ic.circ != nil {
+			if err := ic.circ.Close(); err != nil {
+				result = err
+			}
+		}
+		ic.evicted = true
+		ic.mu.Unlock()
+	}
+	for _, c := range retired {
+		if err := c.Close(); err != nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// expireLoop periodically closes expired circuits until the dialer is closed.
+func (d *Dialer) expireLoop() {
+	ticker := time.NewTicker(dialerExpireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.expire()
+		}
+	}
+}
+
+// expire closes circuits that have been idle for longer than the idle
+// timeout, and dirty circuits whose streams have all ended. Closed circuits
+// are removed from the dialer.
+func (d *Dialer) expire() {
+	now := d.clock()
+
+	d.mu.Lock()
+	entries := make(map[IsolationKey]*isolatedCircuit, len(d.circuits))
+	for key, ic := range d.circuits {
+		entries[key] = ic
+	}
+	var retired []*OriginCircuit
+	for _, c := range d.retired {
+		if c.Closed() || c.NumStreams() == 0 {
+			if err := c.Close(); err != nil {
+				log.WithErr(d.logger, err).Debug("error closing dirty circuit")
+			}
+			continue
+		}
+		retired = append(retired, c)
+	}
+	d.retired = retired
+	d.mu.Unlock()
+
+	// Entries are locked individually, so a circuit being built does not hold
+	// up the others.
+	for key, ic := range entries {
+		ic.mu.Lock()
+		if !d.expired(ic, now) {
+			ic.mu.Unlock()
+			continue
+		}
+		if ic.circ != nil {
+			if err := ic.circ.Close(); err != nil {
+				log.WithErr(d.logger, err).Debug("error closing expired circuit")
+			}
+		}
+		ic.evicted = true
+		ic.mu.Unlock()
+
+		d.mu.Lock()
+		if d.circuits[key] == ic {
+			delete(d.circuits, key)
+		}
+		d.mu.Unlock()
+	}
+}
+
+// expired reports whether the circuit for ic should be closed. It must be
+// called with ic.mu held.
+func (d *Dialer) expired(ic *isolatedCircuit, now time.Time) bool {
+	if ic.circ == nil || ic.circ.Closed() {
+		return true
+	}
+	if ic.circ.NumStreams() > 0 {
+		ic.used = now
+		return false
+	}
+	return d.tooDirty(ic, now) || now.Sub(ic.used) >= d.idleTimeout
+}
+
+// tooDirty reports whether the circuit for ic is too old for new streams.
+func (d *Dialer) tooDirty(ic *isolatedCircuit, now time.Time) bool {
+	return !ic.dirty.IsZero() && now.Sub(ic.dirty) >= d.dirtiness
+}
+
+// circuit returns an open circuit for key, building one if necessary. If ctx
+// is done first, the build continues in the background for later dials.
+func (d *Dialer) circuit(ctx context.Context, key IsolationKey) (*OriginCircuit, error) {
+	type result struct {
+		circ *OriginCircuit
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		c, err := d.isolatedCircuit(key)
+		ch <- result{c, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-ch:
+		return r.circ, r.err
+	}
+}
+
+func (d *Dialer) isolatedCircuit(key IsolationKey) (*OriginCircuit, error) {
+	for {
+		ic, err := d.entry(key)
+		if err != nil {
+			return nil, err
+		}
+
+		ic.mu.Lock()
+		if ic.evicted {
+			// Expired while we waited; look up the replacement.
+			ic.mu.Unlock()
+			continue
+		}
+		c, err := d.useCircuit(ic)
+		ic.mu.Unlock()
+		return c, err
+	}
+}
+
+// entry returns the circuit entry for key, creating it if necessary.
+func (d *Dialer) entry(key IsolationKey) (*isolatedCircuit, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	select {
+	case <-d.done:
+		return nil, errors.New("dialer closed")
+	default:
+	}
+
+	ic, ok := d.circuits[key]
+	if !ok {
+		ic = &isolatedCircuit{}
+		d.circuits[key] = ic
+	}
+	return ic, nil
+}
+
+// useCircuit returns the circuit for ic, marking it dirty. A new circuit is
+// built if there is none, or the existing one is closed or too dirty. It must
+// be called with ic.mu held.
+func (d *Dialer) useCircuit(ic *isolatedCircuit) (*OriginCircuit, error) {
+	now := d.clock()
+
+	if ic.circ != nil && !ic.circ.Closed() {
+		if !d.tooDirty(ic, now) {
+			if ic.dirty.IsZero() {
+				ic.dirty = now
+			}
+			ic.used = now
+			return ic.circ, nil
+		}
+
+		d.retire(ic.circ)
+		ic.circ = nil
+	}
+
+	if d.paths == nil {
+		return nil, errors.New("no path provider")
+	}
+	hops, err := d.paths.Path()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not select path")
+	}
+
+	c, err := d.router.BuildCircuit(hops)
+	if err != nil {
+		return nil, err
+	}
+	ic.circ = c
+	ic.dirty = now
+	ic.used = now
+
+	return c, nil
+}
+
+// retire stops using c for new streams. Existing streams keep the circuit
+// until they end, after which it is closed.
+func (d *Dialer) retire(c *OriginCircuit) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	select {
+	case <-d.done:
+	default:
+		if c.NumStreams() > 0 {
+			d.retired = append(d.retired, c)
+			return
+		}
+	}
+
+	if err := c.Close(); err != nil {
+		log.WithErr(d.logger, err).Debug("error closing dirty circuit")
+	}
+}
+
+func (d *Dialer) clock() time.Time {
+	if d.now == nil {
+		return time.Now()
+	}
+	return d.now()
+}
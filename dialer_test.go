@@ -0,0 +1,315 @@
+package pearl
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/inconshreveable/log15"
+	"github.com/mmcloughlin/pearl/check"
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/mmcloughlin/pearl/torexitpolicy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/uber-go/tally"
+)
+
+// newTestRouter builds a router with freshly generated keys.
+func newTestRouter(t *testing.T, policy *torexitpolicy.Policy) *Router {
+	k, err := torconfig.GenerateKeys()
+	require.NoError(t, err)
+	config := &torconfig.Config{
+		Nickname:   "test",
+		IP:         net.IPv4(127, 0, 0, 1),
+		ExitPolicy: policy,
+		Keys:       k,
+
+		ExtendAllowPrivateAddresses: true,
+	}
+	base := log15.New()
+	base.SetHandler(log15.DiscardHandler())
+	r, err := NewRouter(config, tally.NoopScope, log.NewLog15(base))
+	require.NoError(t, err)
+	return r
+}
+
+// startTestRelay starts an in-process relay, returning a hop for it and a
+// function to stop it.
+func startTestRelay(t *testing.T, r *Router) (*HopSpec, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = r.serve(ln) }()
+
+	fp, err := NewFingerprintFromBytes(r.Fingerprint())
+	require.NoError(t, err)
+	return &HopSpec{
+		Identity: fp,
+		NtorKey:  r.config.Keys.Ntor.Public,
+		Addrs:    []*net.TCPAddr{ln.Addr().(*net.TCPAddr)},
+
+		EdIdentity: r.config.Keys.Ed25519Identity.Public[:],
+	}, func() { check.Close(r.logger, ln) }
+}
+
+// startEchoServer starts a TCP server that echoes all data back, returning its
+// address and a function to stop it.
+func startEchoServer(t *testing.T) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return ln.Addr().String(), func() { _ = ln.Close() }
+}
+
+func TestDialerEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	middle, stopMiddle := startTestRelay(t, newTestRouter(t, torexitpolicy.RejectAllPolicy))
+	defer stopMiddle()
+	exit, stopExit := startTestRelay(t, newTestRouter(t, torexitpolicy.AcceptAllPolicy))
+	defer stopExit()
+	echo, stopEcho := startEchoServer(t)
+	defer stopEcho()
+
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	d := NewDialer(client, DialerOptions{Paths: StaticPath{middle, exit}})
+	defer check.Close(client.logger, d)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	conn, err := d.DialContext(ctx, "tcp", echo)
+	require.NoError(t, err)
+	defer check.Close(client.logger, conn)
+
+	// Send enough data to exercise stream and circuit level SENDMEs.
+	msg := make([]byte, 2*StreamWindowStart*MaxRelayDataLength)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	go func() {
+		_, err := conn.Write(msg)
+		assert.NoError(t, err)
+	}()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+	got := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, got)
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+}
+
+func TestDialerIsolation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	exit, stopExit := startTestRelay(t, newTestRouter(t, torexitpolicy.AcceptAllPolicy))
+	defer stopExit()
+	echo, stopEcho := startEchoServer(t)
+	defer stopEcho()
+
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	d := NewDialer(client, DialerOptions{Paths: StaticPath{exit}})
+	defer check.Close(client.logger, d)
+
+	dial := func(key IsolationKey) *OriginStream {
+		ctx := WithIsolationKey(context.Background(), key)
+		conn, err := d.DialContext(ctx, "tcp", echo)
+		require.NoError(t, err)
+		return conn.(*OriginStream)
+	}
+
+	a1 := dial("a")
+	a2 := dial("a")
+	b := dial("b")
+	assert.Equal(t, a1.circ, a2.circ)
+	assert.NotEqual(t, a1.circ, b.circ)
+
+	for _, s := range []*OriginStream{a1, a2, b} {
+		require.NoError(t, s.Close())
+	}
+}
+
+func TestDialerStreamRefused(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	exit, stopExit := startTestRelay(t, newTestRouter(t, torexitpolicy.RejectAllPolicy))
+	defer stopExit()
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	d := NewDialer(client, DialerOptions{Paths: StaticPath{exit}})
+	defer check.Close(client.logger, d)
+
+	echo, stopEcho := startEchoServer(t)
+	defer stopEcho()
+	_, err := d.Dial("tcp", echo)
+	require.Error(t, err)
+	assert.Equal(t, StreamEndedError{Reason: StreamCloseReasonExitpolicy}, err)
+}
+
+func TestDialerUnknownNetwork(t *testing.T) {
+	d := NewDialer(newTestRouter(t, nil), DialerOptions{})
+	defer check.Close(d.logger, d)
+	_, err := d.Dial("udp", "example.com:53")
+	assert.Error(t, err)
+}
+
+func TestDialerCreateFastHalfClose(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	// Without an ntor key the first hop is created with CREATE_FAST.
+	exit, stopExit := startTestRelay(t, newTestRouter(t, torexitpolicy.AcceptAllPolicy))
+	defer stopExit()
+	exit.NtorKey = [32]byte{}
+	echo, stopEcho := startEchoServer(t)
+	defer stopEcho()
+
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	d := NewDialer(client, DialerOptions{Paths: StaticPath{exit}})
+	defer check.Close(client.logger, d)
+
+	conn, err := d.Dial("tcp", echo)
+	require.NoError(t, err)
+	defer check.Close(client.logger, conn)
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(*OriginStream).CloseWrite())
+	_, err = conn.Write([]byte("world"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	// Data is still readable after closing the write side.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+	got := make([]byte, 5)
+	_, err = io.ReadFull(conn, got)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(got))
+}
+
+// testClock is a manually advanced clock.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestDialerCircuitDirtiness(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	exit, stopExit := startTestRelay(t, newTestRouter(t, torexitpolicy.AcceptAllPolicy))
+	defer stopExit()
+	echo, stopEcho := startEchoServer(t)
+	defer stopEcho()
+
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	d := NewDialer(client, DialerOptions{Paths: StaticPath{exit}})
+	defer check.Close(client.logger, d)
+	clock := &testClock{now: time.Unix(1e9, 0)}
+	d.now = clock.Now
+
+	a, err := d.Dial("tcp", echo)
+	require.NoError(t, err)
+	old := a.(*OriginStream).circ
+
+	// A dirty circuit is not used for new streams.
+	clock.Advance(DefaultMaxCircuitDirtiness)
+	b, err := d.Dial("tcp", echo)
+	require.NoError(t, err)
+	defer check.Close(client.logger, b)
+	assert.NotEqual(t, old, b.(*OriginStream).circ)
+
+	// It remains open while it carries a stream, and is closed once the
+	// stream ends.
+	d.expire()
+	assert.False(t, old.Closed())
+	require.NoError(t, a.Close())
+	d.expire()
+	assert.True(t, old.Closed())
+	assert.False(t, b.(*OriginStream).circ.Closed())
+}
+
+func TestDialerCircuitIdle(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	exit, stopExit := startTestRelay(t, newTestRouter(t, torexitpolicy.AcceptAllPolicy))
+	defer stopExit()
+	echo, stopEcho := startEchoServer(t)
+	defer stopEcho()
+
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	d := NewDialer(client, DialerOptions{
+		Paths:               StaticPath{exit},
+		MaxCircuitDirtiness: 2 * time.Hour,
+	})
+	defer check.Close(client.logger, d)
+	clock := &testClock{now: time.Unix(1e9, 0)}
+	d.now = clock.Now
+
+	dial := func(key IsolationKey) *OriginStream {
+		conn, err := d.DialContext(WithIsolationKey(context.Background(), key), "tcp", echo)
+		require.NoError(t, err)
+		return conn.(*OriginStream)
+	}
+
+	a := dial("a")
+	b := dial("b")
+	require.NoError(t, a.Close())
+	defer check.Close(client.logger, b)
+
+	// Circuits in use are never idle.
+	clock.Advance(DefaultCircuitIdleTimeout)
+	d.expire()
+	assert.True(t, a.circ.Closed())
+	assert.False(t, b.circ.Closed())
+	d.mu.Lock()
+	assert.Len(t, d.circuits, 1)
+	d.mu.Unlock()
+
+	// A new circuit replaces the expired one.
+	c := dial("a")
+	defer check.Close(client.logger, c)
+	assert.NotEqual(t, a.circ, c.circ)
+	assert.False(t, c.circ.Closed())
+}
+
+func TestDialerClosed(t *testing.T) {
+	d := NewDialer(newTestRouter(t, nil), DialerOptions{})
+	require.NoError(t, d.Close())
+	_, err := d.Dial("tcp", "example.com:80")
+	assert.Error(t, err)
+}
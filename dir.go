@@ -0,0 +1,408 @@
+package pearl
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/ratelimit"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/pkg/errors"
+)
+
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L3395-L3404
+//
+//	   The server descriptor with (hex) identity fingerprint F can be
+//	   retrieved at:
+//	      http://<hostname>/tor/server/fp/F.z
+//
+//	   The most recent descriptor for this server can be retrieved at:
+//	      http://<hostname>/tor/server/authority.z
+//
+//	   [Nothing in the Tor protocol uses this resource yet, but it is useful
+//	    for debugging purposes. Also, the official Tor implementations
+//	    (starting at 0.1.1.x) use this resource to test whether a server's
+//	    own DirPort is reachable.]
+//
+const (
+	dirServerAuthorityPath     = "/tor/server/authority"
+	dirServerFingerprintPrefix = "/tor/server/fp/"
+)
+
+// Extra-info documents, the consensus and authority key certificates are
+// served at the following paths, each optionally with a ".z" suffix.
+// Fingerprints and signing key digests are hex, and several may be requested
+// at once separated by "+".
+//
+//	/tor/extra/authority
+//	/tor/extra/fp/<F>
+//	/tor/status-vote/current/consensus
+//	/tor/keys/all
+//	/tor/keys/fp/<F>
+//	/tor/keys/sk/<S>
+//	/tor/keys/fp-sk/<F>-<S>
+//
+const (
+	dirExtraAuthorityPath      = "/tor/extra/authority"
+	dirExtraFingerprintPrefix  = "/tor/extra/fp/"
+	dirConsensusPath           = "/tor/status-vote/current/consensus"
+	dirKeysAllPath             = "/tor/keys/all"
+	dirKeysFingerprintPrefix   = "/tor/keys/fp/"
+	dirKeysSigningKeyPrefix    = "/tor/keys/sk/"
+	dirKeysFingerprintSKPrefix = "/tor/keys/fp-sk/"
+)
+
+// dirYourAddressHeader tells clients the address their request came from.
+const dirYourAddressHeader = "X-Your-Address-Is"
+
+// dirHandler serves directory documents cached by the router.
+type dirHandler struct {
+	router *Router
+	logger log.Logger
+}
+
+// NewDirHandler builds an HTTP handler serving directory documents cached by
+// r.
+func NewDirHandler(r *Router) http.Handler {
+	return &dirHandler{
+		router: r,
+		logger: log.ForComponent(r.logger, "dir"),
+	}
+}
+
+// errDirBadRequest is returned from lookup for malformed requests.
+var errDirBadRequest = errors.New("malformed directory request")
+
+// ServeHTTP responds to directory requests. Paths ending in ".z" are served
+// zlib compressed.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L3332-L3334
+//
+//	   The body of the response may be compressed using zlib: clients should
+//	   append ".z" to the URL to request a compressed document.
+//
+func (h *dirHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	logger := h.logger.With("path", req.URL.Path)
+	logger.Debug("directory request")
+
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil && net.ParseIP(host) != nil {
+		w.Header().Set(dirYourAddressHeader, host)
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := req.URL.Path
+	compress := strings.HasSuffix(path, ".z")
+	path = strings.TrimSuffix(path, ".z")
+
+	doc, modified, err := h.lookup(path)
+	if err == errDirBadRequest {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if doc == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		if ims, err := http.ParseTime(req.Header.Get("If-Modified-Since")); err == nil && !modified.After(ims) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if compress {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		if _, err := zw.Write(doc); err != nil {
+			log.Err(logger, err, "failed to compress document")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if err := zw.Close(); err != nil {
+			log.Err(logger, err, "failed to compress document")
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		doc = buf.Bytes()
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := w.Write(doc); err != nil {
+		log.Err(logger, err, "failed to write response")
+	}
+}
+
+// lookup returns the document at path and the time it was published. Returns
+// a nil document if there is none.
+func (h *dirHandler) lookup(path string) ([]byte, time.Time, error) {
+	data := h.router.config.Data
+	if data == nil {
+		return nil, time.Time{}, nil
+	}
+
+	switch {
+	case path == dirServerAuthorityPath:
+		return h.cached(data.ServerDescriptor, publishedKeyword)
+	case strings.HasPrefix(path, dirServerFingerprintPrefix):
+		return h.self(path, dirServerFingerprintPrefix, data.ServerDescriptor)
+	case path == dirExtraAuthorityPath:
+		return h.cached(data.ExtraInfo, publishedKeyword)
+	case strings.HasPrefix(path, dirExtraFingerprintPrefix):
+		return h.self(path, dirExtraFingerprintPrefix, data.ExtraInfo)
+	case path == dirConsensusPath:
+		return h.cached(data.Consensus, validAfterKeyword)
+	case path == dirKeysAllPath:
+		return h.keys(func(fp, sk string) bool { return true })
+	case strings.HasPrefix(path, dirKeysFingerprintPrefix):
+		fps, err := hexList(strings.TrimPrefix(path, dirKeysFingerprintPrefix))
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return h.keys(func(fp, sk string) bool { return fps[fp] })
+	case strings.HasPrefix(path, dirKeysSigningKeyPrefix):
+		sks, err := hexList(strings.TrimPrefix(path, dirKeysSigningKeyPrefix))
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return h.keys(func(fp, sk string) bool { return sks[sk] })
+	case strings.HasPrefix(path, dirKeysFingerprintSKPrefix):
+		pairs := map[string]bool{}
+		for _, pair := range strings.Split(strings.TrimPrefix(path, dirKeysFingerprintSKPrefix), "+") {
+			parts := strings.Split(pair, "-")
+			if len(parts) != 2 || !isHex(parts[0]) || !isHex(parts[1]) {
+				return nil, time.Time{}, errDirBadRequest
+			}
+			pairs[strings.ToUpper(parts[0]+"-"+parts[1])] = true
+		}
+		return h.keys(func(fp, sk string) bool { return pairs[fp+"-"+sk] })
+	}
+	return nil, time.Time{}, nil
+}
+
+// cached loads a document with load, taking its modification time from the
+// first line with the given timestamp keyword.
+func (h *dirHandler) cached(load func() ([]byte, error), keyword string) ([]byte, time.Time, error) {
+	doc, err := load()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Err(h.logger, err, "could not load cached document")
+		}
+		return nil, time.Time{}, nil
+	}
+	return doc, documentTime(doc, keyword), nil
+}
+
+// self serves a document describing this router, if its fingerprint is in
+// the "+" separated list following prefix.
+func (h *dirHandler) self(path, prefix string, load func() ([]byte, error)) ([]byte, time.Time, error) {
+	fps, err := hexList(strings.TrimPrefix(path, prefix))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !fps[hexUpper(h.router.Fingerprint())] {
+		return nil, time.Time{}, nil
+	}
+	return h.cached(load, publishedKeyword)
+}
+
+// keys serves the concatenation of cached key certificates whose upper case
+// hex identity fingerprint and signing key digest match the predicate. The
+// modification time is that of the most recent certificate.
+func (h *dirHandler) keys(match func(fp, sk string) bool) ([]byte, time.Time, error) {
+	certs, err := torconfig.KeyCertificates(h.router.config.Data)
+	if err != nil {
+		log.Err(h.logger, err, "could not load cached key certificates")
+		return nil, time.Time{}, nil
+	}
+	var doc []byte
+	var modified time.Time
+	for _, c := range certs {
+		sk, err := c.SigningKeyDigest()
+		if err != nil {
+			continue
+		}
+		if !match(hexUpper(c.Fingerprint), hexUpper(sk)) {
+			continue
+		}
+		doc = append(doc, c.Encode()...)
+		if c.Published.After(modified) {
+			modified = c.Published
+		}
+	}
+	return doc, modified, nil
+}
+
+// hexList parses a "+" separated list of hex strings into a set of upper case
+// hex strings.
+func hexList(s string) (map[string]bool, error) {
+	set := map[string]bool{}
+	for _, h := range strings.Split(s, "+") {
+		if !isHex(h) {
+			return nil, errDirBadRequest
+		}
+		set[strings.ToUpper(h)] = true
+	}
+	return set, nil
+}
+
+func hexUpper(b []byte) string {
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return s != "" && err == nil
+}
+
+// Timestamp keywords used to determine document modification times.
+const (
+	publishedKeyword  = "published"
+	validAfterKeyword = "valid-after"
+)
+
+// documentTime returns the time on the first line of doc starting with
+// keyword, or the zero time if there is none.
+func documentTime(doc []byte, keyword string) time.Time {
+	for _, line := range strings.Split(string(doc), "\n") {
+		if !strings.HasPrefix(line, keyword+" ") {
+			continue
+		}
+		t, err := time.Parse("2006-01-02 15:04:05", strings.TrimPrefix(line, keyword+" "))
+		if err != nil {
+			return time.Time{}
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// ServeDir serves directory requests on the DirPort.
+func (r *Router) ServeDir() error {
+	laddr := r.config.DirBindAddr()
+	r.logger.With("laddr", laddr).Info("creating directory listener")
+	ln, err := net.Listen("tcp", laddr)
+	if err != nil {
+		return errors.Wrap(err, "could not create directory listener")
+	}
+	return r.serveDir(ln)
+}
+
+// serveDir serves directory requests on ln. Traffic counts against the
+// router's overall bandwidth limit.
+func (r *Router) serveDir(ln net.Listener) error {
+	srv := &http.Server{
+		Handler:      r.dir,
+		ReadTimeout:  dirTimeout,
+		WriteTimeout: dirTimeout,
+	}
+	return srv.Serve(&limitedListener{Listener: ln, limiter: r.bandwidth})
+}
+
+// dirTimeout bounds the time to read a directory request or write a response.
+const dirTimeout = 2 * time.Minute
+
+// limitedListener rate limits the connections it accepts.
+type limitedListener struct {
+	net.Listener
+	limiter *ratelimit.Limiter
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &limitedConn{
+		Conn: conn,
+		r:    l.limiter.WrapReader(conn),
+		w:    l.limiter.WrapWriter(conn),
+	}, nil
+}
+
+// limitedConn reads and writes through rate limited wrappers.
+type limitedConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *limitedConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *limitedConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+// dirConnect returns a connection to the router's directory handler, for a
+// stream opened with RELAY_BEGIN_DIR.
+func (r *Router) dirConnect() net.Conn {
+	client, server := net.Pipe()
+	ln := newConnListener(server)
+	srv := &http.Server{Handler: r.dir}
+	go func() {
+		if err := srv.Serve(ln); err != io.EOF {
+			log.Err(r.logger, err, "directory server error")
+		}
+	}()
+	return client
+}
+
+// connListener is a net.Listener that accepts a single connection. Accept
+// blocks after the first call until the connection is closed.
+type connListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+	mu   sync.Mutex
+	used bool
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	l := &connListener{done: make(chan struct{})}
+	l.conn = &listenerConn{Conn: conn, l: l}
+	return l
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	used := l.used
+	l.used = true
+	l.mu.Unlock()
+
+	if !used {
+		return l.conn, nil
+	}
+	<-l.done
+	return nil, io.EOF
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// listenerConn closes its listener when closed.
+type listenerConn struct {
+	net.Conn
+	l *connListener
+}
+
+func (c *listenerConn) Close() error {
+	err := c.Conn.Close()
+	_ = c.l.Close()
+	return err
+}
@@ -0,0 +1,268 @@
+package pearl
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/check"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/mmcloughlin/pearl/torexitpolicy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDirRouter builds a router with a cached server descriptor. The
+// returned function removes its data directory.
+func newTestDirRouter(t *testing.T) (*Router, []byte, func()) {
+	dir, err := ioutil.TempDir("", "pearldirtest")
+	require.NoError(t, err)
+	cleanup := func() { _ = os.RemoveAll(dir) }
+
+	r := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	r.config.Data = torconfig.NewDataDirectory(dir)
+
+	desc, err := r.Descriptor()
+	require.NoError(t, err)
+	require.NoError(t, r.config.Data.SetServerDescriptor(desc))
+	doc, err := r.config.Data.ServerDescriptor()
+	require.NoError(t, err)
+
+	return r, doc, cleanup
+}
+
+func TestDirHandler(t *testing.T) {
+	r, doc, cleanup := newTestDirRouter(t)
+	defer cleanup()
+	h := NewDirHandler(r)
+	fp := hex.EncodeToString(r.Fingerprint())
+
+	cases := []struct {
+		Path   string
+		Status int
+	}{
+		{"/tor/server/authority", http.StatusOK},
+		{"/tor/server/fp/" + fp, http.StatusOK},
+		{"/tor/server/fp/0000000000000000000000000000000000000000+" + fp, http.StatusOK},
+		{"/tor/server/fp/0000000000000000000000000000000000000000", http.StatusNotFound},
+		{"/tor/status-vote/current/consensus", http.StatusNotFound},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", c.Path, nil))
+		assert.Equal(t, c.Status, w.Code, c.Path)
+		if c.Status == http.StatusOK {
+			assert.Equal(t, doc, w.Body.Bytes())
+		}
+	}
+}
+
+func TestDirHandlerCompressed(t *testing.T) {
+	r, doc, cleanup := newTestDirRouter(t)
+	defer cleanup()
+	w := httptest.NewRecorder()
+	NewDirHandler(r).ServeHTTP(w, httptest.NewRequest("GET", "/tor/server/authority.z", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	zr, err := zlib.NewReader(w.Body)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, doc, got)
+}
+
+func TestDirHandlerNoData(t *testing.T) {
+	r := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	w := httptest.NewRecorder()
+	NewDirHandler(r).ServeHTTP(w, httptest.NewRequest("GET", "/tor/server/authority", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+// testKeyCertificate generates a key certificate for a new authority,
+// returning the document with its identity fingerprint and signing key digest.
+func testKeyCertificate(t *testing.T, published time.Time) (string, string, string) {
+	identity, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	c, err := tordir.GenerateKeyCertificate(identity, published, published.AddDate(1, 0, 0))
+	require.NoError(t, err)
+	sk, err := c.SigningKeyDigest()
+	require.NoError(t, err)
+	return string(c.Encode()), hexUpper(c.Fingerprint), hexUpper(sk)
+}
+
+func TestDirHandlerDocuments(t *testing.T) {
+	r, _, cleanup := newTestDirRouter(t)
+	defer cleanup()
+
+	consensus := []byte("network-status-version 3\nvalid-after 2020-01-01 00:00:00\n")
+	require.NoError(t, r.config.Data.SetConsensus(consensus))
+
+	certa, ida, ska := testKeyCertificate(t, time.Unix(1e9, 0))
+	certb, idb, skb := testKeyCertificate(t, time.Unix(1e9, 0))
+	require.NoError(t, r.config.Data.SetCertificates([]byte(certa+certb)))
+
+	h := NewDirHandler(r)
+	cases := []struct {
+		Path   string
+		Status int
+		Body   string
+	}{
+		{"/tor/extra/authority", http.StatusNotFound, ""},
+		{"/tor/status-vote/current/consensus", http.StatusOK, string(consensus)},
+		{"/tor/keys/all", http.StatusOK, certa + certb},
+		{"/tor/keys/fp/" + idb, http.StatusOK, certb},
+		{"/tor/keys/fp/" + strings.ToLower(ida) + "+" + idb, http.StatusOK, certa + certb},
+		{"/tor/keys/sk/" + ska, http.StatusOK, certa},
+		{"/tor/keys/fp-sk/" + idb + "-" + skb, http.StatusOK, certb},
+		{"/tor/keys/fp-sk/" + ida + "-" + skb, http.StatusNotFound, ""},
+		{"/tor/keys/fp/nothex", http.StatusBadRequest, ""},
+		{"/tor/keys/fp-sk/" + ida, http.StatusBadRequest, ""},
+		{"/tor/server/fp/xyz", http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", c.Path, nil))
+		assert.Equal(t, c.Status, w.Code, c.Path)
+		if c.Status == http.StatusOK {
+			assert.Equal(t, c.Body, w.Body.String(), c.Path)
+		}
+	}
+}
+
+func TestDirHandlerExtraInfo(t *testing.T) {
+	r, _, cleanup := newTestDirRouter(t)
+	defer cleanup()
+	_, extra, err := r.Descriptors()
+	require.NoError(t, err)
+	require.NoError(t, r.config.Data.SetExtraInfo(extra))
+
+	h := NewDirHandler(r)
+	fp := hex.EncodeToString(r.Fingerprint())
+	for _, path := range []string{"/tor/extra/authority", "/tor/extra/fp/" + fp} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, extra.Encode(), w.Body.Bytes(), path)
+	}
+}
+
+func TestDirHandlerIfModifiedSince(t *testing.T) {
+	r, _, cleanup := newTestDirRouter(t)
+	defer cleanup()
+	consensus := []byte("network-status-version 3\nvalid-after 2020-01-01 12:00:00\n")
+	require.NoError(t, r.config.Data.SetConsensus(consensus))
+	h := NewDirHandler(r)
+
+	cases := []struct {
+		Since  time.Time
+		Status int
+	}{
+		{time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC), http.StatusOK},
+		{time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), http.StatusNotModified},
+		{time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC), http.StatusNotModified},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/tor/status-vote/current/consensus", nil)
+		req.Header.Set("If-Modified-Since", c.Since.Format(http.TimeFormat))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, c.Status, w.Code, c.Since)
+		assert.Equal(t, "Wed, 01 Jan 2020 12:00:00 GMT", w.Header().Get("Last-Modified"))
+	}
+}
+
+func TestDirHandlerYourAddress(t *testing.T) {
+	r, _, cleanup := newTestDirRouter(t)
+	defer cleanup()
+	req := httptest.NewRequest("GET", "/tor/server/authority", nil)
+	req.RemoteAddr = "192.0.2.7:4321"
+	w := httptest.NewRecorder()
+	NewDirHandler(r).ServeHTTP(w, req)
+	assert.Equal(t, "192.0.2.7", w.Header().Get("X-Your-Address-Is"))
+}
+
+func TestDirHandlerMethodNotAllowed(t *testing.T) {
+	r, _, cleanup := newTestDirRouter(t)
+	defer cleanup()
+	w := httptest.NewRecorder()
+	NewDirHandler(r).ServeHTTP(w, httptest.NewRequest("POST", "/tor/server/authority", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestServeDir(t *testing.T) {
+	r, doc, cleanup := newTestDirRouter(t)
+	defer cleanup()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer check.Close(r.logger, ln)
+	go func() { _ = r.serveDir(ln) }()
+
+	res, err := http.Get("http://" + ln.Addr().String() + "/tor/server/authority")
+	require.NoError(t, err)
+	defer check.Close(r.logger, res.Body)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "127.0.0.1", res.Header.Get("X-Your-Address-Is"))
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	assert.Equal(t, doc, body)
+}
+
+func TestBeginDirEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	r, doc, cleanup := newTestDirRouter(t)
+	defer cleanup()
+	dircache, stopDircache := startTestRelay(t, r)
+	defer stopDircache()
+	middle, stopMiddle := startTestRelay(t, newTestRouter(t, torexitpolicy.RejectAllPolicy))
+	defer stopMiddle()
+
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+
+	paths := map[string][]*HopSpec{
+		"OneHop":   {dircache},
+		"MultiHop": {middle, dircache},
+	}
+	for name, path := range paths {
+		t.Run(name, func(t *testing.T) {
+			c, err := client.BuildCircuit(path)
+			require.NoError(t, err)
+			defer check.Close(client.logger, c)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			s, err := c.OpenDirStream(ctx)
+			require.NoError(t, err)
+			defer check.Close(client.logger, s)
+			require.NoError(t, s.SetDeadline(time.Now().Add(10*time.Second)))
+
+			req, err := http.NewRequest("GET", "http://dir/tor/server/authority", nil)
+			require.NoError(t, err)
+			var buf bytes.Buffer
+			require.NoError(t, req.Write(&buf))
+			_, err = s.Write(buf.Bytes())
+			require.NoError(t, err)
+
+			res, err := http.ReadResponse(bufio.NewReader(s), req)
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			body, err := ioutil.ReadAll(res.Body)
+			require.NoError(t, err)
+			assert.Equal(t, doc, body)
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package pearl
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mmcloughlin/pearl/check"
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/mmcloughlin/pearl/tordir"
+)
+
+// DefaultDirectoryFetchInterval is how often the fetcher refreshes the cached
+// consensus. Authorities publish a new consensus every hour.
+const DefaultDirectoryFetchInterval = 30 * time.Minute
+
+// DirectoryFetcher keeps the router's cached consensus and authority key
+// certificates up to date, fetching them from directory authorities. These are
+// the documents served by the directory handler.
+type DirectoryFetcher struct {
+	Router *Router
+	// Authorities to fetch from. Certificates and consensus signatures are
+	// pinned to their v3 identities.
+	Authorities []*tordir.Authority
+	Interval    time.Duration
+
+	Logger log.Logger
+
+	// Overridden in tests.
+	get func(addr, path string) ([]byte, error)
+	now func() time.Time
+}
+
+// Start enters a loop fetching directory documents. It does not return.
+func (f *DirectoryFetcher) Start() {
+	interval := f.Interval
+	if interval == 0 {
+		interval = DefaultDirectoryFetchInterval
+	}
+	for {
+		if err := f.Fetch(); err != nil {
+			log.Err(f.Logger, err, "error fetching directory documents")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Fetch refreshes the cached key certificates and then the consensus, which
+// is only stored if it is signed by a quorum of the authorities.
+func (f *DirectoryFetcher) Fetch() error {
+	data := f.Router.config.Data
+	if data == nil {
+		return errors.New("no data directory")
+	}
+	if err := f.fetchCertificates(data); err != nil {
+		return err
+	}
+	return f.fetchConsensus(data)
+}
+
+// fetchCertificates adds the authorities' current key certificates to the
+// cache.
+func (f *DirectoryFetcher) fetchCertificates(data torconfig.Data) error {
+	b, err := f.fetch(dirKeysAllPath)
+	if err != nil {
+		return err
+	}
+	certs, err := tordir.ParseKeyCertificates(b)
+	if err != nil {
+		return err
+	}
+	now := f.clock()
+	pinned := tordir.PinnedKeyCertificates(certs, f.Authorities, now)
+	f.Logger.With("fetched", len(certs)).With("valid", len(pinned)).Debug("fetched key certificates")
+	return torconfig.CacheKeyCertificates(data, pinned, now)
+}
+
+// fetchConsensus verifies a fetched consensus against the cached certificates
+// and stores it, unless it is older than the cached one.
+func (f *DirectoryFetcher) fetchConsensus(data torconfig.Data) error {
+	b, err := f.fetch(dirConsensusPath)
+	if err != nil {
+		return err
+	}
+	c, err := tordir.ParseConsensus(b)
+	if err != nil {
+		return err
+	}
+	certs, err := torconfig.KeyCertificates(data)
+	if err != nil {
+		return err
+	}
+	if err := c.VerifyAuthorities(certs, f.Authorities, f.clock()); err != nil {
+		return errors.Wrap(err, "consensus verification failed")
+	}
+
+	cached, err := data.Consensus()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if prev, err := tordir.ParseConsensus(cached); err == nil && !c.ValidAfter.After(prev.ValidAfter) {
+		return nil
+	}
+
+	f.Logger.With("valid_after", c.ValidAfter).Info("caching new consensus")
+	return data.SetConsensus(b)
+}
+
+// fetch gets a document from the first authority that serves it.
+func (f *DirectoryFetcher) fetch(path string) ([]byte, error) {
+	get := f.get
+	if get == nil {
+		get = httpGet
+	}
+	var err error
+	for _, a := range f.Authorities {
+		var b []byte
+		b, err = get(a.Address, path)
+		if err == nil {
+			return b, nil
+		}
+		log.WithErr(f.Logger.With("authority", a.Nickname).With("path", path), err).Debug("directory fetch failed")
+	}
+	if err == nil {
+		err = errors.New("no authorities")
+	}
+	return nil, errors.Wrapf(err, "could not fetch %s", path)
+}
+
+func (f *DirectoryFetcher) clock() time.Time {
+	if f.now == nil {
+		return time.Now()
+	}
+	return f.now()
+}
+
+// httpGet fetches path from the directory server at addr.
+func httpGet(addr, path string) ([]byte, error) {
+	client := &http.Client{Timeout: dirTimeout}
+	res, err := client.Get("http://" + addr + path)
+	if err != nil {
+		return nil, err
+	}
+	defer check.MustClose(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %s", res.Status)
+	}
+	return ioutil.ReadAll(res.Body)
+}
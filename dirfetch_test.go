@@ -0,0 +1,238 @@
+package pearl
+
+import (
+	"crypto/rsa"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/mmcloughlin/pearl/torexitpolicy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testFetchConsensusBody = `network-status-version 3
+vote-status consensus
+valid-after 2018-03-01 12:00:00
+fresh-until 2018-03-01 13:00:00
+valid-until 2018-03-01 15:00:00
+known-flags Running Valid
+r alpha AAECAwQFBgcICQoLDA0ODxAREhM 8+GiQUlgMVVV7hcMqOFm+4+xUgw 2018-03-01 10:15:00 203.0.113.1 9001 0
+s Running Valid
+directory-footer
+`
+
+// testDirAuthority is a directory authority serving its key certificate and
+// consensus documents.
+type testDirAuthority struct {
+	identity []byte
+	signing  *rsa.PrivateKey
+	cert     *tordir.KeyCertificate
+}
+
+func newTestDirAuthority(t *testing.T, published time.Time) *testDirAuthority {
+	identity, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	signing, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	cert, err := tordir.NewKeyCertificate(identity, signing, published, published.AddDate(1, 0, 0))
+	require.NoError(t, err)
+	return &testDirAuthority{identity: cert.Fingerprint, signing: signing, cert: cert}
+}
+
+func (a *testDirAuthority) Authority(addr string) *tordir.Authority {
+	return &tordir.Authority{
+		Nickname:   "test",
+		Address:    addr,
+		V3Identity: strings.ToUpper(hex.EncodeToString(a.identity)),
+	}
+}
+
+// signTestFetchConsensus signs body by each of the authorities.
+func signTestFetchConsensus(t *testing.T, body string, auths ...*testDirAuthority) []byte {
+	doc := []byte(body)
+	for _, a := range auths {
+		var err error
+		doc, err = tordir.SignConsensus(doc, a.identity, a.signing)
+		require.NoError(t, err)
+	}
+	return doc
+}
+
+// startTestDirServer serves the documents at the given paths, returning its
+// address and a function to stop it.
+func startTestDirServer(docs map[string][]byte) (string, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		doc, ok := docs[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		_, _ = w.Write(doc)
+	}))
+	return strings.TrimPrefix(srv.URL, "http://"), srv.Close
+}
+
+// newTestFetchRouter builds a router with an empty data directory. The
+// returned function removes it.
+func newTestFetchRouter(t *testing.T) (*Router, func()) {
+	dir, err := ioutil.TempDir("", "pearlfetchtest")
+	require.NoError(t, err)
+	r := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	r.config.Data = torconfig.NewDataDirectory(dir)
+	return r, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestDirectoryFetcherCertificates(t *testing.T) {
+	published := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	a := newTestDirAuthority(t, published)
+	b := newTestDirAuthority(t, published)
+	other := newTestDirAuthority(t, published)
+
+	certs := append(append(append([]byte{}, a.cert.Encode()...), b.cert.Encode()...), other.cert.Encode()...)
+	addr, stop := startTestDirServer(map[string][]byte{
+		"/tor/keys/all": certs,
+	})
+	defer stop()
+
+	r, cleanup := newTestFetchRouter(t)
+	defer cleanup()
+	h := NewDirHandler(r)
+
+	// Nothing is served until the certificates have been fetched.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/tor/keys/all", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	f := &DirectoryFetcher{
+		Router:      r,
+		Authorities: []*tordir.Authority{a.Authority(addr), b.Authority(addr)},
+		Logger:      r.logger,
+		now:         func() time.Time { return published.Add(time.Hour) },
+	}
+	require.NoError(t, f.fetchCertificates(r.config.Data))
+
+	// Only certificates of the pinned authorities are cached.
+	cached, err := torconfig.KeyCertificates(r.config.Data)
+	require.NoError(t, err)
+	assert.Len(t, cached, 2)
+
+	cases := []struct {
+		Path string
+		Body []byte
+	}{
+		{"/tor/keys/all", append(append([]byte{}, a.cert.Encode()...), b.cert.Encode()...)},
+		{"/tor/keys/fp/" + hexUpper(b.identity), b.cert.Encode()},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", c.Path, nil))
+		assert.Equal(t, http.StatusOK, w.Code, c.Path)
+		assert.Equal(t, c.Body, w.Body.Bytes(), c.Path)
+	}
+}
+
+func TestDirectoryFetcherConsensus(t *testing.T) {
+	published := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	a := newTestDirAuthority(t, published)
+	b := newTestDirAuthority(t, published)
+	other := newTestDirAuthority(t, published)
+
+	consensus := signTestFetchConsensus(t, testFetchConsensusBody, a, b)
+	certs := append(append(append([]byte{}, a.cert.Encode()...), b.cert.Encode()...), other.cert.Encode()...)
+	addr, stop := startTestDirServer(map[string][]byte{
+		"/tor/keys/all":                      certs,
+		"/tor/status-vote/current/consensus": consensus,
+	})
+	defer stop()
+
+	r, cleanup := newTestFetchRouter(t)
+	defer cleanup()
+	h := NewDirHandler(r)
+
+	// Nothing is served until the documents have been fetched.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/tor/status-vote/current/consensus", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	f := &DirectoryFetcher{
+		Router:      r,
+		Authorities: []*tordir.Authority{a.Authority(addr), b.Authority(addr)},
+		Logger:      r.logger,
+		now:         func() time.Time { return published.Add(12*time.Hour + time.Minute) },
+	}
+	require.NoError(t, f.Fetch())
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/tor/status-vote/current/consensus", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, consensus, w.Body.Bytes())
+	assert.Equal(t, "Thu, 01 Mar 2018 12:00:00 GMT", w.Header().Get("Last-Modified"))
+}
+
+func TestDirectoryFetcherRejectsConsensus(t *testing.T) {
+	published := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	a := newTestDirAuthority(t, published)
+	b := newTestDirAuthority(t, published)
+
+	docs := map[string][]byte{
+		"/tor/keys/all": append(append([]byte{}, a.cert.Encode()...), b.cert.Encode()...),
+	}
+	addr, stop := startTestDirServer(docs)
+	defer stop()
+
+	r, cleanup := newTestFetchRouter(t)
+	defer cleanup()
+	now := published.Add(12*time.Hour + time.Minute)
+	f := &DirectoryFetcher{
+		Router:      r,
+		Authorities: []*tordir.Authority{a.Authority(addr), b.Authority(addr)},
+		Logger:      r.logger,
+		now:         func() time.Time { return now },
+	}
+
+	// Signed by one of two authorities.
+	docs["/tor/status-vote/current/consensus"] = signTestFetchConsensus(t, testFetchConsensusBody, a)
+	assert.Error(t, f.Fetch())
+	_, err := r.config.Data.Consensus()
+	assert.True(t, os.IsNotExist(err))
+
+	// Not yet valid.
+	now = published.Add(11 * time.Hour)
+	docs["/tor/status-vote/current/consensus"] = signTestFetchConsensus(t, testFetchConsensusBody, a, b)
+	assert.Error(t, f.Fetch())
+
+	// An older consensus does not replace the cached one.
+	now = published.Add(14 * time.Hour)
+	newer := signTestFetchConsensus(t, strings.Replace(testFetchConsensusBody, "valid-after 2018-03-01 12:00:00", "valid-after 2018-03-01 13:00:00", 1), a, b)
+	docs["/tor/status-vote/current/consensus"] = newer
+	require.NoError(t, f.Fetch())
+	docs["/tor/status-vote/current/consensus"] = signTestFetchConsensus(t, testFetchConsensusBody, a, b)
+	require.NoError(t, f.Fetch())
+	cached, err := r.config.Data.Consensus()
+	require.NoError(t, err)
+	assert.Equal(t, newer, cached)
+}
+
+func TestDirectoryFetcherUnavailable(t *testing.T) {
+	addr, stop := startTestDirServer(map[string][]byte{})
+	defer stop()
+
+	r, cleanup := newTestFetchRouter(t)
+	defer cleanup()
+	a := newTestDirAuthority(t, time.Now())
+	f := &DirectoryFetcher{
+		Router:      r,
+		Authorities: []*tordir.Authority{a.Authority(addr)},
+		Logger:      r.logger,
+	}
+	assert.Error(t, f.Fetch())
+}
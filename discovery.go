@@ -0,0 +1,135 @@
+package pearl
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// AddressQuorum is the number of distinct authenticated peers that must agree
+// on our address before AddressDiscovery reports it.
+const AddressQuorum = 3
+
+// AddressVoteLifetime is how long a peer's report of our address counts
+// towards the quorum.
+const AddressVoteLifetime = 3 * time.Hour
+
+// Address probing parameters.
+const (
+	// AddressProbeInterval is how often the relay reconnects to peers to
+	// refresh their votes on its address.
+	AddressProbeInterval = AddressVoteLifetime / 3
+
+	// addressProbeRetry is the delay before probing again if no address was
+	// discovered.
+	addressProbeRetry = 5 * time.Minute
+
+	// addressProbeTimeout bounds the time spent waiting for probe
+	// connections.
+	addressProbeTimeout = 30 * time.Second
+)
+
+// ClockSkewThreshold is the clock skew with a peer above which we warn.
+const ClockSkewThreshold = time.Hour
+
+// addressVote is a peer's report of our address.
+type addressVote struct {
+	addr string
+	at   time.Time
+}
+
+// AddressDiscovery learns the relay's external address from the "other OR's
+// address" field of NETINFO cells sent by authenticated peers. Each peer has
+// one vote per address family, and an address is only reported once
+// AddressQuorum peers agree on it. Votes expire after AddressVoteLifetime so
+// that a change of address is noticed. Tor-spec permits initiators to use this
+// field in this way. Only connections made by ProbeAddress vote, so that
+// clients cannot choose the voters with EXTEND cells.
+type AddressDiscovery struct {
+	mu   sync.Mutex
+	ipv4 map[Fingerprint]addressVote
+	ipv6 map[Fingerprint]addressVote
+
+	// Overridden in tests.
+	allowPrivate bool
+	now          func() time.Time
+}
+
+// NewAddressDiscovery builds an empty AddressDiscovery.
+func NewAddressDiscovery() *AddressDiscovery {
+	return &AddressDiscovery{
+		ipv4: make(map[Fingerprint]addressVote),
+		ipv6: make(map[Fingerprint]addressVote),
+	}
+}
+
+// Observe records that the peer with fingerprint fp saw us at ip, replacing
+// its previous vote for the same address family. Private and unspecified
+// addresses are ignored.
+func (d *AddressDiscovery) Observe(fp Fingerprint, ip net.IP) {
+	if ip == nil || ip.IsUnspecified() || (IsPrivateAddress(ip) && !d.allowPrivate) {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	votes := d.ipv6
+	if ip.To4() != nil {
+		votes = d.ipv4
+	}
+	votes[fp] = addressVote{addr: ip.String(), at: d.clock()}
+}
+
+// Address returns the IPv4 address reported by the most peers, provided at
+// least AddressQuorum agree on it. Otherwise returns nil.
+func (d *AddressDiscovery) Address() net.IP {
+	return d.elect(d.ipv4)
+}
+
+// AddressIPv6 returns the IPv6 address reported by the most peers, provided at
+// least AddressQuorum agree on it. Otherwise returns nil.
+func (d *AddressDiscovery) AddressIPv6() net.IP {
+	return d.elect(d.ipv6)
+}
+
+// elect discards expired votes and returns the most popular address, if it
+// reaches the quorum.
+func (d *AddressDiscovery) elect(votes map[Fingerprint]addressVote) net.IP {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	expiry := d.clock().Add(-AddressVoteLifetime)
+	counts := map[string]int{}
+	best, max := "", 0
+	for fp, v := range votes {
+		if v.at.Before(expiry) {
+			delete(votes, fp)
+			continue
+		}
+		counts[v.addr]++
+		if n := counts[v.addr]; n > max || (n == max && v.addr < best) {
+			best, max = v.addr, n
+		}
+	}
+
+	if max < AddressQuorum {
+		return nil
+	}
+	return net.ParseIP(best)
+}
+
+func (d *AddressDiscovery) clock() time.Time {
+	if d.now == nil {
+		return time.Now()
+	}
+	return d.now()
+}
+
+// clockSkew returns the magnitude of the difference between a peer timestamp
+// and now, and whether it exceeds ClockSkewThreshold.
+func clockSkew(peer, now time.Time) (time.Duration, bool) {
+	skew := now.Sub(peer)
+	if skew < 0 {
+		skew = -skew
+	}
+	return skew, skew > ClockSkewThreshold
+}
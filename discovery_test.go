@@ -0,0 +1,108 @@
+package pearl
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddressDiscoveryQuorum(t *testing.T) {
+	d := NewAddressDiscovery()
+	ip := net.IPv4(1, 2, 3, 4)
+
+	for i := 0; i < AddressQuorum-1; i++ {
+		d.Observe(Fingerprint{byte(i)}, ip)
+	}
+	assert.Nil(t, d.Address())
+
+	d.Observe(Fingerprint{AddressQuorum}, ip)
+	assert.True(t, ip.Equal(d.Address()))
+}
+
+func TestAddressDiscoveryOneVotePerPeer(t *testing.T) {
+	d := NewAddressDiscovery()
+	for i := 0; i < AddressQuorum; i++ {
+		d.Observe(Fingerprint{}, net.IPv4(1, 2, 3, 4))
+	}
+	assert.Nil(t, d.Address())
+}
+
+func TestAddressDiscoveryMajority(t *testing.T) {
+	d := NewAddressDiscovery()
+	a, b := net.IPv4(1, 2, 3, 4), net.IPv4(5, 6, 7, 8)
+	for i := 0; i < AddressQuorum; i++ {
+		d.Observe(Fingerprint{0, byte(i)}, a)
+	}
+	for i := 0; i < AddressQuorum+1; i++ {
+		d.Observe(Fingerprint{1, byte(i)}, b)
+	}
+	assert.True(t, b.Equal(d.Address()))
+}
+
+func TestAddressDiscoveryIgnoresPrivate(t *testing.T) {
+	d := NewAddressDiscovery()
+	for i := 0; i < AddressQuorum; i++ {
+		d.Observe(Fingerprint{byte(i)}, net.IPv4(10, 0, 0, 1))
+	}
+	assert.Nil(t, d.Address())
+}
+
+func TestAddressDiscoveryVotesExpire(t *testing.T) {
+	now := time.Now()
+	d := NewAddressDiscovery()
+	d.now = func() time.Time { return now }
+
+	ip := net.IPv4(1, 2, 3, 4)
+	for i := 0; i < AddressQuorum; i++ {
+		d.Observe(Fingerprint{byte(i)}, ip)
+	}
+	assert.True(t, ip.Equal(d.Address()))
+
+	// An address change is picked up once the old votes expire.
+	now = now.Add(AddressVoteLifetime / 2)
+	other := net.IPv4(5, 6, 7, 8)
+	for i := 0; i < AddressQuorum; i++ {
+		d.Observe(Fingerprint{0xff, byte(i)}, other)
+	}
+	now = now.Add(AddressVoteLifetime / 2)
+	assert.True(t, ip.Equal(d.Address()))
+
+	now = now.Add(time.Second)
+	assert.True(t, other.Equal(d.Address()))
+
+	now = now.Add(AddressVoteLifetime)
+	assert.Nil(t, d.Address())
+}
+
+func TestAddressDiscoveryFamilies(t *testing.T) {
+	d := NewAddressDiscovery()
+	ip4, ip6 := net.IPv4(1, 2, 3, 4), net.ParseIP("2001:db8::1")
+
+	// Each peer reports both families, and neither displaces the other.
+	for i := 0; i < AddressQuorum; i++ {
+		d.Observe(Fingerprint{byte(i)}, ip4)
+		d.Observe(Fingerprint{byte(i)}, ip6)
+	}
+	assert.True(t, ip4.Equal(d.Address()))
+	assert.True(t, ip6.Equal(d.AddressIPv6()))
+
+	// More IPv6 votes do not outweigh the IPv4 address.
+	for i := 0; i < AddressQuorum; i++ {
+		d.Observe(Fingerprint{0xff, byte(i)}, ip6)
+	}
+	assert.True(t, ip4.Equal(d.Address()))
+}
+
+func TestClockSkew(t *testing.T) {
+	now := time.Now()
+
+	skew, warn := clockSkew(now.Add(-time.Minute), now)
+	assert.Equal(t, time.Minute, skew)
+	assert.False(t, warn)
+
+	skew, warn = clockSkew(now.Add(2*ClockSkewThreshold), now)
+	assert.Equal(t, 2*ClockSkewThreshold, skew)
+	assert.True(t, warn)
+}
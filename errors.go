@@ -6,4 +6,5 @@ import "github.com/pkg/errors"
 var (
 	ErrUnexpectedCommand = errors.New("unexpected command")
 	ErrShortCellPayload  = errors.New("cell payload too short")
+	ErrIdentityMismatch  = errors.New("peer identity does not match expected fingerprint")
 )
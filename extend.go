@@ -105,6 +105,16 @@ func NewLinkSpecLegacyID(id []byte) LinkSpec {
 	}
 }
 
+func NewLinkSpecEd25519ID(id []byte) LinkSpec {
+	if len(id) != 32 {
+		panic("wrong length")
+	}
+	return LinkSpec{
+		Type: LinkSpecEd25519Identity,
+		Spec: id,
+	}
+}
+
 // Address converts the LinkSpec into an address. Returns nil if that is not
 // possible, for example in the case of LinkSpecLegacyIdentity or
 // LinkSpecEd25519Identity.
@@ -127,6 +137,42 @@ func (s LinkSpec) Address() (net.Addr, error) {
 	}, nil
 }
 
+// privateNetworks are address ranges that are not publicly routable.
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/127",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// IsPrivateAddress reports whether ip is a private (RFC 1918 or RFC 4193),
+// loopback or link-local address.
+func IsPrivateAddress(ip net.IP) bool {
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 type Extend2Payload struct {
 	LinkSpecs     []LinkSpec
 	HandshakeData []byte
@@ -170,6 +216,36 @@ func (e *Extend2Payload) UnmarshalBinary(p []byte) error {
 	return nil
 }
 
+// NewExtend2Payload builds an EXTEND2 payload for the given link specifiers
+// and client handshake.
+func NewExtend2Payload(specs []LinkSpec, htype HandshakeType, hdata []byte) *Extend2Payload {
+	h := make([]byte, 4+len(hdata))
+	binary.BigEndian.PutUint16(h, uint16(htype))
+	binary.BigEndian.PutUint16(h[2:], uint16(len(hdata)))
+	copy(h[4:], hdata)
+	return &Extend2Payload{
+		LinkSpecs:     specs,
+		HandshakeData: h,
+	}
+}
+
+// MarshalBinary encodes the EXTEND2 payload.
+func (e *Extend2Payload) MarshalBinary() ([]byte, error) {
+	if len(e.LinkSpecs) > 255 {
+		return nil, errors.New("too many link specifiers")
+	}
+	p := []byte{byte(len(e.LinkSpecs))}
+	for _, ls := range e.LinkSpecs {
+		if len(ls.Spec) > 255 {
+			return nil, errors.New("link specifier too long")
+		}
+		p = append(p, byte(ls.Type), byte(len(ls.Spec)))
+		p = append(p, ls.Spec...)
+	}
+	p = append(p, e.HandshakeData...)
+	return p, nil
+}
+
 func (e *Extend2Payload) Fingerprint() (Fingerprint, error) {
 	for _, ls := range e.LinkSpecs {
 		if ls.Type == LinkSpecLegacyIdentity {
@@ -179,18 +255,36 @@ func (e *Extend2Payload) Fingerprint() (Fingerprint, error) {
 	return Fingerprint{}, errors.New("no fingerprint provided in extend cell")
 }
 
+// Ed25519Identity returns the Ed25519 identity given in the link specifiers,
+// or nil if there is none.
+func (e *Extend2Payload) Ed25519Identity() []byte {
+	for _, ls := range e.LinkSpecs {
+		if ls.Type == LinkSpecEd25519Identity {
+			return ls.Spec
+		}
+	}
+	return nil
+}
+
+// Addresses returns the addresses in the link specifiers. IPv4 addresses are
+// listed first, so IPv6 is only used if IPv4 attempts fail or the request has
+// only IPv6 link specifiers.
 func (e *Extend2Payload) Addresses() ([]net.Addr, error) {
-	var addrs []net.Addr
+	var ipv4, ipv6 []net.Addr
 	for _, ls := range e.LinkSpecs {
 		addr, err := ls.Address()
 		if err != nil {
 			return nil, err
 		}
-		if addr != nil {
-			addrs = append(addrs, addr)
+		switch {
+		case addr == nil:
+		case ls.Type == LinkSpecTLSTCPIPv6:
+			ipv6 = append(ipv6, addr)
+		default:
+			ipv4 = append(ipv4, addr)
 		}
 	}
-	return addrs, nil
+	return append(ipv4, ipv6...), nil
 }
 
 func (e *Extend2Payload) Handshake() []byte {
@@ -148,3 +148,47 @@ func TestExtend2UnmarshalBinary(t *testing.T) {
 	}), e.LinkSpecs[1])
 	assert.Equal(t, data[31:], e.HandshakeData)
 }
+
+func TestExtend2AddressesPreferIPv4(t *testing.T) {
+	ip6 := net.ParseIP("2001:db8::1")
+	e := NewExtend2Payload([]LinkSpec{
+		NewLinkSpecTCP(ip6, 9001),
+		NewLinkSpecLegacyID(make([]byte, 20)),
+		NewLinkSpecTCP(net.IPv4(1, 2, 3, 4), 9001),
+	}, HandshakeTypeNTOR, nil)
+
+	addrs, err := e.Addresses()
+	require.NoError(t, err)
+	assert.Equal(t, []net.Addr{
+		&net.TCPAddr{IP: net.IPv4(1, 2, 3, 4).To4(), Port: 9001},
+		&net.TCPAddr{IP: ip6, Port: 9001},
+	}, addrs)
+}
+
+func TestIsPrivateAddress(t *testing.T) {
+	private := []string{
+		"10.1.2.3",
+		"172.16.0.1",
+		"172.31.255.255",
+		"192.168.1.1",
+		"127.0.0.1",
+		"169.254.10.20",
+		"0.0.0.0",
+		"::1",
+		"fd00::1",
+		"fe80::1",
+	}
+	for _, addr := range private {
+		assert.True(t, IsPrivateAddress(net.ParseIP(addr)), addr)
+	}
+
+	public := []string{
+		"8.8.8.8",
+		"172.32.0.1",
+		"192.169.0.1",
+		"2001:db8::1",
+	}
+	for _, addr := range public {
+		assert.False(t, IsPrivateAddress(net.ParseIP(addr)), addr)
+	}
+}
@@ -0,0 +1,54 @@
+package tls
+
+import (
+	"errors"
+)
+
+// ExportKeyingMaterial returns length bytes of exported key material derived
+// from the master secret of a completed handshake, as defined in RFC 5705. If
+// context is nil it is not used in the seed.
+//
+// Adapted from ekmFromMasterSecret in crypto/tls of later Go releases.
+func (c *Conn) ExportKeyingMaterial(label string, context []byte, length int) ([]byte, error) {
+	c.handshakeMutex.Lock()
+	defer c.handshakeMutex.Unlock()
+
+	if !c.handshakeComplete {
+		return nil, errors.New("tls: ExportKeyingMaterial is unavailable before the handshake completes")
+	}
+
+	switch label {
+	case "client finished",
+		"server finished",
+		"master secret",
+		"key expansion":
+		// These values are reserved and may not be used.
+		return nil, errors.New("tls: reserved ExportKeyingMaterial label: " + label)
+	}
+
+	suite := mutualCipherSuite([]uint16{c.cipherSuite}, c.cipherSuite)
+	if suite == nil {
+		return nil, errors.New("tls: unknown negotiated cipher suite")
+	}
+
+	seedLen := len(c.clientRandom) + len(c.serverRandom)
+	if context != nil {
+		seedLen += 2 + len(context)
+	}
+	seed := make([]byte, 0, seedLen)
+
+	seed = append(seed, c.clientRandom...)
+	seed = append(seed, c.serverRandom...)
+
+	if context != nil {
+		if len(context) >= 1<<16 {
+			return nil, errors.New("tls: ExportKeyingMaterial context too long")
+		}
+		seed = append(seed, byte(len(context)>>8), byte(len(context)))
+		seed = append(seed, context...)
+	}
+
+	keyMaterial := make([]byte, length)
+	prfForVersion(c.vers, suite)(keyMaterial, c.masterSecret, []byte(label), seed)
+	return keyMaterial, nil
+}
@@ -6,6 +6,8 @@ import (
 	"crypto/sha256"
 	"hash"
 	"io"
+	"net"
+	"time"
 
 	"github.com/mmcloughlin/pearl/fork/tls"
 	"github.com/mmcloughlin/pearl/log"
@@ -57,7 +59,17 @@ type Handshake struct {
 	IdentityKey *rsa.PublicKey
 
 	PeerFingerprint []byte
-	logger          log.Logger
+	// PeerEd25519Identity is the Ed25519 identity key of the peer, if it
+	// authenticated with one.
+	PeerEd25519Identity []byte
+	// LinkVersion is the negotiated link protocol version.
+	LinkVersion LinkProtocolVersion
+	// Addresses are our public addresses, sent to the peer in NETINFO. If
+	// empty the local address of the connection is sent instead.
+	Addresses []net.IP
+	// PeerNetInfo is the NETINFO cell received from the peer.
+	PeerNetInfo *NetInfoCell
+	logger      log.Logger
 }
 
 func (c *Handshake) Server() error {
@@ -88,6 +100,7 @@ func (c *Handshake) Server() error {
 	certsCell := &CertsCell{}
 	certsCell.AddCert(CertTypeLink, c.TLSContext.LinkCert)
 	certsCell.AddCert(CertTypeIdentity, c.TLSContext.IDCert)
+	c.addEd25519Certs(certsCell, CertTypeEd25519Link, c.TLSContext.Ed25519LinkCert)
 
 	err = c.sendCell(certsCell)
 	if err != nil {
@@ -95,7 +108,11 @@ func (c *Handshake) Server() error {
 	}
 
 	// Send auth challenge cell
-	authChallengeCell, err := NewAuthChallengeCellStandard()
+	methods := []AuthMethod{AuthMethodRSASHA256TLSSecret}
+	if c.TLSContext.Ed25519Identity() != nil {
+		methods = append(methods, AuthMethodEd25519SHA256RFC5705)
+	}
+	authChallengeCell, err := NewAuthChallengeCell(methods)
 	if err != nil {
 		return errors.Wrap(err, "error initializing auth challenge cell")
 	}
@@ -137,38 +154,8 @@ func (c *Handshake) Server() error {
 
 	c.logger.With("numcerts", len(peerCertsCell.Certs)).Debug("received certs cell")
 
-	err = peerCertsCell.ValidateInitiatorRSAOnly()
-	if err != nil {
-		return errors.Wrap(err, "certs cell failed validation")
-	}
-
-	// Form expected AUTHENTICATE values
-	clientIdentityKey, err := peerCertsCell.LookupPublicKey(CertTypeIdentity)
-	if err != nil {
-		return err
-	}
-
-	c.PeerFingerprint, err = torcrypto.Fingerprint(clientIdentityKey)
-	if err != nil {
-		return errors.Wrap(err, "failed to compute client fingerprint")
-	}
-
-	cs := c.Conn.ConnectionState()
-	a := AuthRSASHA256TLSSecret{
-		ClientIdentityKey: clientIdentityKey,
-		ServerIdentityKey: c.IdentityKey,
-		ServerLogHash:     outboundDigest,
-		ClientLogHash:     c.Link.InboundDigest(),
-		ServerLinkCert:    c.TLSContext.LinkCert.Raw,
-		TLSMasterSecret:   cs.MasterSecret,
-		TLSClientRandom:   cs.ClientRandom,
-		TLSServerRandom:   cs.ServerRandom,
-	}
-
-	expectedAuth, err := a.Body()
-	if err != nil {
-		return err
-	}
+	// Both authentication methods cover all bytes received so far.
+	clientLogHash := c.Link.InboundDigest()
 
 	// Receive AUTHENTICATE cell
 	cell, err = c.Link.ReceiveCell()
@@ -181,30 +168,18 @@ func (c *Handshake) Server() error {
 		return errors.Wrap(err, "could not parse authenticate cell")
 	}
 
-	if auth.Method != AuthMethodRSASHA256TLSSecret {
-		return errors.New("unsupported auth method")
-	}
-
-	authPayload, err := NewAuthRSASHA256TLSSecretPayload(auth.Authentication)
-	if err != nil {
-		return err
-	}
-
-	if !bytes.Equal(authPayload.Body(), expectedAuth) {
-		return errors.New("unexpected auth payload")
+	switch auth.Method {
+	case AuthMethodRSASHA256TLSSecret:
+		err = c.verifyAuthRSASHA256TLSSecret(peerCertsCell, auth, outboundDigest, clientLogHash)
+	case AuthMethodEd25519SHA256RFC5705:
+		err = c.verifyAuthEd25519SHA256RFC5705(peerCertsCell, auth, outboundDigest, clientLogHash)
+	default:
+		err = errors.New("unsupported auth method")
 	}
-
-	// Verify authenticate cell signature
-	clientAuthKey, err := peerCertsCell.LookupPublicKey(CertTypeAuth)
 	if err != nil {
 		return err
 	}
 
-	err = torcrypto.VerifyRSASHA256(clientAuthKey, authPayload.ToBeSigned(), authPayload.Signature())
-	if err != nil {
-		return errors.Wrap(err, "bad authenticate signature")
-	}
-
 	// Receive NETINFO cell
 	cell, err = c.Link.ReceiveCell()
 	if err != nil {
@@ -270,6 +245,13 @@ func (c *Handshake) Client() error {
 		return errors.Wrap(err, "certs cell failed validation")
 	}
 
+	if peerCertsCell.HasEd25519() {
+		c.PeerEd25519Identity, err = peerCertsCell.ValidateResponderEd25519(cs.PeerCertificates, time.Now())
+		if err != nil {
+			return errors.Wrap(err, "certs cell failed ed25519 validation")
+		}
+	}
+
 	serverLinkCert, err := peerCertsCell.Lookup(CertTypeLink)
 	if err != nil {
 		return err
@@ -321,9 +303,17 @@ func (c *Handshake) Client() error {
 	//	     * The CERTS cell contains exactly one CertType 3 "AUTH" certificate.
 	//	     * The CERTS cell contains exactly one CertType 2 "ID" certificate.
 	//
+	//
+	// Ed25519 authentication is used whenever both sides support it.
+	ed := c.TLSContext.Ed25519Identity() != nil &&
+		authChallengeCell.SupportsMethod(AuthMethodEd25519SHA256RFC5705)
+
 	certsCell := &CertsCell{}
 	certsCell.AddCert(CertTypeIdentity, c.TLSContext.IDCert)
 	certsCell.AddCert(CertTypeAuth, c.TLSContext.AuthCert)
+	if ed {
+		c.addEd25519Certs(certsCell, CertTypeEd25519Auth, c.TLSContext.Ed25519AuthCert)
+	}
 
 	err = c.sendCell(certsCell)
 	if err != nil {
@@ -331,22 +321,36 @@ func (c *Handshake) Client() error {
 	}
 
 	// Send AUTHENTICATE
-	if !authChallengeCell.SupportsMethod(AuthMethodRSASHA256TLSSecret) {
+	var a CellBuilder
+	switch {
+	case ed:
+		a = &AuthEd25519SHA256RFC5705{
+			AuthKey:               c.TLSContext.Ed25519AuthKey,
+			ClientIdentityKey:     c.IdentityKey,
+			ServerIdentityKey:     serverIDKey,
+			ClientEd25519Identity: c.TLSContext.Ed25519Identity(),
+			ServerEd25519Identity: c.PeerEd25519Identity,
+			ServerLogHash:         c.Link.InboundDigest(),
+			ClientLogHash:         c.Link.OutboundDigest(),
+			ServerLinkCert:        serverLinkCert,
+			TLS:                   c.Conn,
+		}
+	case authChallengeCell.SupportsMethod(AuthMethodRSASHA256TLSSecret):
+		a = &AuthRSASHA256TLSSecret{
+			AuthKey:           c.TLSContext.AuthKey,
+			ClientIdentityKey: c.IdentityKey,
+			ServerIdentityKey: serverIDKey,
+			ServerLogHash:     c.Link.InboundDigest(),
+			ClientLogHash:     c.Link.OutboundDigest(),
+			ServerLinkCert:    serverLinkCert,
+			TLSMasterSecret:   cs.MasterSecret,
+			TLSClientRandom:   cs.ClientRandom,
+			TLSServerRandom:   cs.ServerRandom,
+		}
+	default:
 		return errors.New("server does not support auth method")
 	}
 
-	a := &AuthRSASHA256TLSSecret{
-		AuthKey:           c.TLSContext.AuthKey,
-		ClientIdentityKey: c.IdentityKey,
-		ServerIdentityKey: serverIDKey,
-		ServerLogHash:     c.Link.InboundDigest(),
-		ClientLogHash:     c.Link.OutboundDigest(),
-		ServerLinkCert:    serverLinkCert,
-		TLSMasterSecret:   cs.MasterSecret,
-		TLSClientRandom:   cs.ClientRandom,
-		TLSServerRandom:   cs.ServerRandom,
-	}
-
 	err = c.sendCell(a)
 	if err != nil {
 		return errors.Wrap(err, "failed to send authenticate cell")
@@ -367,6 +371,134 @@ func (c *Handshake) Client() error {
 	return c.processNetInfo(cell)
 }
 
+// verifyAuthRSASHA256TLSSecret checks an AUTH0001 AUTHENTICATE cell from the
+// initiator, and records the peer identity on success.
+func (c *Handshake) verifyAuthRSASHA256TLSSecret(certs *CertsCell, auth *AuthenticateCell, serverLogHash, clientLogHash []byte) error {
+	err := certs.ValidateInitiatorRSAOnly()
+	if err != nil {
+		return errors.Wrap(err, "certs cell failed validation")
+	}
+
+	// Form expected AUTHENTICATE values
+	clientIdentityKey, err := certs.LookupPublicKey(CertTypeIdentity)
+	if err != nil {
+		return err
+	}
+
+	cs := c.Conn.ConnectionState()
+	a := AuthRSASHA256TLSSecret{
+		ClientIdentityKey: clientIdentityKey,
+		ServerIdentityKey: c.IdentityKey,
+		ServerLogHash:     serverLogHash,
+		ClientLogHash:     clientLogHash,
+		ServerLinkCert:    c.TLSContext.LinkCert.Raw,
+		TLSMasterSecret:   cs.MasterSecret,
+		TLSClientRandom:   cs.ClientRandom,
+		TLSServerRandom:   cs.ServerRandom,
+	}
+
+	expectedAuth, err := a.Body()
+	if err != nil {
+		return err
+	}
+
+	authPayload, err := NewAuthRSASHA256TLSSecretPayload(auth.Authentication)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(authPayload.Body(), expectedAuth) {
+		return errors.New("unexpected auth payload")
+	}
+
+	// Verify authenticate cell signature
+	clientAuthKey, err := certs.LookupPublicKey(CertTypeAuth)
+	if err != nil {
+		return err
+	}
+
+	err = torcrypto.VerifyRSASHA256(clientAuthKey, authPayload.ToBeSigned(), authPayload.Signature())
+	if err != nil {
+		return errors.Wrap(err, "bad authenticate signature")
+	}
+
+	c.PeerFingerprint, err = torcrypto.Fingerprint(clientIdentityKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to compute client fingerprint")
+	}
+
+	return nil
+}
+
+// verifyAuthEd25519SHA256RFC5705 checks an AUTH0003 AUTHENTICATE cell from the
+// initiator, and records the peer identities on success.
+func (c *Handshake) verifyAuthEd25519SHA256RFC5705(certs *CertsCell, auth *AuthenticateCell, serverLogHash, clientLogHash []byte) error {
+	if c.TLSContext.Ed25519Identity() == nil {
+		return errors.New("ed25519 authentication not offered")
+	}
+
+	clientEdIdentity, clientAuthKey, err := certs.ValidateInitiatorEd25519(time.Now())
+	if err != nil {
+		return errors.Wrap(err, "certs cell failed validation")
+	}
+
+	// Form expected AUTHENTICATE values
+	clientIdentityKey, err := certs.LookupPublicKey(CertTypeIdentity)
+	if err != nil {
+		return err
+	}
+
+	a := AuthEd25519SHA256RFC5705{
+		ClientIdentityKey:     clientIdentityKey,
+		ServerIdentityKey:     c.IdentityKey,
+		ClientEd25519Identity: clientEdIdentity,
+		ServerEd25519Identity: c.TLSContext.Ed25519Identity(),
+		ServerLogHash:         serverLogHash,
+		ClientLogHash:         clientLogHash,
+		ServerLinkCert:        c.TLSContext.LinkCert.Raw,
+		TLS:                   c.Conn,
+	}
+
+	expectedAuth, err := a.Body()
+	if err != nil {
+		return err
+	}
+
+	authPayload, err := NewAuthEd25519SHA256RFC5705Payload(auth.Authentication)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(authPayload.Body(), expectedAuth) {
+		return errors.New("unexpected auth payload")
+	}
+
+	// Verify authenticate cell signature
+	if !torcrypto.VerifyEd25519(clientAuthKey, authPayload.ToBeSigned(), authPayload.Signature()) {
+		return errors.New("bad authenticate signature")
+	}
+
+	c.PeerFingerprint, err = torcrypto.Fingerprint(clientIdentityKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to compute client fingerprint")
+	}
+	c.PeerEd25519Identity = clientEdIdentity
+
+	return nil
+}
+
+// addEd25519Certs adds the Ed25519 certificates from the TLS context to the
+// cell, if it has them. The link or authentication certificate is given as
+// crt with type t.
+func (c *Handshake) addEd25519Certs(cell *CertsCell, t CertType, crt *torcrypto.Ed25519Certificate) {
+	if c.TLSContext.Ed25519Identity() == nil {
+		return
+	}
+	cell.AddCertDER(CertTypeEd25519Signing, c.TLSContext.Ed25519SigningCert.Encode())
+	cell.AddCertDER(t, crt.Encode())
+	cell.AddCertDER(CertTypeEd25519Identity, c.TLSContext.RSACrossCert.Encode())
+}
+
 // receiveVersions expects a VERSIONS cell and returns the contained
 // LinkProtocolVersions.
 func (c *Handshake) receiveVersions() ([]LinkProtocolVersion, error) {
@@ -418,6 +550,7 @@ func (c *Handshake) establishVersion(a, b []LinkProtocolVersion) error {
 		return errors.Wrap(err, "could not agree on link protocol version")
 	}
 
+	c.LinkVersion = proto
 	c.logger.With("version", proto).Debug("determined link protocol version")
 
 	return nil
@@ -428,6 +561,9 @@ func (c *Handshake) sendNetInfoCell() error {
 	if err != nil {
 		return errors.Wrap(err, "error initializing net info cell")
 	}
+	if len(c.Addresses) > 0 {
+		netInfoCell.SenderAddresses = c.Addresses
+	}
 
 	return c.sendCell(netInfoCell)
 }
@@ -438,8 +574,10 @@ func (c *Handshake) processNetInfo(cell Cell) error {
 		return errors.Wrap(err, "could not parse netinfo cell")
 	}
 
-	c.logger.With("receiver_addr", ni.ReceiverAddress).Debug("received net info cell")
-	c.logger.Warn("net info processing not implemented")
+	c.logger.With("receiver_addr", ni.ReceiverAddress).
+		With("timestamp", ni.Timestamp).
+		Debug("received net info cell")
+	c.PeerNetInfo = ni
 
 	return nil
 }
@@ -4,7 +4,7 @@ import "errors"
 
 // SupportedLinkProtocolVersions contains the list of link protocol versions
 // supported by this relay.
-var SupportedLinkProtocolVersions = []LinkProtocolVersion{4}
+var SupportedLinkProtocolVersions = []LinkProtocolVersion{4, 5}
 
 // LinkProtocolVersion represents the version number of the link protocol.
 type LinkProtocolVersion uint16
@@ -13,6 +13,14 @@ var (
 	// LinkProtocolNone is an empty placeholder value for the
 	// LinkProtocolVersion type.
 	LinkProtocolNone LinkProtocolVersion
+
+	// LinkProtocolRelayEarly is the first link protocol version to support
+	// RELAY_EARLY cells.
+	LinkProtocolRelayEarly LinkProtocolVersion = 2
+
+	// LinkProtocolPadding is the first link protocol version to support
+	// PADDING_NEGOTIATE cells and connection padding.
+	LinkProtocolPadding LinkProtocolVersion = 5
 )
 
 // ErrNoCommonVersion is returned from ResolveVersion when the two lists of
@@ -21,3 +21,9 @@ func TestResolveVersionNoCommonVersion(t *testing.T) {
 	assert.Equal(t, v, LinkProtocolNone)
 	assert.Equal(t, err, ErrNoCommonVersion)
 }
+
+func TestResolveVersionPadding(t *testing.T) {
+	v, err := ResolveVersion(SupportedLinkProtocolVersions, []LinkProtocolVersion{3, 4, 5})
+	assert.NoError(t, err)
+	assert.Equal(t, LinkProtocolPadding, v)
+}
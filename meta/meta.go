@@ -33,4 +33,10 @@ var Protocols = protover.SupportedProtocols{
 	protover.Relay: []protover.VersionRange{
 		protover.NewVersionRange(1, 2),
 	},
+	protover.DirCache: []protover.VersionRange{
+		protover.SingleVersion(1),
+	},
+	protover.FlowCtrl: []protover.VersionRange{
+		protover.SingleVersion(1),
+	},
 }
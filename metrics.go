@@ -1,27 +1,48 @@
 package pearl
 
 import (
+	"github.com/mmcloughlin/pearl/bwhistory"
 	"github.com/mmcloughlin/pearl/log"
 	"github.com/mmcloughlin/pearl/telemetry"
 	"github.com/uber-go/tally"
 )
 
 type Metrics struct {
-	Connections   telemetry.ResourceMetric
-	Circuits      telemetry.ResourceMetric
-	Inbound       *telemetry.Bandwidth
-	Outbound      *telemetry.Bandwidth
-	RelayForward  *telemetry.Bandwidth
-	RelayBackward *telemetry.Bandwidth
+	Connections          telemetry.ResourceMetric
+	Circuits             telemetry.ResourceMetric
+	Streams              telemetry.ResourceMetric
+	Inbound              *telemetry.Bandwidth
+	Outbound             *telemetry.Bandwidth
+	RelayForward         *telemetry.Bandwidth
+	RelayBackward        *telemetry.Bandwidth
+	RelayEarly           tally.Counter
+	RelayEarlyViolations tally.Counter
+	PaddingSent          tally.Counter
+	PaddingReceived      tally.Counter
+	PaddingNegotiate     tally.Counter
+	ClockSkew            tally.Gauge
+	ClockSkewWarnings    tally.Counter
+	ExtendPrivateRefused tally.Counter
 }
 
-func NewMetrics(scope tally.Scope, l log.Logger) *Metrics {
+// NewMetrics builds router metrics reporting to scope. Inbound and outbound
+// traffic is also recorded in the bandwidth history h.
+func NewMetrics(scope tally.Scope, l log.Logger, h *bwhistory.History) *Metrics {
 	return &Metrics{
-		Connections:   telemetry.NewResourceMetric(scope, l, "connections"),
-		Circuits:      telemetry.NewResourceMetric(scope, l, "circuits"),
-		Inbound:       telemetry.NewBandwidth(scope.Counter("inbound_bytes")),
-		Outbound:      telemetry.NewBandwidth(scope.Counter("outbound_bytes")),
-		RelayForward:  telemetry.NewBandwidth(scope.Counter("relay_forward_bytes")),
-		RelayBackward: telemetry.NewBandwidth(scope.Counter("relay_backward_bytes")),
+		Connections:          telemetry.NewResourceMetric(scope, l, "connections"),
+		Circuits:             telemetry.NewResourceMetric(scope, l, "circuits"),
+		Streams:              telemetry.NewResourceMetric(scope, l, "streams"),
+		Inbound:              telemetry.NewBandwidth(telemetry.MultiCounter(scope.Counter("inbound_bytes"), h.Read)),
+		Outbound:             telemetry.NewBandwidth(telemetry.MultiCounter(scope.Counter("outbound_bytes"), h.Write)),
+		RelayForward:         telemetry.NewBandwidth(scope.Counter("relay_forward_bytes")),
+		RelayBackward:        telemetry.NewBandwidth(scope.Counter("relay_backward_bytes")),
+		RelayEarly:           scope.Counter("relay_early_cells"),
+		RelayEarlyViolations: scope.Counter("relay_early_violations"),
+		PaddingSent:          scope.Counter("padding_cells_sent"),
+		PaddingReceived:      scope.Counter("padding_cells_received"),
+		PaddingNegotiate:     scope.Counter("padding_negotiate_cells"),
+		ClockSkew:            scope.Gauge("clock_skew_seconds"),
+		ClockSkewWarnings:    scope.Counter("clock_skew_warnings"),
+		ExtendPrivateRefused: scope.Counter("extend_private_address_refused"),
 	}
 }
@@ -0,0 +1,681 @@
+package pearl
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/ntor"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/pkg/errors"
+)
+
+// Errors returned by origin circuits.
+var (
+	ErrCircuitClosed  = errors.New("circuit closed")
+	ErrCircuitTimeout = errors.New("timeout waiting for circuit reply")
+)
+
+// CircuitTruncatedError is returned when a circuit is truncated or destroyed
+// by a relay.
+type CircuitTruncatedError struct {
+	Reason CircuitErrorCode
+}
+
+func (e CircuitTruncatedError) Error() string {
+	return "circuit truncated: " + e.Reason.String()
+}
+
+// HopSpec specifies a relay to use as a hop in an origin circuit.
+type HopSpec struct {
+	Identity Fingerprint
+	NtorKey  [32]byte
+	Addrs    []*net.TCPAddr
+
+	// EdIdentity is the relay's Ed25519 identity key. Optional.
+	EdIdentity []byte
+}
+
+var _ ConnectionHint = new(HopSpec)
+
+// Fingerprint returns the identity fingerprint of the relay.
+func (h *HopSpec) Fingerprint() (Fingerprint, error) {
+	return h.Identity, nil
+}
+
+// Ed25519Identity returns the Ed25519 identity key of the relay, if known.
+func (h *HopSpec) Ed25519Identity() []byte {
+	return h.EdIdentity
+}
+
+// Addresses returns the relay's addresses.
+func (h *HopSpec) Addresses() ([]net.Addr, error) {
+	addrs := make([]net.Addr, len(h.Addrs))
+	for i, a := range h.Addrs {
+		addrs[i] = a
+	}
+	return addrs, nil
+}
+
+// LinkSpecs returns link specifiers for the relay, suitable for an EXTEND2
+// cell.
+func (h *HopSpec) LinkSpecs() []LinkSpec {
+	var specs []LinkSpec
+	for _, a := range h.Addrs {
+		specs = append(specs, NewLinkSpecTCP(a.IP, uint16(a.Port)))
+	}
+	specs = append(specs, NewLinkSpecLegacyID(h.Identity[:]))
+	if h.EdIdentity != nil {
+		specs = append(specs, NewLinkSpecEd25519ID(h.EdIdentity))
+	}
+	return specs
+}
+
+// OriginRelayCell is a relay cell received on an origin circuit, along with
+// the index of the hop that sent it.
+type OriginRelayCell struct {
+	Hop  int
+	Cell RelayCell
+}
+
+// originHop holds the state for one hop of an origin circuit.
+type originHop struct {
+	forward  *CircuitCryptoState
+	backward *CircuitCryptoState
+
+	packageWindow *packageWindow
+	deliverWindow int
+	packaged      int
+	sendmeDigests [][]byte
+}
+
+func newOriginHop(k *CircuitKeys) *originHop {
+	return &originHop{
+		forward:       k.ForwardCryptoState(),
+		backward:      k.BackwardCryptoState(),
+		packageWindow: newPackageWindow(CircuitWindowStart),
+		deliverWindow: CircuitWindowStart,
+	}
+}
+
+// OriginCircuit is a circuit originating at this router.
+type OriginCircuit struct {
+	Router  *Router
+	Conn    *Connection
+	Link    CircuitLink
+	Metrics *Metrics
+
+	ch     *CellChan
+	relays chan OriginRelayCell
+	done   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+
+	// mu guards the hops and streams, and serializes cryptographic
+	// operations on the hops.
+	mu           sync.Mutex
+	hops         []*originHop
+	relayEarly   int
+	streams      map[uint16]*OriginStream
+	nextStreamID uint16
+
+	logger log.Logger
+}
+
+// NewOriginCircuit registers a new circuit on conn. The first hop must then be
+// established with Create or CreateFast.
+func NewOriginCircuit(conn *Connection, l log.Logger) (*OriginCircuit, error) {
+	done := make(chan struct{})
+	ch := NewCellChan(make(chan Cell, defaultCircuitChannelBuffer), done)
+	r := conn.router
+	c := &OriginCircuit{
+		Router:  r,
+		Conn:    conn,
+		Metrics: r.metrics,
+
+		ch:      ch,
+		relays:  make(chan OriginRelayCell, defaultCircuitChannelBuffer),
+		done:    done,
+		streams: make(map[uint16]*OriginStream),
+	}
+
+	id, err := conn.addCircuit(NewLink(ch, nil, c))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not register circuit")
+	}
+	c.Link = NewCircuitLink(conn, id, ch)
+	c.logger = log.ForComponent(l, "origin_circuit").With("circid", id)
+
+	c.Metrics.Circuits.Alloc()
+
+	return c, nil
+}
+
+// Len returns the number of hops in the circuit.
+func (c *OriginCircuit) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.hops)
+}
+
+// NumStreams returns the number of open streams on the circuit.
+func (c *OriginCircuit) NumStreams() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.streams)
+}
+
+// Closed reports whether the circuit has been closed or destroyed.
+func (c *OriginCircuit) Closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close destroys the circuit.
+func (c *OriginCircuit) Close() error {
+	err := c.shutdown(CircuitErrorNone, true)
+	c.wg.Wait()
+	return err
+}
+
+// shutdown marks the circuit closed. If notify is set the relay is sent a
+// DESTROY cell, otherwise the circuit ID is simply released.
+func (c *OriginCircuit) shutdown(reason CircuitErrorCode, notify bool) error {
+	var err error
+	c.once.Do(func() {
+		c.logger.With("reason", reason).Info("closing circuit")
+		close(c.done)
+		if notify {
+			err = c.Link.Destroy(reason)
+		} else {
+			err = c.Link.Release()
+		}
+		c.Metrics.Circuits.Free()
+	})
+	return err
+}
+
+// Create establishes the first hop of the circuit with a CREATE2 cell using
+// the ntor handshake.
+func (c *OriginCircuit) Create(hop *HopSpec) error {
+	if c.Len() != 0 {
+		return errors.New("circuit already created")
+	}
+
+	kp, err := torcrypto.GenerateCurve25519KeyPair()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate client key pair")
+	}
+
+	create := &Create2Cell{
+		CircID:        c.Link.CircID(),
+		HandshakeType: HandshakeTypeNTOR,
+		HandshakeData: clientHandshakeNTOR(hop, kp),
+	}
+	if err := BuildAndSend(c.Link, create); err != nil {
+		return errors.Wrap(err, "could not send create2 cell")
+	}
+
+	reply, err := c.receiveCreated()
+	if err != nil {
+		return err
+	}
+
+	created := &Created2Cell{}
+	if err := created.UnmarshalCell(reply); err != nil {
+		return errors.Wrap(err, "failed to parse created2 cell")
+	}
+
+	k, err := completeHandshakeNTOR(hop, kp, created.HandshakeData)
+	if err != nil {
+		return err
+	}
+
+	c.addHop(k)
+	c.start()
+
+	return nil
+}
+
+// CreateFast establishes the first hop of the circuit with a CREATE_FAST
+// cell. This relies on the TLS connection for authentication of the relay.
+func (c *OriginCircuit) CreateFast() error {
+	if c.Len() != 0 {
+		return errors.New("circuit already created")
+	}
+
+	X := torcrypto.Rand(torcrypto.HashSize)
+	cell := NewFixedCell(c.Link.CircID(), CommandCreateFast)
+	copy(cell.Payload(), X)
+	if err := c.Link.SendCell(cell); err != nil {
+		return errors.Wrap(err, "could not send create fast cell")
+	}
+
+	reply, err := c.receiveCreated()
+	if err != nil {
+		return err
+	}
+	if reply.Command() != CommandCreatedFast {
+		return ErrUnexpectedCommand
+	}
+
+	// Reference: https://github.com/torproject/torspec/blob/f66d1826c0b32d307898bba081dbf8ef598d4037/tor-spec.txt#L1143-L1146
+	//
+	//	   A CREATED_FAST cell contains:
+	//
+	//	       Key material (Y)    [HASH_LEN bytes]
+	//	       Derivative key data [HASH_LEN bytes] (See 5.2.1 below)
+	//
+	p := reply.Payload()
+	Y := p[:torcrypto.HashSize]
+	KH := p[torcrypto.HashSize : 2*torcrypto.HashSize]
+
+	k, err := BuildCircuitKeysKDFTOR(append(X, Y...))
+	if err != nil {
+		return errors.Wrap(err, "failed to build circuit keys")
+	}
+	if !hmac.Equal(k.KH, KH) {
+		return errors.New("derivative key data mismatch")
+	}
+
+	c.addHop(k)
+	c.start()
+
+	return nil
+}
+
+// Extend adds another hop to the circuit with an EXTEND2 cell sent to the
+// current last hop. The caller must not be consuming relay cells while the
+// extend is in progress.
+func (c *OriginCircuit) Extend(hop *HopSpec) error {
+	last := c.Len() - 1
+	if last < 0 {
+		return errors.New("circuit has not been created")
+	}
+
+	kp, err := torcrypto.GenerateCurve25519KeyPair()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate client key pair")
+	}
+
+	ext := NewExtend2Payload(hop.LinkSpecs(), HandshakeTypeNTOR, clientHandshakeNTOR(hop, kp))
+	p, err := ext.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/tor-spec.txt#L1277-L1279
+	//
+	//	   When a client sends an EXTEND or EXTEND2 cell, it should send it in a
+	//	   RELAY_EARLY cell.
+	//
+	err = c.sendRelayCell(last, CommandRelayEarly, NewRelayCell(RelayExtend2, 0, p))
+	if err != nil {
+		return errors.Wrap(err, "could not send extend2 cell")
+	}
+
+	reply, err := c.receiveRelayCellTimeout(c.Router.extendTimeout())
+	if err != nil {
+		return err
+	}
+	if reply.Hop != last {
+		return errors.New("reply to extend from unexpected hop")
+	}
+
+	r := reply.Cell
+	d, err := r.RelayData()
+	if err != nil {
+		return err
+	}
+
+	switch r.RelayCommand() {
+	case RelayExtended2:
+	case RelayTruncated:
+		reason := CircuitErrorNone
+		if len(d) > 0 {
+			reason = CircuitErrorCode(d[0])
+		}
+		return CircuitTruncatedError{Reason: reason}
+	default:
+		return errors.New("unexpected reply to extend")
+	}
+
+	// The EXTENDED2 payload has the same format as a CREATED2 cell.
+	if len(d) < 2 {
+		return ErrShortCellPayload
+	}
+	n := int(binary.BigEndian.Uint16(d))
+	if len(d) < 2+n {
+		return errors.New("inconsistent extended2 length")
+	}
+
+	k, err := completeHandshakeNTOR(hop, kp, d[2:2+n])
+	if err != nil {
+		return err
+	}
+
+	c.addHop(k)
+
+	return nil
+}
+
+// SendRelayCell sends r to the given hop. Data cells wait for the hop's
+// package window to open.
+func (c *OriginCircuit) SendRelayCell(hop int, r RelayCell) error {
+	if r.RelayCommand() == RelayData {
+		h, err := c.hop(hop)
+		if err != nil {
+			return err
+		}
+		if err := h.packageWindow.Take(c.done); err != nil {
+			return ErrCircuitClosed
+		}
+	}
+	return c.sendRelayCell(hop, CommandRelay, r)
+}
+
+// ReceiveRelayCell returns the next relay cell received on the circuit.
+func (c *OriginCircuit) ReceiveRelayCell() (OriginRelayCell, error) {
+	select {
+	case <-c.done:
+		return OriginRelayCell{}, ErrCircuitClosed
+	case r := <-c.relays:
+		return r, nil
+	}
+}
+
+func (c *OriginCircuit) receiveRelayCellTimeout(timeout time.Duration) (OriginRelayCell, error) {
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-c.done:
+		return OriginRelayCell{}, ErrCircuitClosed
+	case <-t.C:
+		return OriginRelayCell{}, ErrCircuitTimeout
+	case r := <-c.relays:
+		return r, nil
+	}
+}
+
+// receiveCreated waits for the reply to a create cell.
+func (c *OriginCircuit) receiveCreated() (Cell, error) {
+	t := time.NewTimer(c.Router.extendTimeout())
+	defer t.Stop()
+
+	var cell Cell
+	select {
+	case <-c.done:
+		return nil, ErrCircuitClosed
+	case <-t.C:
+		_ = c.shutdown(CircuitErrorNone, true)
+		return nil, ErrCircuitTimeout
+	case cell = <-c.ch.C:
+	}
+
+	if cell.Command() == CommandDestroy {
+		reason := c.handleDestroy(cell)
+		return nil, CircuitTruncatedError{Reason: reason}
+	}
+
+	return cell, nil
+}
+
+func (c *OriginCircuit) hop(i int) (*originHop, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if i < 0 || i >= len(c.hops) {
+		return nil, errors.New("hop index out of range")
+	}
+	return c.hops[i], nil
+}
+
+func (c *OriginCircuit) addHop(k *CircuitKeys) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hops = append(c.hops, newOriginHop(k))
+	c.logger.With("hops", len(c.hops)).Info("circuit extended")
+}
+
+func (c *OriginCircuit) sendRelayCell(hop int, cmd Command, r RelayCell) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sendRelayCellLocked(hop, cmd, r)
+}
+
+// sendRelayCellLocked onion encrypts r for the given hop and sends it. The
+// caller must hold mu.
+func (c *OriginCircuit) sendRelayCellLocked(hop int, cmd Command, r RelayCell) error {
+	select {
+	case <-c.done:
+		return ErrCircuitClosed
+	default:
+	}
+
+	if hop < 0 || hop >= len(c.hops) {
+		return errors.New("hop index out of range")
+	}
+
+	if cmd == CommandRelayEarly {
+		if c.relayEarly >= MaxRelayEarly {
+			return errors.New("relay early cells exhausted")
+		}
+		c.relayEarly++
+	}
+
+	cell := NewFixedCell(c.Link.CircID(), cmd)
+	p := cell.Payload()
+	copy(p, r.Bytes())
+
+	h := c.hops[hop]
+	h.forward.EncryptOrigin(p)
+	if r.RelayCommand() == RelayData {
+		h.packaged++
+		if h.packaged%CircuitWindowIncrement == 0 {
+			h.sendmeDigests = append(h.sendmeDigests, h.forward.Sum())
+		}
+	}
+	for i := hop - 1; i >= 0; i-- {
+		c.hops[i].forward.Encrypt(p)
+	}
+
+	return c.Link.SendCell(cell)
+}
+
+func (c *OriginCircuit) start() {
+	c.wg.Add(1)
+	go c.loop()
+}
+
+func (c *OriginCircuit) loop() {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.done:
+			return
+		case cell := <-c.ch.C:
+			if err := c.handleCell(cell); err != nil {
+				if err != io.EOF {
+					log.Err(c.logger, err, "origin circuit error")
+					_ = c.shutdown(CircuitErrorProtocol, true)
+				}
+				return
+			}
+		}
+	}
+}
+
+func (c *OriginCircuit) handleCell(cell Cell) error {
+	switch cell.Command() {
+	case CommandRelay:
+		return c.handleRelay(cell)
+	case CommandDestroy:
+		c.handleDestroy(cell)
+		return io.EOF
+	case CommandRelayEarly:
+		return errors.New("relay early cell in inbound direction")
+	default:
+		return ErrUnexpectedCommand
+	}
+}
+
+// handleDestroy processes a DESTROY cell from the first hop, returning the
+// reason.
+func (c *OriginCircuit) handleDestroy(cell Cell) CircuitErrorCode {
+	reason := CircuitErrorNone
+	d, err := ParseDestroyCell(cell)
+	if err != nil {
+		log.Err(c.logger, err, "failed to parse destroy cell")
+	} else {
+		reason = d.Reason
+	}
+	if err := c.shutdown(reason, false); err != nil {
+		log.Err(c.logger, err, "failed to release circuit")
+	}
+	return reason
+}
+
+func (c *OriginCircuit) handleRelay(cell Cell) error {
+	c.mu.Lock()
+	hop, r := c.decrypt(cell.Payload())
+	if hop < 0 {
+		c.mu.Unlock()
+		return errors.New("unrecognized relay cell")
+	}
+	deliver, err := c.flowControl(hop, r)
+	if err != nil || !deliver {
+		c.mu.Unlock()
+		return err
+	}
+
+	if r.StreamID() != 0 {
+		s, ok := c.streams[r.StreamID()]
+		if cmd := r.RelayCommand(); cmd == RelayEnd || cmd == RelayResolved {
+			delete(c.streams, r.StreamID())
+		}
+		c.mu.Unlock()
+		if !ok || s.hop != hop {
+			c.logger.With("streamid", r.StreamID()).Debug("dropping cell for unknown stream")
+			return nil
+		}
+		return s.handleRelayCell(r)
+	}
+	c.mu.Unlock()
+
+	// Nothing may be consuming circuit-level cells, so drop them rather than
+	// block the circuit.
+	select {
+	case c.relays <- OriginRelayCell{Hop: hop, Cell: r}:
+	default:
+		c.logger.With("cmd", r.RelayCommand()).Debug("dropping relay cell")
+	}
+	return nil
+}
+
+// decrypt removes layers of encryption from p until a hop recognizes the
+// cell. Returns -1 if no hop recognizes it. The caller must hold mu.
+func (c *OriginCircuit) decrypt(p []byte) (int, RelayCell) {
+	r := NewRelayCellFromBytes(p)
+	for i, h := range c.hops {
+		h.backward.Decrypt(p)
+		if relayCellIsRecogized(r, h.backward) {
+			return i, r
+		}
+	}
+	return -1, nil
+}
+
+// flowControl updates circuit-level flow control state for a relay cell
+// received from the given hop. Returns whether the cell should be delivered
+// to the consumer. The caller must hold mu.
+func (c *OriginCircuit) flowControl(hop int, r RelayCell) (bool, error) {
+	h := c.hops[hop]
+	switch {
+	case r.RelayCommand() == RelayData:
+		h.deliverWindow--
+		if h.deliverWindow < 0 {
+			return false, errors.New("circuit deliver window exceeded")
+		}
+		if h.deliverWindow > CircuitWindowStart-CircuitWindowIncrement {
+			return true, nil
+		}
+		p, err := NewSendmeV1Payload(h.backward.Sum()).MarshalBinary()
+		if err != nil {
+			return false, err
+		}
+		if err := c.sendRelayCellLocked(hop, CommandRelay, NewRelayCell(RelaySendme, 0, p)); err != nil {
+			return false, err
+		}
+		h.deliverWindow += CircuitWindowIncrement
+		return true, nil
+
+	case r.RelayCommand() == RelaySendme && r.StreamID() == 0:
+		d, err := r.RelayData()
+		if err != nil {
+			return false, err
+		}
+		sendme := &SendmePayload{}
+		if err := sendme.UnmarshalBinary(d); err != nil {
+			return false, err
+		}
+		var expect []byte
+		if len(h.sendmeDigests) > 0 {
+			expect = h.sendmeDigests[0]
+			h.sendmeDigests = h.sendmeDigests[1:]
+		}
+		if !sendme.Authenticates(expect) {
+			return false, errors.New("sendme digest mismatch")
+		}
+		return false, h.packageWindow.Give(CircuitWindowIncrement)
+	}
+
+	return true, nil
+}
+
+// clientHandshakeNTOR builds the client side ntor handshake data for hop.
+//
+// Reference: https://github.com/torproject/torspec/blob/8aaa36d1a062b20ca263b6ac613b77a3ba1eb113/tor-spec.txt#L1095-L1098
+//
+//	   and generates a client-side handshake with contents:
+//	       NODEID      Server identity digest  [ID_LENGTH bytes]
+//	       KEYID       KEYID(B)                [H_LENGTH bytes]
+//	       CLIENT_PK   X                       [G_LENGTH bytes]
+//
+func clientHandshakeNTOR(hop *HopSpec, kp *torcrypto.Curve25519KeyPair) ClientHandshakeDataNTOR {
+	var h []byte
+	h = append(h, hop.Identity[:]...)
+	h = append(h, hop.NtorKey[:]...)
+	h = append(h, kp.Public[:]...)
+	return h
+}
+
+// completeHandshakeNTOR verifies the server's ntor reply and derives circuit
+// keys.
+func completeHandshakeNTOR(hop *HopSpec, kp *torcrypto.Curve25519KeyPair, reply []byte) (*CircuitKeys, error) {
+	if len(reply) < 64 {
+		return nil, errors.New("short ntor server handshake")
+	}
+
+	h := ntor.ClientHandshake{
+		Public: ntor.Public{
+			ID: hop.Identity[:],
+			KX: kp.Public,
+			KB: hop.NtorKey,
+		},
+		Kx: kp.Private,
+	}
+	copy(h.KY[:], reply[:32])
+
+	if !hmac.Equal(ntor.Auth(h), reply[32:64]) {
+		return nil, errors.New("ntor server auth mismatch")
+	}
+
+	return BuildCircuitKeysNTOR(ntor.KDF(h))
+}
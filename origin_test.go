@@ -0,0 +1,100 @@
+package pearl
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mmcloughlin/pearl/ntor"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHopSpecLinkSpecs(t *testing.T) {
+	h := &HopSpec{
+		Identity: Fingerprint{1, 2, 3},
+		Addrs: []*net.TCPAddr{
+			{IP: net.IPv4(1, 2, 3, 4), Port: 9001},
+		},
+	}
+	specs := h.LinkSpecs()
+	require.Len(t, specs, 2)
+	assert.Equal(t, LinkSpecTLSTCPIPv4, specs[0].Type)
+	assert.Equal(t, LinkSpecLegacyIdentity, specs[1].Type)
+
+	e := NewExtend2Payload(specs, HandshakeTypeNTOR, []byte{1, 2, 3})
+	p, err := e.MarshalBinary()
+	require.NoError(t, err)
+
+	got := &Extend2Payload{}
+	require.NoError(t, got.UnmarshalBinary(p))
+	assert.Equal(t, e, got)
+
+	fp, err := got.Fingerprint()
+	require.NoError(t, err)
+	assert.Equal(t, h.Identity, fp)
+}
+
+func TestCompleteHandshakeNTOR(t *testing.T) {
+	ntorKey, err := torcrypto.GenerateCurve25519KeyPair()
+	require.NoError(t, err)
+	hop := &HopSpec{
+		Identity: Fingerprint{4, 5, 6},
+		NtorKey:  ntorKey.Public,
+	}
+
+	client, err := torcrypto.GenerateCurve25519KeyPair()
+	require.NoError(t, err)
+	data := clientHandshakeNTOR(hop, client)
+
+	// Server side of the handshake.
+	server, err := torcrypto.GenerateCurve25519KeyPair()
+	require.NoError(t, err)
+	h := ntor.ServerHandshake{
+		Public: ntor.Public{
+			ID: data.ServerFingerprint(),
+			KX: data.ClientPK(),
+			KY: server.Public,
+			KB: ntorKey.Public,
+		},
+		Ky: server.Private,
+		Kb: ntorKey.Private,
+	}
+	expect, err := BuildCircuitKeysNTOR(ntor.KDF(h))
+	require.NoError(t, err)
+	reply := NewServerHandshakeDataNTOR(server.Public, ntor.Auth(h))
+
+	k, err := completeHandshakeNTOR(hop, client, reply)
+	require.NoError(t, err)
+	assert.Equal(t, expect, k)
+
+	reply[40] ^= 1
+	_, err = completeHandshakeNTOR(hop, client, reply)
+	assert.Error(t, err)
+}
+
+func TestOriginCircuitDecryptIdentifiesHop(t *testing.T) {
+	c := &OriginCircuit{}
+	var relays []*CircuitCryptoState
+	for i := 0; i < 3; i++ {
+		k, err := BuildCircuitKeysKDFTOR(torcrypto.Rand(2 * torcrypto.HashSize))
+		require.NoError(t, err)
+		c.hops = append(c.hops, newOriginHop(k))
+		relays = append(relays, k.BackwardCryptoState())
+	}
+
+	for _, from := range []int{2, 0, 1, 2} {
+		data := []byte("hello")
+		p := NewRelayCell(RelayData, 1, data).Bytes()
+		relays[from].EncryptOrigin(p)
+		for i := from - 1; i >= 0; i-- {
+			relays[i].Encrypt(p)
+		}
+
+		hop, r := c.decrypt(p)
+		require.Equal(t, from, hop)
+		d, err := r.RelayData()
+		require.NoError(t, err)
+		assert.Equal(t, data, d)
+	}
+}
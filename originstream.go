@@ -0,0 +1,457 @@
+package pearl
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/pkg/errors"
+)
+
+// ErrStreamClosed is returned when using a stream that has been closed
+// locally.
+var ErrStreamClosed = errors.New("stream closed")
+
+// errCancelled is returned when a wait is cancelled by its caller.
+var errCancelled = errors.New("cancelled")
+
+// StreamEndedError is returned when the exit relay ends a stream.
+type StreamEndedError struct {
+	Reason StreamCloseReason
+}
+
+func (e StreamEndedError) Error() string {
+	return "stream ended: " + e.Reason.String()
+}
+
+// timeoutError is returned when a stream deadline passes.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// streamAddr is the address of one end of a stream.
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tor" }
+func (a streamAddr) String() string  { return string(a) }
+
+// OriginStream is a stream opened over an origin circuit. It implements
+// net.Conn.
+type OriginStream struct {
+	id    uint16
+	hop   int
+	addr  string
+	circ  *OriginCircuit
+	cells chan RelayCell
+	done  chan struct{}
+	once  sync.Once
+
+	ended   int32 // set once the exit has sent RELAY_END
+	wclosed int32 // set once the write side has been closed
+
+	packageWindow *packageWindow
+
+	// rmu serializes readers.
+	rmu       sync.Mutex
+	buf       []byte
+	rerr      error
+	delivered int
+
+	dmu           sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	logger log.Logger
+}
+
+var _ net.Conn = new(OriginStream)
+
+func newOriginStream(c *OriginCircuit, id uint16, hop int, addr string) *OriginStream {
+	// The exit may not send more than a window of data cells before we
+	// acknowledge them, plus the cells that open and close the stream.
+	return &OriginStream{
+		id:    id,
+		hop:   hop,
+		addr:  addr,
+		circ:  c,
+		cells: make(chan RelayCell, StreamWindowStart+2),
+		done:  make(chan struct{}),
+
+		packageWindow: newPackageWindow(StreamWindowStart),
+
+		logger: c.logger.With("streamid", id).With("addr", addr),
+	}
+}
+
+// OpenStream opens a stream to addr, which must be in host:port form, from
+// the last hop of the circuit. Hostnames are resolved by the exit.
+func (c *OriginCircuit) OpenStream(addr string) (*OriginStream, error) {
+	return c.OpenStreamContext(context.Background(), addr, BeginFlagIPv6Okay)
+}
+
+// OpenStreamContext opens a stream to addr with the given begin flags. The
+// context bounds the time spent waiting for the exit to connect.
+func (c *OriginCircuit) OpenStreamContext(ctx context.Context, addr string, flags BeginFlags) (*OriginStream, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return nil, errors.New("bad stream port")
+	}
+
+	begin := BeginPayload{
+		Host:  host,
+		Port:  uint16(n),
+		Flags: flags,
+	}
+	p, err := begin.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.openStream(ctx, addr, RelayBegin, p)
+}
+
+// OpenDirStream opens a stream to the directory server of the last hop, with
+// a RELAY_BEGIN_DIR cell. HTTP directory requests may be made over the
+// returned stream.
+func (c *OriginCircuit) OpenDirStream(ctx context.Context) (*OriginStream, error) {
+	return c.openStream(ctx, "dir", RelayBeginDir, nil)
+}
+
+// openStream registers a new stream, sends the relay cell to begin it and
+// waits for the exit to connect.
+func (c *OriginCircuit) openStream(ctx context.Context, addr string, cmd RelayCommand, p []byte) (*OriginStream, error) {
+	s, err := c.registerStream(addr)
+	if err != nil {
+		return nil, err
+	}
+	c.Metrics.Streams.Alloc()
+
+	if err := c.sendRelayCell(s.hop, CommandRelay, NewRelayCell(cmd, s.id, p)); err != nil {
+		_ = s.Close()
+		return nil, errors.Wrap(err, "could not send begin cell")
+	}
+
+	if err := s.waitConnected(ctx); err != nil {
+		_ = s.Close()
+		return nil, err
+	}
+
+	s.logger.Info("stream connected")
+
+	return s, nil
+}
+
+// registerStream allocates a stream ID and registers a new stream from the
+// last hop.
+func (c *OriginCircuit) registerStream(addr string) (*OriginStream, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hop := len(c.hops) - 1
+	if hop < 0 {
+		return nil, errors.New("circuit has not been created")
+	}
+
+	for i := 0; i < 1<<16; i++ {
+		c.nextStreamID++
+		id := c.nextStreamID
+		if id == 0 {
+			continue
+		}
+		if _, used := c.streams[id]; used {
+			continue
+		}
+		s := newOriginStream(c, id, hop, addr)
+		c.streams[id] = s
+		return s, nil
+	}
+
+	return nil, errors.New("no stream IDs available")
+}
+
+// waitConnected waits for the exit to reply to the RELAY_BEGIN cell.
+func (s *OriginStream) waitConnected(ctx context.Context) error {
+	deadline := time.Now().Add(streamConnectTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	r, err := s.receive(deadline, ctx.Done())
+	if err == errCancelled {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	switch r.RelayCommand() {
+	case RelayConnected:
+		return nil
+	case RelayEnd:
+		d, err := r.RelayData()
+		if err != nil {
+			return err
+		}
+		return StreamEndedError{Reason: ParseEndPayload(d)}
+	default:
+		return errors.New("unexpected reply to begin")
+	}
+}
+
+// handleRelayCell processes a relay cell for this stream. Called from the
+// circuit goroutine, so must not block.
+func (s *OriginStream) handleRelayCell(r RelayCell) error {
+	switch r.RelayCommand() {
+	case RelaySendme:
+		return s.packageWindow.Give(StreamWindowIncrement)
+	case RelayEnd, RelayResolved:
+		atomic.StoreInt32(&s.ended, 1)
+	}
+
+	select {
+	case s.cells <- r:
+		return nil
+	default:
+		return errors.New("stream deliver window exceeded")
+	}
+}
+
+// receive waits for the next relay cell for this stream, until the deadline
+// passes or cancel is closed.
+func (s *OriginStream) receive(deadline time.Time, cancel <-chan struct{}) (RelayCell, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case r := <-s.cells:
+		return r, nil
+	case <-s.done:
+		return nil, ErrStreamClosed
+	case <-s.circ.done:
+		return nil, ErrCircuitClosed
+	case <-timeout:
+		return nil, timeoutError{}
+	case <-cancel:
+		return nil, errCancelled
+	}
+}
+
+// Read reads data received on the stream.
+func (s *OriginStream) Read(b []byte) (int, error) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+
+	for len(s.buf) == 0 {
+		if s.rerr != nil {
+			return 0, s.rerr
+		}
+
+		s.dmu.Lock()
+		deadline := s.readDeadline
+		s.dmu.Unlock()
+
+		r, err := s.receive(deadline, nil)
+		if err != nil {
+			return 0, err
+		}
+
+		switch r.RelayCommand() {
+		case RelayData:
+			if s.buf, err = r.RelayData(); err != nil {
+				return 0, err
+			}
+			if err := s.consumed(); err != nil {
+				return 0, err
+			}
+		case RelayEnd:
+			s.rerr = io.EOF
+		default:
+			s.logger.With("cmd", r.RelayCommand()).Debug("ignoring relay cell")
+		}
+	}
+
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// consumed records that a data cell has been consumed, sending a SENDME
+// when a window increment has been delivered.
+func (s *OriginStream) consumed() error {
+	s.delivered++
+	if s.delivered%StreamWindowIncrement != 0 {
+		return nil
+	}
+	return s.circ.sendRelayCell(s.hop, CommandRelay, NewRelayCell(RelaySendme, s.id, nil))
+}
+
+// Write sends data on the stream, blocking while flow control windows are
+// closed.
+func (s *OriginStream) Write(b []byte) (int, error) {
+	s.dmu.Lock()
+	deadline := s.writeDeadline
+	s.dmu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		if atomic.LoadInt32(&s.ended) != 0 || atomic.LoadInt32(&s.wclosed) != 0 {
+			return written, io.ErrClosedPipe
+		}
+
+		n := len(b)
+		if n > MaxRelayDataLength {
+			n = MaxRelayDataLength
+		}
+
+		if err := s.takeWindow(deadline); err != nil {
+			return written, err
+		}
+		if err := s.circ.SendRelayCell(s.hop, NewRelayCell(RelayData, s.id, b[:n])); err != nil {
+			return written, err
+		}
+
+		written += n
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// takeWindow takes from the stream package window, waiting no later than
+// deadline.
+func (s *OriginStream) takeWindow(deadline time.Time) error {
+	cancel := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			t := time.NewTimer(time.Until(deadline))
+			defer t.Stop()
+			timeout = t.C
+		}
+		select {
+		case <-s.done:
+		case <-s.circ.done:
+		case <-timeout:
+		case <-stop:
+			return
+		}
+		close(cancel)
+	}()
+
+	if err := s.packageWindow.Take(cancel); err == nil {
+		return nil
+	}
+
+	switch {
+	case s.isClosed():
+		return ErrStreamClosed
+	case s.circ.Closed():
+		return ErrCircuitClosed
+	default:
+		return timeoutError{}
+	}
+}
+
+func (s *OriginStream) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close closes the stream, notifying the exit if it has not already ended the
+// stream.
+func (s *OriginStream) Close() error {
+	var err error
+	s.once.Do(func() {
+		c := s.circ
+		c.mu.Lock()
+		if c.streams[s.id] == s {
+			delete(c.streams, s.id)
+		}
+		c.mu.Unlock()
+
+		if atomic.LoadInt32(&s.ended) == 0 {
+			err = c.sendRelayCell(s.hop, CommandRelay, NewRelayCell(RelayEnd, s.id, EndPayload(StreamCloseReasonDone)))
+			if err == ErrCircuitClosed {
+				err = nil
+			}
+		}
+
+		close(s.done)
+		c.Metrics.Streams.Free()
+	})
+	return err
+}
+
+// CloseWrite shuts down the writing side of the stream, while data from the
+// exit may still be read.
+//
+// Reference: https://github.com/torproject/torspec/blob/0fd44031bfd6c6c822bfb194e54a05118c9625e2/tor-spec.txt#L1616-L1620
+//
+//	   --- [The rest of this section describes unimplemented functionality.]
+//
+//	   Because TCP connections can be half-open, we follow an equivalent
+//	   to TCP's FIN/FIN-ACK/ACK protocol to close streams.
+//
+// Since the relay protocol has no half-closed state, the exit is not
+// notified. The stream is fully closed by Close or when the exit ends it.
+func (s *OriginStream) CloseWrite() error {
+	atomic.StoreInt32(&s.wclosed, 1)
+	return nil
+}
+
+// LocalAddr returns the local network address. Streams have no meaningful
+// local address, so this is always empty.
+func (s *OriginStream) LocalAddr() net.Addr {
+	return streamAddr("")
+}
+
+// RemoteAddr returns the address the stream was opened to.
+func (s *OriginStream) RemoteAddr() net.Addr {
+	return streamAddr(s.addr)
+}
+
+// SetDeadline sets the read and write deadlines.
+func (s *OriginStream) SetDeadline(t time.Time) error {
+	s.dmu.Lock()
+	defer s.dmu.Unlock()
+	s.readDeadline = t
+	s.writeDeadline = t
+	return nil
+}
+
+// SetReadDeadline sets the deadline for future Read calls.
+func (s *OriginStream) SetReadDeadline(t time.Time) error {
+	s.dmu.Lock()
+	defer s.dmu.Unlock()
+	s.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future Write calls.
+func (s *OriginStream) SetWriteDeadline(t time.Time) error {
+	s.dmu.Lock()
+	defer s.dmu.Unlock()
+	s.writeDeadline = t
+	return nil
+}
@@ -0,0 +1,270 @@
+package pearl
+
+import (
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Default range for the netflow padding timeout. These correspond to the
+// nf_ito_low and nf_ito_high consensus parameters in padding-spec.
+const (
+	DefaultPaddingTimeoutLow  = 1500 * time.Millisecond
+	DefaultPaddingTimeoutHigh = 9500 * time.Millisecond
+)
+
+// PaddingCommand is the command in a PADDING_NEGOTIATE cell.
+type PaddingCommand byte
+
+// Padding negotiation commands.
+const (
+	PaddingCommandStop  PaddingCommand = 1
+	PaddingCommandStart PaddingCommand = 2
+)
+
+// paddingNegotiateVersion is the only defined version of the
+// PADDING_NEGOTIATE cell.
+const paddingNegotiateVersion = 0
+
+// PaddingNegotiateCell asks the other side of a connection to start or stop
+// padding, and sets the range from which the padding timeout is chosen.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/padding-spec.txt#L192-L212
+//
+//	     const CHANNELPADDING_COMMAND_STOP = 1;
+//	     const CHANNELPADDING_COMMAND_START = 2;
+//
+//	     /* This command tells the relay to alter its min and max netflow
+//	        timeout range values, and send padding at that rate (resuming
+//	        if stopped). */
+//	     struct channelpadding_negotiate {
+//	       u8 version IN [0];
+//	       u8 command IN [CHANNELPADDING_COMMAND_START, CHANNELPADDING_COMMAND_STOP];
+//
+//	       /* Min must not be lower than the current consensus parameter
+//	          nf_ito_low. */
+//	       u16 ito_low_ms;
+//
+//	       /* Max must not be lower than ito_low_ms */
+//	       u16 ito_high_ms;
+//	     };
+//
+type PaddingNegotiateCell struct {
+	Command     PaddingCommand
+	TimeoutLow  time.Duration
+	TimeoutHigh time.Duration
+}
+
+var _ CellBuilder = new(PaddingNegotiateCell)
+
+// ParsePaddingNegotiateCell parses c as a PADDING_NEGOTIATE cell.
+func ParsePaddingNegotiateCell(c Cell) (*PaddingNegotiateCell, error) {
+	if c.Command() != CommandPaddingNegotiate {
+		return nil, ErrUnexpectedCommand
+	}
+
+	p := c.Payload()
+	if len(p) < 6 {
+		return nil, ErrShortCellPayload
+	}
+
+	if p[0] != paddingNegotiateVersion {
+		return nil, errors.New("unknown padding negotiate version")
+	}
+
+	cmd := PaddingCommand(p[1])
+	if cmd != PaddingCommandStart && cmd != PaddingCommandStop {
+		return nil, errors.New("unknown padding command")
+	}
+
+	return &PaddingNegotiateCell{
+		Command:     cmd,
+		TimeoutLow:  time.Duration(binary.BigEndian.Uint16(p[2:])) * time.Millisecond,
+		TimeoutHigh: time.Duration(binary.BigEndian.Uint16(p[4:])) * time.Millisecond,
+	}, nil
+}
+
+// Cell builds the cell.
+func (n PaddingNegotiateCell) Cell() (Cell, error) {
+	c := NewFixedCell(0, CommandPaddingNegotiate)
+	p := c.Payload()
+	p[0] = paddingNegotiateVersion
+	p[1] = byte(n.Command)
+	binary.BigEndian.PutUint16(p[2:], uint16(n.TimeoutLow/time.Millisecond))
+	binary.BigEndian.PutUint16(p[4:], uint16(n.TimeoutHigh/time.Millisecond))
+	return c, nil
+}
+
+// paddingTimeout chooses a padding timeout in the range [low, high]. Following
+// padding-spec, the timeout is the maximum of two uniform samples from the
+// range, which skews it towards the upper end.
+func paddingTimeout(low, high time.Duration, r *rand.Rand) time.Duration {
+	if high <= low {
+		return low
+	}
+	n := int64(high - low + 1)
+	a := time.Duration(r.Int63n(n))
+	b := time.Duration(r.Int63n(n))
+	if b > a {
+		a = b
+	}
+	return low + a
+}
+
+// activityWriter records the time of the most recent write.
+type activityWriter struct {
+	w    io.Writer
+	last int64 // unix nanoseconds, accessed atomically
+}
+
+func newActivityWriter(w io.Writer) *activityWriter {
+	return &activityWriter{
+		w:    w,
+		last: time.Now().UnixNano(),
+	}
+}
+
+func (a *activityWriter) Write(b []byte) (int, error) {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+	return a.w.Write(b)
+}
+
+// LastActivity returns the time of the most recent write.
+func (a *activityWriter) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&a.last))
+}
+
+// channelPadding sends PADDING cells on a connection when no other cells have
+// been sent for the padding timeout.
+type channelPadding struct {
+	conn     *Connection
+	activity *activityWriter
+
+	mu      sync.Mutex
+	enabled bool // allowed by negotiation with the peer
+	active  bool // the connection is in use
+	low     time.Duration
+	high    time.Duration
+	rand    *rand.Rand
+
+	update chan struct{}
+	done   chan struct{}
+}
+
+func newChannelPadding(conn *Connection, activity *activityWriter) *channelPadding {
+	return &channelPadding{
+		conn:     conn,
+		activity: activity,
+		enabled:  true,
+		low:      DefaultPaddingTimeoutLow,
+		high:     DefaultPaddingTimeoutHigh,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		update:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Negotiate processes a PADDING_NEGOTIATE request from the peer.
+func (p *channelPadding) Negotiate(n *PaddingNegotiateCell) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch n.Command {
+	case PaddingCommandStop:
+		p.enabled = false
+	case PaddingCommandStart:
+		if n.TimeoutHigh < n.TimeoutLow {
+			return errors.New("padding timeout high is less than low")
+		}
+		// The peer may not ask for padding more often than the default.
+		p.low = n.TimeoutLow
+		if p.low < DefaultPaddingTimeoutLow {
+			p.low = DefaultPaddingTimeoutLow
+		}
+		p.high = n.TimeoutHigh
+		if p.high < p.low {
+			p.high = p.low
+		}
+		p.enabled = true
+	}
+
+	select {
+	case p.update <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// SetActive sets whether the connection is in use. Padding is only sent on
+// active connections.
+func (p *channelPadding) SetActive(active bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active == active {
+		return
+	}
+	p.active = active
+	select {
+	case p.update <- struct{}{}:
+	default:
+	}
+}
+
+// timeout returns the padding timeout for the next idle period, and whether
+// padding should be sent.
+func (p *channelPadding) timeout() (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.enabled || !p.active {
+		return 0, false
+	}
+	return paddingTimeout(p.low, p.high, p.rand), true
+}
+
+// Run sends padding until Stop is called or sending fails.
+func (p *channelPadding) Run() {
+	for {
+		timeout, ok := p.timeout()
+		if !ok {
+			select {
+			case <-p.done:
+				return
+			case <-p.update:
+				continue
+			}
+		}
+
+		deadline := p.activity.LastActivity().Add(timeout)
+		t := time.NewTimer(time.Until(deadline))
+		select {
+		case <-p.done:
+			t.Stop()
+			return
+		case <-p.update:
+			t.Stop()
+			continue
+		case <-t.C:
+		}
+
+		// Only pad if nothing was sent while we waited.
+		if time.Since(p.activity.LastActivity()) < timeout {
+			continue
+		}
+
+		if err := p.conn.SendCell(NewFixedCell(0, CommandPadding)); err != nil {
+			return
+		}
+		p.conn.router.metrics.PaddingSent.Inc(1)
+	}
+}
+
+// Stop stops sending padding.
+func (p *channelPadding) Stop() {
+	close(p.done)
+}
@@ -0,0 +1,158 @@
+package pearl
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/torexitpolicy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaddingNegotiateCell(t *testing.T) {
+	n := PaddingNegotiateCell{
+		Command:     PaddingCommandStart,
+		TimeoutLow:  1500 * time.Millisecond,
+		TimeoutHigh: 9500 * time.Millisecond,
+	}
+
+	c, err := n.Cell()
+	require.NoError(t, err)
+
+	payload := []byte{
+		0, 0, 0, 0, // circid
+		12,         // command
+		0,          // version
+		2,          // start
+		0x05, 0xdc, // low
+		0x25, 0x1c, // high
+	}
+	expect := make([]byte, 514)
+	copy(expect, payload)
+	assert.Equal(t, expect, c.Bytes())
+
+	p, err := ParsePaddingNegotiateCell(c)
+	require.NoError(t, err)
+	assert.Equal(t, n, *p)
+}
+
+func TestParsePaddingNegotiateCellErrors(t *testing.T) {
+	_, err := ParsePaddingNegotiateCell(NewFixedCell(0, CommandPadding))
+	assert.Equal(t, ErrUnexpectedCommand, err)
+
+	c := NewFixedCell(0, CommandPaddingNegotiate)
+	c.Payload()[0] = 1
+	_, err = ParsePaddingNegotiateCell(c)
+	assert.Error(t, err)
+
+	c = NewFixedCell(0, CommandPaddingNegotiate)
+	c.Payload()[1] = 3
+	_, err = ParsePaddingNegotiateCell(c)
+	assert.Error(t, err)
+}
+
+func TestPaddingTimeoutRange(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		d := paddingTimeout(DefaultPaddingTimeoutLow, DefaultPaddingTimeoutHigh, r)
+		assert.True(t, d >= DefaultPaddingTimeoutLow)
+		assert.True(t, d <= DefaultPaddingTimeoutHigh)
+	}
+	assert.Equal(t, time.Second, paddingTimeout(time.Second, time.Second, r))
+}
+
+func TestChannelPaddingNegotiate(t *testing.T) {
+	p := newChannelPadding(nil, newActivityWriter(new(bytes.Buffer)))
+	p.SetActive(true)
+
+	err := p.Negotiate(&PaddingNegotiateCell{Command: PaddingCommandStop})
+	require.NoError(t, err)
+	_, ok := p.timeout()
+	assert.False(t, ok)
+
+	// Timeouts below the default low are raised to it.
+	err = p.Negotiate(&PaddingNegotiateCell{
+		Command:     PaddingCommandStart,
+		TimeoutLow:  100 * time.Millisecond,
+		TimeoutHigh: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	d, ok := p.timeout()
+	assert.True(t, ok)
+	assert.Equal(t, DefaultPaddingTimeoutLow, d)
+
+	err = p.Negotiate(&PaddingNegotiateCell{
+		Command:     PaddingCommandStart,
+		TimeoutLow:  5 * time.Second,
+		TimeoutHigh: 2 * time.Second,
+	})
+	assert.Error(t, err)
+}
+
+func TestChannelPaddingActive(t *testing.T) {
+	p := newChannelPadding(nil, newActivityWriter(new(bytes.Buffer)))
+	_, ok := p.timeout()
+	assert.False(t, ok)
+
+	p.SetActive(true)
+	_, ok = p.timeout()
+	assert.True(t, ok)
+
+	p.SetActive(false)
+	_, ok = p.timeout()
+	assert.False(t, ok)
+}
+
+// paddingActive reports whether padding is active on conn.
+func paddingActive(conn *Connection) bool {
+	conn.padding.mu.Lock()
+	defer conn.padding.mu.Unlock()
+	return conn.padding.active
+}
+
+func TestConnectionPaddingUsed(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	relay := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	hop, stop := startTestRelay(t, relay)
+	defer stop()
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+
+	a, err := client.BuildCircuit([]*HopSpec{hop})
+	require.NoError(t, err)
+	conn := a.Conn
+	require.NotNil(t, conn.padding)
+	assert.True(t, paddingActive(conn))
+
+	// The relay did not initiate the connection, so does not pad it.
+	fp, err := NewFingerprintFromBytes(client.Fingerprint())
+	require.NoError(t, err)
+	in, ok := relay.connections.Connection(fp)
+	require.True(t, ok)
+	assert.False(t, paddingActive(in))
+
+	b, err := client.BuildCircuit([]*HopSpec{hop})
+	require.NoError(t, err)
+	require.Equal(t, conn, b.Conn)
+
+	// Padding stops once the connection carries no circuits.
+	require.NoError(t, a.Close())
+	assert.True(t, paddingActive(conn))
+	require.NoError(t, b.Close())
+	assert.False(t, paddingActive(conn))
+}
+
+func TestActivityWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := newActivityWriter(buf)
+	before := w.LastActivity()
+	time.Sleep(time.Millisecond)
+	_, err := w.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.True(t, w.LastActivity().After(before))
+	assert.Equal(t, "hello", buf.String())
+}
@@ -0,0 +1,168 @@
+package pearl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/mmcloughlin/pearl/check"
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/socks"
+	"github.com/pkg/errors"
+)
+
+// socksHandshakeTimeout is the maximum time allowed for a SOCKS client to
+// send its request.
+const socksHandshakeTimeout = 30 * time.Second
+
+// PathProvider selects the hops for new circuits.
+type PathProvider interface {
+	Path() ([]*HopSpec, error)
+}
+
+// StaticPath is a PathProvider that always returns the same hops.
+type StaticPath []*HopSpec
+
+// Path returns the hops.
+func (p StaticPath) Path() ([]*HopSpec, error) {
+	if len(p) == 0 {
+		return nil, errors.New("empty path")
+	}
+	return p, nil
+}
+
+// Proxy is a SOCKS proxy carrying connections over circuits built by a
+// router.
+type Proxy struct {
+	dialer *Dialer
+	logger log.Logger
+}
+
+// NewProxy builds a proxy using circuits from r, with paths chosen by paths.
+func NewProxy(r *Router, paths PathProvider, l log.Logger) *Proxy {
+	return &Proxy{
+		dialer: NewDialer(r, DialerOptions{
+			Paths:  paths,
+			Logger: l,
+		}),
+		logger: log.ForComponent(l, "proxy"),
+	}
+}
+
+// ListenAndServe listens for SOCKS connections on addr.
+func (p *Proxy) ListenAndServe(addr string) error {
+	p.logger.With("laddr", addr).Info("creating socks listener")
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "could not create listener")
+	}
+	return p.Serve(ln)
+}
+
+// Serve accepts SOCKS connections on ln.
+func (p *Proxy) Serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return errors.Wrap(err, "error accepting connection")
+		}
+		go p.handle(conn)
+	}
+}
+
+// Close closes all circuits built by the proxy.
+func (p *Proxy) Close() error {
+	return p.dialer.Close()
+}
+
+func (p *Proxy) handle(conn net.Conn) {
+	logger := p.logger.With("raddr", conn.RemoteAddr())
+	defer check.Close(logger, conn)
+
+	if err := conn.SetDeadline(time.Now().Add(socksHandshakeTimeout)); err != nil {
+		log.Err(logger, err, "could not set deadline")
+		return
+	}
+
+	req, err := socks.ReadRequest(conn)
+	if err != nil {
+		log.Err(logger, err, "failed to read socks request")
+		return
+	}
+	logger = logger.With("addr", req.Addr())
+
+	if req.Command != socks.CommandConnect {
+		logger.With("cmd", req.Command).Info("unsupported socks command")
+		_ = req.WriteReply(conn, socks.ReplyCommandNotSupported)
+		return
+	}
+
+	ctx := WithIsolationKey(context.Background(), socksIsolationKey(req))
+	s, err := p.dialer.DialContext(ctx, "tcp", req.Addr())
+	if err != nil {
+		log.Err(logger, err, "failed to open stream")
+		_ = req.WriteReply(conn, socksReplyForError(err))
+		return
+	}
+	defer check.Close(logger, s)
+
+	if err := req.WriteReply(conn, socks.ReplySucceeded); err != nil {
+		log.Err(logger, err, "failed to send socks reply")
+		return
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		log.Err(logger, err, "could not clear deadline")
+		return
+	}
+
+	splice(conn, s)
+}
+
+// socksIsolationKey returns the isolation key for a SOCKS request. Following
+// tor's IsolateSOCKSAuth behavior, requests with different credentials are
+// never carried on the same circuit.
+func socksIsolationKey(req *socks.Request) IsolationKey {
+	return IsolationKey(fmt.Sprintf("socks:%d:%s:%s", len(req.Username), req.Username, req.Password))
+}
+
+// socksReplyForError maps a stream opening error to a SOCKS reply.
+func socksReplyForError(err error) socks.Reply {
+	e, ok := errors.Cause(err).(StreamEndedError)
+	if !ok {
+		return socks.ReplyGeneralFailure
+	}
+
+	switch e.Reason {
+	case StreamCloseReasonExitpolicy:
+		return socks.ReplyNotAllowed
+	case StreamCloseReasonResolvefailed:
+		return socks.ReplyHostUnreachable
+	case StreamCloseReasonConnectrefused:
+		return socks.ReplyConnectionRefused
+	case StreamCloseReasonNoroute:
+		return socks.ReplyNetworkUnreachable
+	case StreamCloseReasonTimeout:
+		return socks.ReplyTTLExpired
+	default:
+		return socks.ReplyGeneralFailure
+	}
+}
+
+// splice copies data in both directions between a and b until either side
+// finishes, then closes both.
+func splice(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	cp := func(dst io.Writer, src io.Reader) {
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	_ = a.Close()
+	_ = b.Close()
+	<-done
+}
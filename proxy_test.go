@@ -0,0 +1,94 @@
+package pearl
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/socks"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSocksReplyForError(t *testing.T) {
+	cases := []struct {
+		Err    error
+		Expect socks.Reply
+	}{
+		{StreamEndedError{Reason: StreamCloseReasonConnectrefused}, socks.ReplyConnectionRefused},
+		{StreamEndedError{Reason: StreamCloseReasonExitpolicy}, socks.ReplyNotAllowed},
+		{errors.Wrap(StreamEndedError{Reason: StreamCloseReasonResolvefailed}, "open"), socks.ReplyHostUnreachable},
+		{StreamEndedError{Reason: StreamCloseReasonDestroy}, socks.ReplyGeneralFailure},
+		{ErrCircuitClosed, socks.ReplyGeneralFailure},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.Expect, socksReplyForError(c.Err), "error %v", c.Err)
+	}
+}
+
+func TestStaticPathEmpty(t *testing.T) {
+	_, err := StaticPath(nil).Path()
+	assert.Error(t, err)
+}
+
+func TestOriginStreamRead(t *testing.T) {
+	c := &OriginCircuit{
+		done:   make(chan struct{}),
+		logger: log.NewDebug(),
+	}
+	s := newOriginStream(c, 1, 0, "example.com:80")
+
+	require.NoError(t, s.handleRelayCell(NewRelayCell(RelayData, 1, []byte("hello "))))
+	require.NoError(t, s.handleRelayCell(NewRelayCell(RelayData, 1, []byte("world"))))
+	require.NoError(t, s.handleRelayCell(NewRelayCell(RelayEnd, 1, EndPayload(StreamCloseReasonDone))))
+
+	b := make([]byte, 4)
+	n, err := s.Read(b)
+	require.NoError(t, err)
+	assert.Equal(t, "hell", string(b[:n]))
+
+	rest, err := readAll(s)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "o world", string(rest))
+
+	_, err = s.Write([]byte("x"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+}
+
+func TestOriginStreamReadDeadline(t *testing.T) {
+	c := &OriginCircuit{
+		done:   make(chan struct{}),
+		logger: log.NewDebug(),
+	}
+	s := newOriginStream(c, 1, 0, "example.com:80")
+	require.NoError(t, s.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+
+	_, err := s.Read(make([]byte, 1))
+	require.Error(t, err)
+	ne, ok := err.(interface{ Timeout() bool })
+	require.True(t, ok)
+	assert.True(t, ne.Timeout())
+}
+
+func TestOriginStreamSendme(t *testing.T) {
+	c := &OriginCircuit{
+		done:   make(chan struct{}),
+		logger: log.NewDebug(),
+	}
+	s := newOriginStream(c, 1, 0, "example.com:80")
+	assert.Equal(t, ErrWindowOverflow, s.handleRelayCell(NewRelayCell(RelaySendme, 1, nil)))
+}
+
+func readAll(r io.Reader) ([]byte, error) {
+	var all []byte
+	b := make([]byte, 3)
+	for {
+		n, err := r.Read(b)
+		all = append(all, b[:n]...)
+		if err != nil {
+			return all, err
+		}
+	}
+}
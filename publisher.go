@@ -1,9 +1,11 @@
 package pearl
 
 import (
+	"sync"
 	"time"
 
 	"github.com/mmcloughlin/pearl/log"
+	"github.com/mmcloughlin/pearl/tordir"
 )
 
 // Reference: https://github.com/torproject/torspec/blob/f66d1826c0b32d307898bba081dbf8ef598d4037/dir-spec.txt#L341-L371
@@ -41,46 +43,268 @@ import (
 //	   authorities SHOULD reject them.
 //
 
+// Republishing parameters.
+const (
+	// DefaultPublishCheckInterval is how often the publisher regenerates the
+	// descriptor to check whether it should be republished.
+	DefaultPublishCheckInterval = time.Minute
+
+	// DescriptorMaxAge is the time after which a descriptor is republished
+	// even if nothing has changed.
+	DescriptorMaxAge = 18 * time.Hour
+
+	// BandwidthChangeMinAge is the minimum age of a descriptor before it is
+	// republished due to a change in observed bandwidth.
+	BandwidthChangeMinAge = 20 * time.Minute
+
+	// Bounds on the delay before retrying a failed upload to an authority.
+	publishRetryMin = time.Minute
+	publishRetryMax = time.Hour
+)
+
+// AuthorityStatus records the state of descriptor uploads to one authority.
+type AuthorityStatus struct {
+	Address     string
+	Pending     bool // whether the current descriptor is still to be uploaded
+	LastAttempt time.Time
+	LastSuccess time.Time
+	LastError   error
+	Failures    int // consecutive failed uploads
+
+	next time.Time
+}
+
+// Publisher uploads the router's descriptors to directory authorities,
+// republishing when they change according to the rules above.
 type Publisher struct {
-	Router      *Router
-	Interval    time.Duration
-	Authorities []string
+	Router        *Router
+	CheckInterval time.Duration
+	Authorities   []string
 
 	Logger log.Logger
+
+	mu        sync.Mutex
+	desc      *tordir.Document
+	extra     *tordir.Document
+	published time.Time
+	observed  int
+	status    map[string]*AuthorityStatus
+
+	// Overridden in tests.
+	upload func(addr string, docs ...*tordir.Document) error
+	now    func() time.Time
 }
 
+// Start enters a loop checking for changes to the descriptor and uploading it
+// to authorities. It does not return.
+func (p *Publisher) Start() {
+	interval := p.CheckInterval
+	if interval == 0 {
+		interval = DefaultPublishCheckInterval
+	}
+	for {
+		if err := p.Check(); err != nil {
+			log.Err(p.Logger, err, "error publishing descriptor")
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Publish regenerates the descriptors and uploads them to every authority
+// immediately.
 func (p *Publisher) Publish() error {
-	desc, err := p.Router.Descriptor()
-	if err != nil {
+	if err := p.regenerate(true); err != nil {
 		return err
 	}
+	p.uploadPending(true)
+	return nil
+}
 
-	data := p.Router.config.Data
-	err = data.SetServerDescriptor(desc)
-	if err != nil {
+// Check regenerates the descriptors, republishing them if required. Uploads
+// that previously failed are retried once their backoff has expired.
+func (p *Publisher) Check() error {
+	if err := p.regenerate(false); err != nil {
 		return err
 	}
+	p.uploadPending(false)
+	return nil
+}
 
+// Status returns the upload state for each authority.
+func (p *Publisher) Status() []AuthorityStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	statuses := make([]AuthorityStatus, 0, len(p.Authorities))
 	for _, addr := range p.Authorities {
-		err = desc.PublishToAuthority(addr)
-		lg := p.Logger.With("authority", addr)
-		if err != nil {
-			log.Err(lg, err, "failed to publish descriptor")
+		if st, ok := p.status[addr]; ok {
+			statuses = append(statuses, *st)
 		} else {
-			lg.Info("published descriptor")
+			statuses = append(statuses, AuthorityStatus{Address: addr})
+		}
+	}
+	return statuses
+}
+
+// regenerate builds new descriptors, and marks them for upload if they
+// should be republished.
+func (p *Publisher) regenerate(force bool) error {
+	observed := p.Router.history.Observed()
+	desc, extra, err := p.Router.Descriptors()
+	if err != nil {
+		return err
+	}
+	doc, err := desc.Document()
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.clock()
+	reason := p.republishReason(doc, observed, now)
+	if reason == "" {
+		if !force {
+			return nil
+		}
+		reason = "requested"
+	}
+	p.Logger.With("reason", reason).Info("publishing new descriptor")
+
+	if data := p.Router.config.Data; data != nil {
+		if err := data.SetServerDescriptor(desc); err != nil {
+			return err
+		}
+		if err := data.SetExtraInfo(extra); err != nil {
+			return err
+		}
+	}
+
+	p.desc = doc
+	p.extra = extra
+	p.published = now
+	p.observed = observed
+
+	if p.status == nil {
+		p.status = make(map[string]*AuthorityStatus)
+	}
+	for _, addr := range p.Authorities {
+		st, ok := p.status[addr]
+		if !ok {
+			st = &AuthorityStatus{Address: addr}
+			p.status[addr] = st
 		}
+		st.Pending = true
+		st.Failures = 0
+		st.next = now
 	}
 
 	return nil
 }
 
-func (p *Publisher) Start() {
-	for {
-		err := p.Publish()
-		if err != nil {
-			log.Err(p.Logger, err, "error publishing descriptor")
-			return
+// republishReason returns why the descriptor doc should replace the last one
+// published, or the empty string if it should not. The caller must hold mu.
+func (p *Publisher) republishReason(doc *tordir.Document, observed int, now time.Time) string {
+	age := now.Sub(p.published)
+	switch {
+	case p.desc == nil:
+		return "startup"
+	case age >= DescriptorMaxAge:
+		return "expired"
+	case !tordir.CosmeticallyEqual(p.desc, doc):
+		return "changed"
+	case age >= BandwidthChangeMinAge && bandwidthChanged(p.observed, observed):
+		return "bandwidth changed"
+	}
+	return ""
+}
+
+// bandwidthChanged reports whether bandwidth has changed by a factor of two.
+func bandwidthChanged(prev, cur int) bool {
+	return cur > 2*prev || prev > 2*cur
+}
+
+// uploadPending uploads the current descriptors concurrently to authorities
+// that have not yet accepted them. Unless force is set, authorities that
+// recently failed are skipped until their backoff expires.
+func (p *Publisher) uploadPending(force bool) {
+	p.mu.Lock()
+	now := p.clock()
+	docs := []*tordir.Document{p.desc, p.extra}
+	var addrs []string
+	for _, addr := range p.Authorities {
+		st := p.status[addr]
+		if st == nil || !st.Pending {
+			continue
+		}
+		if force || !now.Before(st.next) {
+			addrs = append(addrs, addr)
 		}
-		time.Sleep(p.Interval)
 	}
+	upload := p.upload
+	if upload == nil {
+		upload = tordir.PublishToAuthority
+	}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			err := upload(addr, docs...)
+			p.record(addr, docs[0], err)
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// record updates authority status following an upload attempt of desc.
+func (p *Publisher) record(addr string, desc *tordir.Document, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lg := p.Logger.With("authority", addr)
+	now := p.clock()
+	st := p.status[addr]
+	st.LastAttempt = now
+	st.LastError = err
+
+	// The descriptor may have been replaced during upload.
+	if desc != p.desc {
+		return
+	}
+
+	if err != nil {
+		st.Failures++
+		st.next = now.Add(publishBackoff(st.Failures))
+		log.Err(lg.With("retry", st.next), err, "failed to publish descriptor")
+		return
+	}
+
+	st.Pending = false
+	st.Failures = 0
+	st.LastSuccess = now
+	lg.Info("published descriptor")
+}
+
+// publishBackoff returns the delay before retrying an upload after the given
+// number of consecutive failures.
+func publishBackoff(failures int) time.Duration {
+	d := publishRetryMin
+	for i := 1; i < failures && d < publishRetryMax; i++ {
+		d *= 2
+	}
+	if d > publishRetryMax {
+		d = publishRetryMax
+	}
+	return d
+}
+
+func (p *Publisher) clock() time.Time {
+	if p.now == nil {
+		return time.Now()
+	}
+	return p.now()
 }
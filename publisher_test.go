@@ -0,0 +1,151 @@
+package pearl
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testUploader struct {
+	mu    sync.Mutex
+	fail  map[string]bool
+	count map[string]int
+}
+
+func newTestUploader() *testUploader {
+	return &testUploader{
+		fail:  map[string]bool{},
+		count: map[string]int{},
+	}
+}
+
+func (u *testUploader) upload(addr string, docs ...*tordir.Document) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.count[addr]++
+	if u.fail[addr] {
+		return errors.New("upload failed")
+	}
+	return nil
+}
+
+func (u *testUploader) uploads(addr string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.count[addr]
+}
+
+func newTestPublisher(t *testing.T) (*Publisher, *testUploader, *time.Time) {
+	r := newTestRouter(t, nil)
+	u := newTestUploader()
+	now := time.Now()
+	p := &Publisher{
+		Router:      r,
+		Authorities: []string{"a:80", "b:80"},
+		Logger:      r.logger,
+		upload:      u.upload,
+		now:         func() time.Time { return now },
+	}
+	return p, u, &now
+}
+
+func TestPublisherCheckUnchanged(t *testing.T) {
+	p, u, now := newTestPublisher(t)
+
+	require.NoError(t, p.Check())
+	assert.Equal(t, 1, u.uploads("a:80"))
+	assert.Equal(t, 1, u.uploads("b:80"))
+
+	// Nothing has changed, so no republish.
+	*now = now.Add(time.Hour)
+	require.NoError(t, p.Check())
+	assert.Equal(t, 1, u.uploads("a:80"))
+
+	// Republish once the descriptor is old enough.
+	*now = now.Add(DescriptorMaxAge)
+	require.NoError(t, p.Check())
+	assert.Equal(t, 2, u.uploads("a:80"))
+	assert.Equal(t, 2, u.uploads("b:80"))
+}
+
+func TestPublisherCheckChanged(t *testing.T) {
+	p, u, now := newTestPublisher(t)
+	require.NoError(t, p.Check())
+
+	*now = now.Add(time.Minute)
+	p.Router.config.Contact = "someone@example.com"
+	require.NoError(t, p.Check())
+	assert.Equal(t, 2, u.uploads("a:80"))
+}
+
+func TestPublisherRepublishReasonBandwidth(t *testing.T) {
+	p, _, now := newTestPublisher(t)
+	require.NoError(t, p.Check())
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.observed = 1000
+
+	// Bandwidth changes are ignored for recent descriptors.
+	*now = now.Add(time.Minute)
+	assert.Equal(t, "", p.republishReason(p.desc, 3000, *now))
+
+	*now = now.Add(BandwidthChangeMinAge)
+	assert.Equal(t, "", p.republishReason(p.desc, 1500, *now))
+	assert.Equal(t, "bandwidth changed", p.republishReason(p.desc, 3000, *now))
+	assert.Equal(t, "bandwidth changed", p.republishReason(p.desc, 400, *now))
+}
+
+func TestPublisherRetryBackoff(t *testing.T) {
+	p, u, now := newTestPublisher(t)
+	u.fail["b:80"] = true
+	start := *now
+
+	require.NoError(t, p.Check())
+	status := p.Status()
+	require.Len(t, status, 2)
+	assert.False(t, status[0].Pending)
+	assert.Equal(t, start, status[0].LastSuccess)
+	assert.True(t, status[1].Pending)
+	assert.Error(t, status[1].LastError)
+	assert.Equal(t, 1, status[1].Failures)
+
+	// Not retried before the backoff expires.
+	*now = start.Add(publishRetryMin / 2)
+	require.NoError(t, p.Check())
+	assert.Equal(t, 1, u.uploads("b:80"))
+
+	*now = start.Add(publishRetryMin)
+	require.NoError(t, p.Check())
+	assert.Equal(t, 2, u.uploads("b:80"))
+	assert.Equal(t, 2, p.Status()[1].Failures)
+
+	// Success clears the failure state.
+	u.fail["b:80"] = false
+	*now = now.Add(publishBackoff(2))
+	require.NoError(t, p.Check())
+	status = p.Status()
+	assert.False(t, status[1].Pending)
+	assert.Equal(t, 0, status[1].Failures)
+	assert.Equal(t, *now, status[1].LastSuccess)
+	assert.Equal(t, 1, u.uploads("a:80"))
+}
+
+func TestPublishBackoff(t *testing.T) {
+	assert.Equal(t, publishRetryMin, publishBackoff(1))
+	assert.Equal(t, 2*publishRetryMin, publishBackoff(2))
+	assert.Equal(t, 4*publishRetryMin, publishBackoff(3))
+	assert.Equal(t, publishRetryMax, publishBackoff(100))
+}
+
+func TestPublisherPublishForce(t *testing.T) {
+	p, u, _ := newTestPublisher(t)
+	require.NoError(t, p.Publish())
+	require.NoError(t, p.Publish())
+	assert.Equal(t, 2, u.uploads("a:80"))
+}
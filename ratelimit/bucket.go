@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket. Tokens are added by Refill at a fixed rate, up to
+// a maximum of burst. Consumers wait for tokens to become available, and may
+// overdraw the bucket, in which case later consumers wait for the debt to be
+// repaid.
+type Bucket struct {
+	rate  int64 // tokens per second
+	burst int64
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	tokens int64
+	frac   int64 // fractional tokens, in units of 1/time.Second
+	closed bool
+}
+
+// NewBucket builds a full bucket refilled at rate tokens per second, holding
+// at most burst tokens.
+func NewBucket(rate, burst int64) *Bucket {
+	if burst < rate {
+		burst = rate
+	}
+	b := &Bucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// Rate returns the refill rate in tokens per second.
+func (b *Bucket) Rate() int64 {
+	return b.rate
+}
+
+// Burst returns the capacity of the bucket.
+func (b *Bucket) Burst() int64 {
+	return b.burst
+}
+
+// Tokens returns the number of tokens currently available. This is negative
+// if the bucket is overdrawn.
+func (b *Bucket) Tokens() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens
+}
+
+// Refill adds the tokens accumulated over the elapsed duration d.
+func (b *Bucket) Refill(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Whole seconds are handled separately to avoid overflow for high rates.
+	secs := int64(d / time.Second)
+	if b.rate > 0 && secs > b.burst/b.rate {
+		secs = b.burst/b.rate + 1
+	}
+	b.tokens += b.rate * secs
+
+	// Track fractions of a token so slow rates and short intervals still
+	// accumulate tokens.
+	n := b.rate*int64(d%time.Second) + b.frac
+	b.tokens += n / int64(time.Second)
+	b.frac = n % int64(time.Second)
+
+	if b.tokens >= b.burst {
+		b.tokens = b.burst
+		b.frac = 0
+	}
+	if b.tokens > 0 {
+		b.cond.Broadcast()
+	}
+}
+
+// Wait blocks until tokens are available, returning how many. Once the bucket
+// is closed, Wait returns max without blocking.
+func (b *Bucket) Wait(max int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for b.tokens <= 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if b.closed || int64(max) < b.tokens {
+		return max
+	}
+	return int(b.tokens)
+}
+
+// Take waits until tokens are available and then removes n, overdrawing the
+// bucket if necessary.
+func (b *Bucket) Take(n int) {
+	b.Wait(n)
+	b.Consume(n)
+}
+
+// Consume removes n tokens from the bucket.
+func (b *Bucket) Consume(n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens -= int64(n)
+}
+
+// Close releases all waiters and disables limiting.
+func (b *Bucket) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
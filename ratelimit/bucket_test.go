@@ -0,0 +1,79 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewBucketFull(t *testing.T) {
+	b := NewBucket(100, 1000)
+	assert.Equal(t, int64(1000), b.Tokens())
+	assert.Equal(t, int64(100), b.Rate())
+	assert.Equal(t, int64(1000), b.Burst())
+}
+
+func TestNewBucketBurstAtLeastRate(t *testing.T) {
+	b := NewBucket(100, 10)
+	assert.Equal(t, int64(100), b.Burst())
+}
+
+func TestBucketRefill(t *testing.T) {
+	b := NewBucket(100, 1000)
+	b.Consume(1000)
+	b.Refill(time.Second)
+	assert.Equal(t, int64(100), b.Tokens())
+	b.Refill(time.Hour)
+	assert.Equal(t, int64(1000), b.Tokens())
+}
+
+func TestBucketRefillFractional(t *testing.T) {
+	b := NewBucket(3, 3)
+	b.Consume(3)
+	for i := 0; i < 10; i++ {
+		b.Refill(100 * time.Millisecond)
+	}
+	assert.Equal(t, int64(3), b.Tokens())
+}
+
+func TestBucketRefillHighRate(t *testing.T) {
+	b := NewBucket(1<<40, 1<<41)
+	b.Consume(1 << 41)
+	b.Refill(24 * time.Hour)
+	assert.Equal(t, int64(1<<41), b.Tokens())
+}
+
+func TestBucketWait(t *testing.T) {
+	b := NewBucket(100, 100)
+	assert.Equal(t, 10, b.Wait(10))
+	assert.Equal(t, 100, b.Wait(1000))
+}
+
+func TestBucketWaitBlocksWhenOverdrawn(t *testing.T) {
+	b := NewBucket(100, 100)
+	b.Consume(150)
+
+	got := make(chan int)
+	go func() { got <- b.Wait(1000) }()
+
+	b.Refill(250 * time.Millisecond)
+	select {
+	case <-got:
+		t.Fatal("wait returned while overdrawn")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	b.Refill(500 * time.Millisecond)
+	assert.Equal(t, 25, <-got)
+}
+
+func TestBucketClose(t *testing.T) {
+	b := NewBucket(1, 1)
+	b.Consume(10)
+
+	got := make(chan int)
+	go func() { got <- b.Wait(42) }()
+	b.Close()
+	assert.Equal(t, 42, <-got)
+}
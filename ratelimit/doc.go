@@ -0,0 +1,2 @@
+// Package ratelimit implements token bucket bandwidth limiting.
+package ratelimit
@@ -0,0 +1,144 @@
+package ratelimit
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// DefaultRefillInterval is how often limiter buckets are refilled. This
+// matches tor's default TokenBucketRefillInterval.
+const DefaultRefillInterval = 100 * time.Millisecond
+
+// Limiter limits bandwidth in each direction with separate read and write
+// token buckets.
+type Limiter struct {
+	Read  *Bucket
+	Write *Bucket
+
+	interval time.Duration
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// NewLimiter builds a limiter allowing rate bytes per second in each
+// direction, with bursts of up to burst bytes. The limiter does nothing until
+// started.
+func NewLimiter(rate, burst int64) *Limiter {
+	return &Limiter{
+		Read:     NewBucket(rate, burst),
+		Write:    NewBucket(rate, burst),
+		interval: DefaultRefillInterval,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start launches a goroutine refilling the buckets on a ticker.
+func (l *Limiter) Start() {
+	go l.run()
+}
+
+func (l *Limiter) run() {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(last)
+			last = now
+			l.Read.Refill(elapsed)
+			l.Write.Refill(elapsed)
+		}
+	}
+}
+
+// Stop halts refilling and releases any blocked readers and writers. Limits
+// are no longer applied after Stop.
+func (l *Limiter) Stop() {
+	l.once.Do(func() {
+		close(l.stop)
+		l.Read.Close()
+		l.Write.Close()
+	})
+}
+
+// WrapReader limits reads from r by the limiter's read bucket. A nil limiter
+// returns r unchanged.
+func (l *Limiter) WrapReader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return NewReader(r, l.Read)
+}
+
+// WrapWriter limits writes to w by the limiter's write bucket. A nil limiter
+// returns w unchanged.
+func (l *Limiter) WrapWriter(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+	return NewWriter(w, l.Write)
+}
+
+// Charge accounts for traffic that does not pass through a wrapped reader or
+// writer, blocking until the limiter allows it. A nil limiter does nothing.
+func (l *Limiter) Charge(read, written int) {
+	if l == nil {
+		return
+	}
+	if read > 0 {
+		l.Read.Take(read)
+	}
+	if written > 0 {
+		l.Write.Take(written)
+	}
+}
+
+// Reader is a rate limited reader. Reads block until tokens are available, so
+// a slow bucket applies back-pressure to the underlying connection.
+type Reader struct {
+	r io.Reader
+	b *Bucket
+}
+
+// NewReader builds a reader limited by b.
+func NewReader(r io.Reader, b *Bucket) *Reader {
+	return &Reader{r: r, b: b}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return r.r.Read(p)
+	}
+	n := r.b.Wait(len(p))
+	n, err := r.r.Read(p[:n])
+	r.b.Consume(n)
+	return n, err
+}
+
+// Writer is a rate limited writer. Each write is passed to the underlying
+// writer in a single call once any tokens are available, overdrawing the
+// bucket if necessary. Splitting writes would allow concurrent writers to
+// interleave partial cells on the wire.
+type Writer struct {
+	w io.Writer
+	b *Bucket
+}
+
+// NewWriter builds a writer limited by b.
+func NewWriter(w io.Writer, b *Bucket) *Writer {
+	return &Writer{w: w, b: b}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		w.b.Wait(len(p))
+	}
+	n, err := w.w.Write(p)
+	w.b.Consume(n)
+	return n, err
+}
@@ -0,0 +1,160 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNilLimiterPassthrough(t *testing.T) {
+	var l *Limiter
+	r := bytes.NewReader(nil)
+	assert.Equal(t, io.Reader(r), l.WrapReader(r))
+	var w bytes.Buffer
+	assert.Equal(t, io.Writer(&w), l.WrapWriter(&w))
+}
+
+func TestLimiterCharge(t *testing.T) {
+	var nl *Limiter
+	nl.Charge(100, 100)
+
+	l := NewLimiter(10, 10)
+	l.Charge(25, 5)
+	assert.Equal(t, int64(-15), l.Read.Tokens())
+	assert.Equal(t, int64(5), l.Write.Tokens())
+}
+
+func TestReaderLimitsReads(t *testing.T) {
+	b := NewBucket(10, 10)
+	r := NewReader(bytes.NewReader(make([]byte, 100)), b)
+
+	p := make([]byte, 100)
+	n, err := r.Read(p)
+	require.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, int64(0), b.Tokens())
+}
+
+func TestWriterOverdraws(t *testing.T) {
+	b := NewBucket(10, 10)
+	var buf bytes.Buffer
+	w := NewWriter(&buf, b)
+
+	n, err := w.Write(make([]byte, 25))
+	require.NoError(t, err)
+	assert.Equal(t, 25, n)
+	assert.Equal(t, int64(-15), b.Tokens())
+
+	// The next write waits for the debt to be repaid.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := w.Write(make([]byte, 5))
+		assert.NoError(t, err)
+	}()
+
+	refills := 0
+	for {
+		select {
+		case <-done:
+			assert.Equal(t, 30, buf.Len())
+			assert.True(t, refills >= 2)
+			return
+		case <-time.After(time.Millisecond):
+			b.Refill(time.Second)
+			refills++
+		}
+	}
+}
+
+// recordingWriter records the data passed to each Write call.
+type recordingWriter struct {
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func TestWriterConcurrentWritesAtomic(t *testing.T) {
+	const (
+		writers  = 8
+		cells    = 10
+		cellSize = 514
+	)
+
+	// Start empty, and refill less than a cell's worth of tokens each tick.
+	const rate = 400 * cellSize
+	l := NewLimiter(rate, rate)
+	l.Write.Consume(rate)
+	l.interval = time.Millisecond
+	l.Start()
+	defer l.Stop()
+
+	rec := &recordingWriter{}
+	w := l.WrapWriter(rec)
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(b byte) {
+			defer wg.Done()
+			for j := 0; j < cells; j++ {
+				_, err := w.Write(bytes.Repeat([]byte{b}, cellSize))
+				assert.NoError(t, err)
+			}
+		}(byte(i))
+	}
+	wg.Wait()
+
+	require.Len(t, rec.writes, writers*cells)
+	for _, p := range rec.writes {
+		require.Len(t, p, cellSize)
+		assert.Equal(t, bytes.Repeat(p[:1], cellSize), p)
+	}
+}
+
+func TestLimiterThroughput(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping timing test")
+	}
+
+	const rate = 50 << 10
+	l := NewLimiter(rate, rate)
+	l.Start()
+	defer l.Stop()
+
+	// The initial burst is available immediately, and the remaining half
+	// second of data must wait for refills.
+	const size = rate + rate/2
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, l.WrapReader(bytes.NewReader(make([]byte, size))))
+	require.NoError(t, err)
+	assert.Equal(t, int64(size), n)
+	assert.True(t, time.Since(start) > 300*time.Millisecond)
+}
+
+func TestLimiterStopReleasesWaiters(t *testing.T) {
+	l := NewLimiter(1, 1)
+	l.Read.Consume(100)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p := make([]byte, 10)
+		n, _ := l.WrapReader(bytes.NewReader(p)).Read(p)
+		assert.Equal(t, 10, n)
+	}()
+	l.Stop()
+	<-done
+}
@@ -7,6 +7,9 @@ import (
 	"github.com/mmcloughlin/pearl/log"
 )
 
+// MaxRelayDataLength is the maximum length of the data in a relay cell.
+const MaxRelayDataLength = MaxPayloadLength - 11
+
 type RelayCell interface {
 	RelayCommand() RelayCommand
 	Recognized() uint16
@@ -0,0 +1,228 @@
+package pearl
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mmcloughlin/pearl/check"
+	"github.com/mmcloughlin/pearl/tordns"
+	"github.com/pkg/errors"
+)
+
+// ResolvedType is the type of an answer in a RELAY_RESOLVED cell.
+type ResolvedType byte
+
+// Possible ResolvedType values.
+const (
+	ResolvedTypeHostname          ResolvedType = 0x00
+	ResolvedTypeIPv4              ResolvedType = 0x04
+	ResolvedTypeIPv6              ResolvedType = 0x06
+	ResolvedTypeErrorTransient    ResolvedType = 0xf0
+	ResolvedTypeErrorNontransient ResolvedType = 0xf1
+)
+
+// ResolvedAnswer is one answer in a RELAY_RESOLVED cell.
+type ResolvedAnswer struct {
+	Type  ResolvedType
+	Value []byte
+	TTL   uint32
+}
+
+// IP returns the address in an IPv4 or IPv6 answer, or nil for other types.
+func (a ResolvedAnswer) IP() net.IP {
+	switch {
+	case a.Type == ResolvedTypeIPv4 && len(a.Value) == net.IPv4len:
+		return net.IP(a.Value).To16()
+	case a.Type == ResolvedTypeIPv6 && len(a.Value) == net.IPv6len:
+		return net.IP(a.Value)
+	default:
+		return nil
+	}
+}
+
+// IsError reports whether the answer is an error.
+func (a ResolvedAnswer) IsError() bool {
+	return a.Type == ResolvedTypeErrorTransient || a.Type == ResolvedTypeErrorNontransient
+}
+
+// ResolvedPayload encodes answers as a RELAY_RESOLVED payload. Answers that do
+// not fit in a relay cell are dropped.
+//
+// Reference: https://github.com/torproject/torspec/blob/0fd44031bfd6c6c822bfb194e54a05118c9625e2/tor-spec.txt#L1672-L1698
+//
+//	   To find the address associated with a hostname, the OP sends a
+//	   RELAY_RESOLVE cell containing the hostname to be resolved with a NUL
+//	   terminating byte. (For a reverse lookup, the OP sends a RELAY_RESOLVE
+//	   cell containing an in-addr.arpa address.) The OR replies with a
+//	   RELAY_RESOLVED cell containing any number of answers. Each answer is
+//	   of the form:
+//	       Type   (1 octet)
+//	       Length (1 octet)
+//	       Value  (variable-width)
+//	       TTL    (4 octets)
+//	   "Length" is the length of the Value field.
+//	   "Type" is one of:
+//	      0x00 -- Hostname
+//	      0x04 -- IPv4 address
+//	      0x06 -- IPv6 address
+//	      0xF0 -- Error, transient
+//	      0xF1 -- Error, nontransient
+//
+//	    If any answer has a type of 'Error', then no other answer may be given.
+//
+//	    For backward compatibility, if there are any IPv4 answers, one of those
+//	    must be given as the first answer.
+//
+func ResolvedPayload(answers []ResolvedAnswer) ([]byte, error) {
+	p := make([]byte, 0, MaxRelayDataLength)
+	for _, a := range answers {
+		if len(a.Value) > 255 {
+			return nil, errors.New("resolved answer too long")
+		}
+		if len(p)+len(a.Value)+6 > MaxRelayDataLength {
+			break
+		}
+		p = append(p, byte(a.Type), byte(len(a.Value)))
+		p = append(p, a.Value...)
+		var ttl [4]byte
+		binary.BigEndian.PutUint32(ttl[:], a.TTL)
+		p = append(p, ttl[:]...)
+	}
+	return p, nil
+}
+
+// ParseResolvedPayload decodes the answers in a RELAY_RESOLVED payload.
+func ParseResolvedPayload(p []byte) ([]ResolvedAnswer, error) {
+	var answers []ResolvedAnswer
+	for len(p) > 0 {
+		if len(p) < 2 {
+			return nil, errors.New("resolved answer truncated")
+		}
+		n := int(p[1])
+		if len(p) < 2+n+4 {
+			return nil, errors.New("resolved answer truncated")
+		}
+		answers = append(answers, ResolvedAnswer{
+			Type:  ResolvedType(p[0]),
+			Value: append([]byte(nil), p[2:2+n]...),
+			TTL:   binary.BigEndian.Uint32(p[2+n:]),
+		})
+		p = p[2+n+4:]
+	}
+	return answers, nil
+}
+
+// Resolve asks the last hop to look up host with a RELAY_RESOLVE cell. For a
+// reverse lookup, host should be an in-addr.arpa or ip6.arpa name. Lookup
+// failures are reported by the exit as a single error answer.
+func (c *OriginCircuit) Resolve(ctx context.Context, host string) ([]ResolvedAnswer, error) {
+	s, err := c.registerStream(host)
+	if err != nil {
+		return nil, err
+	}
+	c.Metrics.Streams.Alloc()
+	defer check.Close(s.logger, s)
+
+	p := append([]byte(host), 0)
+	if err := c.sendRelayCell(s.hop, CommandRelay, NewRelayCell(RelayResolve, s.id, p)); err != nil {
+		return nil, errors.Wrap(err, "could not send resolve cell")
+	}
+
+	deadline := time.Now().Add(streamConnectTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	r, err := s.receive(deadline, ctx.Done())
+	if err == errCancelled {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := r.RelayData()
+	if err != nil {
+		return nil, err
+	}
+	switch r.RelayCommand() {
+	case RelayResolved:
+		return ParseResolvedPayload(d)
+	case RelayEnd:
+		return nil, StreamEndedError{Reason: ParseEndPayload(d)}
+	default:
+		return nil, errors.New("unexpected reply to resolve")
+	}
+}
+
+// resolvedAnswers performs the lookup requested by a RELAY_RESOLVE cell for
+// host. Reverse lookups are performed for in-addr.arpa and ip6.arpa names.
+func resolvedAnswers(ctx context.Context, r *tordns.Resolver, host string) []ResolvedAnswer {
+	if ip, ok := tordns.ParseReverseName(host); ok {
+		a, err := r.LookupAddr(ctx, ip)
+		if err != nil {
+			return resolvedError(err)
+		}
+		ttl := resolvedTTL(a.TTL)
+		var answers []ResolvedAnswer
+		for _, name := range a.Names {
+			name = strings.TrimSuffix(name, ".")
+			if len(name) > 255 {
+				continue
+			}
+			answers = append(answers, ResolvedAnswer{
+				Type:  ResolvedTypeHostname,
+				Value: []byte(name),
+				TTL:   ttl,
+			})
+		}
+		if len(answers) == 0 {
+			return resolvedError(tordns.ErrNotFound)
+		}
+		return answers
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return resolvedIPAnswers([]net.IP{ip}, resolvedTTL(tordns.MaxTTL))
+	}
+
+	a, err := r.LookupHost(ctx, host)
+	if err != nil {
+		return resolvedError(err)
+	}
+	answers := resolvedIPAnswers(a.IPs, resolvedTTL(a.TTL))
+	if len(answers) == 0 {
+		return resolvedError(tordns.ErrNotFound)
+	}
+	return answers
+}
+
+// resolvedIPAnswers converts ips to answers, with IPv4 addresses first.
+func resolvedIPAnswers(ips []net.IP, ttl uint32) []ResolvedAnswer {
+	var v4, v6 []ResolvedAnswer
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = append(v4, ResolvedAnswer{Type: ResolvedTypeIPv4, Value: []byte(ip4), TTL: ttl})
+		} else if ip6 := ip.To16(); ip6 != nil {
+			v6 = append(v6, ResolvedAnswer{Type: ResolvedTypeIPv6, Value: []byte(ip6), TTL: ttl})
+		}
+	}
+	return append(v4, v6...)
+}
+
+// resolvedError returns the single error answer for err.
+func resolvedError(err error) []ResolvedAnswer {
+	if err == tordns.ErrNotFound {
+		return []ResolvedAnswer{{
+			Type: ResolvedTypeErrorNontransient,
+			TTL:  resolvedTTL(tordns.NegativeTTL),
+		}}
+	}
+	return []ResolvedAnswer{{Type: ResolvedTypeErrorTransient}}
+}
+
+func resolvedTTL(d time.Duration) uint32 {
+	return uint32(d / time.Second)
+}
@@ -0,0 +1,197 @@
+package pearl
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/check"
+	"github.com/mmcloughlin/pearl/tordns"
+	"github.com/mmcloughlin/pearl/torexitpolicy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubDNSBackend answers lookups from fixed tables.
+type stubDNSBackend struct {
+	hosts map[string][]net.IP
+	addrs map[string][]string
+}
+
+func (b stubDNSBackend) LookupHost(ctx context.Context, host string) (*tordns.Answer, error) {
+	ips, ok := b.hosts[host]
+	if !ok {
+		return nil, tordns.ErrNotFound
+	}
+	return &tordns.Answer{IPs: ips, TTL: time.Minute}, nil
+}
+
+func (b stubDNSBackend) LookupAddr(ctx context.Context, ip net.IP) (*tordns.Answer, error) {
+	names, ok := b.addrs[ip.String()]
+	if !ok {
+		return nil, tordns.ErrNotFound
+	}
+	return &tordns.Answer{Names: names, TTL: 2 * time.Hour}, nil
+}
+
+// countingDNSBackend counts the lookups made of a backend.
+type countingDNSBackend struct {
+	tordns.Backend
+	lookups int32
+}
+
+func (b *countingDNSBackend) LookupHost(ctx context.Context, host string) (*tordns.Answer, error) {
+	atomic.AddInt32(&b.lookups, 1)
+	return b.Backend.LookupHost(ctx, host)
+}
+
+func (b *countingDNSBackend) LookupAddr(ctx context.Context, ip net.IP) (*tordns.Answer, error) {
+	atomic.AddInt32(&b.lookups, 1)
+	return b.Backend.LookupAddr(ctx, ip)
+}
+
+var testDNSBackend = stubDNSBackend{
+	hosts: map[string][]net.IP{
+		"example.com": {net.ParseIP("2001:db8::1"), net.IPv4(192, 0, 2, 1)},
+	},
+	addrs: map[string][]string{
+		"192.0.2.1": {"example.com."},
+	},
+}
+
+func TestResolvedPayloadRoundTrip(t *testing.T) {
+	answers := []ResolvedAnswer{
+		{Type: ResolvedTypeIPv4, Value: []byte{192, 0, 2, 1}, TTL: 300},
+		{Type: ResolvedTypeIPv6, Value: net.ParseIP("2001:db8::1"), TTL: 3600},
+		{Type: ResolvedTypeHostname, Value: []byte("example.com"), TTL: 42},
+	}
+	p, err := ResolvedPayload(answers)
+	require.NoError(t, err)
+	assert.Len(t, p, 10+22+17)
+
+	got, err := ParseResolvedPayload(p)
+	require.NoError(t, err)
+	assert.Equal(t, answers, got)
+	assert.True(t, net.IPv4(192, 0, 2, 1).Equal(got[0].IP()))
+}
+
+func TestResolvedPayloadTruncatesToCell(t *testing.T) {
+	var answers []ResolvedAnswer
+	for i := 0; i < 100; i++ {
+		answers = append(answers, ResolvedAnswer{Type: ResolvedTypeIPv4, Value: []byte{10, 0, 0, byte(i)}})
+	}
+	p, err := ResolvedPayload(answers)
+	require.NoError(t, err)
+	assert.True(t, len(p) <= MaxRelayDataLength)
+	got, err := ParseResolvedPayload(p)
+	require.NoError(t, err)
+	assert.Len(t, got, MaxRelayDataLength/10)
+}
+
+func TestParseResolvedPayloadTruncated(t *testing.T) {
+	_, err := ParseResolvedPayload([]byte{byte(ResolvedTypeIPv4), 4, 1, 2, 3, 4, 0, 0})
+	assert.Error(t, err)
+}
+
+func TestResolvedAnswers(t *testing.T) {
+	r := tordns.NewResolver(testDNSBackend, 16)
+	ctx := context.Background()
+
+	cases := []struct {
+		Host    string
+		Answers []ResolvedAnswer
+	}{
+		{
+			Host: "example.com",
+			Answers: []ResolvedAnswer{
+				{Type: ResolvedTypeIPv4, Value: []byte{192, 0, 2, 1}, TTL: 300},
+				{Type: ResolvedTypeIPv6, Value: []byte(net.ParseIP("2001:db8::1")), TTL: 300},
+			},
+		},
+		{
+			Host: "1.2.0.192.in-addr.arpa",
+			Answers: []ResolvedAnswer{
+				{Type: ResolvedTypeHostname, Value: []byte("example.com"), TTL: 3600},
+			},
+		},
+		{
+			Host: "missing.example",
+			Answers: []ResolvedAnswer{
+				{Type: ResolvedTypeErrorNontransient, TTL: 60},
+			},
+		},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.Answers, resolvedAnswers(ctx, r, c.Host), c.Host)
+	}
+}
+
+func TestResolveEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	r := newTestRouter(t, torexitpolicy.AcceptAllPolicy)
+	r.resolver = tordns.NewResolver(testDNSBackend, 16)
+	exit, stopExit := startTestRelay(t, r)
+	defer stopExit()
+
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	c, err := client.BuildCircuit([]*HopSpec{exit})
+	require.NoError(t, err)
+	defer check.Close(client.logger, c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	answers, err := c.Resolve(ctx, "example.com")
+	require.NoError(t, err)
+	require.Len(t, answers, 2)
+	assert.True(t, net.IPv4(192, 0, 2, 1).Equal(answers[0].IP()))
+	assert.True(t, net.ParseIP("2001:db8::1").Equal(answers[1].IP()))
+
+	answers, err = c.Resolve(ctx, tordns.ReverseName(net.IPv4(192, 0, 2, 1)))
+	require.NoError(t, err)
+	require.Len(t, answers, 1)
+	assert.Equal(t, ResolvedTypeHostname, answers[0].Type)
+	assert.Equal(t, "example.com", string(answers[0].Value))
+
+	answers, err = c.Resolve(ctx, "missing.example")
+	require.NoError(t, err)
+	require.Len(t, answers, 1)
+	assert.True(t, answers[0].IsError())
+
+	// Hostnames in RELAY_BEGIN use the same resolver.
+	_, err = c.OpenStreamContext(ctx, "missing.example:80", 0)
+	assert.Equal(t, StreamEndedError{Reason: StreamCloseReasonResolvefailed}, err)
+}
+
+func TestResolveNonExit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	backend := &countingDNSBackend{Backend: testDNSBackend}
+	r := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	r.resolver = tordns.NewResolver(backend, 16)
+	exit, stopExit := startTestRelay(t, r)
+	defer stopExit()
+
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	c, err := client.BuildCircuit([]*HopSpec{exit})
+	require.NoError(t, err)
+	defer check.Close(client.logger, c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = c.Resolve(ctx, "example.com")
+	assert.Equal(t, StreamEndedError{Reason: StreamCloseReasonExitpolicy}, err)
+
+	_, err = c.OpenStreamContext(ctx, "example.com:80", 0)
+	assert.Equal(t, StreamEndedError{Reason: StreamCloseReasonExitpolicy}, err)
+
+	assert.Equal(t, int32(0), atomic.LoadInt32(&backend.lookups))
+}
@@ -1,15 +1,22 @@
 package pearl
 
 import (
+	"bytes"
 	"crypto/rsa"
 	"net"
+	"net/http"
+	"os"
 	"time"
 
+	"github.com/mmcloughlin/pearl/bwhistory"
+	"github.com/mmcloughlin/pearl/check"
 	"github.com/mmcloughlin/pearl/log"
 	"github.com/mmcloughlin/pearl/meta"
+	"github.com/mmcloughlin/pearl/ratelimit"
 	"github.com/mmcloughlin/pearl/torconfig"
 	"github.com/mmcloughlin/pearl/torcrypto"
 	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/mmcloughlin/pearl/tordns"
 	"github.com/mmcloughlin/pearl/torexitpolicy"
 	"github.com/pkg/errors"
 	"github.com/uber-go/tally"
@@ -22,6 +29,16 @@ type Router struct {
 	fingerprint []byte
 
 	connections *ConnectionManager
+	discovery   *AddressDiscovery
+	dir         http.Handler
+	resolver    *tordns.Resolver
+
+	// bandwidth limits all traffic and relayBandwidth limits relayed traffic
+	// only. Either is nil if unlimited.
+	bandwidth      *ratelimit.Limiter
+	relayBandwidth *ratelimit.Limiter
+
+	history *bwhistory.History
 
 	metrics *Metrics
 	scope   tally.Scope
@@ -39,15 +56,71 @@ func NewRouter(config *torconfig.Config, scope tally.Scope, logger log.Logger) (
 	}
 
 	logger = log.ForComponent(logger, "router")
-	return &Router{
+	history := bwhistory.NewHistory()
+	r := &Router{
 		config:      config,
 		startTime:   time.Now(),
 		fingerprint: fingerprint,
 		connections: NewConnectionManager(),
-		metrics:     NewMetrics(scope, logger),
+		discovery:   NewAddressDiscovery(),
+		history:     history,
+		metrics:     NewMetrics(scope, logger, history),
 		scope:       scope,
 		logger:      logger,
-	}, nil
+	}
+	r.loadState()
+	r.dir = NewDirHandler(r)
+
+	backend := config.DNSBackend
+	if backend == nil {
+		backend = tordns.SystemBackend{}
+	}
+	r.resolver = tordns.NewResolver(backend, tordns.DefaultCacheSize)
+
+	r.bandwidth = startLimiter(config.BandwidthAverage, config.BandwidthBurst)
+	r.relayBandwidth = startLimiter(config.RelayBandwidthAverage, config.RelayBandwidthBurst)
+
+	return r, nil
+}
+
+// loadState restores bandwidth history from the data directory, if any.
+func (r *Router) loadState() {
+	if r.config.Data == nil {
+		return
+	}
+	state, err := r.config.Data.State()
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = r.history.UnmarshalText(state)
+	}
+	if err != nil {
+		log.Err(r.logger, err, "failed to load state")
+	}
+}
+
+// SaveState writes bandwidth history to the data directory.
+func (r *Router) SaveState() error {
+	if r.config.Data == nil {
+		return nil
+	}
+	state, err := r.history.MarshalText()
+	if err != nil {
+		return err
+	}
+	return r.config.Data.SetState(state)
+}
+
+// startLimiter starts a bandwidth limiter with the given rate and burst in
+// bytes per second. Returns nil if rate is zero.
+func startLimiter(rate, burst int) *ratelimit.Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	l := ratelimit.NewLimiter(int64(rate), int64(burst))
+	l.Start()
+	return l
 }
 
 // IdentityKey returns the identity key of the router.
@@ -60,15 +133,96 @@ func (r *Router) Fingerprint() []byte {
 	return r.fingerprint
 }
 
-// Serve starts a listener and enters a main loop handling connections.
+// ExitPolicy returns the policy applied to exit streams from this router. If
+// none is configured, all exit traffic is rejected.
+func (r *Router) ExitPolicy() *torexitpolicy.Policy {
+	if r.config.ExitPolicy == nil {
+		return torexitpolicy.RejectAllPolicy
+	}
+	return r.config.ExitPolicy
+}
+
+// exitAllowed reports whether exit traffic to ip:port is permitted by the exit
+// policy. If private addresses are rejected, so are all currently known
+// addresses of the router.
+func (r *Router) exitAllowed(ip net.IP, port uint16) bool {
+	if r.config.ExitPolicyRejectPrivate {
+		for _, addr := range r.Addresses() {
+			if addr.Equal(ip) {
+				return false
+			}
+		}
+	}
+	return r.ExitPolicy().Allow(ip, port)
+}
+
+// extendTimeout returns the maximum time to wait for a circuit extend to
+// complete.
+func (r *Router) extendTimeout() time.Duration {
+	if r.config.ExtendTimeout == 0 {
+		return torconfig.DefaultExtendTimeout
+	}
+	return r.config.ExtendTimeout
+}
+
+// extendAllowed reports whether circuits may be extended to addr.
+func (r *Router) extendAllowed(addr net.Addr) bool {
+	if r.config.ExtendAllowPrivateAddresses {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	return !IsPrivateAddress(tcp.IP)
+}
+
+// Serve starts listeners on all ORPorts, and the DirPort if configured, and
+// handles connections until one of them fails.
 func (r *Router) Serve() error {
-	laddr := r.config.ORBindAddr()
-	r.logger.With("laddr", laddr).Info("creating listener")
-	ln, err := net.Listen("tcp", laddr)
-	if err != nil {
-		return errors.Wrap(err, "could not create listener")
+	laddrs := r.config.ORListenAddrs()
+	if len(laddrs) == 0 {
+		return errors.New("no ORPorts to listen on")
+	}
+
+	var lns []net.Listener
+	defer func() {
+		for _, ln := range lns {
+			check.Close(r.logger, ln)
+		}
+	}()
+
+	for _, laddr := range laddrs {
+		r.logger.With("laddr", laddr).Info("creating listener")
+		ln, err := net.ListenTCP(listenNetwork(laddr.IP), laddr)
+		if err != nil {
+			return errors.Wrap(err, "could not create listener")
+		}
+		lns = append(lns, ln)
+	}
+
+	errc := make(chan error, len(lns)+1)
+	for _, ln := range lns {
+		go func(ln net.Listener) { errc <- r.serve(ln) }(ln)
+	}
+	if r.config.DirPort != 0 {
+		go func() { errc <- r.ServeDir() }()
 	}
+	return <-errc
+}
 
+// listenNetwork returns the network to listen on for ip. Unspecified
+// addresses listen on IPv4 only, so that they do not conflict with IPv6
+// ORPorts on the same port.
+func listenNetwork(ip net.IP) string {
+	if ip != nil && ip.To4() == nil {
+		return "tcp6"
+	}
+	return "tcp4"
+}
+
+// serve accepts OR connections on ln.
+func (r *Router) serve(ln net.Listener) error {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -110,41 +264,239 @@ func (r *Router) Connect(raddr string) (*Connection, error) {
 
 // Connection returns a connection to the indicated relay. Returns an existing
 // connection, if it exists. Otherwise opens a connection and returns it.
+// Concurrent calls for the same relay share a single connection attempt.
+//
+// If the hint also specifies an Ed25519 identity, the connected peer must
+// have authenticated with it.
 func (r *Router) Connection(hint ConnectionHint) (*Connection, error) {
 	fp, err := hint.Fingerprint()
 	if err != nil {
 		return nil, errors.Wrap(err, "missing fingerprint from connection hint")
 	}
 
-	if conn, ok := r.connections.Connection(fp); ok {
-		return conn, nil
+	conn, err := r.connection(fp, hint)
+	if err != nil {
+		return nil, err
 	}
 
-	addrs, err := hint.Addresses()
-	if err != nil {
-		return nil, errors.Wrap(err, "no addresses provided")
+	if ed, ok := hint.(Ed25519Identified); ok && ed.Ed25519Identity() != nil {
+		if !bytes.Equal(ed.Ed25519Identity(), conn.Ed25519Identity()) {
+			return nil, errors.Wrap(ErrIdentityMismatch, "ed25519 identity")
+		}
 	}
 
-	for _, addr := range addrs {
-		raddr := addr.String()
-		conn, err := r.Connect(raddr)
+	return conn, nil
+}
+
+// connection returns a connection to the relay with fingerprint fp, dialing
+// the addresses in hint if there is no existing connection.
+func (r *Router) connection(fp Fingerprint, hint ConnectionHint) (*Connection, error) {
+	return r.connections.Dial(fp, func() (*Connection, error) {
+		addrs, err := hint.Addresses()
 		if err != nil {
-			log.WithErr(r.logger, err).Warn("connection attempt failed")
-			continue
+			return nil, errors.Wrap(err, "no addresses provided")
+		}
+
+		result := errors.New("all connection attempts failed")
+		for _, addr := range addrs {
+			raddr := addr.String()
+			conn, err := r.Connect(raddr)
+			if err != nil {
+				log.WithErr(r.logger, err).Warn("connection attempt failed")
+				continue
+			}
+
+			// Ensure we reached the relay that was asked for.
+			peer, err := conn.Fingerprint()
+			if err != nil || peer != fp {
+				r.logger.With("raddr", raddr).Warn("peer identity mismatch")
+				check.Close(r.logger, conn)
+				result = ErrIdentityMismatch
+				continue
+			}
+
+			return conn, nil
+		}
+
+		return nil, result
+	})
+}
+
+// BuildCircuit builds an origin circuit through the given hops. The first hop
+// is created with the ntor handshake if its ntor key is known, otherwise with
+// CREATE_FAST.
+func (r *Router) BuildCircuit(hops []*HopSpec) (*OriginCircuit, error) {
+	if len(hops) == 0 {
+		return nil, errors.New("no hops specified")
+	}
+
+	conn, err := r.Connection(hops[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to first hop")
+	}
+
+	c, err := NewOriginCircuit(conn, r.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if hops[0].NtorKey == ([32]byte{}) {
+		err = c.CreateFast()
+	} else {
+		err = c.Create(hops[0])
+	}
+	if err != nil {
+		check.Close(r.logger, c)
+		return nil, errors.Wrap(err, "failed to create circuit")
+	}
+
+	for _, hop := range hops[1:] {
+		if err := c.Extend(hop); err != nil {
+			check.Close(r.logger, c)
+			return nil, errors.Wrap(err, "failed to extend circuit")
+		}
+	}
+
+	return c, nil
+}
+
+// bandwidthLimits returns the rate and burst available for relayed traffic,
+// taking the lower of the overall and relay-only limits.
+func (r *Router) bandwidthLimits() (int, int) {
+	avg, burst := r.config.BandwidthAverage, r.config.BandwidthBurst
+	if ravg := r.config.RelayBandwidthAverage; ravg > 0 && ravg < avg {
+		avg = ravg
+	}
+	if rburst := r.config.RelayBandwidthBurst; rburst > 0 && rburst < burst {
+		burst = rburst
+	}
+	return avg, burst
+}
+
+// Address returns the public IP address of the router. This is the configured
+// address if there is one, otherwise the address learned from peers, falling
+// back to the configured FallbackIP. Returns nil if none is known.
+func (r *Router) Address() net.IP {
+	if r.config.IP != nil {
+		return r.config.IP
+	}
+	if ip := r.discovery.Address(); ip != nil {
+		return ip
+	}
+	return r.config.FallbackIP
+}
+
+// Addresses returns all known public addresses of the router. An IPv6 address
+// learned from peers is included if none is configured.
+func (r *Router) Addresses() []net.IP {
+	var addrs []net.IP
+	if ip := r.Address(); ip != nil {
+		addrs = append(addrs, ip)
+	}
+	ipv6 := r.config.AdvertisedIPv6ORAddrs()
+	for _, addr := range ipv6 {
+		addrs = append(addrs, addr.IP)
+	}
+	if ip := r.discovery.AddressIPv6(); ip != nil && len(ipv6) == 0 {
+		addrs = append(addrs, ip)
+	}
+	return addrs
+}
+
+// ProbeAddress connects to the relays at raddrs so that they report the
+// address they see us at, closing the connections once the handshake is
+// complete. Returns the discovered IPv4 address, or nil if peers have not
+// reached a quorum.
+func (r *Router) ProbeAddress(raddrs []string) net.IP {
+	done := make(chan struct{}, len(raddrs))
+	for _, raddr := range raddrs {
+		go func(raddr string) {
+			defer func() { done <- struct{}{} }()
+			c, err := r.Connect(raddr)
+			if err != nil {
+				log.Err(r.logger.With("raddr", raddr), err, "address probe failed")
+				return
+			}
+			defer check.Close(r.logger, c)
+			fp, err := c.Fingerprint()
+			if err != nil {
+				return
+			}
+			r.discovery.Observe(fp, c.observed)
+		}(raddr)
+	}
+
+	timeout := time.NewTimer(addressProbeTimeout)
+	defer timeout.Stop()
+	for range raddrs {
+		select {
+		case <-done:
+		case <-timeout.C:
+			return r.discovery.Address()
+		}
+	}
+	return r.discovery.Address()
+}
+
+// DiscoverAddress learns the router's address by probing the relays at raddrs
+// immediately, and again periodically so that their votes do not expire. It
+// does not return.
+func (r *Router) DiscoverAddress(raddrs []string) {
+	for {
+		interval := AddressProbeInterval
+		if ip := r.ProbeAddress(raddrs); ip != nil {
+			r.logger.With("ip", ip).Info("discovered address")
+		} else {
+			r.logger.Warn("could not discover address")
+			interval = addressProbeRetry
 		}
-		return conn, nil
+		time.Sleep(interval)
+	}
+}
+
+// observeNetInfo processes the NETINFO cell received from an authenticated
+// peer during the handshake. Peer timestamps are checked for clock skew, and
+// on connections we initiated the address the peer saw us at is recorded on
+// the connection. Only ProbeAddress counts it as a vote, since other outbound
+// connections go to relays chosen by clients in EXTEND cells.
+func (r *Router) observeNetInfo(c *Connection, ni *NetInfoCell, outbound bool) {
+	if ni == nil || !c.PeerAuthenticated() {
+		return
+	}
+
+	skew, warn := clockSkew(ni.Timestamp, time.Now())
+	r.metrics.ClockSkew.Update(skew.Seconds())
+	if warn {
+		r.metrics.ClockSkewWarnings.Inc(1)
+		c.logger.With("skew", skew).Warn("clock skew with peer exceeds threshold")
 	}
 
-	return nil, errors.New("all connection attempts failed")
+	if outbound {
+		c.observed = ni.ReceiverAddress
+	}
 }
 
 // Descriptor returns a server descriptor for this router.
 func (r *Router) Descriptor() (*tordir.ServerDescriptor, error) {
+	return r.descriptor(time.Now())
+}
+
+// descriptor builds a server descriptor published at the given time.
+func (r *Router) descriptor(published time.Time) (*tordir.ServerDescriptor, error) {
 	s := tordir.NewServerDescriptor()
 
-	if err := s.SetRouter(r.config.Nickname, r.config.IP, r.config.ORPort, 0); err != nil {
+	ip := r.Address()
+	if ip == nil {
+		return nil, errors.New("relay address unknown")
+	}
+	if err := s.SetRouter(r.config.Nickname, ip, r.config.AdvertisedORPort(), r.config.DirPort); err != nil {
 		return nil, err
 	}
+	for _, addr := range r.config.AdvertisedIPv6ORAddrs() {
+		if err := s.AddORAddress(addr); err != nil {
+			return nil, err
+		}
+	}
 	if err := s.SetSigningKey(r.IdentityKey()); err != nil {
 		return nil, err
 	}
@@ -153,14 +505,74 @@ func (r *Router) Descriptor() (*tordir.ServerDescriptor, error) {
 	}
 
 	s.SetNtorOnionKey(r.config.Keys.Ntor)
+	if err := r.setDescriptorEd25519(s); err != nil {
+		return nil, err
+	}
 	s.SetPlatform(r.config.Platform)
 	s.SetContact(r.config.Contact)
-	// TODO(mbm): publish real bandwidth values
-	s.SetBandwidth(r.config.BandwidthAverage, r.config.BandwidthBurst, r.config.BandwidthAverage)
-	s.SetPublishedTime(time.Now())
+	avg, burst := r.bandwidthLimits()
+	s.SetBandwidth(avg, burst, r.history.Observed())
+	s.SetPublishedTime(published)
 	s.SetUptime(time.Since(r.startTime))
-	s.SetExitPolicy(torexitpolicy.RejectAllPolicy)
+	s.SetExitPolicy(r.ExitPolicy())
 	s.SetProtocols(meta.Protocols)
+	s.SetTunnelledDirServer()
 
 	return s, nil
 }
+
+// setDescriptorEd25519 adds the Ed25519 identity and cross-certificates to the
+// descriptor, if the router has Ed25519 keys.
+func (r *Router) setDescriptorEd25519(s *tordir.ServerDescriptor) error {
+	k := r.config.Keys
+	if k.Ed25519Identity == nil || k.Ed25519Signing == nil || k.Ed25519SigningCert == nil {
+		return nil
+	}
+
+	if err := s.SetEd25519Identity(k.Ed25519SigningCert, k.Ed25519Signing); err != nil {
+		return err
+	}
+	s.SetNtorOnionKeyCrosscert(k.Ntor, k.Ed25519Identity.Public, k.Ed25519SigningCert.Expiration)
+	return s.SetOnionKeyCrosscert(k.Onion, &k.Identity.PublicKey, k.Ed25519Identity.Public)
+}
+
+// ExtraInfo returns an extra-info document for this router, published at the
+// given time. The time must match the corresponding server descriptor.
+func (r *Router) ExtraInfo(published time.Time) (*tordir.ExtraInfo, error) {
+	e := tordir.NewExtraInfo()
+	if err := e.SetIdentity(r.config.Nickname, r.IdentityKey()); err != nil {
+		return nil, err
+	}
+	e.SetPublishedTime(published)
+
+	end, read := r.history.Read.History()
+	e.SetReadHistory(end, bwhistory.Interval, read)
+	end, write := r.history.Write.History()
+	e.SetWriteHistory(end, bwhistory.Interval, write)
+
+	return e, nil
+}
+
+// Descriptors returns a server descriptor and its linked extra-info document.
+func (r *Router) Descriptors() (*tordir.ServerDescriptor, *tordir.Document, error) {
+	now := time.Now()
+
+	extra, err := r.ExtraInfo(now)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err := extra.Document()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	desc, err := r.descriptor(now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := desc.SetExtraInfoDigest(doc); err != nil {
+		return nil, nil, err
+	}
+
+	return desc, doc, nil
+}
@@ -0,0 +1,405 @@
+package pearl
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/bwhistory"
+	"github.com/mmcloughlin/pearl/check"
+	"github.com/mmcloughlin/pearl/ratelimit"
+	"github.com/mmcloughlin/pearl/torconfig"
+	"github.com/mmcloughlin/pearl/tordir"
+	"github.com/mmcloughlin/pearl/torexitpolicy"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouterBandwidthLimits(t *testing.T) {
+	r := newTestRouter(t, nil)
+	r.config.BandwidthAverage = 100
+	r.config.BandwidthBurst = 200
+
+	avg, burst := r.bandwidthLimits()
+	assert.Equal(t, 100, avg)
+	assert.Equal(t, 200, burst)
+
+	r.config.RelayBandwidthAverage = 50
+	r.config.RelayBandwidthBurst = 300
+	avg, burst = r.bandwidthLimits()
+	assert.Equal(t, 50, avg)
+	assert.Equal(t, 200, burst)
+}
+
+func TestRouterBandwidthLimited(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	const rate = 128 << 10
+	exit := newTestRouter(t, torexitpolicy.AcceptAllPolicy)
+	exit.relayBandwidth = startLimiter(rate, rate)
+	defer exit.relayBandwidth.Stop()
+	hop, stopHop := startTestRelay(t, exit)
+	defer stopHop()
+	echo, stopEcho := startEchoServer(t)
+	defer stopEcho()
+
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	d := NewDialer(client, DialerOptions{Paths: StaticPath{hop}})
+	defer check.Close(client.logger, d)
+
+	conn, err := d.Dial("tcp", echo)
+	require.NoError(t, err)
+	defer check.Close(client.logger, conn)
+
+	// Twice the burst must pass through the exit in each direction, so the
+	// transfer takes at least a second.
+	msg := make([]byte, 2*rate)
+	start := time.Now()
+	go func() {
+		_, err := conn.Write(msg)
+		assert.NoError(t, err)
+	}()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(20*time.Second)))
+	_, err = io.ReadFull(conn, make([]byte, len(msg)))
+	require.NoError(t, err)
+	assert.True(t, time.Since(start) > 900*time.Millisecond)
+}
+
+func TestRouterRelayBandwidthExcludesDirectory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	// Neither limiter is refilled. The directory cache has no relay tokens
+	// at all, so its directory stream would stall if it were charged.
+	const tokens = 1 << 30
+	middle := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	middle.relayBandwidth = ratelimit.NewLimiter(tokens, tokens)
+	r, doc, cleanup := newTestDirRouter(t)
+	defer cleanup()
+	r.relayBandwidth = ratelimit.NewLimiter(tokens, tokens)
+	r.relayBandwidth.Read.Consume(2 * tokens)
+	r.relayBandwidth.Write.Consume(2 * tokens)
+
+	hop, stopMiddle := startTestRelay(t, middle)
+	defer stopMiddle()
+	dircache, stopDircache := startTestRelay(t, r)
+	defer stopDircache()
+	path := []*HopSpec{hop, dircache}
+	client := newTestRouter(t, torexitpolicy.RejectAllPolicy)
+	c, err := client.BuildCircuit(path)
+	require.NoError(t, err)
+	defer check.Close(client.logger, c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s, err := c.OpenDirStream(ctx)
+	require.NoError(t, err)
+	defer check.Close(client.logger, s)
+	require.NoError(t, s.SetDeadline(time.Now().Add(10*time.Second)))
+
+	_, err = io.WriteString(s, "GET /tor/server/authority HTTP/1.0\r\n\r\n")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(s)
+	require.NoError(t, err)
+	assert.True(t, bytes.HasSuffix(body, doc))
+
+	// Cells forwarded by the middle relay were charged in both directions.
+	assert.True(t, middle.relayBandwidth.Read.Tokens() < tokens)
+	assert.True(t, middle.relayBandwidth.Write.Tokens() < tokens)
+}
+
+func TestRouterStateRestored(t *testing.T) {
+	r := newTestRouter(t, nil)
+	dir, err := ioutil.TempDir("", "pearlstatetest")
+	require.NoError(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	data := torconfig.NewDataDirectory(dir)
+	r.config.Data = data
+
+	// No state file yet.
+	r.loadState()
+	assert.Equal(t, 0, r.history.Observed())
+
+	end := time.Now().Truncate(bwhistory.Interval).UTC().Format(bwhistory.TimeFormat)
+	state := "BWHistoryReadEnds " + end + "\n" +
+		"BWHistoryReadInterval 900\n" +
+		"BWHistoryReadValues 1000000\n" +
+		"BWHistoryReadMaxima 4000\n" +
+		"BWHistoryWriteEnds " + end + "\n" +
+		"BWHistoryWriteInterval 900\n" +
+		"BWHistoryWriteValues 2000000\n" +
+		"BWHistoryWriteMaxima 3000\n"
+	require.NoError(t, data.SetState([]byte(state)))
+
+	r.loadState()
+	assert.Equal(t, 3000, r.history.Observed())
+
+	desc, err := r.Descriptor()
+	require.NoError(t, err)
+	doc, err := desc.Document()
+	require.NoError(t, err)
+	assert.Contains(t, string(doc.Encode()), "\nbandwidth 0 0 3000\n")
+
+	require.NoError(t, r.SaveState())
+	saved, err := data.State()
+	require.NoError(t, err)
+	assert.Contains(t, string(saved), "BWHistoryWriteMaxima 3000\n")
+}
+
+func TestRouterDescriptors(t *testing.T) {
+	r := newTestRouter(t, nil)
+
+	desc, extra, err := r.Descriptors()
+	require.NoError(t, err)
+	doc, err := desc.Document()
+	require.NoError(t, err)
+
+	published := func(d *tordir.Document) string {
+		for _, line := range strings.Split(string(d.Encode()), "\n") {
+			if strings.HasPrefix(line, "published ") {
+				return line
+			}
+		}
+		return ""
+	}
+	assert.NotEmpty(t, published(extra))
+	assert.Equal(t, published(doc), published(extra))
+	assert.Contains(t, string(doc.Encode()), "\nextra-info-digest ")
+	assert.Contains(t, string(extra.Encode()), "\nread-history ")
+	assert.Contains(t, string(extra.Encode()), "\nwrite-history ")
+}
+
+func TestRouterDescriptorEd25519(t *testing.T) {
+	r := newTestRouter(t, nil)
+
+	desc, err := r.Descriptor()
+	require.NoError(t, err)
+	doc, err := desc.Document()
+	require.NoError(t, err)
+
+	lines := strings.Split(string(doc.Encode()), "\n")
+	assert.Equal(t, "identity-ed25519", lines[1])
+	for _, keyword := range []string{
+		"master-key-ed25519 ",
+		"ntor-onion-key-crosscert ",
+		"onion-key-crosscert",
+		"router-sig-ed25519 ",
+	} {
+		assert.Contains(t, string(doc.Encode()), "\n"+keyword)
+	}
+}
+
+func TestRouterDescriptorDiscoveredAddress(t *testing.T) {
+	r := newTestRouter(t, nil)
+	r.config.IP = nil
+
+	_, err := r.Descriptor()
+	assert.Error(t, err)
+
+	ip := net.IPv4(1, 2, 3, 4)
+	for i := 0; i < AddressQuorum; i++ {
+		r.discovery.Observe(Fingerprint{byte(i)}, ip)
+	}
+	desc, err := r.Descriptor()
+	require.NoError(t, err)
+	doc, err := desc.Document()
+	require.NoError(t, err)
+	assert.Contains(t, string(doc.Encode()), "router test 1.2.3.4 ")
+}
+
+func TestRouterAddressFallback(t *testing.T) {
+	r := newTestRouter(t, nil)
+	r.config.IP = nil
+	assert.Nil(t, r.Address())
+
+	loopback := net.IPv4(127, 0, 0, 1)
+	r.config.FallbackIP = loopback
+	assert.True(t, loopback.Equal(r.Address()))
+
+	// A discovered address takes precedence.
+	ip := net.IPv4(1, 2, 3, 4)
+	for i := 0; i < AddressQuorum; i++ {
+		r.discovery.Observe(Fingerprint{byte(i)}, ip)
+	}
+	assert.True(t, ip.Equal(r.Address()))
+}
+
+func TestRouterProbeAddress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	var raddrs []string
+	for i := 0; i < AddressQuorum; i++ {
+		hop, stop := startTestRelay(t, newTestRouter(t, nil))
+		defer stop()
+		raddrs = append(raddrs, hop.Addrs[0].String())
+	}
+
+	// Started without an address, the router cannot describe itself until
+	// it has probed its peers.
+	r := newTestRouter(t, nil)
+	r.config.IP = nil
+	r.discovery.allowPrivate = true
+	_, err := r.Descriptor()
+	require.Error(t, err)
+
+	ip := r.ProbeAddress(raddrs)
+	require.NotNil(t, ip)
+	assert.True(t, net.IPv4(127, 0, 0, 1).Equal(ip))
+
+	desc, err := r.Descriptor()
+	require.NoError(t, err)
+	doc, err := desc.Document()
+	require.NoError(t, err)
+	assert.Contains(t, string(doc.Encode()), "router test 127.0.0.1 ")
+}
+
+func TestRouterExtendDoesNotVoteAddress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end to end test")
+	}
+
+	var hops []*HopSpec
+	var raddrs []string
+	for i := 0; i < AddressQuorum; i++ {
+		hop, stop := startTestRelay(t, newTestRouter(t, nil))
+		defer stop()
+		hops = append(hops, hop)
+		raddrs = append(raddrs, hop.Addrs[0].String())
+	}
+
+	r := newTestRouter(t, nil)
+	r.config.IP = nil
+	r.discovery.allowPrivate = true
+
+	// Connections opened for EXTEND cells go to relays chosen by clients, so
+	// they must not be able to decide our address.
+	for _, hop := range hops {
+		conn, err := r.Connection(hop)
+		require.NoError(t, err)
+		require.NotNil(t, conn.observed)
+	}
+	assert.Nil(t, r.Address())
+
+	ip := r.ProbeAddress(raddrs)
+	assert.True(t, net.IPv4(127, 0, 0, 1).Equal(ip))
+}
+
+func TestRouterExitAllowedOwnAddress(t *testing.T) {
+	r := newTestRouter(t, torexitpolicy.AcceptAllPolicy)
+	r.config.IP = nil
+	r.config.ExitPolicyRejectPrivate = true
+
+	ip := net.IPv4(1, 2, 3, 4)
+	assert.True(t, r.exitAllowed(ip, 443))
+
+	// The address learned from peers is rejected once known.
+	for i := 0; i < AddressQuorum; i++ {
+		r.discovery.Observe(Fingerprint{byte(i)}, ip)
+	}
+	assert.False(t, r.exitAllowed(ip, 443))
+	assert.True(t, r.exitAllowed(net.IPv4(1, 2, 3, 5), 443))
+
+	r.config.ExitPolicyRejectPrivate = false
+	assert.True(t, r.exitAllowed(ip, 443))
+}
+
+func TestRouterDescriptorORAddress(t *testing.T) {
+	r := newTestRouter(t, nil)
+	r.config.ORPort = 9001
+	r.config.ORPorts = []torconfig.ORPortConfig{
+		{IP: net.ParseIP("2001:db8::1"), Port: 9002},
+		{IP: net.ParseIP("2001:db8::2"), Port: 9003, NoAdvertise: true},
+	}
+
+	desc, err := r.Descriptor()
+	require.NoError(t, err)
+	doc, err := desc.Document()
+	require.NoError(t, err)
+	enc := string(doc.Encode())
+	assert.Contains(t, enc, "router test 127.0.0.1 9001 ")
+	assert.Contains(t, enc, "\nor-address [2001:db8::1]:9002\n")
+	assert.NotContains(t, enc, "2001:db8::2")
+
+	assert.Equal(t, []net.IP{r.config.IP, net.ParseIP("2001:db8::1")}, r.Addresses())
+}
+
+func TestRouterDescriptorDirPort(t *testing.T) {
+	r := newTestRouter(t, nil)
+	r.config.ORPort = 9001
+	r.config.DirPort = 9030
+
+	desc, err := r.Descriptor()
+	require.NoError(t, err)
+	doc, err := desc.Document()
+	require.NoError(t, err)
+	assert.Contains(t, string(doc.Encode()), "router test 127.0.0.1 9001 0 9030\n")
+}
+
+func TestRouterConnectionExtend2IPv6Only(t *testing.T) {
+	server := newTestRouter(t, nil)
+	ln, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 loopback unavailable")
+	}
+	defer check.Close(server.logger, ln)
+	go func() { _ = server.serve(ln) }()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	ext := NewExtend2Payload([]LinkSpec{
+		NewLinkSpecLegacyID(server.Fingerprint()),
+		NewLinkSpecTCP(addr.IP, uint16(addr.Port)),
+	}, HandshakeTypeNTOR, nil)
+
+	client := newTestRouter(t, nil)
+	conn, err := client.Connection(ext)
+	require.NoError(t, err)
+	fp, err := conn.Fingerprint()
+	require.NoError(t, err)
+	assert.Equal(t, server.Fingerprint(), fp[:])
+}
+
+func TestRouterConnectionEd25519Identity(t *testing.T) {
+	server := newTestRouter(t, nil)
+	hop, stopHop := startTestRelay(t, server)
+	defer stopHop()
+	client := newTestRouter(t, nil)
+
+	conn, err := client.Connection(hop)
+	require.NoError(t, err)
+	assert.Equal(t, server.config.Keys.Ed25519Identity.Public[:], conn.Ed25519Identity())
+
+	// The server records the client's identity once it has authenticated.
+	fp, err := NewFingerprintFromBytes(client.Fingerprint())
+	require.NoError(t, err)
+	inbound, ok := server.connections.Connection(fp)
+	for deadline := time.Now().Add(5 * time.Second); !ok && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		inbound, ok = server.connections.Connection(fp)
+	}
+	require.True(t, ok)
+	assert.Equal(t, client.config.Keys.Ed25519Identity.Public[:], inbound.Ed25519Identity())
+}
+
+func TestRouterConnectionEd25519IdentityMismatch(t *testing.T) {
+	server := newTestRouter(t, nil)
+	hop, stopHop := startTestRelay(t, server)
+	defer stopHop()
+	client := newTestRouter(t, nil)
+
+	hop.EdIdentity = make([]byte, 32)
+	_, err := client.Connection(hop)
+	assert.Equal(t, ErrIdentityMismatch, errors.Cause(err))
+}
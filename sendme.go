@@ -0,0 +1,214 @@
+package pearl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/pkg/errors"
+)
+
+// Flow control window parameters.
+//
+// Reference: https://github.com/torproject/torspec/blob/0fd44031bfd6c6c822bfb194e54a05118c9625e2/tor-spec.txt#L1710-L1729
+//
+//	   Each client and relay keeps two 'windows' for each circuit: a
+//	   'packaging window' that tracks how many RELAY_DATA cells the edge is
+//	   allowed to originate at the edge, and a 'delivery window' that tracks
+//	   how many RELAY_DATA cells it is willing to deliver to streams outside
+//	   the network.  Each 'window' value is initially set based on the
+//	   consensus parameter 'circwindow' in the range [100, 1000] (default
+//	   1000).  Each time a RELAY_DATA cell is packaged or delivered, the
+//	   appropriate window is decremented.  When the packaging window
+//	   reaches 0, the edge stops reading from TCP connections for all
+//	   streams on the corresponding circuit, and sends no more RELAY_DATA
+//	   cells until receiving a RELAY_SENDME cell.
+//
+//	   Whenever the delivery window falls below CIRCWINDOW_START - 100
+//	   (900), the OR or OP sends a RELAY_SENDME cell towards the edge, and
+//	   increments the delivery window by 100.
+//
+//	   ...
+//
+//	   The stream-level windows start at 500 and are incremented by 50 in
+//	   the same manner.
+//
+const (
+	CircuitWindowStart     = 1000
+	CircuitWindowIncrement = 100
+	StreamWindowStart      = 500
+	StreamWindowIncrement  = 50
+)
+
+// Versions of the SENDME cell payload.
+const (
+	SendmeVersion0 = 0
+	SendmeVersion1 = 1
+)
+
+// ErrWindowOverflow is returned when a SENDME would increase a package window
+// beyond its initial size.
+var ErrWindowOverflow = errors.New("flow control window overflow")
+
+// SendmePayload is the payload of a RELAY_SENDME cell.
+//
+// Reference: https://github.com/torproject/torspec/blob/0fd44031bfd6c6c822bfb194e54a05118c9625e2/tor-spec.txt#L1757-L1774
+//
+//	   The RELAY_SENDME payload contains the following:
+//
+//	      VERSION     [1 byte]
+//	      DATA_LEN    [2 bytes]
+//	      DATA        [DATA_LEN bytes]
+//
+//	   The VERSION tells us what is expected in the DATA section of length
+//	   DATA_LEN and how to handle it. The recognized values are:
+//
+//	      0x00: The rest of the payload should be ignored.
+//
+//	      0x01: Authenticated SENDME. The DATA section MUST contain:
+//
+//	         DIGEST   [20 bytes]
+//
+//	         If the DATA_LEN value is less than 20 bytes, the cell should be
+//	         dropped and the circuit closed. If the value is more than 20 bytes,
+//	         then the first 20 bytes should be read to get the DIGEST value.
+//
+type SendmePayload struct {
+	Version byte
+	Digest  []byte
+}
+
+// NewSendmeV1Payload builds an authenticated SENDME payload.
+func NewSendmeV1Payload(digest []byte) *SendmePayload {
+	return &SendmePayload{
+		Version: SendmeVersion1,
+		Digest:  digest,
+	}
+}
+
+// UnmarshalBinary parses a SENDME payload. An empty payload is interpreted
+// as a version 0 SENDME.
+func (s *SendmePayload) UnmarshalBinary(p []byte) error {
+	s.Version = SendmeVersion0
+	s.Digest = nil
+
+	if len(p) == 0 {
+		return nil
+	}
+
+	s.Version = p[0]
+	if s.Version != SendmeVersion1 {
+		return nil
+	}
+
+	if len(p) < 3 {
+		return ErrShortCellPayload
+	}
+	n := int(binary.BigEndian.Uint16(p[1:]))
+	p = p[3:]
+	if n < torcrypto.HashSize || len(p) < torcrypto.HashSize {
+		return errors.New("short sendme digest")
+	}
+	s.Digest = p[:torcrypto.HashSize]
+
+	return nil
+}
+
+// MarshalBinary encodes the SENDME payload.
+func (s *SendmePayload) MarshalBinary() ([]byte, error) {
+	switch s.Version {
+	case SendmeVersion0:
+		return []byte{}, nil
+	case SendmeVersion1:
+		if len(s.Digest) != torcrypto.HashSize {
+			return nil, errors.New("sendme digest has incorrect length")
+		}
+		p := make([]byte, 3+torcrypto.HashSize)
+		p[0] = SendmeVersion1
+		binary.BigEndian.PutUint16(p[1:], torcrypto.HashSize)
+		copy(p[3:], s.Digest)
+		return p, nil
+	default:
+		return nil, errors.New("unknown sendme version")
+	}
+}
+
+// Authenticates reports whether the SENDME acknowledges the cell with the
+// given digest. Version 0 SENDMEs carry no digest and are always accepted.
+func (s *SendmePayload) Authenticates(digest []byte) bool {
+	if s.Version != SendmeVersion1 {
+		return true
+	}
+	return bytes.Equal(s.Digest, digest)
+}
+
+// packageWindow is a flow control window limiting how many cells may be
+// packaged. Take blocks until the window is open.
+type packageWindow struct {
+	mu    sync.Mutex
+	n     int
+	max   int
+	avail chan struct{}
+}
+
+func newPackageWindow(n int) *packageWindow {
+	return &packageWindow{
+		n:     n,
+		max:   n,
+		avail: make(chan struct{}, 1),
+	}
+}
+
+// Take decrements the window, blocking while it is empty. Returns io.EOF if
+// done is closed first.
+func (w *packageWindow) Take(done <-chan struct{}) error {
+	for {
+		w.mu.Lock()
+		if w.n > 0 {
+			w.n--
+			more := w.n > 0
+			w.mu.Unlock()
+			if more {
+				w.signal()
+			}
+			return nil
+		}
+		w.mu.Unlock()
+
+		select {
+		case <-done:
+			return io.EOF
+		case <-w.avail:
+		}
+	}
+}
+
+// Give increments the window by n. Returns ErrWindowOverflow if the window
+// would exceed its initial size.
+func (w *packageWindow) Give(n int) error {
+	w.mu.Lock()
+	if w.n+n > w.max {
+		w.mu.Unlock()
+		return ErrWindowOverflow
+	}
+	w.n += n
+	w.mu.Unlock()
+	w.signal()
+	return nil
+}
+
+// Size returns the current size of the window.
+func (w *packageWindow) Size() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.n
+}
+
+func (w *packageWindow) signal() {
+	select {
+	case w.avail <- struct{}{}:
+	default:
+	}
+}
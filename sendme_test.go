@@ -0,0 +1,81 @@
+package pearl
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSendmePayloadV1RoundTrip(t *testing.T) {
+	digest := torcrypto.Rand(torcrypto.HashSize)
+	p, err := NewSendmeV1Payload(digest).MarshalBinary()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 0, 20}, p[:3])
+
+	s := &SendmePayload{}
+	require.NoError(t, s.UnmarshalBinary(p))
+	assert.Equal(t, byte(SendmeVersion1), s.Version)
+	assert.Equal(t, digest, s.Digest)
+	assert.True(t, s.Authenticates(digest))
+	assert.False(t, s.Authenticates(make([]byte, torcrypto.HashSize)))
+}
+
+func TestSendmePayloadV0(t *testing.T) {
+	s := &SendmePayload{}
+	require.NoError(t, s.UnmarshalBinary(nil))
+	assert.Equal(t, byte(SendmeVersion0), s.Version)
+	assert.True(t, s.Authenticates(nil))
+
+	p, err := s.MarshalBinary()
+	require.NoError(t, err)
+	assert.Len(t, p, 0)
+}
+
+func TestSendmePayloadShortDigest(t *testing.T) {
+	s := &SendmePayload{}
+	assert.Error(t, s.UnmarshalBinary([]byte{1, 0, 19}))
+	assert.Error(t, s.UnmarshalBinary([]byte{1, 0, 20, 1, 2, 3}))
+	assert.Error(t, s.UnmarshalBinary([]byte{1}))
+}
+
+func TestPackageWindow(t *testing.T) {
+	w := newPackageWindow(2)
+	done := make(chan struct{})
+	require.NoError(t, w.Take(done))
+	require.NoError(t, w.Take(done))
+	assert.Equal(t, 0, w.Size())
+
+	require.NoError(t, w.Give(2))
+	assert.Equal(t, ErrWindowOverflow, w.Give(1))
+}
+
+func TestPackageWindowBlocks(t *testing.T) {
+	w := newPackageWindow(1)
+	done := make(chan struct{})
+	require.NoError(t, w.Take(done))
+
+	taken := make(chan error)
+	go func() {
+		taken <- w.Take(done)
+	}()
+
+	select {
+	case <-taken:
+		t.Fatal("take should block on empty window")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	require.NoError(t, w.Give(1))
+	assert.NoError(t, <-taken)
+}
+
+func TestPackageWindowDone(t *testing.T) {
+	w := newPackageWindow(0)
+	done := make(chan struct{})
+	close(done)
+	assert.Equal(t, io.EOF, w.Take(done))
+}
@@ -0,0 +1,367 @@
+// Package socks implements the server side of the SOCKS4, SOCKS4a and SOCKS5
+// proxy protocols.
+package socks
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Protocol versions.
+const (
+	Version4 = 4
+	Version5 = 5
+)
+
+// Command is a SOCKS request command.
+type Command byte
+
+// Supported commands.
+const (
+	CommandConnect Command = 1
+)
+
+// Authentication methods.
+//
+// Reference: https://tools.ietf.org/html/rfc1928#section-3
+//
+//	   The values currently defined for METHOD are:
+//
+//	          o  X'00' NO AUTHENTICATION REQUIRED
+//	          o  X'01' GSSAPI
+//	          o  X'02' USERNAME/PASSWORD
+//	          o  X'03' to X'7F' IANA ASSIGNED
+//	          o  X'80' to X'FE' RESERVED FOR PRIVATE METHODS
+//	          o  X'FF' NO ACCEPTABLE METHODS
+//
+const (
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xff
+)
+
+// Address types.
+const (
+	addrTypeIPv4   = 0x01
+	addrTypeDomain = 0x03
+	addrTypeIPv6   = 0x04
+)
+
+// Reply is a SOCKS5 reply code.
+//
+// Reference: https://tools.ietf.org/html/rfc1928#section-6
+//
+//	        o  REP    Reply field:
+//	             o  X'00' succeeded
+//	             o  X'01' general SOCKS server failure
+//	             o  X'02' connection not allowed by ruleset
+//	             o  X'03' Network unreachable
+//	             o  X'04' Host unreachable
+//	             o  X'05' Connection refused
+//	             o  X'06' TTL expired
+//	             o  X'07' Command not supported
+//	             o  X'08' Address type not supported
+//	             o  X'09' to X'FF' unassigned
+//
+type Reply byte
+
+// Reply codes.
+const (
+	ReplySucceeded               Reply = 0x00
+	ReplyGeneralFailure          Reply = 0x01
+	ReplyNotAllowed              Reply = 0x02
+	ReplyNetworkUnreachable      Reply = 0x03
+	ReplyHostUnreachable         Reply = 0x04
+	ReplyConnectionRefused       Reply = 0x05
+	ReplyTTLExpired              Reply = 0x06
+	ReplyCommandNotSupported     Reply = 0x07
+	ReplyAddressTypeNotSupported Reply = 0x08
+)
+
+// SOCKS4 reply codes.
+const (
+	reply4Granted  = 0x5a
+	reply4Rejected = 0x5b
+)
+
+// Errors returned while reading requests.
+var (
+	ErrUnsupportedVersion  = errors.New("unsupported socks version")
+	ErrNoAcceptableMethods = errors.New("no acceptable socks authentication methods")
+)
+
+// Request is a SOCKS request from a client.
+type Request struct {
+	Version  byte
+	Command  Command
+	Host     string
+	Port     uint16
+	Username string
+	Password string
+}
+
+// Addr returns the requested destination in host:port form.
+func (r *Request) Addr() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(int(r.Port)))
+}
+
+// ReadRequest reads a SOCKS request from rw, performing any authentication
+// negotiation required. Usernames and passwords offered by the client are
+// accepted without verification and recorded in the request.
+func ReadRequest(rw io.ReadWriter) (*Request, error) {
+	br := byteReader{rw}
+	v, err := br.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch v {
+	case Version4:
+		return readRequest4(br)
+	case Version5:
+		return readRequest5(br, rw)
+	default:
+		return nil, ErrUnsupportedVersion
+	}
+}
+
+// readRequest4 reads a SOCKS4 or SOCKS4a request, following the version byte.
+//
+// Reference: https://www.openssh.com/txt/socks4.protocol
+//
+//	   		+----+----+----+----+----+----+----+----+----+----+....+----+
+//	   		| VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+//	   		+----+----+----+----+----+----+----+----+----+----+....+----+
+//	   # of bytes:	   1    1      2              4           variable       1
+//
+// Reference: https://www.openssh.com/txt/socks4a.protocol
+//
+//	   For version 4A, if the client cannot resolve the destination host's
+//	   domain name to find its IP address, it should set the first three bytes
+//	   of DSTIP to NULL and the last byte to a non-zero value. (This
+//	   corresponds to IP address 0.0.0.x, with x nonzero.) Following the NULL
+//	   byte terminating USERID, the client must sends the destination domain
+//	   name and termiantes it with another NULL byte.
+//
+func readRequest4(br byteReader) (*Request, error) {
+	hdr := make([]byte, 7)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+
+	user, err := readString(br)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Request{
+		Version:  Version4,
+		Command:  Command(hdr[0]),
+		Port:     binary.BigEndian.Uint16(hdr[1:]),
+		Username: user,
+	}
+
+	ip := net.IP(hdr[3:7])
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		r.Host, err = readString(br)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		r.Host = ip.String()
+	}
+
+	return r, nil
+}
+
+// readRequest5 negotiates authentication and reads a SOCKS5 request, following
+// the version byte.
+//
+// Reference: https://tools.ietf.org/html/rfc1928#section-4
+//
+//	        +----+-----+-------+------+----------+----------+
+//	        |VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+//	        +----+-----+-------+------+----------+----------+
+//	        | 1  |  1  | X'00' |  1   | Variable |    2     |
+//	        +----+-----+-------+------+----------+----------+
+//
+func readRequest5(br byteReader, w io.Writer) (*Request, error) {
+	r := &Request{Version: Version5}
+	if err := negotiate5(br, w, r); err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0] != Version5 {
+		return nil, ErrUnsupportedVersion
+	}
+	r.Command = Command(hdr[1])
+
+	switch hdr[3] {
+	case addrTypeIPv4, addrTypeIPv6:
+		n := net.IPv4len
+		if hdr[3] == addrTypeIPv6 {
+			n = net.IPv6len
+		}
+		ip := make(net.IP, n)
+		if _, err := io.ReadFull(br, ip); err != nil {
+			return nil, err
+		}
+		r.Host = ip.String()
+	case addrTypeDomain:
+		n, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		host := make([]byte, n)
+		if _, err := io.ReadFull(br, host); err != nil {
+			return nil, err
+		}
+		r.Host = string(host)
+	default:
+		_ = writeReply5(w, ReplyAddressTypeNotSupported)
+		return nil, errors.New("unsupported socks address type")
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(br, port); err != nil {
+		return nil, err
+	}
+	r.Port = binary.BigEndian.Uint16(port)
+
+	return r, nil
+}
+
+// negotiate5 performs SOCKS5 method selection. Username/password
+// authentication is preferred when offered, so that clients may use
+// credentials to request isolation.
+//
+// Reference: https://tools.ietf.org/html/rfc1929#section-2
+//
+//	           +----+------+----------+------+----------+
+//	           |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+//	           +----+------+----------+------+----------+
+//	           | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+//	           +----+------+----------+------+----------+
+//
+func negotiate5(br byteReader, w io.Writer, r *Request) error {
+	n, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	methods := make([]byte, n)
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return err
+	}
+
+	method := byte(methodNoAcceptable)
+	for _, m := range methods {
+		if m == methodUserPass {
+			method = m
+			break
+		}
+		if m == methodNoAuth {
+			method = m
+		}
+	}
+
+	if _, err := w.Write([]byte{Version5, method}); err != nil {
+		return err
+	}
+
+	switch method {
+	case methodNoAuth:
+		return nil
+	case methodUserPass:
+	default:
+		return ErrNoAcceptableMethods
+	}
+
+	v, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	if v != 1 {
+		return errors.New("unsupported username/password auth version")
+	}
+	if r.Username, err = readLengthPrefixed(br); err != nil {
+		return err
+	}
+	if r.Password, err = readLengthPrefixed(br); err != nil {
+		return err
+	}
+
+	_, err = w.Write([]byte{1, 0})
+	return err
+}
+
+// WriteReply sends the reply to r. The bound address is always reported as
+// unspecified.
+func (r *Request) WriteReply(w io.Writer, reply Reply) error {
+	if r.Version == Version4 {
+		code := byte(reply4Granted)
+		if reply != ReplySucceeded {
+			code = reply4Rejected
+		}
+		_, err := w.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+	return writeReply5(w, reply)
+}
+
+// writeReply5 writes a SOCKS5 reply with an unspecified bound address.
+func writeReply5(w io.Writer, reply Reply) error {
+	_, err := w.Write([]byte{Version5, byte(reply), 0, addrTypeIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// maxStringLength bounds the nul-terminated strings read from SOCKS4 requests.
+const maxStringLength = 255
+
+// byteReader reads without buffering, so that any data the client sends
+// after its request remains unread.
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func readString(br byteReader) (string, error) {
+	var s []byte
+	for len(s) <= maxStringLength {
+		b, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(s), nil
+		}
+		s = append(s, b)
+	}
+	return "", errors.New("socks string too long")
+}
+
+func readLengthPrefixed(br byteReader) (string, error) {
+	n, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
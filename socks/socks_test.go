@@ -0,0 +1,108 @@
+package socks
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// conn is a fake connection with fixed input, recording output.
+type conn struct {
+	io.Reader
+	bytes.Buffer
+}
+
+func newConn(in []byte) *conn {
+	return &conn{Reader: bytes.NewReader(in)}
+}
+
+func (c *conn) Read(b []byte) (int, error) { return c.Reader.Read(b) }
+
+func TestReadRequest4(t *testing.T) {
+	c := newConn([]byte{4, 1, 0, 80, 1, 2, 3, 4, 'b', 'o', 'b', 0})
+	r, err := ReadRequest(c)
+	require.NoError(t, err)
+	expect := &Request{
+		Version:  Version4,
+		Command:  CommandConnect,
+		Host:     "1.2.3.4",
+		Port:     80,
+		Username: "bob",
+	}
+	assert.Equal(t, expect, r)
+	assert.Equal(t, "1.2.3.4:80", r.Addr())
+
+	require.NoError(t, r.WriteReply(c, ReplySucceeded))
+	assert.Equal(t, []byte{0, 0x5a, 0, 0, 0, 0, 0, 0}, c.Bytes())
+}
+
+func TestReadRequest4a(t *testing.T) {
+	in := []byte{4, 1, 0x01, 0xbb, 0, 0, 0, 1, 0}
+	in = append(in, "example.com\x00"...)
+	r, err := ReadRequest(newConn(in))
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", r.Host)
+	assert.Equal(t, uint16(443), r.Port)
+	assert.Equal(t, "", r.Username)
+}
+
+func TestReadRequest5NoAuth(t *testing.T) {
+	in := []byte{5, 1, 0, 5, 1, 0, 3, 11}
+	in = append(in, "example.com"...)
+	in = append(in, 0, 80, 'x')
+	c := newConn(in)
+	r, err := ReadRequest(c)
+	require.NoError(t, err)
+	expect := &Request{
+		Version: Version5,
+		Command: CommandConnect,
+		Host:    "example.com",
+		Port:    80,
+	}
+	assert.Equal(t, expect, r)
+	assert.Equal(t, []byte{5, 0}, c.Bytes())
+
+	// Data following the request is left unread.
+	rest, err := ioutil.ReadAll(c)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("x"), rest)
+}
+
+func TestReadRequest5UserPass(t *testing.T) {
+	in := []byte{5, 2, 0, 2, 1, 1, 'u', 2, 'p', 'w'}
+	in = append(in, 5, 1, 0, 4)
+	in = append(in, make([]byte, 15)...)
+	in = append(in, 1, 0, 22)
+	c := newConn(in)
+	r, err := ReadRequest(c)
+	require.NoError(t, err)
+	assert.Equal(t, "u", r.Username)
+	assert.Equal(t, "pw", r.Password)
+	assert.Equal(t, "::1", r.Host)
+	assert.Equal(t, uint16(22), r.Port)
+	assert.Equal(t, []byte{5, 2, 1, 0}, c.Bytes())
+
+	c.Reset()
+	require.NoError(t, r.WriteReply(c, ReplyConnectionRefused))
+	assert.Equal(t, []byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0}, c.Bytes())
+}
+
+func TestReadRequestErrors(t *testing.T) {
+	cases := map[string][]byte{
+		"Version":      {6},
+		"NoMethods":    {5, 1, 1},
+		"AddressType":  {5, 1, 0, 5, 1, 0, 9},
+		"Truncated":    {5, 1, 0, 5, 1, 0, 1, 1, 2},
+		"Unterminated": {4, 1, 0, 80, 1, 2, 3, 4, 'b'},
+	}
+	for name, in := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := ReadRequest(newConn(in))
+			assert.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,548 @@
+package pearl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mmcloughlin/pearl/check"
+	"github.com/mmcloughlin/pearl/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// streamConnectTimeout is the maximum time an exit stream will spend
+	// resolving and connecting to its target.
+	streamConnectTimeout = 60 * time.Second
+
+	// streamConnectedTTL is the TTL reported in RELAY_CONNECTED cells.
+	streamConnectedTTL = 300
+)
+
+// BeginFlags are options in a RELAY_BEGIN cell.
+//
+// Reference: https://github.com/torproject/torspec/blob/0fd44031bfd6c6c822bfb194e54a05118c9625e2/tor-spec.txt#L1391-L1401
+//
+//	   The FLAGS value has one or more of the following bits set, where
+//	   "bit 1" is the LSB of the 32-bit value, and "bit 32" is the MSB.
+//	   (Remember that all values in Tor are big-endian (see 0.1.1 above), so
+//	   the MSB of a 4-byte value is the MSB of the first byte, and the LSB
+//	   of a 4-byte value is the LSB of its last byte.)
+//
+//	     bit   meaning
+//	      1 -- IPv6 okay.  We support learning about IPv6 addresses and
+//	           connecting to IPv6 addresses.
+//	      2 -- IPv4 not okay.  We don't want to learn about IPv4 addresses
+//	           or connect to them.
+//	      3 -- IPv6 preferred.  If there are both IPv4 and IPv6 addresses,
+//	           we want to connect to the IPv6 one.  (By default, we connect
+//	           to the IPv4 address.)
+//	      4..32 -- Reserved. Current clients MUST NOT set these. Servers
+//	           MUST ignore them.
+//
+type BeginFlags uint32
+
+// Possible BeginFlags bits.
+const (
+	BeginFlagIPv6Okay      BeginFlags = 1 << 0
+	BeginFlagIPv4NotOkay   BeginFlags = 1 << 1
+	BeginFlagIPv6Preferred BeginFlags = 1 << 2
+)
+
+// BeginPayload is the payload of a RELAY_BEGIN cell.
+//
+// Reference: https://github.com/torproject/torspec/blob/0fd44031bfd6c6c822bfb194e54a05118c9625e2/tor-spec.txt#L1371-L1380
+//
+//	   To open a new anonymized TCP connection, the OP chooses an open
+//	   circuit to an exit that may be able to connect to the destination
+//	   address, selects an arbitrary StreamID not yet used on that circuit,
+//	   and constructs a RELAY_BEGIN cell with a payload encoding the address
+//	   and port of the destination host.  The payload format is:
+//
+//	         ADDRPORT [nul-terminated string]
+//	         FLAGS    [4 bytes]
+//
+//	   ADDRPORT is made of ADDRESS | ':' | PORT | [00]
+//
+type BeginPayload struct {
+	Host  string
+	Port  uint16
+	Flags BeginFlags
+}
+
+// UnmarshalBinary parses a RELAY_BEGIN payload.
+func (b *BeginPayload) UnmarshalBinary(p []byte) error {
+	i := bytes.IndexByte(p, 0)
+	if i < 0 {
+		return errors.New("begin address not nul-terminated")
+	}
+
+	host, port, err := net.SplitHostPort(string(p[:i]))
+	if err != nil {
+		return errors.Wrap(err, "bad begin address")
+	}
+	if host == "" {
+		return errors.New("empty begin host")
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || n == 0 {
+		return errors.New("bad begin port")
+	}
+
+	b.Host = host
+	b.Port = uint16(n)
+	b.Flags = 0
+
+	// The FLAGS field is optional.
+	rest := p[i+1:]
+	if len(rest) >= 4 {
+		b.Flags = BeginFlags(binary.BigEndian.Uint32(rest))
+	}
+
+	return nil
+}
+
+// MarshalBinary encodes the RELAY_BEGIN payload.
+func (b BeginPayload) MarshalBinary() ([]byte, error) {
+	addr := net.JoinHostPort(b.Host, strconv.Itoa(int(b.Port)))
+	p := make([]byte, len(addr)+1+4)
+	copy(p, addr)
+	binary.BigEndian.PutUint32(p[len(addr)+1:], uint32(b.Flags))
+	return p, nil
+}
+
+// ConnectedPayload builds the payload for a RELAY_CONNECTED cell reporting
+// that a stream has connected to ip.
+//
+// Reference: https://github.com/torproject/torspec/blob/0fd44031bfd6c6c822bfb194e54a05118c9625e2/tor-spec.txt#L1436-L1449
+//
+//	   Otherwise, the exit node replies with a RELAY_CONNECTED cell, whose
+//	   payload is in one of the following formats:
+//
+//	       The IPv4 address to which the connection was made [4 octets]
+//	       A number of seconds (TTL) for which the address may be cached [4 octets]
+//
+//	    or
+//
+//	       Four zero-valued octets [4 octets]
+//	       An address type (6)     [1 octet]
+//	       The IPv6 address to which the connection was made [16 octets]
+//	       A number of seconds (TTL) for which the address may be cached [4 octets]
+//
+func ConnectedPayload(ip net.IP, ttl uint32) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		p := make([]byte, 8)
+		copy(p, ip4)
+		binary.BigEndian.PutUint32(p[4:], ttl)
+		return p
+	}
+
+	p := make([]byte, 25)
+	p[4] = 6
+	copy(p[5:], ip.To16())
+	binary.BigEndian.PutUint32(p[21:], ttl)
+	return p
+}
+
+// EndPayload builds the payload for a RELAY_END cell with the given reason.
+func EndPayload(reason StreamCloseReason) []byte {
+	return []byte{byte(reason)}
+}
+
+// ParseEndPayload extracts the reason from a RELAY_END payload.
+//
+// Reference: https://github.com/torproject/torspec/blob/0fd44031bfd6c6c822bfb194e54a05118c9625e2/tor-spec.txt#L1583-L1589
+//
+//	   The payload of a RELAY_END cell begins with a single 'reason' byte to
+//	   describe why the stream is closing.  For some reasons, it contains
+//	   additional data (depending on the reason.)
+//
+func ParseEndPayload(p []byte) StreamCloseReason {
+	if len(p) == 0 {
+		return StreamCloseReasonMisc
+	}
+	return StreamCloseReason(p[0])
+}
+
+// streamCloseReasonForError maps a dial error to the closest stream close
+// reason.
+func streamCloseReasonForError(err error) StreamCloseReason {
+	err = errors.Cause(err)
+
+	if op, ok := err.(*net.OpError); ok {
+		err = op.Err
+	}
+	if sys, ok := err.(*os.SyscallError); ok {
+		err = sys.Err
+	}
+
+	switch e := err.(type) {
+	case *net.DNSError:
+		return StreamCloseReasonResolvefailed
+	case syscall.Errno:
+		switch e {
+		case syscall.ECONNREFUSED:
+			return StreamCloseReasonConnectrefused
+		case syscall.ECONNRESET:
+			return StreamCloseReasonConnreset
+		case syscall.ENETUNREACH, syscall.EHOSTUNREACH:
+			return StreamCloseReasonNoroute
+		case syscall.ETIMEDOUT:
+			return StreamCloseReasonTimeout
+		}
+	case net.Error:
+		if e.Timeout() {
+			return StreamCloseReasonTimeout
+		}
+	}
+
+	if err == context.DeadlineExceeded {
+		return StreamCloseReasonTimeout
+	}
+
+	return StreamCloseReasonMisc
+}
+
+// originatedCell is a relay cell originated at this hop on behalf of a stream.
+type originatedCell struct {
+	stream *exitStream
+	cell   RelayCell
+}
+
+// exitStream is a TCP connection from this relay to a destination requested by
+// a RELAY_BEGIN cell, or a connection to the directory handler requested by a
+// RELAY_BEGIN_DIR cell. Lookups requested by RELAY_RESOLVE cells are also
+// tracked as streams until the RELAY_RESOLVED reply is sent.
+type exitStream struct {
+	id          uint16
+	begin       BeginPayload
+	dir         bool
+	resolveOnly bool
+	circ        *TransverseCircuit
+	data        chan []byte
+	done        chan struct{}
+	once        sync.Once
+	cancel      context.CancelFunc
+
+	packageWindow *packageWindow
+	deliverWindow int // only accessed from the circuit goroutine
+
+	mu   sync.Mutex
+	conn net.Conn
+
+	logger log.Logger
+}
+
+func newExitStream(circ *TransverseCircuit, id uint16, begin BeginPayload) *exitStream {
+	// Well-behaved clients cannot send more than a window of data without a
+	// SENDME, so the data buffer never blocks the circuit.
+	return &exitStream{
+		id:    id,
+		begin: begin,
+		circ:  circ,
+		data:  make(chan []byte, StreamWindowStart),
+		done:  make(chan struct{}),
+
+		packageWindow: newPackageWindow(StreamWindowStart),
+		deliverWindow: StreamWindowStart,
+
+		logger: circ.logger.With("streamid", id).With("host", begin.Host).With("port", begin.Port),
+	}
+}
+
+// Close shuts down the stream without notifying the other side.
+func (s *exitStream) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// Write queues data received from the client to be written to the
+// destination.
+func (s *exitStream) Write(d []byte) error {
+	select {
+	case <-s.done:
+		return io.EOF
+	case <-s.circ.done:
+		return io.EOF
+	case s.data <- d:
+		return nil
+	}
+}
+
+// originate sends a relay cell from this stream back towards the client.
+func (s *exitStream) originate(cmd RelayCommand, data []byte) error {
+	o := originatedCell{
+		stream: s,
+		cell:   NewRelayCell(cmd, s.id, data),
+	}
+	select {
+	case <-s.done:
+		return io.EOF
+	case <-s.circ.done:
+		return io.EOF
+	case s.circ.och <- o:
+		return nil
+	}
+}
+
+func (s *exitStream) end(reason StreamCloseReason) {
+	s.logger.With("reason", reason).Debug("ending stream")
+	if err := s.originate(RelayEnd, EndPayload(reason)); err != nil {
+		s.logger.Debug("could not send end cell")
+	}
+}
+
+func (s *exitStream) run() {
+	defer s.circ.wg.Done()
+	defer s.circ.Metrics.Streams.Free()
+	defer check.Close(s.logger, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), streamConnectTimeout)
+	defer cancel()
+
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	// Closing the stream before this point would have missed the cancel
+	// function.
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	if s.resolveOnly {
+		s.answerResolve(ctx)
+		return
+	}
+
+	conn, reason := s.connect(ctx)
+	if conn == nil {
+		s.end(reason)
+		return
+	}
+
+	s.mu.Lock()
+	s.conn = conn
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		check.Close(s.logger, s)
+		return
+	default:
+	}
+
+	// Reference: https://github.com/torproject/torspec/blob/0fd44031bfd6c6c822bfb194e54a05118c9625e2/tor-spec.txt#L1470-L1474
+	//
+	//	   In response to a RELAY_BEGIN_DIR cell, the OR SHOULD reply with a
+	//	   RELAY_CONNECTED cell with an empty payload.
+	//
+	var connected []byte
+	if !s.dir {
+		ip := conn.RemoteAddr().(*net.TCPAddr).IP
+		connected = ConnectedPayload(ip, streamConnectedTTL)
+	}
+	if err := s.originate(RelayConnected, connected); err != nil {
+		return
+	}
+	s.logger.Info("stream connected")
+
+	// Exit traffic is relayed, directory traffic is not.
+	var rw io.ReadWriter = conn
+	if !s.dir {
+		l := s.circ.Router.relayBandwidth
+		rw = struct {
+			io.Reader
+			io.Writer
+		}{l.WrapReader(conn), l.WrapWriter(conn)}
+	}
+
+	go s.writeLoop(rw)
+	s.readLoop(rw)
+}
+
+// connect resolves and dials the target, or connects to the directory handler
+// for directory streams. On failure it returns a nil connection and the reason
+// to report to the client.
+func (s *exitStream) connect(ctx context.Context) (net.Conn, StreamCloseReason) {
+	if s.dir {
+		return s.circ.Router.dirConnect(), 0
+	}
+
+	ip, err := s.resolve(ctx)
+	if err != nil {
+		log.Err(s.logger, err, "could not resolve stream target")
+		return nil, StreamCloseReasonResolvefailed
+	}
+
+	if !s.circ.Router.exitAllowed(ip, s.begin.Port) {
+		s.logger.With("ip", ip).Info("stream rejected by exit policy")
+		return nil, StreamCloseReasonExitpolicy
+	}
+
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(s.begin.Port)))
+	d := &net.Dialer{}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		log.Err(s.logger, err, "stream connect failed")
+		return nil, streamCloseReasonForError(err)
+	}
+
+	return conn, 0
+}
+
+// resolve determines the IP address to connect to, respecting the address
+// family preferences in the begin flags.
+func (s *exitStream) resolve(ctx context.Context) (net.IP, error) {
+	var ips []net.IP
+	if ip := net.ParseIP(s.begin.Host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		a, err := s.circ.Router.resolver.LookupHost(ctx, s.begin.Host)
+		if err != nil {
+			return nil, err
+		}
+		ips = a.IPs
+	}
+
+	ip := selectStreamIP(ips, s.begin.Flags)
+	if ip == nil {
+		return nil, errors.New("no usable address for stream target")
+	}
+	return ip, nil
+}
+
+// answerResolve looks up the host of a RELAY_RESOLVE request and replies with
+// a RELAY_RESOLVED cell.
+func (s *exitStream) answerResolve(ctx context.Context) {
+	answers := resolvedAnswers(ctx, s.circ.Router.resolver, s.begin.Host)
+	p, err := ResolvedPayload(answers)
+	if err != nil {
+		log.Err(s.logger, err, "could not build resolved payload")
+		p, _ = ResolvedPayload(resolvedError(err))
+	}
+	if err := s.originate(RelayResolved, p); err != nil {
+		s.logger.Debug("could not send resolved cell")
+		return
+	}
+	s.logger.Debug("resolve answered")
+}
+
+// selectStreamIP picks an address from ips according to flags.
+func selectStreamIP(ips []net.IP, flags BeginFlags) net.IP {
+	var v4, v6 net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if v4 == nil {
+				v4 = ip
+			}
+		} else if v6 == nil {
+			v6 = ip
+		}
+	}
+
+	if flags&BeginFlagIPv6Okay == 0 {
+		v6 = nil
+	}
+	if flags&BeginFlagIPv4NotOkay != 0 {
+		v4 = nil
+	}
+
+	if v6 != nil && (v4 == nil || flags&BeginFlagIPv6Preferred != 0) {
+		return v6
+	}
+	return v4
+}
+
+// readLoop pumps data from the destination back to the client.
+func (s *exitStream) readLoop(conn io.Reader) {
+	buf := make([]byte, MaxRelayDataLength)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			d := make([]byte, n)
+			copy(d, buf[:n])
+			if err := s.packageData(d); err != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			s.end(StreamCloseReasonDone)
+			return
+		}
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				log.Err(s.logger, err, "stream read error")
+				s.end(StreamCloseReasonConnreset)
+			}
+			return
+		}
+	}
+}
+
+// packageData sends a RELAY_DATA cell once both the stream and circuit
+// package windows allow it.
+func (s *exitStream) packageData(d []byte) error {
+	if err := s.packageWindow.Take(s.done); err != nil {
+		return err
+	}
+	if err := s.circ.packageWindow.Take(s.done); err != nil {
+		return err
+	}
+	if err := s.originate(RelayData, d); err != nil {
+		_ = s.circ.packageWindow.Give(1)
+		return err
+	}
+	return nil
+}
+
+// writeLoop writes client data to the destination. Stream-level SENDMEs are
+// only sent once data has been written, so that a slow destination pushes
+// back on the client.
+func (s *exitStream) writeLoop(conn io.Writer) {
+	written := 0
+	for {
+		select {
+		case <-s.done:
+			return
+		case d := <-s.data:
+			if _, err := conn.Write(d); err != nil {
+				log.Err(s.logger, err, "stream write error")
+				s.end(StreamCloseReasonConnreset)
+				check.Close(s.logger, s)
+				return
+			}
+		}
+
+		written++
+		if written%StreamWindowIncrement == 0 {
+			if err := s.originate(RelaySendme, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package pearl
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBeginPayloadUnmarshal(t *testing.T) {
+	cases := []struct {
+		Payload []byte
+		Expect  BeginPayload
+	}{
+		{
+			[]byte("example.com:80\x00"),
+			BeginPayload{Host: "example.com", Port: 80},
+		},
+		{
+			[]byte("1.2.3.4:443\x00\x00\x00\x00\x05"),
+			BeginPayload{Host: "1.2.3.4", Port: 443, Flags: BeginFlagIPv6Okay | BeginFlagIPv6Preferred},
+		},
+		{
+			[]byte("[2001:db8::1]:22\x00\x00\x00\x00\x01"),
+			BeginPayload{Host: "2001:db8::1", Port: 22, Flags: BeginFlagIPv6Okay},
+		},
+	}
+	for _, c := range cases {
+		b := BeginPayload{}
+		err := b.UnmarshalBinary(c.Payload)
+		require.NoError(t, err)
+		assert.Equal(t, c.Expect, b)
+	}
+}
+
+func TestBeginPayloadUnmarshalErrors(t *testing.T) {
+	payloads := [][]byte{
+		[]byte("example.com:80"),
+		[]byte("example.com\x00"),
+		[]byte(":80\x00"),
+		[]byte("example.com:0\x00"),
+		[]byte("example.com:65536\x00"),
+	}
+	for _, p := range payloads {
+		b := BeginPayload{}
+		assert.Error(t, b.UnmarshalBinary(p), "payload %q", p)
+	}
+}
+
+func TestBeginPayloadRoundTrip(t *testing.T) {
+	b := BeginPayload{Host: "2001:db8::1", Port: 8080, Flags: BeginFlagIPv4NotOkay}
+	p, err := b.MarshalBinary()
+	require.NoError(t, err)
+	c := BeginPayload{}
+	require.NoError(t, c.UnmarshalBinary(p))
+	assert.Equal(t, b, c)
+}
+
+func TestConnectedPayload(t *testing.T) {
+	p := ConnectedPayload(net.IPv4(1, 2, 3, 4), 0x100)
+	assert.Equal(t, []byte{1, 2, 3, 4, 0, 0, 1, 0}, p)
+
+	p = ConnectedPayload(net.ParseIP("2001:db8::1"), 0x100)
+	expect := []byte{
+		0, 0, 0, 0, 6,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 1,
+		0, 0, 1, 0,
+	}
+	assert.Equal(t, expect, p)
+}
+
+func TestSelectStreamIP(t *testing.T) {
+	v4 := net.IPv4(1, 2, 3, 4)
+	v6 := net.ParseIP("2001:db8::1")
+	both := []net.IP{v6, v4}
+
+	assert.Equal(t, v4, selectStreamIP(both, 0))
+	assert.Equal(t, v4, selectStreamIP(both, BeginFlagIPv6Okay))
+	assert.Equal(t, v6, selectStreamIP(both, BeginFlagIPv6Okay|BeginFlagIPv6Preferred))
+	assert.Equal(t, v6, selectStreamIP(both, BeginFlagIPv6Okay|BeginFlagIPv4NotOkay))
+	assert.Nil(t, selectStreamIP([]net.IP{v6}, 0))
+	assert.Nil(t, selectStreamIP([]net.IP{v4}, BeginFlagIPv4NotOkay))
+}
+
+func TestStreamCloseReasonForErrorRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	_, err = net.Dial("tcp", addr)
+	require.Error(t, err)
+	assert.Equal(t, StreamCloseReasonConnectrefused, streamCloseReasonForError(err))
+}
+
+func TestStreamCloseReasonForErrorResolve(t *testing.T) {
+	err := &net.DNSError{Err: "no such host", Name: "invalid."}
+	assert.Equal(t, StreamCloseReasonResolvefailed, streamCloseReasonForError(err))
+}
@@ -29,3 +29,16 @@ func (b *Bandwidth) WrapReader(r io.Reader) io.Reader {
 func (b *Bandwidth) WrapWriter(w io.Writer) io.Writer {
 	return io.MultiWriter(w, b)
 }
+
+type multiCounter []tally.Counter
+
+// MultiCounter returns a counter that increments all the given counters.
+func MultiCounter(counters ...tally.Counter) tally.Counter {
+	return multiCounter(counters)
+}
+
+func (m multiCounter) Inc(delta int64) {
+	for _, c := range m {
+		c.Inc(delta)
+	}
+}
@@ -3,6 +3,7 @@ package pearl
 import (
 	cryptorand "crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"io"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/mmcloughlin/pearl/fork/tls"
 
+	"github.com/mmcloughlin/pearl/torconfig"
 	"github.com/mmcloughlin/pearl/torcrypto"
 	"github.com/pkg/errors"
 )
@@ -26,6 +28,87 @@ type TLSContext struct {
 	LinkCert *x509.Certificate
 	AuthKey  *rsa.PrivateKey
 	AuthCert *x509.Certificate
+
+	// Ed25519 certificates, present only if the router has Ed25519 keys.
+	Ed25519SigningCert *torcrypto.Ed25519Certificate
+	Ed25519LinkCert    *torcrypto.Ed25519Certificate
+	Ed25519AuthKey     *torcrypto.Ed25519KeyPair
+	Ed25519AuthCert    *torcrypto.Ed25519Certificate
+	RSACrossCert       *torcrypto.RSACrossCert
+}
+
+// ed25519LinkCertLifetime is the validity period of the Ed25519 link and
+// authentication certificates generated for each connection.
+const ed25519LinkCertLifetime = 2 * 24 * time.Hour
+
+// NewTLSContextFromKeys builds a TLS context for a new connection from the
+// router keys. If Ed25519 keys are present the context also includes the
+// certificates required for Ed25519 link authentication.
+func NewTLSContextFromKeys(k *torconfig.Keys) (*TLSContext, error) {
+	ctx, err := NewTLSContext(k.Identity)
+	if err != nil {
+		return nil, err
+	}
+
+	if k.Ed25519Identity == nil || k.Ed25519Signing == nil || k.Ed25519SigningCert == nil {
+		return ctx, nil
+	}
+
+	if err := ctx.certifyEd25519(k, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return ctx, nil
+}
+
+// certifyEd25519 generates the Ed25519 link and authentication certificates
+// for this context, signed by the router's Ed25519 signing key, along with the
+// RSA->Ed25519 cross-certificate that binds the two identities.
+func (t *TLSContext) certifyEd25519(k *torconfig.Keys, now time.Time) error {
+	signing := k.Ed25519Signing
+	exp := now.Add(ed25519LinkCertLifetime)
+
+	t.Ed25519SigningCert = k.Ed25519SigningCert
+
+	t.Ed25519LinkCert = torcrypto.NewEd25519Certificate(
+		torcrypto.CertTypeTLSLink,
+		torcrypto.CertKeyTypeSHA256X509,
+		sha256.Sum256(t.LinkCert.Raw),
+		exp,
+	)
+	t.Ed25519LinkCert.Sign(signing)
+
+	var err error
+	t.Ed25519AuthKey, err = torcrypto.GenerateEd25519KeyPair()
+	if err != nil {
+		return errors.Wrap(err, "failed to generate ed25519 auth key")
+	}
+
+	t.Ed25519AuthCert = torcrypto.NewEd25519Certificate(
+		torcrypto.CertTypeAuthKey,
+		torcrypto.CertKeyTypeEd25519,
+		t.Ed25519AuthKey.Public,
+		exp,
+	)
+	t.Ed25519AuthCert.Sign(signing)
+
+	// The cross-certificate need not outlive the signing key certificate it
+	// accompanies.
+	t.RSACrossCert = torcrypto.NewRSACrossCert(k.Ed25519Identity.Public, k.Ed25519SigningCert.Expiration)
+	if err := t.RSACrossCert.Sign(k.Identity); err != nil {
+		return errors.Wrap(err, "error signing rsa cross certificate")
+	}
+
+	return nil
+}
+
+// Ed25519Identity returns the Ed25519 identity key certified by this context,
+// or nil if it has none.
+func (t *TLSContext) Ed25519Identity() []byte {
+	if t.RSACrossCert == nil {
+		return nil
+	}
+	return t.RSACrossCert.Ed25519Key[:]
 }
 
 // NewTLSContext builds a TLS context for a new connection with the given
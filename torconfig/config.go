@@ -1,21 +1,54 @@
 package torconfig
 
-import "net"
+import (
+	"net"
+	"time"
+
+	"github.com/mmcloughlin/pearl/tordns"
+	"github.com/mmcloughlin/pearl/torexitpolicy"
+)
 
 // Config encapsulates configuration options for a Tor relay.
 type Config struct {
 	Nickname         string
 	IP               net.IP // Relay public IP
+	FallbackIP       net.IP // Used if IP is unset and no address has been discovered
 	ORBindIP         net.IP // OR bind address
 	ORPort           uint16
+	ORPorts          []ORPortConfig // Additional ORPorts
+	SOCKSBindIP      net.IP         // SOCKS bind address, defaults to loopback
+	SOCKSPort        uint16         // Client SOCKS port
+	DirBindIP        net.IP         // Directory bind address
+	DirPort          uint16         // Directory HTTP port, zero to disable
 	Platform         string
 	Contact          string
-	BandwidthAverage int
+	BandwidthAverage int // Limits all traffic, in bytes per second
 	BandwidthBurst   int
+	ExitPolicy       *torexitpolicy.Policy // Defaults to rejecting all exit traffic
+	ExtendTimeout    time.Duration         // Defaults to DefaultExtendTimeout
+	DNSBackend       tordns.Backend        // Defaults to the system resolver
 	Keys             *Keys
 	Data             Data
+
+	// RelayBandwidthAverage and RelayBandwidthBurst additionally limit
+	// relayed traffic, in bytes per second. Zero means no separate limit.
+	RelayBandwidthAverage int
+	RelayBandwidthBurst   int
+
+	// ExtendAllowPrivateAddresses permits circuits to be extended to
+	// private, loopback and link-local addresses.
+	ExtendAllowPrivateAddresses bool
+
+	// ExitPolicyRejectPrivate rejects exit traffic to the relay's own
+	// addresses, including those learned from peers after ExitPolicy was
+	// built.
+	ExitPolicyRejectPrivate bool
 }
 
+// DefaultExtendTimeout is the maximum time allowed for a circuit extend, if
+// not otherwise configured.
+const DefaultExtendTimeout = 30 * time.Second
+
 // ORBindAddr returns the address the relay should bind to.
 func (c Config) ORBindAddr() string {
 	addr := net.TCPAddr{
@@ -24,3 +57,86 @@ func (c Config) ORBindAddr() string {
 	}
 	return addr.String()
 }
+
+// DirBindAddr returns the address the directory server should bind to.
+func (c Config) DirBindAddr() string {
+	addr := net.TCPAddr{
+		IP:   c.DirBindIP,
+		Port: int(c.DirPort),
+	}
+	return addr.String()
+}
+
+// SOCKSBindAddr returns the address a client SOCKS proxy should bind to.
+func (c Config) SOCKSBindAddr() string {
+	ip := c.SOCKSBindIP
+	if ip == nil {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	addr := net.TCPAddr{
+		IP:   ip,
+		Port: int(c.SOCKSPort),
+	}
+	return addr.String()
+}
+
+// ORPortConfig is an ORPort with an explicit address or flags, in addition to
+// the main ORPort.
+type ORPortConfig struct {
+	IP          net.IP // Bind and advertised address, nil for all IPv4 interfaces
+	Port        uint16
+	NoAdvertise bool // Listen but do not publish in the descriptor
+	NoListen    bool // Publish in the descriptor but do not listen
+}
+
+// Addr returns the address the ORPort binds to.
+func (p ORPortConfig) Addr() *net.TCPAddr {
+	return &net.TCPAddr{
+		IP:   p.IP,
+		Port: int(p.Port),
+	}
+}
+
+// IsIPv6 reports whether the ORPort has an IPv6 address.
+func (p ORPortConfig) IsIPv6() bool {
+	return p.IP != nil && p.IP.To4() == nil
+}
+
+// ORListenAddrs returns the addresses the relay should accept OR connections
+// on. A nil IP means all IPv4 interfaces.
+func (c Config) ORListenAddrs() []*net.TCPAddr {
+	var addrs []*net.TCPAddr
+	if c.ORPort != 0 {
+		addrs = append(addrs, &net.TCPAddr{IP: c.ORBindIP, Port: int(c.ORPort)})
+	}
+	for _, p := range c.ORPorts {
+		if !p.NoListen {
+			addrs = append(addrs, p.Addr())
+		}
+	}
+	return addrs
+}
+
+// AdvertisedORPort returns the IPv4 ORPort to publish, or 0 if there is none.
+func (c Config) AdvertisedORPort() uint16 {
+	if c.ORPort != 0 {
+		return c.ORPort
+	}
+	for _, p := range c.ORPorts {
+		if !p.NoAdvertise && !p.IsIPv6() {
+			return p.Port
+		}
+	}
+	return 0
+}
+
+// AdvertisedIPv6ORAddrs returns the IPv6 ORPort addresses to publish.
+func (c Config) AdvertisedIPv6ORAddrs() []*net.TCPAddr {
+	var addrs []*net.TCPAddr
+	for _, p := range c.ORPorts {
+		if !p.NoAdvertise && p.IsIPv6() {
+			addrs = append(addrs, p.Addr())
+		}
+	}
+	return addrs
+}
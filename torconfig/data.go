@@ -1,8 +1,11 @@
 package torconfig
 
 import (
+	"bytes"
 	"io/ioutil"
+	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/mmcloughlin/pearl/tordir"
 )
@@ -12,6 +15,15 @@ type Data interface {
 	Keys() (*Keys, error)
 	SetKeys(*Keys) error
 	SetServerDescriptor(*tordir.ServerDescriptor) error
+	ServerDescriptor() ([]byte, error)
+	SetExtraInfo(*tordir.Document) error
+	ExtraInfo() ([]byte, error)
+	SetConsensus([]byte) error
+	Consensus() ([]byte, error)
+	SetCertificates([]byte) error
+	Certificates() ([]byte, error)
+	SetState([]byte) error
+	State() ([]byte, error)
 }
 
 // dataDirectory manages the data directory structure for a relay.
@@ -42,6 +54,106 @@ func (d dataDirectory) SetServerDescriptor(desc *tordir.ServerDescriptor) error
 	return ioutil.WriteFile(filename, doc.Encode(), 0600)
 }
 
+// ServerDescriptor reads the cached server descriptor document.
+func (d dataDirectory) ServerDescriptor() ([]byte, error) {
+	return ioutil.ReadFile(d.path("cached-descriptors"))
+}
+
+// SetExtraInfo writes the extra-info document to disk.
+func (d dataDirectory) SetExtraInfo(doc *tordir.Document) error {
+	return ioutil.WriteFile(d.path("cached-extrainfo"), doc.Encode(), 0600)
+}
+
+// ExtraInfo reads the cached extra-info document.
+func (d dataDirectory) ExtraInfo() ([]byte, error) {
+	return ioutil.ReadFile(d.path("cached-extrainfo"))
+}
+
+// SetConsensus writes the consensus document to disk.
+func (d dataDirectory) SetConsensus(doc []byte) error {
+	return ioutil.WriteFile(d.path("cached-consensus"), doc, 0600)
+}
+
+// Consensus reads the cached consensus document.
+func (d dataDirectory) Consensus() ([]byte, error) {
+	return ioutil.ReadFile(d.path("cached-consensus"))
+}
+
+// SetCertificates writes authority key certificates to disk.
+func (d dataDirectory) SetCertificates(certs []byte) error {
+	return ioutil.WriteFile(d.path("cached-certs"), certs, 0600)
+}
+
+// Certificates reads the cached authority key certificates.
+func (d dataDirectory) Certificates() ([]byte, error) {
+	return ioutil.ReadFile(d.path("cached-certs"))
+}
+
+// KeyCertificates loads the cached authority key certificates. Returns an
+// empty list if there is no cache.
+func KeyCertificates(d Data) ([]*tordir.KeyCertificate, error) {
+	b, err := d.Certificates()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tordir.ParseKeyCertificates(b)
+}
+
+// CacheKeyCertificates adds certificates to the cache. A certificate replaces
+// any cached one for the same identity and signing key, and certificates
+// expired at time now are dropped.
+func CacheKeyCertificates(d Data, certs []*tordir.KeyCertificate, now time.Time) error {
+	cached, err := KeyCertificates(d)
+	if err != nil {
+		return err
+	}
+
+	var keep []*tordir.KeyCertificate
+	for _, c := range append(cached, certs...) {
+		if now.After(c.Expires) {
+			continue
+		}
+		replaced := false
+		for i, k := range keep {
+			if sameKeyCertificate(c, k) {
+				keep[i] = c
+				replaced = true
+			}
+		}
+		if !replaced {
+			keep = append(keep, c)
+		}
+	}
+
+	var b []byte
+	for _, c := range keep {
+		b = append(b, c.Encode()...)
+	}
+	return d.SetCertificates(b)
+}
+
+// sameKeyCertificate reports whether a and b certify the same signing key for
+// the same authority.
+func sameKeyCertificate(a, b *tordir.KeyCertificate) bool {
+	ska, erra := a.SigningKeyDigest()
+	skb, errb := b.SigningKeyDigest()
+	return erra == nil && errb == nil &&
+		bytes.Equal(a.Fingerprint, b.Fingerprint) && bytes.Equal(ska, skb)
+}
+
+// SetState writes the state file.
+func (d dataDirectory) SetState(state []byte) error {
+	return ioutil.WriteFile(d.path("state"), state, 0600)
+}
+
+// State reads the state file.
+func (d dataDirectory) State() ([]byte, error) {
+	return ioutil.ReadFile(d.path("state"))
+}
+
 func (d dataDirectory) keysDir() string {
 	return d.path("keys")
 }
@@ -0,0 +1,47 @@
+package torconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/mmcloughlin/pearl/tordir"
+)
+
+func TestCacheKeyCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pearltordatatest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	d := NewDataDirectory(dir)
+
+	certs, err := KeyCertificates(d)
+	require.NoError(t, err)
+	assert.Len(t, certs, 0)
+
+	now := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	identity, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	a, err := tordir.GenerateKeyCertificate(identity, now.AddDate(0, -1, 0), now.AddDate(1, 0, 0))
+	require.NoError(t, err)
+	expired, err := tordir.GenerateKeyCertificate(identity, now.AddDate(-1, 0, 0), now.AddDate(0, 0, -1))
+	require.NoError(t, err)
+	require.NoError(t, CacheKeyCertificates(d, []*tordir.KeyCertificate{a, expired}, now))
+
+	b, err := tordir.GenerateKeyCertificate(identity, now, now.AddDate(1, 0, 0))
+	require.NoError(t, err)
+	require.NoError(t, CacheKeyCertificates(d, []*tordir.KeyCertificate{b, a}, now))
+
+	certs, err = KeyCertificates(d)
+	require.NoError(t, err)
+	require.Len(t, certs, 2)
+	assert.Equal(t, a.Encode(), certs[0].Encode())
+	assert.Equal(t, b.Encode(), certs[1].Encode())
+	for _, c := range certs {
+		assert.NoError(t, c.Verify(now))
+	}
+}
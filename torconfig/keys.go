@@ -4,6 +4,7 @@ import (
 	"crypto/rsa"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/mmcloughlin/pearl/torcrypto"
 	"github.com/pkg/errors"
@@ -14,12 +15,27 @@ const (
 	identityKeyFilename = "secret_id_key"
 	onionKeyFilename    = "secret_onion_key"
 	ntorKeyFilename     = "secret_onion_key_ntor"
+
+	ed25519IdentitySecretKeyFilename = "ed25519_master_id_secret_key"
+	ed25519IdentityPublicKeyFilename = "ed25519_master_id_public_key"
+	ed25519SigningSecretKeyFilename  = "ed25519_signing_secret_key"
+	ed25519SigningCertFilename       = "ed25519_signing_cert"
 )
 
+// SigningKeyLifetime is the validity period of a newly certified Ed25519
+// signing key.
+const SigningKeyLifetime = 30 * 24 * time.Hour
+
 type Keys struct {
 	Identity *rsa.PrivateKey
 	Onion    *rsa.PrivateKey
 	Ntor     *torcrypto.Curve25519KeyPair
+
+	// Ed25519Identity is the master identity key, which certifies
+	// Ed25519Signing in Ed25519SigningCert.
+	Ed25519Identity    *torcrypto.Ed25519KeyPair
+	Ed25519Signing     *torcrypto.Ed25519KeyPair
+	Ed25519SigningCert *torcrypto.Ed25519Certificate
 }
 
 func GenerateKeys() (*Keys, error) {
@@ -38,11 +54,53 @@ func GenerateKeys() (*Keys, error) {
 		return nil, err
 	}
 
-	return &Keys{
+	k := &Keys{
 		Identity: idKey,
 		Onion:    onionKey,
 		Ntor:     ntorKey,
-	}, nil
+	}
+
+	if _, err := k.EnsureEd25519(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// EnsureEd25519 generates Ed25519 keys that are missing, and certifies a new
+// signing key if the current certificate has expired at time now. Returns
+// whether any keys changed.
+func (k *Keys) EnsureEd25519(now time.Time) (bool, error) {
+	changed := false
+
+	if k.Ed25519Identity == nil {
+		id, err := torcrypto.GenerateEd25519KeyPair()
+		if err != nil {
+			return false, err
+		}
+		k.Ed25519Identity = id
+		k.Ed25519Signing = nil
+		changed = true
+	}
+
+	if k.Ed25519Signing == nil || k.Ed25519SigningCert == nil || !now.Before(k.Ed25519SigningCert.Expiration) {
+		signing, err := torcrypto.GenerateEd25519KeyPair()
+		if err != nil {
+			return false, err
+		}
+		cert := torcrypto.NewEd25519Certificate(
+			torcrypto.CertTypeSigningKey,
+			torcrypto.CertKeyTypeEd25519,
+			signing.Public,
+			now.Add(SigningKeyLifetime),
+		)
+		cert.Sign(k.Ed25519Identity)
+		k.Ed25519Signing = signing
+		k.Ed25519SigningCert = cert
+		changed = true
+	}
+
+	return changed, nil
 }
 
 func LoadKeysFromDirectory(path string) (*Keys, error) {
@@ -64,9 +122,46 @@ func LoadKeysFromDirectory(path string) (*Keys, error) {
 		return nil, errors.Wrap(err, "failed to load onion ntor key")
 	}
 
+	// Ed25519 keys are optional, since data directories may predate them.
+	// Callers should use EnsureEd25519 to generate them.
+	k.Ed25519Identity, err = torcrypto.LoadEd25519KeyPairFromFile(filepath.Join(path, ed25519IdentitySecretKeyFilename))
+	if os.IsNotExist(errors.Cause(err)) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load ed25519 identity key")
+	}
+
+	k.Ed25519Signing, err = torcrypto.LoadEd25519KeyPairFromFile(filepath.Join(path, ed25519SigningSecretKeyFilename))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load ed25519 signing key")
+	}
+
+	k.Ed25519SigningCert, err = torcrypto.LoadEd25519CertificateFromFile(filepath.Join(path, ed25519SigningCertFilename))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load ed25519 signing certificate")
+	}
+
+	if err := k.verifyEd25519(); err != nil {
+		return nil, err
+	}
+
 	return k, nil
 }
 
+// verifyEd25519 checks the signing key certificate is for the signing key and
+// signed by the identity key. Expiry is not checked.
+func (k *Keys) verifyEd25519() error {
+	cert := k.Ed25519SigningCert
+	if cert.Type != torcrypto.CertTypeSigningKey || cert.CertifiedKey != k.Ed25519Signing.Public {
+		return errors.New("ed25519 signing certificate does not certify signing key")
+	}
+	if err := cert.Verify(k.Ed25519Identity.Public, cert.Expiration.Add(-time.Second)); err != nil {
+		return errors.Wrap(err, "invalid ed25519 signing certificate")
+	}
+	return nil
+}
+
 func (k *Keys) SaveToDirectory(path string) error {
 	if err := os.MkdirAll(path, 0700); err != nil {
 		return err
@@ -80,5 +175,20 @@ func (k *Keys) SaveToDirectory(path string) error {
 	if err := torcrypto.SaveCurve25519KeyPairPrivateKeyToFile(k.Ntor, filepath.Join(path, ntorKeyFilename), "onion"); err != nil {
 		return err
 	}
+	if k.Ed25519Identity == nil {
+		return nil
+	}
+	if err := torcrypto.SaveEd25519KeyPairToFile(k.Ed25519Identity, filepath.Join(path, ed25519IdentitySecretKeyFilename)); err != nil {
+		return err
+	}
+	if err := torcrypto.SaveEd25519PublicKeyToFile(k.Ed25519Identity.Public, filepath.Join(path, ed25519IdentityPublicKeyFilename)); err != nil {
+		return err
+	}
+	if err := torcrypto.SaveEd25519KeyPairToFile(k.Ed25519Signing, filepath.Join(path, ed25519SigningSecretKeyFilename)); err != nil {
+		return err
+	}
+	if err := torcrypto.SaveEd25519CertificateToFile(k.Ed25519SigningCert, filepath.Join(path, ed25519SigningCertFilename)); err != nil {
+		return err
+	}
 	return nil
 }
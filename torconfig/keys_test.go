@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/mmcloughlin/pearl/torcrypto"
 	"github.com/stretchr/testify/assert"
@@ -38,3 +39,58 @@ func TestKeysRoundTrip(t *testing.T) {
 
 	assert.Equal(t, start, k)
 }
+
+func TestLoadKeysFromDirectoryWithoutEd25519(t *testing.T) {
+	start, err := GenerateKeys()
+	require.NoError(t, err)
+	start.Ed25519Identity = nil
+
+	dir, err := ioutil.TempDir("", "pearltorkeystest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, start.SaveToDirectory(dir))
+
+	k, err := LoadKeysFromDirectory(dir)
+	require.NoError(t, err)
+	assert.Nil(t, k.Ed25519Identity)
+
+	changed, err := k.EnsureEd25519(time.Now())
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.NoError(t, k.Ed25519SigningCert.Verify(k.Ed25519Identity.Public, time.Now()))
+}
+
+func TestKeysEnsureEd25519RenewsSigningKey(t *testing.T) {
+	k, err := GenerateKeys()
+	require.NoError(t, err)
+	id := k.Ed25519Identity
+	signing := k.Ed25519Signing
+
+	changed, err := k.EnsureEd25519(time.Now())
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	later := time.Now().Add(SigningKeyLifetime + time.Hour)
+	changed, err = k.EnsureEd25519(later)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, id, k.Ed25519Identity)
+	assert.NotEqual(t, signing, k.Ed25519Signing)
+	assert.NoError(t, k.Ed25519SigningCert.Verify(id.Public, later))
+}
+
+func TestLoadKeysFromDirectoryMismatchedSigningKey(t *testing.T) {
+	k, err := GenerateKeys()
+	require.NoError(t, err)
+	k.Ed25519Signing, err = torcrypto.GenerateEd25519KeyPair()
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "pearltorkeystest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, k.SaveToDirectory(dir))
+	_, err = LoadKeysFromDirectory(dir)
+	assert.Error(t, err)
+}
@@ -9,6 +9,7 @@ import (
 	"strings"
 
 	"github.com/mmcloughlin/pearl/check"
+	"github.com/mmcloughlin/pearl/torexitpolicy"
 	"github.com/pkg/errors"
 )
 
@@ -23,17 +24,35 @@ type optionHandler func(*Config, string) error
 // optionHandlers is a map from keywords (lowercased) to the associated
 // handler. Used by ParseTorrc.
 var optionHandlers = map[string]optionHandler{
-	"nickname":       nicknameHandler,
-	"orport":         orPortHandler,
-	"contactinfo":    contactInfoHandler,
-	"address":        addressHandler,
-	"bandwidthrate":  bandwidthRateHandler,
-	"bandwidthburst": bandwidthBurstHandler,
+	"nickname":            nicknameHandler,
+	"orport":              orPortHandler,
+	"socksport":           socksPortHandler,
+	"dirport":             dirPortHandler,
+	"contactinfo":         contactInfoHandler,
+	"address":             addressHandler,
+	"bandwidthrate":       bandwidthRateHandler,
+	"bandwidthburst":      bandwidthBurstHandler,
+	"relaybandwidthrate":  relayBandwidthRateHandler,
+	"relaybandwidthburst": relayBandwidthBurstHandler,
+}
+
+// exitOptionHandler is a function that modifies exit policy options based on
+// string argument(s).
+type exitOptionHandler func(*torexitpolicy.TorrcOptions, string) error
+
+// exitOptionHandlers is a map from keywords (lowercased) to handlers for
+// options determining the exit policy. The policy is built once all lines are
+// parsed, since it depends on several options.
+var exitOptionHandlers = map[string]exitOptionHandler{
+	"exitpolicy":              exitPolicyHandler,
+	"exitpolicyrejectprivate": exitPolicyRejectPrivateHandler,
+	"reducedexitpolicy":       reducedExitPolicyHandler,
 }
 
 // ParseTorrc parses Config from the given reader (in torrc format).
 func ParseTorrc(r io.Reader) (*Config, error) {
 	cfg := &Config{}
+	exit := &torexitpolicy.TorrcOptions{RejectPrivate: true}
 	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
@@ -55,6 +74,13 @@ func ParseTorrc(r io.Reader) (*Config, error) {
 		args := parts[1]
 
 		// pass to handler, if any
+		if handler, ok := exitOptionHandlers[keyword]; ok {
+			if err := handler(exit, args); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		handler, ok := optionHandlers[keyword]
 		if !ok {
 			continue
@@ -70,6 +96,15 @@ func ParseTorrc(r io.Reader) (*Config, error) {
 		return nil, err
 	}
 
+	// Without an exit policy the config default, rejecting all exit traffic,
+	// applies.
+	if len(exit.Rules) > 0 || exit.Reduced {
+		if cfg.IP != nil {
+			exit.Addresses = []net.IP{cfg.IP}
+		}
+		cfg.ExitPolicy = exit.Policy()
+	}
+
 	return cfg, nil
 }
 
@@ -90,16 +125,145 @@ func nicknameHandler(cfg *Config, args string) error {
 	return nil
 }
 
-// orPortHandler parses the "OrPort" line.
+// orPortHandler parses the "OrPort" line. The first plain port sets the main
+// ORPort; lines with an address or flags add to the additional ORPorts.
 func orPortHandler(cfg *Config, args string) error {
-	port, err := strconv.ParseUint(args, 10, 16)
+	p, err := ParseORPort(args)
+	if err != nil {
+		return err
+	}
+	if cfg.ORPort == 0 && p.IP == nil && !p.NoAdvertise && !p.NoListen {
+		cfg.ORPort = p.Port
+		return nil
+	}
+	cfg.ORPorts = append(cfg.ORPorts, p)
+	return nil
+}
+
+// ParseORPort parses the arguments of a torrc ORPort line: a port or an
+// address and port, optionally followed by NoAdvertise or NoListen. Other
+// flags are ignored.
+func ParseORPort(args string) (ORPortConfig, error) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return ORPortConfig{}, ErrTorrcMissingArguments
+	}
+
+	ip, port, err := parsePortAddr(fields[0])
+	if err != nil {
+		return ORPortConfig{}, err
+	}
+	p := ORPortConfig{IP: ip, Port: port}
+
+	for _, flag := range fields[1:] {
+		switch strings.ToLower(flag) {
+		case "noadvertise":
+			p.NoAdvertise = true
+		case "nolisten":
+			p.NoListen = true
+		}
+	}
+	if p.NoAdvertise && p.NoListen {
+		return ORPortConfig{}, errors.New("ORPort cannot be both NoAdvertise and NoListen")
+	}
+
+	return p, nil
+}
+
+// socksPortHandler parses the "SOCKSPort" line. Accepts either a port or an
+// address and port. Flags following the address are ignored.
+func socksPortHandler(cfg *Config, args string) error {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return ErrTorrcMissingArguments
+	}
+
+	ip, port, err := parsePortAddr(fields[0])
+	if err != nil {
+		return err
+	}
+	if ip != nil {
+		cfg.SOCKSBindIP = ip
+	}
+	cfg.SOCKSPort = port
+	return nil
+}
+
+// dirPortHandler parses the "DirPort" line. Accepts either a port or an
+// address and port. Flags following the address are ignored.
+func dirPortHandler(cfg *Config, args string) error {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return ErrTorrcMissingArguments
+	}
+
+	ip, port, err := parsePortAddr(fields[0])
+	if err != nil {
+		return err
+	}
+	cfg.DirBindIP = ip
+	cfg.DirPort = port
+	return nil
+}
+
+// parsePortAddr parses either a port or an address and port. The returned IP
+// is nil if only a port is given.
+func parsePortAddr(addr string) (net.IP, uint16, error) {
+	var ip net.IP
+	if strings.Contains(addr, ":") {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, 0, err
+		}
+		ip = net.ParseIP(host)
+		if ip == nil {
+			return nil, 0, errors.New("could not parse IP")
+		}
+		addr = port
+	}
+
+	port, err := strconv.ParseUint(addr, 10, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ip, uint16(port), nil
+}
+
+// exitPolicyHandler parses the "ExitPolicy" line, a comma separated list of
+// rules. Rules from multiple lines are concatenated.
+func exitPolicyHandler(exit *torexitpolicy.TorrcOptions, args string) error {
+	rules, err := torexitpolicy.ParseTorrcRules(args)
 	if err != nil {
 		return err
 	}
-	cfg.ORPort = uint16(port)
+	exit.Rules = append(exit.Rules, rules...)
 	return nil
 }
 
+// exitPolicyRejectPrivateHandler parses the "ExitPolicyRejectPrivate" line.
+func exitPolicyRejectPrivateHandler(exit *torexitpolicy.TorrcOptions, args string) (err error) {
+	exit.RejectPrivate, err = parseBool(args)
+	return
+}
+
+// reducedExitPolicyHandler parses the "ReducedExitPolicy" line.
+func reducedExitPolicyHandler(exit *torexitpolicy.TorrcOptions, args string) (err error) {
+	exit.Reduced, err = parseBool(args)
+	return
+}
+
+// parseBool parses a torrc boolean, "0" or "1".
+func parseBool(s string) (bool, error) {
+	switch s {
+	case "0":
+		return false, nil
+	case "1":
+		return true, nil
+	default:
+		return false, errors.Errorf("invalid boolean %q", s)
+	}
+}
+
 // addressHandler parses the "Address" line as an IP address.
 func addressHandler(cfg *Config, args string) error {
 	ip := net.ParseIP(args)
@@ -128,6 +292,18 @@ func bandwidthBurstHandler(cfg *Config, args string) (err error) {
 	return
 }
 
+// relayBandwidthRateHandler parses the "RelayBandwidthRate" line.
+func relayBandwidthRateHandler(cfg *Config, args string) (err error) {
+	cfg.RelayBandwidthAverage, err = parseBytes(args)
+	return
+}
+
+// relayBandwidthBurstHandler parses the "RelayBandwidthBurst" line.
+func relayBandwidthBurstHandler(cfg *Config, args string) (err error) {
+	cfg.RelayBandwidthBurst, err = parseBytes(args)
+	return
+}
+
 // parseBytes parses a string as a number of bytes.
 func parseBytes(s string) (int, error) {
 	parts := strings.Split(s, " ")
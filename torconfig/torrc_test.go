@@ -62,3 +62,116 @@ func TestParseTorrcReaderError(t *testing.T) {
 	_, err := ParseTorrc(r)
 	assert.Error(t, err)
 }
+
+func TestParseTorrcSOCKSPort(t *testing.T) {
+	cases := []struct {
+		Input string
+		IP    net.IP
+		Port  uint16
+	}{
+		{"SOCKSPort 9050\n", nil, 9050},
+		{"SocksPort 10.0.0.1:9150 IsolateDestAddr\n", net.ParseIP("10.0.0.1"), 9150},
+		{"SOCKSPort [::1]:9050\n", net.ParseIP("::1"), 9050},
+	}
+	for _, c := range cases {
+		cfg, err := ParseTorrc(strings.NewReader(c.Input))
+		require.NoError(t, err)
+		assert.Equal(t, c.IP, cfg.SOCKSBindIP)
+		assert.Equal(t, c.Port, cfg.SOCKSPort)
+	}
+
+	_, err := ParseTorrc(strings.NewReader("SOCKSPort localhost:9050\n"))
+	assert.Error(t, err)
+}
+
+func TestParseTorrcExitPolicy(t *testing.T) {
+	input := "Address 93.184.216.34\n" +
+		"ExitPolicy accept *:80,accept *:443\n" +
+		"ExitPolicy reject *:*\n"
+	cfg, err := ParseTorrc(strings.NewReader(input))
+	require.NoError(t, err)
+	require.NotNil(t, cfg.ExitPolicy)
+
+	other := net.ParseIP("198.51.100.7")
+	assert.True(t, cfg.ExitPolicy.Allow(other, 443))
+	assert.False(t, cfg.ExitPolicy.Allow(other, 22))
+	assert.False(t, cfg.ExitPolicy.Allow(net.ParseIP("10.0.0.1"), 80))
+	assert.False(t, cfg.ExitPolicy.Allow(net.ParseIP("93.184.216.34"), 80))
+	assert.Equal(t, "accept 80,443", cfg.ExitPolicy.Summary().String())
+}
+
+func TestParseTorrcExitPolicyOptions(t *testing.T) {
+	input := "ExitPolicyRejectPrivate 0\n" +
+		"ReducedExitPolicy 1\n"
+	cfg, err := ParseTorrc(strings.NewReader(input))
+	require.NoError(t, err)
+	require.NotNil(t, cfg.ExitPolicy)
+	assert.True(t, cfg.ExitPolicy.Allow(net.ParseIP("10.0.0.1"), 443))
+	assert.False(t, cfg.ExitPolicy.Allow(net.ParseIP("10.0.0.1"), 25))
+}
+
+func TestParseTorrcExitPolicyErrors(t *testing.T) {
+	for _, input := range []string{
+		"ExitPolicy allow *:*\n",
+		"ExitPolicy accept *:http\n",
+		"ReducedExitPolicy yes\n",
+	} {
+		_, err := ParseTorrc(strings.NewReader(input))
+		assert.Error(t, err, input)
+	}
+}
+
+func TestParseTorrcRelayBandwidth(t *testing.T) {
+	input := "RelayBandwidthRate 50 KB\n" +
+		"RelayBandwidthBurst 1 MB\n"
+	cfg, err := ParseTorrc(strings.NewReader(input))
+	require.NoError(t, err)
+	assert.Equal(t, 50<<10, cfg.RelayBandwidthAverage)
+	assert.Equal(t, 1<<20, cfg.RelayBandwidthBurst)
+}
+
+func TestParseTorrcORPorts(t *testing.T) {
+	input := "ORPort 9001\n" +
+		"ORPort [2001:db8::1]:9001\n" +
+		"ORPort 443 NoListen\n" +
+		"ORPort 127.0.0.1:9090 NoAdvertise IPv4Only\n"
+	cfg, err := ParseTorrc(strings.NewReader(input))
+	require.NoError(t, err)
+
+	assert.Equal(t, uint16(9001), cfg.ORPort)
+	assert.Equal(t, []ORPortConfig{
+		{IP: net.ParseIP("2001:db8::1"), Port: 9001},
+		{Port: 443, NoListen: true},
+		{IP: net.ParseIP("127.0.0.1"), Port: 9090, NoAdvertise: true},
+	}, cfg.ORPorts)
+
+	assert.Equal(t, []*net.TCPAddr{
+		{Port: 9001},
+		{IP: net.ParseIP("2001:db8::1"), Port: 9001},
+		{IP: net.ParseIP("127.0.0.1"), Port: 9090},
+	}, cfg.ORListenAddrs())
+	assert.Equal(t, uint16(9001), cfg.AdvertisedORPort())
+	assert.Equal(t, []*net.TCPAddr{
+		{IP: net.ParseIP("2001:db8::1"), Port: 9001},
+	}, cfg.AdvertisedIPv6ORAddrs())
+}
+
+func TestParseORPortErrors(t *testing.T) {
+	for _, args := range []string{
+		"",
+		"[::1]:bad",
+		"notanip:9001",
+		"9001 NoAdvertise NoListen",
+	} {
+		_, err := ParseORPort(args)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestParseTorrcDirPort(t *testing.T) {
+	cfg, err := ParseTorrc(strings.NewReader("DirPort 10.0.0.1:9030\n"))
+	require.NoError(t, err)
+	assert.Equal(t, net.ParseIP("10.0.0.1"), cfg.DirBindIP)
+	assert.Equal(t, uint16(9030), cfg.DirPort)
+	assert.Equal(t, "10.0.0.1:9030", cfg.DirBindAddr())
+}
@@ -0,0 +1,224 @@
+package torcrypto
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/ed25519"
+
+	"github.com/mmcloughlin/pearl/fork/edwards25519"
+)
+
+// Ed25519 key and signature sizes.
+const (
+	Ed25519PublicKeySize = ed25519.PublicKeySize
+	Ed25519SecretKeySize = 64
+	Ed25519SignatureSize = ed25519.SignatureSize
+
+	ed25519SeedSize     = 32
+	ed25519ScalarSize   = 32
+	ed25519PrefixOffset = ed25519ScalarSize
+)
+
+// Ed25519KeyPair is an Ed25519 key pair.
+//
+// The private key is held in "expanded" form: the clamped secret scalar
+// followed by the 32-byte nonce prefix. This is how tor stores Ed25519 secret
+// keys, and unlike the seed form used by golang.org/x/crypto/ed25519 it is
+// all that's needed to sign.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/tor-spec.txt#L185-L206
+//
+//	   These are Ed25519 keys:
+//
+//	    - A long-term "master identity" key.  This key never
+//	      changes; it is used only to sign the "signing" key below.  It may be
+//	      kept offline.
+//
+//	    - A medium-term "signing" key.  This key is signed by the master
+//	      identity key, and must be kept online.  A new one should be generated
+//	      periodically.  It signs nearly everything else.
+//
+//	    - A short-term "link authentication" key, used to authenticate
+//	      the link handshake: see section 4 below.  This key is signed
+//	      by the "signing" key, and should be regenerated frequently.
+//
+type Ed25519KeyPair struct {
+	Private [Ed25519SecretKeySize]byte
+	Public  [Ed25519PublicKeySize]byte
+}
+
+// GenerateEd25519KeyPair generates an Ed25519KeyPair using crypto/rand as the
+// random source.
+func GenerateEd25519KeyPair() (*Ed25519KeyPair, error) {
+	return generateEd25519KeyPairFromRandom(rand.Reader)
+}
+
+// generateEd25519KeyPairFromRandom generates an Ed25519KeyPair from a seed
+// read from r.
+func generateEd25519KeyPairFromRandom(r io.Reader) (*Ed25519KeyPair, error) {
+	seed := make([]byte, ed25519SeedSize)
+	if _, err := io.ReadFull(r, seed); err != nil {
+		return nil, err
+	}
+	return NewEd25519KeyPairFromSeed(seed), nil
+}
+
+// NewEd25519KeyPairFromSeed derives a key pair from a 32-byte seed, as in
+// RFC 8032. The resulting keys are identical to those produced by
+// golang.org/x/crypto/ed25519 from the same seed.
+func NewEd25519KeyPairFromSeed(seed []byte) *Ed25519KeyPair {
+	digest := sha512.Sum512(seed)
+	digest[0] &= 248
+	digest[31] &= 127
+	digest[31] |= 64
+
+	k := &Ed25519KeyPair{}
+	copy(k.Private[:], digest[:])
+	k.Public = ed25519PublicFromScalar(k.Private[:ed25519ScalarSize])
+	return k
+}
+
+// NewEd25519KeyPairFromExpanded builds a key pair from an expanded secret
+// key, computing the public key.
+func NewEd25519KeyPairFromExpanded(secret [Ed25519SecretKeySize]byte) *Ed25519KeyPair {
+	return &Ed25519KeyPair{
+		Private: secret,
+		Public:  ed25519PublicFromScalar(secret[:ed25519ScalarSize]),
+	}
+}
+
+func ed25519PublicFromScalar(scalar []byte) [Ed25519PublicKeySize]byte {
+	var a [32]byte
+	copy(a[:], scalar)
+
+	var A edwards25519.ExtendedGroupElement
+	edwards25519.GeScalarMultBase(&A, &a)
+
+	var pub [Ed25519PublicKeySize]byte
+	A.ToBytes(&pub)
+	return pub
+}
+
+// Sign signs msg with the key pair.
+func (k *Ed25519KeyPair) Sign(msg []byte) []byte {
+	h := sha512.New()
+
+	var messageDigest, hramDigest [64]byte
+	h.Write(k.Private[ed25519PrefixOffset:])
+	h.Write(msg)
+	h.Sum(messageDigest[:0])
+
+	var messageDigestReduced [32]byte
+	edwards25519.ScReduce(&messageDigestReduced, &messageDigest)
+	var R edwards25519.ExtendedGroupElement
+	edwards25519.GeScalarMultBase(&R, &messageDigestReduced)
+
+	var encodedR [32]byte
+	R.ToBytes(&encodedR)
+
+	h.Reset()
+	h.Write(encodedR[:])
+	h.Write(k.Public[:])
+	h.Write(msg)
+	h.Sum(hramDigest[:0])
+	var hramDigestReduced [32]byte
+	edwards25519.ScReduce(&hramDigestReduced, &hramDigest)
+
+	var a [32]byte
+	copy(a[:], k.Private[:ed25519ScalarSize])
+
+	var s [32]byte
+	edwards25519.ScMulAdd(&s, &hramDigestReduced, &a, &messageDigestReduced)
+
+	sig := make([]byte, Ed25519SignatureSize)
+	copy(sig[:32], encodedR[:])
+	copy(sig[32:], s[:])
+	return sig
+}
+
+// VerifyEd25519 reports whether sig is a valid signature of msg by pub.
+func VerifyEd25519(pub [Ed25519PublicKeySize]byte, msg, sig []byte) bool {
+	return ed25519.Verify(ed25519.PublicKey(pub[:]), msg, sig)
+}
+
+// Ed25519KeyPairFromCurve25519 derives an Ed25519 key pair from a Curve25519
+// key pair, such that signatures made with it can be verified by anyone who
+// knows the Curve25519 public key. Also returns the sign bit of the Ed25519
+// public key, which is required to recover it from the Curve25519 public key.
+//
+// Reference: https://github.com/torproject/tor/blob/b9b5f9a1a5a683611789ffe4c49e41325102cabc/src/common/crypto_ed25519.c#L616-L634
+//
+//	  const char string[] = "Derive high part of ed25519 key from curve25519 key";
+//	  ed25519_public_key_t pubkey_check;
+//	  crypto_digest_t *ctx;
+//	  uint8_t sha512_output[DIGEST512_LEN];
+//
+//	  memcpy(out->seckey.seckey, inp->seckey.secret_key, 32);
+//
+//	  ctx = crypto_digest512_new(DIGEST_SHA512);
+//	  crypto_digest_add_bytes(ctx, (const char*)out->seckey.seckey, 32);
+//	  crypto_digest_add_bytes(ctx, (const char*)string, sizeof(string));
+//	  crypto_digest_get_digest(ctx, (char *)sha512_output, sizeof(sha512_output));
+//	  crypto_digest_free(ctx);
+//	  memcpy(out->seckey.seckey + 32, sha512_output, 32);
+//
+//	  ed25519_public_key_generate(&out->pubkey, &out->seckey);
+//
+//	  *signbit_out = out->pubkey.pubkey[31] >> 7;
+//
+func Ed25519KeyPairFromCurve25519(k *Curve25519KeyPair) (*Ed25519KeyPair, byte) {
+	var secret [Ed25519SecretKeySize]byte
+	copy(secret[:], k.Private[:])
+
+	// Tor stores Curve25519 secret keys clamped. Ours may not be, since
+	// clamping is also applied during scalar multiplication.
+	secret[0] &= 248
+	secret[31] &= 127
+	secret[31] |= 64
+
+	h := sha512.New()
+	h.Write(secret[:ed25519ScalarSize])
+	h.Write([]byte("Derive high part of ed25519 key from curve25519 key\x00"))
+	copy(secret[ed25519PrefixOffset:], h.Sum(nil))
+
+	ed := NewEd25519KeyPairFromExpanded(secret)
+	return ed, ed.Public[31] >> 7
+}
+
+// Ed25519PublicKeyFromCurve25519 recovers the Ed25519 public key derived from
+// the Curve25519 public key pub with Ed25519KeyPairFromCurve25519, given the
+// sign bit of the Ed25519 key.
+//
+// The Edwards y-coordinate is computed from the Montgomery u-coordinate as
+// y = (u-1)/(u+1).
+func Ed25519PublicKeyFromCurve25519(pub [32]byte, signbit byte) [Ed25519PublicKeySize]byte {
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	u := new(big.Int).SetBytes(reverse(pub[:]))
+	u.SetBit(u, 255, 0)
+
+	num := new(big.Int).Sub(u, big.NewInt(1))
+	den := new(big.Int).Add(u, big.NewInt(1))
+	den.ModInverse(den.Mod(den, p), p)
+	y := num.Mul(num, den)
+	y.Mod(y, p)
+
+	var out [Ed25519PublicKeySize]byte
+	b := y.Bytes()
+	for i := range b {
+		out[i] = b[len(b)-1-i]
+	}
+	out[31] |= (signbit & 1) << 7
+	return out
+}
+
+// reverse returns a copy of b in reverse order.
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
@@ -0,0 +1,98 @@
+package torcrypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestGenerateEd25519KeyPair(t *testing.T) {
+	_, err := GenerateEd25519KeyPair()
+	assert.NoError(t, err)
+}
+
+func TestGenerateEd25519KeyPairFromRandomShortRead(t *testing.T) {
+	r := bytes.NewReader([]byte("not long enough"))
+	kp, err := generateEd25519KeyPairFromRandom(r)
+	assert.Nil(t, kp)
+	assert.Error(t, err)
+}
+
+// Reference: https://tools.ietf.org/html/rfc8032#section-7.1
+//
+//	   -----TEST 1
+//
+//	   ALGORITHM:
+//	   Ed25519
+//
+//	   SECRET KEY:
+//	   9d61b19deffd5a60ba844af492ec2cc4
+//	   4449c5697b326919703bac031cae7f60
+//
+//	   PUBLIC KEY:
+//	   d75a980182b10ab7d54bfed3c964073a
+//	   0ee172f3daa62325af021a68f707511a
+//
+//	   MESSAGE (length 0 bytes):
+//
+//	   SIGNATURE:
+//	   e5564300c360ac729086e2cc806e828a
+//	   84877f1eb8e5d974d873e06522490155
+//	   5fb8821590a33bacc61e39701cf9b46b
+//	   d25bf5f0595bbe24655141438e7a100b
+//
+func TestEd25519KeyPairRFC8032Vector(t *testing.T) {
+	seed, err := hex.DecodeString("9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60")
+	require.NoError(t, err)
+
+	k := NewEd25519KeyPairFromSeed(seed)
+	assert.Equal(t, "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a", hex.EncodeToString(k.Public[:]))
+
+	sig := k.Sign([]byte{})
+	expect := "e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b"
+	assert.Equal(t, expect, hex.EncodeToString(sig))
+}
+
+func TestEd25519KeyPairMatchesStandard(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	k := NewEd25519KeyPairFromSeed(priv[:32])
+	assert.Equal(t, []byte(pub), k.Public[:])
+
+	msg := []byte("hello world")
+	assert.Equal(t, ed25519.Sign(priv, msg), k.Sign(msg))
+}
+
+func TestEd25519KeyPairFromExpanded(t *testing.T) {
+	k, err := GenerateEd25519KeyPair()
+	require.NoError(t, err)
+	assert.Equal(t, k, NewEd25519KeyPairFromExpanded(k.Private))
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	k, err := GenerateEd25519KeyPair()
+	require.NoError(t, err)
+
+	msg := []byte("hello world")
+	sig := k.Sign(msg)
+	assert.True(t, VerifyEd25519(k.Public, msg, sig))
+	assert.False(t, VerifyEd25519(k.Public, []byte("goodbye world"), sig))
+}
+
+func TestEd25519KeyPairFromCurve25519(t *testing.T) {
+	for i := 0; i < 16; i++ {
+		k, err := GenerateCurve25519KeyPair()
+		require.NoError(t, err)
+		ed, signbit := Ed25519KeyPairFromCurve25519(k)
+		assert.Equal(t, ed.Public, Ed25519PublicKeyFromCurve25519(k.Public, signbit))
+
+		msg := []byte("hello")
+		assert.True(t, VerifyEd25519(ed.Public, msg, ed.Sign(msg)))
+	}
+}
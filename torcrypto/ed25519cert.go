@@ -0,0 +1,399 @@
+package torcrypto
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CertType identifies the purpose of a certificate.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/cert-spec.txt#L86-L98
+//
+//	   [01..03] -- Reserved. Used with X.509 certificates in the legacy
+//	               link handshake.
+//	   [04] - Ed25519 signing key with an identity key
+//	   [05] - TLS link certificate signed with ed25519 signing key
+//	   [06] - Ed25519 authentication key signed with ed25519 signing key
+//	   [07] - Reserved for RSA identity -> Ed25519 identity.
+//
+type CertType byte
+
+// Certificate types.
+const (
+	CertTypeSigningKey   CertType = 0x04
+	CertTypeTLSLink      CertType = 0x05
+	CertTypeAuthKey      CertType = 0x06
+	CertTypeRSACrossCert CertType = 0x07
+
+	// CertTypeNtorOnionKey certifies the Ed25519 identity key with an
+	// Ed25519 key derived from the ntor onion key. It is used for the
+	// "ntor-onion-key-crosscert" item in server descriptors.
+	CertTypeNtorOnionKey CertType = 0x0a
+)
+
+// CertKeyType identifies the kind of key certified by a certificate.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/cert-spec.txt#L72-L81
+//
+//	   The CERT_KEY_TYPE field is used to indicate the type of the
+//	   certified key. Currently defined values are:
+//
+//	      [01] - ed25519 key
+//	      [02] - SHA256 hash of an RSA key
+//	      [03] - SHA256 hash of an X.509 certificate
+//
+type CertKeyType byte
+
+// Certified key types.
+const (
+	CertKeyTypeEd25519    CertKeyType = 0x01
+	CertKeyTypeSHA256RSA  CertKeyType = 0x02
+	CertKeyTypeSHA256X509 CertKeyType = 0x03
+)
+
+// CertExtensionType identifies a certificate extension.
+type CertExtensionType byte
+
+// CertExtensionSignedWithKey contains the key that signed the certificate.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/cert-spec.txt#L122-L131
+//
+//	   ExtType: 04
+//	   ExtLength: 32
+//	   ExtData:
+//	      An ed25519 key    [32 bytes]
+//
+//	   When this extension is present, it MUST match the key used to
+//	   sign the certificate.
+//
+const CertExtensionSignedWithKey CertExtensionType = 0x04
+
+// CertExtensionAffectsValidation is the extension flag indicating the
+// extension must be understood for the certificate to be considered valid.
+const CertExtensionAffectsValidation byte = 0x01
+
+// Certificate errors.
+var (
+	ErrCertificateShort            = errors.New("certificate too short")
+	ErrCertificateVersion          = errors.New("unsupported certificate version")
+	ErrCertificateExpired          = errors.New("certificate expired")
+	ErrCertificateBadSignature     = errors.New("bad certificate signature")
+	ErrCertificateUnknownExtension = errors.New("unrecognized certificate extension affects validation")
+	ErrCertificateSignedWithKey    = errors.New("signed-with-key extension does not match signing key")
+	ErrCertificateTrailingData     = errors.New("trailing data after certificate")
+)
+
+const (
+	ed25519CertVersion    = 0x01
+	ed25519CertHeaderSize = 1 + 1 + 4 + 1 + 32 + 1
+)
+
+// CertExtension is an extension to an Ed25519 certificate.
+type CertExtension struct {
+	Type  CertExtensionType
+	Flags byte
+	Data  []byte
+}
+
+// Ed25519Certificate is a certificate in tor's own format, signed by an
+// Ed25519 key.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/cert-spec.txt#L37-L70
+//
+//	   The certificate format is:
+//
+//	       VERSION         [1 Byte]
+//	       CERT_TYPE       [1 Byte]
+//	       EXPIRATION_DATE [4 Bytes]
+//	       CERT_KEY_TYPE   [1 byte]
+//	       CERTIFIED_KEY   [32 Bytes]
+//	       N_EXTENSIONS    [1 byte]
+//	       EXTENSIONS      [N_EXTENSIONS times]
+//	       SIGNATURE       [64 Bytes]
+//
+//	   The "VERSION" field holds the value [01].  The "CERT_TYPE" field
+//	   holds a value depending on the type of certificate. (See appendix
+//	   A.1.) The CERTIFIED_KEY field is an Ed25519 public key if
+//	   CERT_KEY_TYPE is [01], or a SHA256 hash of some other key type
+//	   depending on the value of CERT_KEY_TYPE. The EXPIRATION_DATE is a
+//	   date, given in HOURS since the epoch, after which this
+//	   certificate isn't valid. (A four-byte field here will work fine
+//	   until 10136 A.D.)
+//
+//	   The EXTENSIONS field contains zero or more extensions, each of
+//	   the format:
+//
+//	          ExtLength [2 bytes]
+//	          ExtType   [1 byte]
+//	          ExtFlags  [1 byte]
+//	          ExtData   [ExtLength bytes]
+//
+//	   The SIGNATURE field holds a signature, by the signing key, of all
+//	   the bytes in the certificate that come before the signature.
+//
+type Ed25519Certificate struct {
+	Type         CertType
+	Expiration   time.Time
+	KeyType      CertKeyType
+	CertifiedKey [32]byte
+	Extensions   []CertExtension
+	Signature    []byte
+}
+
+// NewEd25519Certificate builds an unsigned certificate for key.
+func NewEd25519Certificate(typ CertType, keyType CertKeyType, key [32]byte, expiration time.Time) *Ed25519Certificate {
+	return &Ed25519Certificate{
+		Type:         typ,
+		Expiration:   truncateHour(expiration),
+		KeyType:      keyType,
+		CertifiedKey: key,
+	}
+}
+
+// Sign signs the certificate with k, including a signed-with-key extension
+// identifying k.
+func (c *Ed25519Certificate) Sign(k *Ed25519KeyPair) {
+	exts := []CertExtension{}
+	for _, ext := range c.Extensions {
+		if ext.Type != CertExtensionSignedWithKey {
+			exts = append(exts, ext)
+		}
+	}
+	c.Extensions = append(exts, CertExtension{
+		Type: CertExtensionSignedWithKey,
+		Data: append([]byte(nil), k.Public[:]...),
+	})
+	c.Signature = k.Sign(c.body())
+}
+
+// SigningKey returns the key from the signed-with-key extension, if present.
+func (c *Ed25519Certificate) SigningKey() ([32]byte, bool) {
+	var k [32]byte
+	for _, ext := range c.Extensions {
+		if ext.Type == CertExtensionSignedWithKey && len(ext.Data) == len(k) {
+			copy(k[:], ext.Data)
+			return k, true
+		}
+	}
+	return k, false
+}
+
+// Verify checks that the certificate has not expired at time now and is
+// correctly signed by pub.
+func (c *Ed25519Certificate) Verify(pub [32]byte, now time.Time) error {
+	if !now.Before(c.Expiration) {
+		return ErrCertificateExpired
+	}
+	for _, ext := range c.Extensions {
+		if ext.Type == CertExtensionSignedWithKey {
+			continue
+		}
+		if ext.Flags&CertExtensionAffectsValidation != 0 {
+			return ErrCertificateUnknownExtension
+		}
+	}
+	if k, ok := c.SigningKey(); ok && k != pub {
+		return ErrCertificateSignedWithKey
+	}
+	if !VerifyEd25519(pub, c.body(), c.Signature) {
+		return ErrCertificateBadSignature
+	}
+	return nil
+}
+
+// Encode returns the binary certificate.
+func (c *Ed25519Certificate) Encode() []byte {
+	return append(c.body(), c.Signature...)
+}
+
+// body returns the signed portion of the certificate.
+func (c *Ed25519Certificate) body() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteByte(ed25519CertVersion)
+	buf.WriteByte(byte(c.Type))
+	writeExpirationHours(buf, c.Expiration)
+	buf.WriteByte(byte(c.KeyType))
+	buf.Write(c.CertifiedKey[:])
+	buf.WriteByte(byte(len(c.Extensions)))
+	for _, ext := range c.Extensions {
+		var n [2]byte
+		binary.BigEndian.PutUint16(n[:], uint16(len(ext.Data)))
+		buf.Write(n[:])
+		buf.WriteByte(byte(ext.Type))
+		buf.WriteByte(ext.Flags)
+		buf.Write(ext.Data)
+	}
+	return buf.Bytes()
+}
+
+// ParseEd25519Certificate parses a binary certificate. The signature is not
+// verified.
+func ParseEd25519Certificate(b []byte) (*Ed25519Certificate, error) {
+	if len(b) < ed25519CertHeaderSize+Ed25519SignatureSize {
+		return nil, ErrCertificateShort
+	}
+	if b[0] != ed25519CertVersion {
+		return nil, ErrCertificateVersion
+	}
+
+	c := &Ed25519Certificate{
+		Type:       CertType(b[1]),
+		Expiration: parseExpirationHours(b[2:6]),
+		KeyType:    CertKeyType(b[6]),
+	}
+	copy(c.CertifiedKey[:], b[7:39])
+
+	n := int(b[39])
+	rest := b[ed25519CertHeaderSize:]
+	for i := 0; i < n; i++ {
+		if len(rest) < 4 {
+			return nil, ErrCertificateShort
+		}
+		size := int(binary.BigEndian.Uint16(rest))
+		if len(rest) < 4+size {
+			return nil, ErrCertificateShort
+		}
+		c.Extensions = append(c.Extensions, CertExtension{
+			Type:  CertExtensionType(rest[2]),
+			Flags: rest[3],
+			Data:  append([]byte(nil), rest[4:4+size]...),
+		})
+		rest = rest[4+size:]
+	}
+
+	if len(rest) < Ed25519SignatureSize {
+		return nil, ErrCertificateShort
+	}
+	if len(rest) > Ed25519SignatureSize {
+		return nil, ErrCertificateTrailingData
+	}
+	c.Signature = append([]byte(nil), rest...)
+
+	return c, nil
+}
+
+// rsaCrossCertPrefix is prepended to the cross-certificate body when signing.
+const rsaCrossCertPrefix = "Tor TLS RSA/Ed25519 cross-certificate"
+
+// RSACrossCert certifies an Ed25519 identity key with an RSA identity key
+// (certificate type 7).
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/cert-spec.txt#L183-L206
+//
+//	   In order to prove that an RSA identity key and an Ed25519 identity key
+//	   are controlled by the same entity, a relay can produce a cross-
+//	   certificate:
+//
+//	       ED25519_KEY                       [32 bytes]
+//	       EXPIRATION_DATE                   [4 bytes]
+//	       SIGLEN                            [1 byte]
+//	       SIGNATURE                         [SIGLEN bytes]
+//
+//	   Here, the Ed25519 identity key is signed with the RSA identity key,
+//	   using the following algorithm:
+//
+//	       SIGNATURE = RSA-SIGN(SHA256("Tor TLS RSA/Ed25519 cross-certificate"
+//	                                   | ED25519_KEY | EXPIRATION_DATE))
+//
+//	   where RSA-SIGN is an RSA signature with PKCS1 padding over the SHA256
+//	   digest, and EXPIRATION_DATE is in HOURS since the epoch.
+//
+type RSACrossCert struct {
+	Ed25519Key [32]byte
+	Expiration time.Time
+	Signature  []byte
+}
+
+// NewRSACrossCert builds an unsigned cross-certificate for key.
+func NewRSACrossCert(key [32]byte, expiration time.Time) *RSACrossCert {
+	return &RSACrossCert{
+		Ed25519Key: key,
+		Expiration: truncateHour(expiration),
+	}
+}
+
+// Sign signs the cross-certificate with the RSA identity key k.
+func (c *RSACrossCert) Sign(k *rsa.PrivateKey) error {
+	sig, err := SignRSASHA256(c.signedData(), k)
+	if err != nil {
+		return err
+	}
+	c.Signature = sig
+	return nil
+}
+
+// Verify checks that the cross-certificate has not expired at time now and is
+// correctly signed by the RSA identity key k.
+func (c *RSACrossCert) Verify(k *rsa.PublicKey, now time.Time) error {
+	if !now.Before(c.Expiration) {
+		return ErrCertificateExpired
+	}
+	if err := VerifyRSASHA256(k, c.signedData(), c.Signature); err != nil {
+		return ErrCertificateBadSignature
+	}
+	return nil
+}
+
+// Encode returns the binary cross-certificate.
+func (c *RSACrossCert) Encode() []byte {
+	b := c.body()
+	b = append(b, byte(len(c.Signature)))
+	return append(b, c.Signature...)
+}
+
+func (c *RSACrossCert) body() []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(c.Ed25519Key[:])
+	writeExpirationHours(buf, c.Expiration)
+	return buf.Bytes()
+}
+
+func (c *RSACrossCert) signedData() []byte {
+	return append([]byte(rsaCrossCertPrefix), c.body()...)
+}
+
+// ParseRSACrossCert parses a binary cross-certificate. The signature is not
+// verified.
+func ParseRSACrossCert(b []byte) (*RSACrossCert, error) {
+	if len(b) < 32+4+1 {
+		return nil, ErrCertificateShort
+	}
+	c := &RSACrossCert{
+		Expiration: parseExpirationHours(b[32:36]),
+	}
+	copy(c.Ed25519Key[:], b[:32])
+
+	n := int(b[36])
+	rest := b[37:]
+	if len(rest) < n {
+		return nil, ErrCertificateShort
+	}
+	if len(rest) > n {
+		return nil, ErrCertificateTrailingData
+	}
+	c.Signature = append([]byte(nil), rest...)
+
+	return c, nil
+}
+
+// truncateHour rounds t down to the hour, the precision of certificate
+// expiration dates.
+func truncateHour(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Hour)
+}
+
+// writeExpirationHours writes t as a 4-byte count of hours since the epoch.
+func writeExpirationHours(buf *bytes.Buffer, t time.Time) {
+	var h [4]byte
+	binary.BigEndian.PutUint32(h[:], uint32(t.Unix()/3600))
+	buf.Write(h[:])
+}
+
+func parseExpirationHours(b []byte) time.Time {
+	h := binary.BigEndian.Uint32(b)
+	return time.Unix(int64(h)*3600, 0).UTC()
+}
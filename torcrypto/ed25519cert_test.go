@@ -0,0 +1,115 @@
+package torcrypto
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSigningKeyCert(t *testing.T) (*Ed25519Certificate, *Ed25519KeyPair, *Ed25519KeyPair) {
+	id, err := GenerateEd25519KeyPair()
+	require.NoError(t, err)
+	signing, err := GenerateEd25519KeyPair()
+	require.NoError(t, err)
+
+	exp := time.Now().Add(24 * time.Hour)
+	c := NewEd25519Certificate(CertTypeSigningKey, CertKeyTypeEd25519, signing.Public, exp)
+	c.Sign(id)
+	return c, id, signing
+}
+
+func TestEd25519CertificateRoundTrip(t *testing.T) {
+	c, id, signing := testSigningKeyCert(t)
+
+	parsed, err := ParseEd25519Certificate(c.Encode())
+	require.NoError(t, err)
+	assert.Equal(t, c, parsed)
+
+	assert.Equal(t, CertTypeSigningKey, parsed.Type)
+	assert.Equal(t, signing.Public, parsed.CertifiedKey)
+	k, ok := parsed.SigningKey()
+	assert.True(t, ok)
+	assert.Equal(t, id.Public, k)
+	assert.NoError(t, parsed.Verify(id.Public, time.Now()))
+}
+
+func TestEd25519CertificateEncodingLength(t *testing.T) {
+	c, _, _ := testSigningKeyCert(t)
+	// Header, one 32-byte extension and signature.
+	assert.Len(t, c.Encode(), 40+4+32+64)
+}
+
+func TestEd25519CertificateVerifyErrors(t *testing.T) {
+	c, id, signing := testSigningKeyCert(t)
+
+	assert.Equal(t, ErrCertificateExpired, c.Verify(id.Public, c.Expiration))
+	assert.Equal(t, ErrCertificateSignedWithKey, c.Verify(signing.Public, time.Now()))
+
+	tampered := *c
+	tampered.Type = CertTypeAuthKey
+	assert.Equal(t, ErrCertificateBadSignature, tampered.Verify(id.Public, time.Now()))
+
+	c.Extensions = append(c.Extensions, CertExtension{Type: 0x42, Flags: CertExtensionAffectsValidation})
+	assert.Equal(t, ErrCertificateUnknownExtension, c.Verify(id.Public, time.Now()))
+}
+
+func TestEd25519CertificateIgnorableExtension(t *testing.T) {
+	id, err := GenerateEd25519KeyPair()
+	require.NoError(t, err)
+
+	c := NewEd25519Certificate(CertTypeAuthKey, CertKeyTypeEd25519, id.Public, time.Now().Add(time.Hour*2))
+	c.Extensions = []CertExtension{{Type: 0x42, Data: []byte("ignore me")}}
+	c.Sign(id)
+
+	parsed, err := ParseEd25519Certificate(c.Encode())
+	require.NoError(t, err)
+	require.Len(t, parsed.Extensions, 2)
+	assert.NoError(t, parsed.Verify(id.Public, time.Now()))
+}
+
+func TestParseEd25519CertificateErrors(t *testing.T) {
+	c, _, _ := testSigningKeyCert(t)
+	b := c.Encode()
+
+	_, err := ParseEd25519Certificate(b[:50])
+	assert.Equal(t, ErrCertificateShort, err)
+
+	_, err = ParseEd25519Certificate(append(b, 0))
+	assert.Equal(t, ErrCertificateTrailingData, err)
+
+	bad := append([]byte{}, b...)
+	bad[0] = 2
+	_, err = ParseEd25519Certificate(bad)
+	assert.Equal(t, ErrCertificateVersion, err)
+
+	// Claims more extensions than present.
+	bad = append([]byte{}, b...)
+	bad[39] = 5
+	_, err = ParseEd25519Certificate(bad)
+	assert.Equal(t, ErrCertificateShort, err)
+}
+
+func TestRSACrossCertRoundTrip(t *testing.T) {
+	k, err := GenerateRSA()
+	require.NoError(t, err)
+	id, err := GenerateEd25519KeyPair()
+	require.NoError(t, err)
+
+	c := NewRSACrossCert(id.Public, time.Now().Add(time.Hour*48))
+	require.NoError(t, c.Sign(k))
+
+	parsed, err := ParseRSACrossCert(c.Encode())
+	require.NoError(t, err)
+	assert.Equal(t, c, parsed)
+	assert.NoError(t, parsed.Verify(&k.PublicKey, time.Now()))
+
+	other, err := GenerateRSA()
+	require.NoError(t, err)
+	assert.Equal(t, ErrCertificateBadSignature, parsed.Verify(&other.PublicKey, time.Now()))
+	assert.Equal(t, ErrCertificateExpired, parsed.Verify(&k.PublicKey, time.Now().Add(time.Hour*72)))
+
+	_, err = ParseRSACrossCert(c.Encode()[:40])
+	assert.Equal(t, ErrCertificateShort, err)
+}
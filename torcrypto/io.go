@@ -135,7 +135,107 @@ func SaveCurve25519KeyPairPrivateKeyToFile(k *Curve25519KeyPair, filename, label
 }
 
 func curve25519FileMagic(label string) ([]byte, error) {
-	leader := fmt.Sprintf("== c25519v1: %s ==", label)
+	return taggedFileMagic("c25519v1", label)
+}
+
+// Tags for Ed25519 key and certificate files.
+const (
+	ed25519KeyTag  = "type0"
+	ed25519CertTag = "type4"
+)
+
+// LoadEd25519KeyPairFromFile loads an Ed25519 secret key from a file in tor's
+// format.
+func LoadEd25519KeyPairFromFile(filename string) (*Ed25519KeyPair, error) {
+	if err := CheckPrivateKeyPermissions(filename); err != nil {
+		return nil, err
+	}
+
+	b, err := loadTaggedFile(filename, "ed25519v1-secret", ed25519KeyTag, Ed25519SecretKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	var secret [Ed25519SecretKeySize]byte
+	copy(secret[:], b)
+	return NewEd25519KeyPairFromExpanded(secret), nil
+}
+
+// SaveEd25519KeyPairToFile writes the secret key to a file in tor's format.
+func SaveEd25519KeyPairToFile(k *Ed25519KeyPair, filename string) error {
+	return saveTaggedFile(filename, "ed25519v1-secret", ed25519KeyTag, k.Private[:], privateKeyPermissions)
+}
+
+// LoadEd25519PublicKeyFromFile loads an Ed25519 public key from a file in
+// tor's format.
+func LoadEd25519PublicKeyFromFile(filename string) ([Ed25519PublicKeySize]byte, error) {
+	var pub [Ed25519PublicKeySize]byte
+	b, err := loadTaggedFile(filename, "ed25519v1-public", ed25519KeyTag, Ed25519PublicKeySize)
+	if err != nil {
+		return pub, err
+	}
+	copy(pub[:], b)
+	return pub, nil
+}
+
+// SaveEd25519PublicKeyToFile writes the public key to a file in tor's format.
+func SaveEd25519PublicKeyToFile(pub [Ed25519PublicKeySize]byte, filename string) error {
+	return saveTaggedFile(filename, "ed25519v1-public", ed25519KeyTag, pub[:], publicKeyPermissions)
+}
+
+// LoadEd25519CertificateFromFile loads a signing key certificate from a file
+// in tor's format.
+func LoadEd25519CertificateFromFile(filename string) (*Ed25519Certificate, error) {
+	b, err := loadTaggedFile(filename, "ed25519v1-cert", ed25519CertTag, -1)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEd25519Certificate(b)
+}
+
+// SaveEd25519CertificateToFile writes a signing key certificate to a file in
+// tor's format.
+func SaveEd25519CertificateToFile(c *Ed25519Certificate, filename string) error {
+	return saveTaggedFile(filename, "ed25519v1-cert", ed25519CertTag, c.Encode(), publicKeyPermissions)
+}
+
+// loadTaggedFile reads a file consisting of a 32-byte header followed by
+// data. If size is non-negative the data must be exactly that long.
+func loadTaggedFile(filename, typ, tag string, size int) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read file")
+	}
+
+	magic, err := taggedFileMagic(typ, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < len(magic) || !bytes.Equal(b[:len(magic)], magic) {
+		return nil, errors.Errorf("incorrect magic bytes in %s file", typ)
+	}
+
+	data := b[len(magic):]
+	if size >= 0 && len(data) != size {
+		return nil, errors.Errorf("%s file should contain %d bytes of data", typ, size)
+	}
+
+	return data, nil
+}
+
+func saveTaggedFile(filename, typ, tag string, data []byte, perm os.FileMode) error {
+	magic, err := taggedFileMagic(typ, tag)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(magic, data...), perm)
+}
+
+// taggedFileMagic returns the 32-byte header tor writes at the start of key
+// files.
+func taggedFileMagic(typ, tag string) ([]byte, error) {
+	leader := fmt.Sprintf("== %s: %s ==", typ, tag)
 	if len(leader) > 32 {
 		return nil, errors.New("label too long")
 	}
@@ -44,3 +44,34 @@ func TestCheckPermissionsAtMost(t *testing.T) {
 		}
 	}
 }
+
+func TestEd25519FilesRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ed25519filestest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	k, err := GenerateEd25519KeyPair()
+	require.NoError(t, err)
+
+	secret := filepath.Join(dir, "ed25519_master_id_secret_key")
+	require.NoError(t, SaveEd25519KeyPairToFile(k, secret))
+	loaded, err := LoadEd25519KeyPairFromFile(secret)
+	require.NoError(t, err)
+	assert.Equal(t, k, loaded)
+
+	b, err := ioutil.ReadFile(secret)
+	require.NoError(t, err)
+	assert.Len(t, b, 96)
+	assert.Equal(t, "== ed25519v1-secret: type0 ==\x00\x00\x00", string(b[:32]))
+
+	public := filepath.Join(dir, "ed25519_master_id_public_key")
+	require.NoError(t, SaveEd25519PublicKeyToFile(k.Public, public))
+	pub, err := LoadEd25519PublicKeyFromFile(public)
+	require.NoError(t, err)
+	assert.Equal(t, k.Public, pub)
+
+	// Secret key loader rejects the public key file.
+	require.NoError(t, SetPrivateKeyPermissions(public))
+	_, err = LoadEd25519KeyPairFromFile(public)
+	assert.Error(t, err)
+}
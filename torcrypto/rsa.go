@@ -88,6 +88,13 @@ func SignRSASHA256(data []byte, k *rsa.PrivateKey) ([]byte, error) {
 	return signRSA(data, k, sha256.New())
 }
 
+// SignRSANoDigest signs data with k directly, without hashing it first. This
+// is the RSA encryption of data with PKCS#1 v1.5 padding, so data must be
+// short enough to fit in a single block.
+func SignRSANoDigest(data []byte, k *rsa.PrivateKey) ([]byte, error) {
+	return rsa.SignPKCS1v15(nil, k, 0, data)
+}
+
 func signRSA(data []byte, k *rsa.PrivateKey, h hash.Hash) ([]byte, error) {
 	_, err := h.Write(data)
 	if err != nil {
@@ -108,6 +115,12 @@ func VerifyRSASHA256(k *rsa.PublicKey, data, sig []byte) error {
 	return verifyRSA(k, data, sig, sha256.New())
 }
 
+// VerifyRSANoDigest verifies an RSA signature of data, as produced by
+// SignRSANoDigest.
+func VerifyRSANoDigest(k *rsa.PublicKey, data, sig []byte) error {
+	return rsa.VerifyPKCS1v15(k, 0, data, sig)
+}
+
 func verifyRSA(k *rsa.PublicKey, data, sig []byte, h hash.Hash) error {
 	_, err := h.Write(data)
 	if err != nil {
@@ -121,3 +121,14 @@ func TestSignVerifyRSA(t *testing.T) {
 	require.NoError(t, err)
 	assert.NoError(t, VerifyRSASHA256(&k.PublicKey, data, sig))
 }
+
+func TestSignRSANoDigest(t *testing.T) {
+	k, err := GenerateRSA()
+	require.NoError(t, err)
+	data := make([]byte, 52)
+	sig, err := SignRSANoDigest(data, k)
+	require.NoError(t, err)
+	assert.NoError(t, VerifyRSANoDigest(&k.PublicKey, data, sig))
+	data[0] = 1
+	assert.Error(t, VerifyRSANoDigest(&k.PublicKey, data, sig))
+}
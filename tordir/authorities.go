@@ -1,6 +1,13 @@
 package tordir
 
-import "github.com/erans/gonionoo"
+import (
+	"bytes"
+	"encoding/hex"
+	"net"
+	"strconv"
+
+	"github.com/erans/gonionoo"
+)
 
 // Reference: https://github.com/torproject/tor/blob/f755f9b9e67232d9d39682cbcdf4433ac738e17a/src/or/config.c#L1063-L1097
 //
@@ -41,21 +48,141 @@ import "github.com/erans/gonionoo"
 //	};
 //
 
-// Authorities is a list of the directory addresses for the Tor directory
-// authorities. This is unlikely to change often, but can be queried with the
-// SearchAuthorityDirectoryAddresses() function. Listed at
-// https://atlas.torproject.org/#search/flag:authority.
-var Authorities = []string{
-	"193.23.244.244:80",  // dannenberg
-	"199.58.81.140:80",   // longclaw
-	"194.109.206.212:80", // dizum
-	"131.188.40.189:80",  // gabelmoo
-	"86.59.21.38:80",     // tor26
-	"37.218.247.217:80",  // Bifroest
-	"154.35.175.225:80",  // Faravahar
-	"128.31.0.34:9131",   // moria1
-	"171.25.193.9:443",   // maatuska
-	"204.13.164.118:80",  // bastet
+// Authority is a directory authority.
+type Authority struct {
+	Nickname string
+	// Address is the directory address.
+	Address string
+	ORPort  uint16
+	// IPv6ORAddress is the IPv6 OR address, if any.
+	IPv6ORAddress string
+	// V3Identity is the hex fingerprint of the v3 authority identity key,
+	// which certifies its signing keys. It is empty for bridge authorities.
+	V3Identity string
+	// Fingerprint is the hex fingerprint of the router identity key.
+	Fingerprint string
+}
+
+// DefaultAuthorities are the default directory authorities, as listed above.
+var DefaultAuthorities = []*Authority{
+	{
+		Nickname:    "moria1",
+		Address:     "128.31.0.39:9131",
+		ORPort:      9101,
+		V3Identity:  "D586D18309DED4CD6D57C18FDB97EFA96D330566",
+		Fingerprint: "9695DFC35FFEB861329B9F1AB04C46397020CE31",
+	},
+	{
+		Nickname:      "tor26",
+		Address:       "86.59.21.38:80",
+		ORPort:        443,
+		IPv6ORAddress: "[2001:858:2:2:aabb:0:563b:1526]:443",
+		V3Identity:    "14C131DFC5C6F93646BE72FA1401C02A8DF2E8B4",
+		Fingerprint:   "847B1F850344D7876491A54892F904934E4EB85D",
+	},
+	{
+		Nickname:    "dizum",
+		Address:     "194.109.206.212:80",
+		ORPort:      443,
+		V3Identity:  "E8A9C45EDE6D711294FADF8E7951F4DE6CA56B58",
+		Fingerprint: "7EA6EAD6FD83083C538F44038BBFA077587DD755",
+	},
+	{
+		Nickname:    "Bifroest",
+		Address:     "37.218.247.217:80",
+		ORPort:      443,
+		Fingerprint: "1D8F3A91C37C5D1C4C19B1AD1D0CFBE8BF72D8E1",
+	},
+	{
+		Nickname:      "gabelmoo",
+		Address:       "131.188.40.189:80",
+		ORPort:        443,
+		IPv6ORAddress: "[2001:638:a000:4140::ffff:189]:443",
+		V3Identity:    "ED03BB616EB2F60BEC80151114BB25CEF515B226",
+		Fingerprint:   "F2044413DAC2E02E3D6BCF4735A19BCA1DE97281",
+	},
+	{
+		Nickname:    "dannenberg",
+		Address:     "193.23.244.244:80",
+		ORPort:      443,
+		V3Identity:  "0232AF901C31A04EE9848595AF9BB7620D4C5B2E",
+		Fingerprint: "7BE683E65D48141321C5ED92F075C55364AC7123",
+	},
+	{
+		Nickname:      "maatuska",
+		Address:       "171.25.193.9:443",
+		ORPort:        80,
+		IPv6ORAddress: "[2001:67c:289c::9]:80",
+		V3Identity:    "49015F787433103580E3B66A1707A00E60F2D15B",
+		Fingerprint:   "BD6A829255CB08E66FBE7D3748363586E46B3810",
+	},
+	{
+		Nickname:    "Faravahar",
+		Address:     "154.35.175.225:80",
+		ORPort:      443,
+		V3Identity:  "EFCBE720AB3A82B99F9E953CD5BF50F7EEFC7B97",
+		Fingerprint: "CF6D0AAFB385BE71B8E111FC5CFF4B47923733BC",
+	},
+	{
+		Nickname:    "longclaw",
+		Address:     "199.58.81.140:80",
+		ORPort:      443,
+		V3Identity:  "23D15D965BC35114467363C165C4F724B64B4F66",
+		Fingerprint: "74A910646BCEEFBCD2E874FC1DC997430F968145",
+	},
+	{
+		Nickname:    "bastet",
+		Address:     "204.13.164.118:80",
+		ORPort:      443,
+		V3Identity:  "27102BC123E7AF1D4741AE047E160C91ADC76B21",
+		Fingerprint: "24E2F139121D4394C54B5BCC368B3B411857C413",
+	},
+}
+
+// ORAddress returns the IPv4 OR address of the authority.
+func (a *Authority) ORAddress() (string, error) {
+	host, _, err := net.SplitHostPort(a.Address)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(a.ORPort))), nil
+}
+
+// V3Authorities returns the authorities with a v3 identity, which vote on and
+// sign the consensus.
+func V3Authorities(auths []*Authority) []*Authority {
+	var v3 []*Authority
+	for _, a := range auths {
+		if a.V3Identity != "" {
+			v3 = append(v3, a)
+		}
+	}
+	return v3
+}
+
+// isV3Authority reports whether fp is the v3 identity of one of auths.
+func isV3Authority(auths []*Authority, fp []byte) bool {
+	for _, a := range V3Authorities(auths) {
+		id, err := hex.DecodeString(a.V3Identity)
+		if err == nil && bytes.Equal(id, fp) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorities is a list of the directory addresses of DefaultAuthorities.
+// This is unlikely to change often, but can be queried with the
+// SearchAuthorityDirectoryAddresses() function.
+var Authorities = DirectoryAddresses(DefaultAuthorities)
+
+// DirectoryAddresses returns the directory addresses of auths.
+func DirectoryAddresses(auths []*Authority) []string {
+	addrs := make([]string, len(auths))
+	for i, a := range auths {
+		addrs[i] = a.Address
+	}
+	return addrs
 }
 
 // SearchAuthorityDirectoryAddresses queries the onionoo API for the directory
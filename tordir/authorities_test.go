@@ -1,6 +1,7 @@
 package tordir
 
 import (
+	"encoding/hex"
 	"io/ioutil"
 	"net/http"
 	"sort"
@@ -32,7 +33,19 @@ func TestSearchAuthorityDirectoryAddresses(t *testing.T) {
 
 	addresses, err := SearchWithResponder(responder)
 	require.NoError(t, err)
-	assert.Equal(t, Authorities, addresses)
+	expect := []string{
+		"193.23.244.244:80",
+		"199.58.81.140:80",
+		"194.109.206.212:80",
+		"131.188.40.189:80",
+		"86.59.21.38:80",
+		"37.218.247.217:80",
+		"154.35.175.225:80",
+		"128.31.0.34:9131",
+		"171.25.193.9:443",
+		"204.13.164.118:80",
+	}
+	assert.Equal(t, expect, addresses)
 }
 
 func TestSearchAuthorityDirectoryAddressesError(t *testing.T) {
@@ -49,3 +62,37 @@ func TestAuthoritiesListIsUpToDate(t *testing.T) {
 	sort.Strings(addrs)
 	assert.Equal(t, Authorities, addrs)
 }
+
+func TestDefaultAuthorities(t *testing.T) {
+	assert.Len(t, DefaultAuthorities, 10)
+	v3 := V3Authorities(DefaultAuthorities)
+	assert.Len(t, v3, 9)
+	for _, a := range v3 {
+		id, err := hex.DecodeString(a.V3Identity)
+		require.NoError(t, err)
+		assert.Len(t, id, 20, a.Nickname)
+		assert.True(t, isV3Authority(DefaultAuthorities, id))
+	}
+	for _, a := range DefaultAuthorities {
+		fp, err := hex.DecodeString(a.Fingerprint)
+		require.NoError(t, err)
+		assert.Len(t, fp, 20, a.Nickname)
+	}
+}
+
+func TestAuthoritiesFromDefaultAuthorities(t *testing.T) {
+	require.Len(t, Authorities, len(DefaultAuthorities))
+	for i, a := range DefaultAuthorities {
+		assert.Equal(t, a.Address, Authorities[i], a.Nickname)
+	}
+	assert.Equal(t, "128.31.0.39:9131", Authorities[0])
+}
+
+func TestAuthorityORAddress(t *testing.T) {
+	addr, err := DefaultAuthorities[0].ORAddress()
+	require.NoError(t, err)
+	assert.Equal(t, "128.31.0.39:9101", addr)
+
+	_, err = (&Authority{Address: "nope"}).ORAddress()
+	assert.Error(t, err)
+}
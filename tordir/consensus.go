@@ -0,0 +1,470 @@
+package tordir
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/mmcloughlin/pearl/torexitpolicy"
+)
+
+const (
+	networkStatusVersionKeyword = "network-status-version"
+	validAfterKeyword           = "valid-after"
+	freshUntilKeyword           = "fresh-until"
+	validUntilKeyword           = "valid-until"
+	knownFlagsKeyword           = "known-flags"
+	paramsKeyword               = "params"
+	directoryFooterKeyword      = "directory-footer"
+	directorySignatureKeyword   = "directory-signature"
+
+	routerStatusKeyword          = "r"
+	routerAddressKeyword         = "a"
+	routerFlagsKeyword           = "s"
+	routerVersionKeyword         = "v"
+	routerProtocolsKeyword       = "pr"
+	routerBandwidthKeyword       = "w"
+	routerPolicyKeyword          = "p"
+	routerMicrodescriptorKeyword = "m"
+)
+
+// Consensus parsing and verification errors.
+var (
+	ErrConsensusMalformed          = errors.New("malformed consensus")
+	ErrConsensusUnsigned           = errors.New("consensus has no signatures")
+	ErrConsensusInsufficientQuorum = errors.New("insufficient valid consensus signatures")
+	ErrConsensusNotYetValid        = errors.New("consensus not yet valid")
+)
+
+// timeLayout is the format of timestamps in directory documents.
+const timeLayout = "2006-01-02 15:04:05"
+
+// Consensus is a network-status consensus document.
+type Consensus struct {
+	Flavor     string // empty for the "ns" flavor
+	ValidAfter time.Time
+	FreshUntil time.Time
+	ValidUntil time.Time
+	KnownFlags []string
+	Params     map[string]int
+	Routers    []*RouterStatus
+	Signatures []*DirectorySignature
+
+	// signed is the portion of the document covered by the signatures.
+	signed []byte
+	byID   map[string]*RouterStatus
+}
+
+// RouterStatus is a router entry in a consensus.
+type RouterStatus struct {
+	Nickname    string
+	Identity    []byte // SHA-1 fingerprint of the identity key
+	Digest      []byte // descriptor digest, nil in the microdesc flavor
+	Published   time.Time
+	Address     net.IP
+	ORPort      uint16
+	DirPort     uint16
+	ORAddresses []*net.TCPAddr
+	Flags       []string
+	Version     string
+	Protocols   string
+	Bandwidth   int
+	Unmeasured  bool
+	ExitPolicy  *torexitpolicy.Summary
+	// MicrodescriptorDigest is the SHA-256 digest of the router's
+	// microdescriptor, in the microdesc flavor only.
+	MicrodescriptorDigest []byte
+}
+
+// HasFlag reports whether the router has the given flag.
+func (r *RouterStatus) HasFlag(flag string) bool {
+	for _, f := range r.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// DirectorySignature is an authority signature on a consensus.
+type DirectorySignature struct {
+	Algorithm        string // "sha1" or "sha256"
+	Identity         []byte // SHA-1 fingerprint of the authority identity key
+	SigningKeyDigest []byte // SHA-1 digest of the authority signing key
+	Signature        []byte
+}
+
+// AuthorityKey is an authority signing key, used to verify consensus
+// signatures.
+type AuthorityKey struct {
+	Identity   []byte // SHA-1 fingerprint of the authority identity key
+	SigningKey *rsa.PublicKey
+}
+
+// ParseConsensus parses a network-status consensus document.
+func ParseConsensus(b []byte) (*Consensus, error) {
+	doc, err := Parse(b)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Consensus{
+		Params: map[string]int{},
+		byID:   map[string]*RouterStatus{},
+	}
+
+	items := doc.items
+	if len(items) == 0 || items[0].Keyword != networkStatusVersionKeyword {
+		return nil, errors.Wrap(ErrConsensusMalformed, "missing network-status-version")
+	}
+	if args := arguments(items[0]); len(args) > 1 {
+		c.Flavor = args[1]
+	}
+
+	var r *RouterStatus
+	for _, item := range items {
+		args := arguments(item)
+		switch item.Keyword {
+		case validAfterKeyword:
+			c.ValidAfter, err = parseTime(args)
+		case freshUntilKeyword:
+			c.FreshUntil, err = parseTime(args)
+		case validUntilKeyword:
+			c.ValidUntil, err = parseTime(args)
+		case knownFlagsKeyword:
+			c.KnownFlags = args
+		case paramsKeyword:
+			err = c.parseParams(args)
+		case routerStatusKeyword:
+			r, err = parseRouterStatus(args, c.Flavor == "")
+			if err == nil {
+				c.Routers = append(c.Routers, r)
+				c.byID[string(r.Identity)] = r
+			}
+		case directoryFooterKeyword:
+			r = nil
+		case directorySignatureKeyword:
+			r = nil
+			var sig *DirectorySignature
+			sig, err = parseDirectorySignature(item)
+			if err == nil {
+				c.Signatures = append(c.Signatures, sig)
+			}
+		default:
+			if r != nil {
+				err = r.parseItem(item.Keyword, args)
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %q", item.Keyword)
+		}
+	}
+
+	if c.ValidAfter.IsZero() || c.FreshUntil.IsZero() || c.ValidUntil.IsZero() {
+		return nil, errors.Wrap(ErrConsensusMalformed, "missing validity times")
+	}
+
+	// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+	//
+	//	        This is a signature of the status document, with the initial item
+	//	        "network-status-version", and the signature item
+	//	        "directory-signature", using the signing key.  (In this case, we take
+	//	        the hash through the _space_ after directory-signature, not the
+	//	        newline: this ensures that all authorities sign the same thing.)
+	//
+	marker := []byte("\n" + directorySignatureKeyword + " ")
+	if i := bytes.Index(b, marker); i >= 0 {
+		c.signed = b[:i+len(marker)]
+	}
+
+	return c, nil
+}
+
+// parseParams parses the "params" line, a list of space separated
+// "Keyword=Int32" pairs.
+func (c *Consensus) parseParams(args []string) error {
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("malformed parameter %q", arg)
+		}
+		v, err := strconv.ParseInt(parts[1], 10, 32)
+		if err != nil {
+			return err
+		}
+		c.Params[parts[0]] = int(v)
+	}
+	return nil
+}
+
+// parseRouterStatus parses the arguments of an "r" line. The descriptor
+// digest is present only in the "ns" flavor.
+func parseRouterStatus(args []string, hasDigest bool) (*RouterStatus, error) {
+	n := 7
+	if hasDigest {
+		n = 8
+	}
+	if len(args) != n {
+		return nil, ErrConsensusMalformed
+	}
+
+	r := &RouterStatus{Nickname: args[0]}
+	var err error
+	if r.Identity, err = decodeBase64(args[1]); err != nil {
+		return nil, err
+	}
+	args = args[2:]
+	if hasDigest {
+		if r.Digest, err = decodeBase64(args[0]); err != nil {
+			return nil, err
+		}
+		args = args[1:]
+	}
+	if r.Published, err = parseTime(args[:2]); err != nil {
+		return nil, err
+	}
+	if r.Address = net.ParseIP(args[2]); r.Address == nil {
+		return nil, errors.New("bad router address")
+	}
+	if r.ORPort, err = parsePort(args[3]); err != nil {
+		return nil, err
+	}
+	if r.DirPort, err = parsePort(args[4]); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// parseItem parses an item following the "r" line of a router entry.
+// Unrecognized items are ignored.
+func (r *RouterStatus) parseItem(keyword string, args []string) error {
+	switch keyword {
+	case routerAddressKeyword:
+		if len(args) != 1 {
+			return ErrConsensusMalformed
+		}
+		addr, err := net.ResolveTCPAddr("tcp", args[0])
+		if err != nil || addr.IP == nil {
+			return errors.New("bad router address")
+		}
+		r.ORAddresses = append(r.ORAddresses, addr)
+	case routerFlagsKeyword:
+		r.Flags = args
+	case routerVersionKeyword:
+		r.Version = strings.Join(args, " ")
+	case routerProtocolsKeyword:
+		r.Protocols = strings.Join(args, " ")
+	case routerBandwidthKeyword:
+		for _, arg := range args {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			switch parts[0] {
+			case "Bandwidth":
+				bw, err := strconv.Atoi(parts[1])
+				if err != nil {
+					return err
+				}
+				r.Bandwidth = bw
+			case "Unmeasured":
+				r.Unmeasured = parts[1] == "1"
+			}
+		}
+	case routerPolicyKeyword:
+		s, err := torexitpolicy.ParseSummary(strings.Join(args, " "))
+		if err != nil {
+			return err
+		}
+		r.ExitPolicy = &s
+	case routerMicrodescriptorKeyword:
+		if len(args) != 1 {
+			return ErrConsensusMalformed
+		}
+		d, err := decodeBase64(args[0])
+		if err != nil {
+			return err
+		}
+		r.MicrodescriptorDigest = d
+	}
+	return nil
+}
+
+// parseDirectorySignature parses a "directory-signature" item.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "directory-signature" [SP Algorithm] SP identity SP signing-key-digest
+//	        NL Signature
+//
+func parseDirectorySignature(item *Item) (*DirectorySignature, error) {
+	args := arguments(item)
+	sig := &DirectorySignature{Algorithm: "sha1"}
+	switch len(args) {
+	case 2:
+	case 3:
+		sig.Algorithm = args[0]
+		args = args[1:]
+	default:
+		return nil, ErrConsensusMalformed
+	}
+
+	var err error
+	if sig.Identity, err = hex.DecodeString(args[0]); err != nil {
+		return nil, err
+	}
+	if sig.SigningKeyDigest, err = hex.DecodeString(args[1]); err != nil {
+		return nil, err
+	}
+	if sig.Signature, err = itemObject(item); err != nil {
+		return nil, err
+	}
+	return sig, nil
+}
+
+// Router looks up a router by identity fingerprint.
+func (c *Consensus) Router(fingerprint []byte) (*RouterStatus, bool) {
+	r, ok := c.byID[string(fingerprint)]
+	return r, ok
+}
+
+// RoutersWithFlags returns the routers that have all the given flags.
+func (c *Consensus) RoutersWithFlags(flags ...string) []*RouterStatus {
+	var routers []*RouterStatus
+	for _, r := range c.Routers {
+		match := true
+		for _, f := range flags {
+			match = match && r.HasFlag(f)
+		}
+		if match {
+			routers = append(routers, r)
+		}
+	}
+	return routers
+}
+
+// Param returns the named consensus parameter, or def if it is not set.
+func (c *Consensus) Param(name string, def int) int {
+	if v, ok := c.Params[name]; ok {
+		return v
+	}
+	return def
+}
+
+// Live reports whether the consensus is valid at time t.
+func (c *Consensus) Live(t time.Time) bool {
+	return !t.Before(c.ValidAfter) && !t.After(c.ValidUntil)
+}
+
+// Verify checks the consensus signatures against the given authority keys.
+// At least threshold distinct authorities must have valid signatures.
+// Signatures from unknown authorities are ignored. A consensus used at time
+// now, before its valid-after time, is rejected.
+func (c *Consensus) Verify(keys []*AuthorityKey, threshold int, now time.Time) error {
+	if len(c.Signatures) == 0 || c.signed == nil {
+		return ErrConsensusUnsigned
+	}
+	if now.Before(c.ValidAfter) {
+		return ErrConsensusNotYetValid
+	}
+
+	valid := map[string]bool{}
+	for _, sig := range c.Signatures {
+		for _, k := range keys {
+			if bytes.Equal(sig.Identity, k.Identity) && c.verifySignature(sig, k.SigningKey) {
+				valid[string(k.Identity)] = true
+			}
+		}
+	}
+
+	if len(valid) < threshold {
+		return errors.Wrapf(ErrConsensusInsufficientQuorum, "%d of %d required", len(valid), threshold)
+	}
+	return nil
+}
+
+// verifySignature reports whether sig is a valid signature by k.
+func (c *Consensus) verifySignature(sig *DirectorySignature, k *rsa.PublicKey) bool {
+	digest, err := torcrypto.Fingerprint(k)
+	if err != nil || !bytes.Equal(digest, sig.SigningKeyDigest) {
+		return false
+	}
+	switch sig.Algorithm {
+	case "sha1":
+		return torcrypto.VerifyRSASHA1(k, c.signed, sig.Signature) == nil
+	case "sha256":
+		return torcrypto.VerifyRSASHA256(k, c.signed, sig.Signature) == nil
+	}
+	return false
+}
+
+// SignConsensus appends a sha256 directory-signature to the consensus
+// document b, made with the signing key of the authority with the given v3
+// identity fingerprint. The document may already carry signatures.
+func SignConsensus(b, identity []byte, signing *rsa.PrivateKey) ([]byte, error) {
+	marker := []byte("\n" + directorySignatureKeyword + " ")
+	signed := append(append([]byte{}, b...), marker[1:]...)
+	if i := bytes.Index(b, marker); i >= 0 {
+		signed = b[:i+len(marker)]
+	}
+
+	digest, err := torcrypto.Fingerprint(&signing.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := torcrypto.SignRSASHA256(signed, signing)
+	if err != nil {
+		return nil, err
+	}
+
+	item := NewItemWithObject(directorySignatureKeyword, []string{
+		"sha256",
+		strings.ToUpper(hex.EncodeToString(identity)),
+		strings.ToUpper(hex.EncodeToString(digest)),
+	}, &pem.Block{Type: "SIGNATURE", Bytes: sig})
+	return append(append([]byte{}, b...), item.Encode()...), nil
+}
+
+// Quorum returns the number of signatures required from n authorities: more
+// than half of them.
+func Quorum(n int) int {
+	return n/2 + 1
+}
+
+// arguments returns the non-empty arguments of an item.
+func arguments(item *Item) []string {
+	args := make([]string, 0, len(item.Arguments))
+	for _, arg := range item.Arguments {
+		if arg != "" {
+			args = append(args, arg)
+		}
+	}
+	return args
+}
+
+// parseTime parses a timestamp split across two arguments.
+func parseTime(args []string) (time.Time, error) {
+	if len(args) != 2 {
+		return time.Time{}, ErrConsensusMalformed
+	}
+	return time.Parse(timeLayout, args[0]+" "+args[1])
+}
+
+func parsePort(s string) (uint16, error) {
+	p, err := strconv.ParseUint(s, 10, 16)
+	return uint16(p), err
+}
+
+// decodeBase64 decodes base64 with or without trailing padding.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(s, "="))
+}
@@ -0,0 +1,237 @@
+package tordir
+
+import (
+	"crypto/rsa"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+)
+
+const testConsensusBody = `network-status-version 3
+vote-status consensus
+consensus-method 28
+valid-after 2018-03-01 12:00:00
+fresh-until 2018-03-01 13:00:00
+valid-until 2018-03-01 15:00:00
+voting-delay 300 300
+known-flags Exit Fast Guard Running Stable V2Dir Valid
+params CircuitPriorityHalflifeMsec=30000 nf_ito_low=1500 nf_ito_high=9500
+r alpha AAECAwQFBgcICQoLDA0ODxAREhM 8+GiQUlgMVVV7hcMqOFm+4+xUgw 2018-03-01 10:15:00 203.0.113.1 9001 9030
+a [2001:db8::1]:9001
+s Exit Fast Running Stable Valid
+v Tor 0.3.2.10
+pr Cons=1-2 Link=1-5 Relay=1-2
+w Bandwidth=5120
+p accept 80,443
+r beta FBUWFxgZGhscHR4fICEiIyQlJic lBNgN3dPoGRphnS0UuCbFzmUTjM 2018-03-01 11:45:00 198.51.100.7 443 0
+s Fast Guard Running V2Dir Valid
+v Tor 0.3.3.3-alpha
+w Bandwidth=20 Unmeasured=1
+p reject 1-65535
+directory-footer
+`
+
+// testAuthority is a directory authority for signing test consensuses.
+type testAuthority struct {
+	identity []byte
+	key      *rsa.PrivateKey
+}
+
+func newTestAuthority(t *testing.T) *testAuthority {
+	id, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	fp, err := torcrypto.Fingerprint(&id.PublicKey)
+	require.NoError(t, err)
+	k, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	return &testAuthority{identity: fp, key: k}
+}
+
+func (a *testAuthority) AuthorityKey() *AuthorityKey {
+	return &AuthorityKey{Identity: a.identity, SigningKey: &a.key.PublicKey}
+}
+
+// signTestConsensus appends a directory-signature from each authority.
+func signTestConsensus(t *testing.T, body string, auths ...*testAuthority) []byte {
+	doc := []byte(body)
+	for _, a := range auths {
+		var err error
+		doc, err = SignConsensus(doc, a.identity, a.key)
+		require.NoError(t, err)
+	}
+	return doc
+}
+
+func TestParseConsensus(t *testing.T) {
+	a := newTestAuthority(t)
+	c, err := ParseConsensus(signTestConsensus(t, testConsensusBody, a))
+	require.NoError(t, err)
+
+	assert.Equal(t, "", c.Flavor)
+	assert.Equal(t, time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC), c.ValidAfter)
+	assert.Equal(t, time.Date(2018, 3, 1, 13, 0, 0, 0, time.UTC), c.FreshUntil)
+	assert.Equal(t, time.Date(2018, 3, 1, 15, 0, 0, 0, time.UTC), c.ValidUntil)
+	assert.Len(t, c.KnownFlags, 7)
+	assert.Equal(t, 1500, c.Param("nf_ito_low", 0))
+	assert.Equal(t, 42, c.Param("missing", 42))
+
+	require.Len(t, c.Routers, 2)
+	r := c.Routers[0]
+	assert.Equal(t, "alpha", r.Nickname)
+	assert.Len(t, r.Digest, 20)
+	assert.Equal(t, time.Date(2018, 3, 1, 10, 15, 0, 0, time.UTC), r.Published)
+	assert.Equal(t, net.ParseIP("203.0.113.1").To4(), r.Address.To4())
+	assert.Equal(t, uint16(9001), r.ORPort)
+	assert.Equal(t, uint16(9030), r.DirPort)
+	require.Len(t, r.ORAddresses, 1)
+	assert.Equal(t, "[2001:db8::1]:9001", r.ORAddresses[0].String())
+	assert.True(t, r.HasFlag("Exit"))
+	assert.False(t, r.HasFlag("Guard"))
+	assert.Equal(t, "Tor 0.3.2.10", r.Version)
+	assert.Equal(t, "Cons=1-2 Link=1-5 Relay=1-2", r.Protocols)
+	assert.Equal(t, 5120, r.Bandwidth)
+	assert.False(t, r.Unmeasured)
+	require.NotNil(t, r.ExitPolicy)
+
+	assert.True(t, c.Routers[1].Unmeasured)
+
+	require.Len(t, c.Signatures, 1)
+	assert.Equal(t, "sha256", c.Signatures[0].Algorithm)
+	assert.Equal(t, a.identity, c.Signatures[0].Identity)
+}
+
+func TestConsensusLookup(t *testing.T) {
+	c, err := ParseConsensus(signTestConsensus(t, testConsensusBody, newTestAuthority(t)))
+	require.NoError(t, err)
+
+	fp, err := hex.DecodeString("1415161718191a1b1c1d1e1f2021222324252627")
+	require.NoError(t, err)
+	r, ok := c.Router(fp)
+	require.True(t, ok)
+	assert.Equal(t, "beta", r.Nickname)
+
+	_, ok = c.Router(make([]byte, 20))
+	assert.False(t, ok)
+
+	guards := c.RoutersWithFlags("Guard", "Running")
+	require.Len(t, guards, 1)
+	assert.Equal(t, "beta", guards[0].Nickname)
+	assert.Len(t, c.RoutersWithFlags("Fast"), 2)
+	assert.Len(t, c.RoutersWithFlags("Exit", "Guard"), 0)
+}
+
+func TestParseConsensusMicrodesc(t *testing.T) {
+	body := `network-status-version 3 microdesc
+valid-after 2018-03-01 12:00:00
+fresh-until 2018-03-01 13:00:00
+valid-until 2018-03-01 15:00:00
+r alpha AAECAwQFBgcICQoLDA0ODxAREhM 2018-03-01 10:15:00 203.0.113.1 9001 0
+m 4tDAWgNBwhVqIMAsP5LzDEFqPFuKlGmzaLhxAEpDzIY
+s Running Valid
+`
+	c, err := ParseConsensus([]byte(body))
+	require.NoError(t, err)
+	assert.Equal(t, "microdesc", c.Flavor)
+	require.Len(t, c.Routers, 1)
+	assert.Nil(t, c.Routers[0].Digest)
+	assert.Len(t, c.Routers[0].MicrodescriptorDigest, 32)
+	assert.Equal(t, ErrConsensusUnsigned, c.Verify(nil, 0, time.Time{}))
+}
+
+func TestParseConsensusErrors(t *testing.T) {
+	for _, body := range []string{
+		"",
+		"valid-after 2018-03-01 12:00:00\n",
+		"network-status-version 3\n",
+		strings.Replace(testConsensusBody, "9001 9030", "9001", 1),
+		strings.Replace(testConsensusBody, "nf_ito_low=1500", "nf_ito_low", 1),
+		strings.Replace(testConsensusBody, "2018-03-01 13:00:00", "tomorrow", 1),
+	} {
+		_, err := ParseConsensus([]byte(body))
+		assert.Error(t, err)
+	}
+}
+
+func TestConsensusVerify(t *testing.T) {
+	auths := []*testAuthority{newTestAuthority(t), newTestAuthority(t), newTestAuthority(t)}
+	keys := make([]*AuthorityKey, len(auths))
+	for i, a := range auths {
+		keys[i] = a.AuthorityKey()
+	}
+
+	c, err := ParseConsensus(signTestConsensus(t, testConsensusBody, auths[0], auths[1]))
+	require.NoError(t, err)
+	assert.NoError(t, c.Verify(keys, Quorum(len(keys)), c.ValidAfter))
+	assert.Error(t, c.Verify(keys, 3, c.ValidAfter))
+
+	// Signatures from unknown authorities do not count.
+	assert.Error(t, c.Verify(keys[2:], 1, c.ValidAfter))
+
+	// The consensus may not be used before it is valid.
+	assert.Equal(t, ErrConsensusNotYetValid, c.Verify(keys, Quorum(len(keys)), c.ValidAfter.Add(-time.Second)))
+	assert.NoError(t, c.Verify(keys, Quorum(len(keys)), c.ValidUntil))
+}
+
+func TestConsensusVerifyBadSignature(t *testing.T) {
+	a := newTestAuthority(t)
+	b, err := ParseConsensus(signTestConsensus(t, testConsensusBody, a))
+	require.NoError(t, err)
+
+	// Tamper with the signed portion.
+	doc := []byte(strings.Replace(string(signTestConsensus(t, testConsensusBody, a)), "Bandwidth=5120", "Bandwidth=9999", 1))
+	c, err := ParseConsensus(doc)
+	require.NoError(t, err)
+	assert.Error(t, c.Verify([]*AuthorityKey{a.AuthorityKey()}, 1, c.ValidAfter))
+
+	// Signing key not matching the advertised digest.
+	other := newTestAuthority(t)
+	k := &AuthorityKey{Identity: a.identity, SigningKey: &other.key.PublicKey}
+	assert.Error(t, b.Verify([]*AuthorityKey{k}, 1, b.ValidAfter))
+}
+
+func TestQuorum(t *testing.T) {
+	assert.Equal(t, 5, Quorum(9))
+	assert.Equal(t, 5, Quorum(8))
+	assert.Equal(t, 1, Quorum(1))
+}
+
+// readTestVector reads a real directory document from testdata. These are not
+// generated, and must be saved from a directory cache.
+func readTestVector(t *testing.T, name string) []byte {
+	b, err := ioutil.ReadFile("./testdata/" + name)
+	require.NoError(t, err, "test vector %s", name)
+	return b
+}
+
+// TestConsensusVerifyRealVectors verifies consensus documents signed by the
+// real directory authorities. The consensuses and the authority certificates
+// that signed them are saved from /tor/status-vote/current/consensus,
+// /tor/status-vote/current/consensus-microdesc and /tor/keys/all on the same
+// directory cache. They are kept whole, since the signatures cover the entire
+// document.
+func TestConsensusVerifyRealVectors(t *testing.T) {
+	certs, err := ParseKeyCertificates(readTestVector(t, "cached-certs"))
+	require.NoError(t, err)
+
+	for _, name := range []string{"cached-consensus", "cached-microdesc-consensus"} {
+		t.Run(name, func(t *testing.T) {
+			c, err := ParseConsensus(readTestVector(t, name))
+			require.NoError(t, err)
+			assert.NotEmpty(t, c.Routers)
+			assert.NoError(t, c.VerifyAuthorities(certs, DefaultAuthorities, c.ValidAfter))
+
+			// Any change to the signed portion breaks the signatures.
+			c.signed = append([]byte{}, c.signed...)
+			c.signed[len(c.signed)/2] ^= 1
+			assert.Error(t, c.VerifyAuthorities(certs, DefaultAuthorities, c.ValidAfter))
+		})
+	}
+}
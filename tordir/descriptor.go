@@ -3,6 +3,7 @@ package tordir
 import (
 	"bytes"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/pem"
 	"fmt"
@@ -11,6 +12,7 @@ import (
 	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -23,6 +25,7 @@ import (
 
 const (
 	routerKeyword          = "router"
+	orAddressKeyword       = "or-address"
 	bandwidthKeyword       = "bandwidth"
 	publishedKeyword       = "published"
 	uptimeKeyword          = "uptime"
@@ -36,6 +39,15 @@ const (
 	platformKeyword        = "platform"
 	protoKeyword           = "proto"
 	contactKeyword         = "contact"
+
+	tunnelledDirServerKeyword = "tunnelled-dir-server"
+	ipv6PolicyKeyword         = "ipv6-policy"
+
+	identityEd25519Keyword       = "identity-ed25519"
+	masterKeyEd25519Keyword      = "master-key-ed25519"
+	routerSigEd25519Keyword      = "router-sig-ed25519"
+	ntorOnionKeyCrosscertKeyword = "ntor-onion-key-crosscert"
+	onionKeyCrosscertKeyword     = "onion-key-crosscert"
 )
 
 var requiredKeywords = []string{
@@ -47,11 +59,26 @@ var requiredKeywords = []string{
 	fingerprintKeyword,
 }
 
+// requiredEd25519Keywords must be present in descriptors for routers with an
+// Ed25519 identity.
+var requiredEd25519Keywords = []string{
+	masterKeyEd25519Keyword,
+	ntorOnionKeyCrosscertKeyword,
+	onionKeyCrosscertKeyword,
+}
+
+// routerSigEd25519Prefix is prepended to the document when computing the
+// Ed25519 signature.
+const routerSigEd25519Prefix = "Tor router descriptor signature v1"
+
 // Potential errors when constructing a server descriptor.
 var (
 	ErrServerDescriptorBadNickname  = errors.New("invalid nickname")
 	ErrServerDescriptorNotIPv4      = errors.New("require ipv4 address")
+	ErrServerDescriptorNotIPv6      = errors.New("require ipv6 address")
 	ErrServerDescriptorNoExitPolicy = errors.New("missing exit policy")
+
+	ErrServerDescriptorBadIdentityCert = errors.New("invalid ed25519 identity certificate")
 )
 
 // ErrServerDescriptorPublishBadStatus is returned from a publish operation
@@ -69,10 +96,12 @@ func (e ServerDescriptorMissingFieldError) Error() string {
 // ServerDescriptor is a builder for a server descriptor to be published to
 // directory servers.
 type ServerDescriptor struct {
-	router     *Item
-	items      []*Item
-	keywords   map[string]bool
-	signingKey *rsa.PrivateKey
+	router          *Item
+	identityEd25519 *Item
+	items           []*Item
+	keywords        map[string]bool
+	signingKey      *rsa.PrivateKey
+	edSigningKey    *torcrypto.Ed25519KeyPair
 }
 
 // NewServerDescriptor constructs an empty server descriptor.
@@ -138,6 +167,30 @@ func (d *ServerDescriptor) SetRouter(nickname string, addr net.IP, orPort, dirPo
 	return nil
 }
 
+// AddORAddress adds an alternative IPv6 address and ORPort for the router.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "or-address" SP ADDRESS ":" PORT NL
+//
+//	       [Any number]
+//
+//	       ADDRESS = IP6ADDR | IP4ADDR
+//	       IPV6ADDR = an ipv6 address, surrounded by square brackets.
+//	       IPV4ADDR = an ipv4 address, represented as a dotted quad.
+//	       PORT = a number between 1 and 65535 inclusive.
+//
+//	       An alternative for the address and ORPort of the OR, as described
+//	       below.  Currently, the address must be IPv6.
+//
+func (d *ServerDescriptor) AddORAddress(addr *net.TCPAddr) error {
+	if addr.IP.To4() != nil || addr.IP.To16() == nil {
+		return ErrServerDescriptorNotIPv6
+	}
+	d.addItem(NewItem(orAddressKeyword, []string{addr.String()}))
+	return nil
+}
+
 // SetBandwidth sets the bandwidth of the server.
 //
 // Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt#L419-L430
@@ -221,12 +274,36 @@ func (d *ServerDescriptor) SetUptime(dur time.Duration) {
 //	       the address will be accepted.  For clarity, the last such entry SHOULD
 //	       be accept *:* or reject *:*.
 //
+//
+// These lines only apply to IPv4, so rules for IPv6 networks are omitted.
+// Instead, if the policy allows any IPv6 exit traffic, its summary is given in
+// an "ipv6-policy" line.
 func (d *ServerDescriptor) SetExitPolicy(policy *torexitpolicy.Policy) {
 	for _, rule := range policy.Rules() {
+		if a, ok := rule.Pattern.(*torexitpolicy.AddressPattern); ok && a.IsIPv6() {
+			continue
+		}
 		keyword := rule.Action.Describe()
 		args := []string{rule.Pattern.Describe()}
 		d.addItem(NewItem(keyword, args))
 	}
+
+	// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L819-L827
+	//
+	//	    "ipv6-policy" SP ("accept" / "reject") SP PortList NL
+	//
+	//	       [At most once.]
+	//
+	//	       An exit-policy summary as specified in sections 3.4.1 and 3.8.2,
+	//	       summarizing the router's rules for connecting to IPv6 addresses. A
+	//	       missing "ipv6-policy" line is equivalent to "ipv6-policy reject
+	//	       1-65535".
+	//
+	summary := policy.SummaryIPv6()
+	if summary.Action == torexitpolicy.Reject && len(summary.Ports) == 1 && summary.Ports[0] == torexitpolicy.AllPorts {
+		return
+	}
+	d.addItem(NewItem(ipv6PolicyKeyword, strings.Fields(summary.String())))
 }
 
 // SetProtocols specifies which sub-protocols the router supports.
@@ -249,6 +326,22 @@ func (d *ServerDescriptor) SetContact(c string) {
 	d.addItem(NewItem(contactKeyword, []string{c}))
 }
 
+// SetTunnelledDirServer advertises that the router accepts tunnelled
+// directory requests.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L796-L801
+//
+//	    "tunnelled-dir-server"
+//
+//	       [At most once]
+//
+//	       Present only if this router accepts "tunnelled" directory requests
+//	       using a BEGIN_DIR cell over the router's OR port.
+//
+func (d *ServerDescriptor) SetTunnelledDirServer() {
+	d.addItem(NewItemKeywordOnly(tunnelledDirServerKeyword))
+}
+
 // SetNtorOnionKey sets the key used for ntor circuit extended handshake.
 //
 // Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt#L513-L522
@@ -362,6 +455,138 @@ func (d *ServerDescriptor) setFingerprint(k *rsa.PublicKey) error {
 	return nil
 }
 
+// SetEd25519Identity sets the router's Ed25519 identity by way of the
+// certificate for its signing key. The signing key is used to sign the
+// descriptor, in addition to the RSA signature.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L396-L420
+//
+//	    "identity-ed25519" NL "-----BEGIN ED25519 CERT-----" NL certificate
+//	           "-----END ED25519 CERT-----" NL
+//
+//	       [Exactly once, in second position in document.]
+//	       [No extra arguments]
+//
+//	       The certificate is a base64-encoded Ed25519 certificate (see
+//	       cert-spec.txt) with terminating =s removed.  When this element
+//	       is present, it MUST appear as the first or second element in
+//	       the router descriptor.
+//
+//	       The certificate has CERT_TYPE of [04].  It must include a
+//	       signed-with-ed25519-key extension (see cert-spec.txt,
+//	       section 2.2.1), so that we can extract the master identity key.
+//
+//	    "master-key-ed25519" SP MasterKey NL
+//
+//	       [Exactly once]
+//
+//	       Contains the base-64 encoded ed25519 master key as a single
+//	       argument.  If it is present, it MUST match the identity key
+//	       in the identity-ed25519 entry.
+//
+func (d *ServerDescriptor) SetEd25519Identity(cert *torcrypto.Ed25519Certificate, signing *torcrypto.Ed25519KeyPair) error {
+	if cert.Type != torcrypto.CertTypeSigningKey || cert.CertifiedKey != signing.Public {
+		return ErrServerDescriptorBadIdentityCert
+	}
+	identity, ok := cert.SigningKey()
+	if !ok {
+		return ErrServerDescriptorBadIdentityCert
+	}
+
+	d.identityEd25519 = NewItemWithObject(identityEd25519Keyword, []string{}, &pem.Block{
+		Type:  "ED25519 CERT",
+		Bytes: cert.Encode(),
+	})
+	d.keywords[identityEd25519Keyword] = true
+
+	d.addItem(NewItem(masterKeyEd25519Keyword, []string{
+		base64.RawStdEncoding.EncodeToString(identity[:]),
+	}))
+
+	d.edSigningKey = signing
+	return nil
+}
+
+// SetNtorOnionKeyCrosscert proves possession of the ntor onion key by
+// certifying the Ed25519 identity key with it.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L530-L544
+//
+//	    "ntor-onion-key-crosscert" SP Bit NL
+//	           "-----BEGIN ED25519 CERT-----" NL certificate
+//	           "-----END ED25519 CERT-----" NL
+//
+//	       [Exactly once]
+//
+//	       A signature created with the router's ntor onion key, of the
+//	       router's ed25519 identity key, using the certificate format.  The
+//	       certificate has CERT_TYPE of [0A].  The "Bit" argument is the
+//	       sign bit of the ed25519 public key corresponding to the ntor
+//	       onion key, used to convert the curve25519 key to an ed25519 key.
+//	       The certificate's expiration MUST be no later than the expiration
+//	       of the identity-ed25519 certificate.
+//
+func (d *ServerDescriptor) SetNtorOnionKeyCrosscert(k *torcrypto.Curve25519KeyPair, identity [32]byte, expiration time.Time) {
+	signer, signbit := torcrypto.Ed25519KeyPairFromCurve25519(k)
+	cert := torcrypto.NewEd25519Certificate(
+		torcrypto.CertTypeNtorOnionKey,
+		torcrypto.CertKeyTypeEd25519,
+		identity,
+		expiration,
+	)
+	cert.Sign(signer)
+
+	d.addItem(NewItemWithObject(ntorOnionKeyCrosscertKeyword, []string{strconv.Itoa(int(signbit))}, &pem.Block{
+		Type:  "ED25519 CERT",
+		Bytes: cert.Encode(),
+	}))
+}
+
+// SetOnionKeyCrosscert proves possession of the TAP onion key by signing the
+// router's identities with it.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L488-L505
+//
+//	    "onion-key-crosscert" NL a RSA signature in PEM format.
+//
+//	       [Exactly once]
+//	       [No extra arguments]
+//
+//	       This element contains an RSA signature, generated using the
+//	       onion-key, of the following:
+//
+//	          A SHA1 hash of the RSA identity key,
+//	            i.e. RSA key from "signing-key" (see below) [20 bytes]
+//	          The Ed25519 identity key,
+//	            i.e. Ed25519 key from "master-key-ed25519" [32 bytes]
+//
+//	       If there is no Ed25519 identity key, or if in some future version
+//	       there is no RSA identity key, the corresponding field must be
+//	       zero-filled.
+//
+//	       Parties verifying this signature MUST allow additional data
+//	       beyond the 52 bytes listed above.
+//
+//	       This signature uses PKCS1 padding, but does not use a digest.
+//
+func (d *ServerDescriptor) SetOnionKeyCrosscert(onion *rsa.PrivateKey, identity *rsa.PublicKey, edIdentity [32]byte) error {
+	fp, err := torcrypto.Fingerprint(identity)
+	if err != nil {
+		return err
+	}
+
+	sig, err := torcrypto.SignRSANoDigest(append(fp, edIdentity[:]...), onion)
+	if err != nil {
+		return err
+	}
+
+	d.addItem(NewItemWithObject(onionKeyCrosscertKeyword, []string{}, &pem.Block{
+		Type:  "CROSSCERT",
+		Bytes: sig,
+	}))
+	return nil
+}
+
 // Validate checks whether the descriptor is valid.
 func (d *ServerDescriptor) Validate() error {
 	for _, keyword := range requiredKeywords {
@@ -375,6 +600,14 @@ func (d *ServerDescriptor) Validate() error {
 		return ErrServerDescriptorNoExitPolicy
 	}
 
+	if d.hasKeyword(identityEd25519Keyword) {
+		for _, keyword := range requiredEd25519Keywords {
+			if !d.hasKeyword(keyword) {
+				return ServerDescriptorMissingFieldError(keyword)
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -392,6 +625,9 @@ func (d *ServerDescriptor) Document() (*Document, error) {
 
 	doc := &Document{}
 	doc.AddItem(d.router)
+	if d.identityEd25519 != nil {
+		doc.AddItem(d.identityEd25519)
+	}
 	for _, item := range d.items {
 		doc.AddItem(item)
 	}
@@ -421,6 +657,10 @@ func (d *ServerDescriptor) Document() (*Document, error) {
 //	       with the router's identity key.
 //
 func (d *ServerDescriptor) sign(doc *Document) error {
+	if d.edSigningKey != nil {
+		d.signEd25519(doc)
+	}
+
 	item := NewItemKeywordOnly(routerSignatureKeyword)
 	doc.AddItem(item)
 
@@ -438,6 +678,68 @@ func (d *ServerDescriptor) sign(doc *Document) error {
 	return nil
 }
 
+// signEd25519 appends the Ed25519 signature to the document. This must
+// precede the RSA signature, which covers it.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L605-L619
+//
+//	    "router-sig-ed25519" SP Signature NL
+//
+//	       [Exactly once.]
+//
+//	       It MUST be the next-to-last element in the descriptor, appearing
+//	       immediately before the RSA signature.  It MUST contain an Ed25519
+//	       signature of a SHA256 digest of the entire document. This digest is
+//	       taken from the first character up to and including the first space
+//	       after the "router-sig-ed25519" string. Before computing the digest,
+//	       the string "Tor router descriptor signature v1" is prefixed to the
+//	       document.
+//
+//	       The signature is encoded in Base64, with terminating =s removed.
+//
+//	       The signing key in the identity-ed25519 certificate MUST
+//	       be the one used to sign the document.
+//
+func (d *ServerDescriptor) signEd25519(doc *Document) {
+	h := sha256.New()
+	h.Write([]byte(routerSigEd25519Prefix))
+	h.Write(doc.Encode())
+	h.Write([]byte(routerSigEd25519Keyword + " "))
+
+	sig := d.edSigningKey.Sign(h.Sum(nil))
+	doc.AddItem(NewItem(routerSigEd25519Keyword, []string{
+		base64.RawStdEncoding.EncodeToString(sig),
+	}))
+}
+
+// cosmeticKeywords are server descriptor items that may change without
+// requiring a new descriptor to be published.
+var cosmeticKeywords = map[string]bool{
+	publishedKeyword:        true,
+	uptimeKeyword:           true,
+	bandwidthKeyword:        true,
+	extraInfoDigestKeyword:  true,
+	routerSigEd25519Keyword: true,
+	routerSignatureKeyword:  true,
+}
+
+// CosmeticallyEqual reports whether the server descriptor documents a and b
+// differ only in cosmetic items: the published time, uptime, bandwidth,
+// extra-info digest and signatures.
+func CosmeticallyEqual(a, b *Document) bool {
+	return bytes.Equal(nonCosmetic(a), nonCosmetic(b))
+}
+
+func nonCosmetic(doc *Document) []byte {
+	var b []byte
+	for _, item := range doc.items {
+		if !cosmeticKeywords[item.Keyword] {
+			b = append(b, item.Encode()...)
+		}
+	}
+	return b
+}
+
 // PublishToAuthority publishes this server descriptor to the authority with
 // the given address (in host:port format).
 func (d *ServerDescriptor) PublishToAuthority(addr string) error {
@@ -445,14 +747,24 @@ func (d *ServerDescriptor) PublishToAuthority(addr string) error {
 	if err != nil {
 		return err
 	}
+	return PublishToAuthority(addr, doc)
+}
 
+// PublishToAuthority uploads the given documents to the authority with the
+// given address (in host:port format) in a single request. This is used to
+// publish a server descriptor together with its extra-info document.
+func PublishToAuthority(addr string, docs ...*Document) error {
 	u := &url.URL{
 		Scheme: "http",
 		Host:   addr,
 		Path:   "/tor/",
 	}
 
-	body := bytes.NewReader(doc.Encode())
+	var buf bytes.Buffer
+	for _, doc := range docs {
+		buf.Write(doc.Encode())
+	}
+	body := bytes.NewReader(buf.Bytes())
 
 	resp, err := http.Post(u.String(), "tor/descriptor", body)
 	if err != nil {
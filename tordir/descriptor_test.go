@@ -1,12 +1,16 @@
 package tordir
 
 import (
+	"bytes"
 	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
+	"strconv"
 	"testing"
 	"time"
 
@@ -178,3 +182,198 @@ func TestPublishHTTPErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestServerDescriptorTunnelledDirServer(t *testing.T) {
+	s := BuildValidServerDescriptor()
+	s.SetTunnelledDirServer()
+	doc, err := s.Document()
+	require.NoError(t, err)
+	assert.Contains(t, string(doc.Encode()), "\ntunnelled-dir-server\n")
+}
+
+func TestServerDescriptorORAddress(t *testing.T) {
+	s := BuildValidServerDescriptor()
+	addr := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 9001}
+	require.NoError(t, s.AddORAddress(addr))
+	doc, err := s.Document()
+	require.NoError(t, err)
+	assert.Contains(t, string(doc.Encode()), "\nor-address [2001:db8::1]:9001\n")
+
+	err = s.AddORAddress(&net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 9001})
+	assert.Equal(t, ErrServerDescriptorNotIPv6, err)
+}
+
+func TestServerDescriptorExitPolicy(t *testing.T) {
+	rules, err := torexitpolicy.ParseTorrcRules("reject 10.0.0.0/8:*,accept6 [2001:db8::]/32:*,accept6 *:443,accept *:80,reject *:*")
+	require.NoError(t, err)
+
+	s := BuildValidServerDescriptor()
+	s.SetExitPolicy(torexitpolicy.NewPolicyFromRules(rules))
+	doc, err := s.Document()
+	require.NoError(t, err)
+	enc := string(doc.Encode())
+
+	assert.Contains(t, enc, "\nreject 10.0.0.0/8:*\naccept *:80\nreject *:*\n")
+	assert.NotContains(t, enc, "2001:db8")
+	assert.Contains(t, enc, "\nipv6-policy accept 80,443\n")
+}
+
+func TestCosmeticallyEqual(t *testing.T) {
+	k, err := torcrypto.ParseRSAPrivateKeyPKCS1PEM(keyPEM)
+	require.NoError(t, err)
+
+	document := func(d *ServerDescriptor) *Document {
+		doc, err := d.Document()
+		require.NoError(t, err)
+		return doc
+	}
+
+	base := document(BuildValidServerDescriptorWithKey(k))
+
+	// Cosmetic changes.
+	d := BuildValidServerDescriptorWithKey(k)
+	d.SetBandwidth(1, 2, 3)
+	d.SetPublishedTime(time.Now())
+	d.SetUptime(time.Hour)
+	assert.True(t, CosmeticallyEqual(base, document(d)))
+
+	// Non-cosmetic change.
+	d = BuildValidServerDescriptorWithKey(k)
+	d.SetContact("someone@example.com")
+	assert.False(t, CosmeticallyEqual(base, document(d)))
+}
+
+type ed25519TestKeys struct {
+	Identity *torcrypto.Ed25519KeyPair
+	Signing  *torcrypto.Ed25519KeyPair
+	Cert     *torcrypto.Ed25519Certificate
+	Ntor     *torcrypto.Curve25519KeyPair
+}
+
+func generateEd25519TestKeys(t *testing.T) ed25519TestKeys {
+	id, err := torcrypto.GenerateEd25519KeyPair()
+	require.NoError(t, err)
+	signing, err := torcrypto.GenerateEd25519KeyPair()
+	require.NoError(t, err)
+	ntor, err := torcrypto.GenerateCurve25519KeyPair()
+	require.NoError(t, err)
+	cert := torcrypto.NewEd25519Certificate(
+		torcrypto.CertTypeSigningKey,
+		torcrypto.CertKeyTypeEd25519,
+		signing.Public,
+		time.Now().Add(24*time.Hour),
+	)
+	cert.Sign(id)
+	return ed25519TestKeys{
+		Identity: id,
+		Signing:  signing,
+		Cert:     cert,
+		Ntor:     ntor,
+	}
+}
+
+func buildEd25519ServerDescriptor(t *testing.T, k *rsa.PrivateKey, e ed25519TestKeys) *ServerDescriptor {
+	s := BuildValidServerDescriptorWithKey(k)
+	require.NoError(t, s.SetEd25519Identity(e.Cert, e.Signing))
+	s.SetNtorOnionKey(e.Ntor)
+	s.SetNtorOnionKeyCrosscert(e.Ntor, e.Identity.Public, e.Cert.Expiration)
+	require.NoError(t, s.SetOnionKeyCrosscert(k, &k.PublicKey, e.Identity.Public))
+	return s
+}
+
+func TestServerDescriptorEd25519(t *testing.T) {
+	k, err := torcrypto.ParseRSAPrivateKeyPKCS1PEM(keyPEM)
+	require.NoError(t, err)
+	e := generateEd25519TestKeys(t)
+
+	doc, err := buildEd25519ServerDescriptor(t, k, e).Document()
+	require.NoError(t, err)
+	items := doc.items
+	n := len(items)
+
+	// identity-ed25519 must be second.
+	require.Equal(t, identityEd25519Keyword, items[1].Keyword)
+	cert, err := torcrypto.ParseEd25519Certificate(items[1].Object.Bytes)
+	require.NoError(t, err)
+	assert.Equal(t, e.Signing.Public, cert.CertifiedKey)
+
+	// router-sig-ed25519 must be next-to-last, followed by router-signature.
+	require.Equal(t, routerSigEd25519Keyword, items[n-2].Keyword)
+	require.Equal(t, routerSignatureKeyword, items[n-1].Keyword)
+
+	enc := doc.Encode()
+	i := bytes.Index(enc, []byte("\n"+routerSigEd25519Keyword+" "))
+	require.True(t, i > 0)
+	h := sha256.New()
+	h.Write([]byte(routerSigEd25519Prefix))
+	h.Write(enc[:i+len(routerSigEd25519Keyword)+2])
+	sig, err := base64.RawStdEncoding.DecodeString(items[n-2].Arguments[0])
+	require.NoError(t, err)
+	assert.True(t, torcrypto.VerifyEd25519(e.Signing.Public, h.Sum(nil), sig))
+
+	// The RSA signature covers the Ed25519 signature.
+	j := bytes.Index(enc, []byte("\n"+routerSignatureKeyword+"\n"))
+	require.True(t, j > i)
+	err = torcrypto.VerifyRSASHA1(&k.PublicKey, enc[:j+len(routerSignatureKeyword)+2], items[n-1].Object.Bytes)
+	assert.NoError(t, err)
+}
+
+func TestServerDescriptorEd25519Crosscerts(t *testing.T) {
+	k, err := torcrypto.ParseRSAPrivateKeyPKCS1PEM(keyPEM)
+	require.NoError(t, err)
+	e := generateEd25519TestKeys(t)
+
+	doc, err := buildEd25519ServerDescriptor(t, k, e).Document()
+	require.NoError(t, err)
+
+	var ntor, onion *Item
+	var master string
+	for _, item := range doc.items {
+		switch item.Keyword {
+		case ntorOnionKeyCrosscertKeyword:
+			ntor = item
+		case onionKeyCrosscertKeyword:
+			onion = item
+		case masterKeyEd25519Keyword:
+			master = item.Arguments[0]
+		}
+	}
+
+	assert.Equal(t, base64.RawStdEncoding.EncodeToString(e.Identity.Public[:]), master)
+
+	// ntor-onion-key-crosscert is verifiable from the public ntor key.
+	require.NotNil(t, ntor)
+	bit, err := strconv.Atoi(ntor.Arguments[0])
+	require.NoError(t, err)
+	pub := torcrypto.Ed25519PublicKeyFromCurve25519(e.Ntor.Public, byte(bit))
+	cert, err := torcrypto.ParseEd25519Certificate(ntor.Object.Bytes)
+	require.NoError(t, err)
+	assert.Equal(t, torcrypto.CertTypeNtorOnionKey, cert.Type)
+	assert.Equal(t, e.Identity.Public, cert.CertifiedKey)
+	assert.NoError(t, cert.Verify(pub, time.Now()))
+
+	// onion-key-crosscert signs the RSA fingerprint and Ed25519 identity.
+	require.NotNil(t, onion)
+	fp, err := torcrypto.Fingerprint(&k.PublicKey)
+	require.NoError(t, err)
+	signed := append(fp, e.Identity.Public[:]...)
+	assert.NoError(t, torcrypto.VerifyRSANoDigest(&k.PublicKey, signed, onion.Object.Bytes))
+}
+
+func TestServerDescriptorEd25519MissingFields(t *testing.T) {
+	e := generateEd25519TestKeys(t)
+	s := BuildValidServerDescriptor()
+	require.NoError(t, s.SetEd25519Identity(e.Cert, e.Signing))
+	assert.Equal(t, ServerDescriptorMissingFieldError(ntorOnionKeyCrosscertKeyword), s.Validate())
+
+	s.SetNtorOnionKeyCrosscert(e.Ntor, e.Identity.Public, e.Cert.Expiration)
+	assert.Equal(t, ServerDescriptorMissingFieldError(onionKeyCrosscertKeyword), s.Validate())
+}
+
+func TestServerDescriptorEd25519BadCert(t *testing.T) {
+	e := generateEd25519TestKeys(t)
+	other, err := torcrypto.GenerateEd25519KeyPair()
+	require.NoError(t, err)
+	s := BuildValidServerDescriptor()
+	assert.Equal(t, ErrServerDescriptorBadIdentityCert, s.SetEd25519Identity(e.Cert, other))
+}
@@ -0,0 +1,291 @@
+package tordir
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+)
+
+const (
+	extraInfoKeyword          = "extra-info"
+	readHistoryKeyword        = "read-history"
+	writeHistoryKeyword       = "write-history"
+	dirreqReadHistoryKeyword  = "dirreq-read-history"
+	dirreqWriteHistoryKeyword = "dirreq-write-history"
+	dirreqStatsEndKeyword     = "dirreq-stats-end"
+	dirreqV3RespKeyword       = "dirreq-v3-resp"
+	extraInfoDigestKeyword    = "extra-info-digest"
+)
+
+// ErrExtraInfoMissingIdentity is returned when building an extra-info
+// document without a nickname and identity.
+var ErrExtraInfoMissingIdentity = errors.New("missing extra-info identity")
+
+// ExtraInfo is a builder for an extra-info document, published to directory
+// authorities alongside the server descriptor.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L882-L893
+//
+//	2.1.2. Extra-info documents
+//
+//	   Extra-info documents consist of the following items:
+//
+//	    "extra-info" Nickname Fingerprint NL
+//
+//	        [At start, exactly once.]
+//
+//	        Identifies what router this is an extra-info descriptor for.
+//	        Fingerprint is encoded in hex (using upper-case letters), with
+//	        no spaces.
+//
+type ExtraInfo struct {
+	extraInfo  *Item
+	items      []*Item
+	signingKey *rsa.PrivateKey
+}
+
+// NewExtraInfo constructs an empty extra-info document.
+func NewExtraInfo() *ExtraInfo {
+	return &ExtraInfo{
+		items: make([]*Item, 0),
+	}
+}
+
+func (e *ExtraInfo) addItem(item *Item) {
+	e.items = append(e.items, item)
+}
+
+// SetIdentity sets the router nickname and identity key. The key is also used
+// to sign the document. This is required.
+func (e *ExtraInfo) SetIdentity(nickname string, k *rsa.PrivateKey) error {
+	if !nicknameRx.MatchString(nickname) {
+		return ErrServerDescriptorBadNickname
+	}
+
+	fp, err := torcrypto.Fingerprint(&k.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		nickname,
+		strings.ToUpper(hex.EncodeToString(fp)),
+	}
+	e.extraInfo = NewItem(extraInfoKeyword, args)
+	e.signingKey = k
+	return nil
+}
+
+// SetPublishedTime sets the time the document was generated. It must match
+// the corresponding server descriptor.
+func (e *ExtraInfo) SetPublishedTime(t time.Time) {
+	e.addItem(NewItem(publishedKeyword, []string{formatTime(t)}))
+}
+
+// SetReadHistory records bytes read in consecutive intervals, oldest first,
+// where the most recent interval ended at end.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L911-L922
+//
+//	    "read-history" YYYY-MM-DD HH:MM:SS (NSEC s) NUM,NUM,NUM,NUM,NUM... NL
+//	        [At most once]
+//	    "write-history" YYYY-MM-DD HH:MM:SS (NSEC s) NUM,NUM,NUM,NUM,NUM... NL
+//	        [At most once]
+//
+//	        Declare how much bandwidth the OR has used recently. Usage is
+//	        divided into intervals of NSEC seconds.  The YYYY-MM-DD HH:MM:SS
+//	        field defines the end of the most recent interval.  The numbers
+//	        are the number of bytes used in the most recent intervals, ordered
+//	        from oldest to newest.
+//
+func (e *ExtraInfo) SetReadHistory(end time.Time, interval time.Duration, values []int64) {
+	e.addItem(historyItem(readHistoryKeyword, end, interval, values))
+}
+
+// SetWriteHistory records bytes written, as for SetReadHistory.
+func (e *ExtraInfo) SetWriteHistory(end time.Time, interval time.Duration, values []int64) {
+	e.addItem(historyItem(writeHistoryKeyword, end, interval, values))
+}
+
+// SetDirreqReadHistory records bytes read answering directory requests, as
+// for SetReadHistory.
+func (e *ExtraInfo) SetDirreqReadHistory(end time.Time, interval time.Duration, values []int64) {
+	e.addItem(historyItem(dirreqReadHistoryKeyword, end, interval, values))
+}
+
+// SetDirreqWriteHistory records bytes written answering directory requests, as
+// for SetReadHistory.
+func (e *ExtraInfo) SetDirreqWriteHistory(end time.Time, interval time.Duration, values []int64) {
+	e.addItem(historyItem(dirreqWriteHistoryKeyword, end, interval, values))
+}
+
+// DirreqResponses counts responses to v3 network status requests.
+type DirreqResponses struct {
+	OK            int
+	NotEnoughSigs int
+	Unavailable   int
+	NotFound      int
+	NotModified   int
+	Busy          int
+}
+
+// SetDirreqStats records directory request statistics for the interval ending
+// at end.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L979-L1005
+//
+//	    "dirreq-stats-end" YYYY-MM-DD HH:MM:SS (NSEC s) NL
+//	        [At most once.]
+//
+//	        YYYY-MM-DD HH:MM:SS defines the end of the included measurement
+//	        interval of length NSEC seconds (86400 seconds by default).
+//
+//	    "dirreq-v3-resp" status=num,... NL
+//	        [At most once.]
+//
+//	        List of mappings from response statuses to the number of requests
+//	        for v3 network statuses that were answered with that response
+//	        status, rounded up to the nearest multiple of 4. Only response
+//	        statuses with at least 1 response are reported.
+//
+func (e *ExtraInfo) SetDirreqStats(end time.Time, interval time.Duration, resp DirreqResponses) {
+	e.addItem(NewItem(dirreqStatsEndKeyword, []string{
+		formatTime(end),
+		formatInterval(interval),
+	}))
+
+	counts := []struct {
+		status string
+		n      int
+	}{
+		{"ok", resp.OK},
+		{"not-enough-sigs", resp.NotEnoughSigs},
+		{"unavailable", resp.Unavailable},
+		{"not-found", resp.NotFound},
+		{"not-modified", resp.NotModified},
+		{"busy", resp.Busy},
+	}
+	var mappings []string
+	for _, c := range counts {
+		if c.n <= 0 {
+			continue
+		}
+		mappings = append(mappings, fmt.Sprintf("%s=%d", c.status, (c.n+3)/4*4))
+	}
+	if len(mappings) == 0 {
+		e.addItem(NewItemKeywordOnly(dirreqV3RespKeyword))
+		return
+	}
+	e.addItem(NewItem(dirreqV3RespKeyword, []string{strings.Join(mappings, ",")}))
+}
+
+// Document generates the signed Document for this extra-info.
+func (e *ExtraInfo) Document() (*Document, error) {
+	if e.extraInfo == nil || e.signingKey == nil {
+		return nil, ErrExtraInfoMissingIdentity
+	}
+
+	doc := &Document{}
+	doc.AddItem(e.extraInfo)
+	for _, item := range e.items {
+		doc.AddItem(item)
+	}
+
+	// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L1210-L1216
+	//
+	//	    "router-signature" NL Signature NL
+	//	        [At end, exactly once.]
+	//
+	//	        A document signature as documented in section 1.3, using the
+	//	        initial item "extra-info" and the final item "router-signature",
+	//	        signed with the router's identity key.
+	//
+	item := NewItemKeywordOnly(routerSignatureKeyword)
+	doc.AddItem(item)
+
+	sig, err := torcrypto.SignRSASHA1(doc.Encode(), e.signingKey)
+	if err != nil {
+		return nil, err
+	}
+	item.Object = &pem.Block{
+		Type:  "SIGNATURE",
+		Bytes: sig,
+	}
+
+	return doc, nil
+}
+
+// SetExtraInfoDigest links the server descriptor to the given extra-info
+// document.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L681-L694
+//
+//	    "extra-info-digest" SP sha1-digest [SP sha256-digest] NL
+//
+//	       [At most once]
+//
+//	       "sha1-digest" is a hex-encoded SHA1 digest of the router's
+//	       extra-info document, as signed in the router's extra-info
+//	       (that is, not including the signature).  (If this field is absent,
+//	       the router is not uploading a corresponding extra-info document.)
+//
+//	       "sha256-digest" is a base64-encoded SHA256 digest of the extra-info
+//	       document. Unlike the "sha1-digest", this digest is calculated over
+//	       the entire document, including the signature. This difference is
+//	       due to a long-lived bug in the tor implementation that it would be
+//	       difficult to roll out an incremental fix for, not a design choice.
+//
+func (d *ServerDescriptor) SetExtraInfoDigest(extra *Document) error {
+	doc := extra.Encode()
+	signed := []byte("\n" + routerSignatureKeyword + "\n")
+	i := bytes.Index(doc, signed)
+	if i < 0 {
+		return errors.New("extra-info document is not signed")
+	}
+
+	h1 := sha1.Sum(doc[:i+len(signed)])
+	h256 := sha256.Sum256(doc)
+	args := []string{
+		strings.ToUpper(hex.EncodeToString(h1[:])),
+		base64.RawStdEncoding.EncodeToString(h256[:]),
+	}
+	d.addItem(NewItem(extraInfoDigestKeyword, args))
+	return nil
+}
+
+func historyItem(keyword string, end time.Time, interval time.Duration, values []int64) *Item {
+	nums := make([]string, len(values))
+	for i, v := range values {
+		nums[i] = strconv.FormatInt(v, 10)
+	}
+	args := []string{
+		formatTime(end),
+		formatInterval(interval),
+	}
+	if len(nums) > 0 {
+		args = append(args, strings.Join(nums, ","))
+	}
+	return NewItem(keyword, args)
+}
+
+// formatTime formats t as a UTC "YYYY-MM-DD HH:MM:SS" timestamp.
+func formatTime(t time.Time) string {
+	return t.In(time.UTC).Format("2006-01-02 15:04:05")
+}
+
+// formatInterval formats d as "(NSEC s)".
+func formatInterval(d time.Duration) string {
+	return fmt.Sprintf("(%d s)", int(d/time.Second))
+}
@@ -0,0 +1,126 @@
+package tordir
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jarcoal/httpmock"
+	"github.com/mmcloughlin/pearl/torcrypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func BuildValidExtraInfo() *ExtraInfo {
+	k, err := torcrypto.ParseRSAPrivateKeyPKCS1PEM(keyPEM)
+	if err != nil {
+		panic(err)
+	}
+	e := NewExtraInfo()
+	if err := e.SetIdentity("nickname", k); err != nil {
+		panic(err)
+	}
+	e.SetPublishedTime(time.Unix(0, 0))
+	return e
+}
+
+func TestExtraInfo(t *testing.T) {
+	e := BuildValidExtraInfo()
+	end := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	e.SetReadHistory(end, 15*time.Minute, []int64{100, 200, 300})
+	e.SetWriteHistory(end, 15*time.Minute, nil)
+	e.SetDirreqStats(end, 24*time.Hour, DirreqResponses{OK: 5, NotFound: 1})
+
+	doc, err := e.Document()
+	require.NoError(t, err)
+	lines := strings.Split(string(doc.Encode()), "\n")
+
+	k, err := torcrypto.ParseRSAPrivateKeyPKCS1PEM(keyPEM)
+	require.NoError(t, err)
+	fp, err := torcrypto.Fingerprint(&k.PublicKey)
+	require.NoError(t, err)
+
+	expect := []string{
+		"extra-info nickname " + strings.ToUpper(hex.EncodeToString(fp)),
+		"published 1970-01-01 00:00:00",
+		"read-history 2017-06-01 12:00:00 (900 s) 100,200,300",
+		"write-history 2017-06-01 12:00:00 (900 s)",
+		"dirreq-stats-end 2017-06-01 12:00:00 (86400 s)",
+		"dirreq-v3-resp ok=8,not-found=4",
+		"router-signature",
+		"-----BEGIN SIGNATURE-----",
+	}
+	assert.Equal(t, expect, lines[:len(expect)])
+}
+
+func TestExtraInfoMissingIdentity(t *testing.T) {
+	_, err := NewExtraInfo().Document()
+	assert.Equal(t, ErrExtraInfoMissingIdentity, err)
+}
+
+func TestExtraInfoSignature(t *testing.T) {
+	doc, err := BuildValidExtraInfo().Document()
+	require.NoError(t, err)
+
+	k, err := torcrypto.ParseRSAPrivateKeyPKCS1PEM(keyPEM)
+	require.NoError(t, err)
+
+	n := len(doc.items)
+	sig := doc.items[n-1].Object.Bytes
+	signed := bytes.TrimSuffix(doc.Encode(), []byte(string(doc.items[n-1].Encode())))
+	signed = append(signed, []byte(routerSignatureKeyword+"\n")...)
+	assert.NoError(t, torcrypto.VerifyRSASHA1(&k.PublicKey, signed, sig))
+}
+
+func TestServerDescriptorExtraInfoDigest(t *testing.T) {
+	extra, err := BuildValidExtraInfo().Document()
+	require.NoError(t, err)
+
+	d := BuildValidServerDescriptor()
+	require.NoError(t, d.SetExtraInfoDigest(extra))
+	doc, err := d.Document()
+	require.NoError(t, err)
+
+	enc := extra.Encode()
+	i := bytes.Index(enc, []byte("\nrouter-signature\n"))
+	h := sha1.Sum(enc[:i+len("\nrouter-signature\n")])
+	assert.Contains(t, string(doc.Encode()), "\nextra-info-digest "+strings.ToUpper(hex.EncodeToString(h[:]))+" ")
+}
+
+func TestServerDescriptorExtraInfoDigestUnsigned(t *testing.T) {
+	d := BuildValidServerDescriptor()
+	assert.Error(t, d.SetExtraInfoDigest(&Document{}))
+}
+
+func TestPublishToAuthorityMultipleDocuments(t *testing.T) {
+	httpmock.Activate()
+	defer httpmock.DeactivateAndReset()
+
+	desc, err := BuildValidServerDescriptor().Document()
+	require.NoError(t, err)
+	extra, err := BuildValidExtraInfo().Document()
+	require.NoError(t, err)
+
+	addr := Authorities[0]
+	var body []byte
+	httpmock.RegisterResponder(
+		http.MethodPost,
+		fmt.Sprintf("http://%s/tor/", addr),
+		func(req *http.Request) (*http.Response, error) {
+			body, err = ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			return httpmock.NewBytesResponse(200, nil), nil
+		},
+	)
+
+	require.NoError(t, PublishToAuthority(addr, desc, extra))
+	assert.Equal(t, append(desc.Encode(), extra.Encode()...), body)
+}
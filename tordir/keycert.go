@@ -0,0 +1,319 @@
+package tordir
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/pem"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+)
+
+const (
+	keyCertificateVersionKeyword = "dir-key-certificate-version"
+	dirAddressKeyword            = "dir-address"
+	dirKeyPublishedKeyword       = "dir-key-published"
+	dirKeyExpiresKeyword         = "dir-key-expires"
+	dirIdentityKeyKeyword        = "dir-identity-key"
+	dirSigningKeyKeyword         = "dir-signing-key"
+	dirKeyCrosscertKeyword       = "dir-key-crosscert"
+	dirKeyCertificationKeyword   = "dir-key-certification"
+)
+
+// keyCertificateVersion is the only supported key certificate version.
+const keyCertificateVersion = "3"
+
+// Key certificate errors.
+var (
+	ErrKeyCertificateMalformed           = errors.New("malformed key certificate")
+	ErrKeyCertificateFingerprintMismatch = errors.New("key certificate fingerprint does not match identity key")
+	ErrKeyCertificateBadCrosscert        = errors.New("invalid key certificate cross-certification")
+	ErrKeyCertificateBadSignature        = errors.New("invalid key certificate signature")
+	ErrKeyCertificateExpired             = errors.New("key certificate expired")
+)
+
+// KeyCertificate is a directory authority key certificate, binding a
+// medium-term signing key to the authority's long-term identity key.
+type KeyCertificate struct {
+	Address     string // directory address, if given
+	Fingerprint []byte // SHA-1 fingerprint of the identity key
+	Published   time.Time
+	Expires     time.Time
+	IdentityKey *rsa.PublicKey
+	SigningKey  *rsa.PublicKey
+
+	crosscert     []byte
+	certification []byte
+	signed        []byte
+	raw           []byte
+}
+
+// NewKeyCertificate builds a key certificate for the signing key, certified
+// by the identity key.
+func NewKeyCertificate(identity, signing *rsa.PrivateKey, published, expires time.Time) (*KeyCertificate, error) {
+	fp, err := torcrypto.Fingerprint(&identity.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &Document{}
+	doc.AddItem(NewItem(keyCertificateVersionKeyword, []string{keyCertificateVersion}))
+	doc.AddItem(NewItem(fingerprintKeyword, []string{strings.ToUpper(hex.EncodeToString(fp))}))
+	doc.AddItem(NewItem(dirKeyPublishedKeyword, []string{formatTime(published)}))
+	doc.AddItem(NewItem(dirKeyExpiresKeyword, []string{formatTime(expires)}))
+
+	for _, k := range []struct {
+		keyword string
+		key     *rsa.PublicKey
+	}{
+		{dirIdentityKeyKeyword, &identity.PublicKey},
+		{dirSigningKeyKeyword, &signing.PublicKey},
+	} {
+		item, err := newItemWithKey(k.keyword, k.key)
+		if err != nil {
+			return nil, err
+		}
+		doc.AddItem(item)
+	}
+
+	crosscert, err := torcrypto.SignRSANoDigest(fp, signing)
+	if err != nil {
+		return nil, err
+	}
+	doc.AddItem(NewItemWithObject(dirKeyCrosscertKeyword, []string{}, &pem.Block{
+		Type:  "ID SIGNATURE",
+		Bytes: crosscert,
+	}))
+
+	item := NewItemKeywordOnly(dirKeyCertificationKeyword)
+	doc.AddItem(item)
+	sig, err := torcrypto.SignRSASHA1(doc.Encode(), identity)
+	if err != nil {
+		return nil, err
+	}
+	item.Object = &pem.Block{
+		Type:  "SIGNATURE",
+		Bytes: sig,
+	}
+
+	return ParseKeyCertificate(doc.Encode())
+}
+
+// GenerateKeyCertificate generates a new signing key and certifies it with the
+// identity key.
+func GenerateKeyCertificate(identity *rsa.PrivateKey, published, expires time.Time) (*KeyCertificate, error) {
+	signing, err := torcrypto.GenerateRSA()
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyCertificate(identity, signing, published, expires)
+}
+
+// ParseKeyCertificates parses concatenated key certificates, as served by
+// directory caches and stored in the cached-certs file.
+func ParseKeyCertificates(b []byte) ([]*KeyCertificate, error) {
+	sep := []byte("\n" + keyCertificateVersionKeyword + " ")
+	var certs []*KeyCertificate
+	for {
+		b = bytes.TrimLeft(b, "\n")
+		if len(b) == 0 {
+			return certs, nil
+		}
+		end := len(b)
+		if i := bytes.Index(b, sep); i >= 0 {
+			end = i + 1
+		}
+		c, err := ParseKeyCertificate(b[:end])
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, c)
+		b = b[end:]
+	}
+}
+
+// ParseKeyCertificate parses a single key certificate. The certificate is not
+// verified; see Verify.
+func ParseKeyCertificate(b []byte) (*KeyCertificate, error) {
+	doc, err := Parse(b)
+	if err != nil {
+		return nil, err
+	}
+
+	items := doc.items
+	if len(items) == 0 || items[0].Keyword != keyCertificateVersionKeyword {
+		return nil, errors.Wrap(ErrKeyCertificateMalformed, "missing version")
+	}
+	if args := arguments(items[0]); len(args) != 1 || args[0] != keyCertificateVersion {
+		return nil, errors.Wrap(ErrKeyCertificateMalformed, "unsupported version")
+	}
+	if items[len(items)-1].Keyword != dirKeyCertificationKeyword {
+		return nil, errors.Wrap(ErrKeyCertificateMalformed, "certification must be last")
+	}
+
+	c := &KeyCertificate{raw: b}
+	for _, item := range items[1:] {
+		args := arguments(item)
+		switch item.Keyword {
+		case dirAddressKeyword:
+			if len(args) == 1 {
+				c.Address = args[0]
+			}
+		case fingerprintKeyword:
+			if len(args) == 1 {
+				c.Fingerprint, err = hex.DecodeString(args[0])
+			}
+		case dirKeyPublishedKeyword:
+			c.Published, err = parseTime(args)
+		case dirKeyExpiresKeyword:
+			c.Expires, err = parseTime(args)
+		case dirIdentityKeyKeyword:
+			c.IdentityKey, err = parseItemKey(item)
+		case dirSigningKeyKeyword:
+			c.SigningKey, err = parseItemKey(item)
+		case dirKeyCrosscertKeyword:
+			c.crosscert, err = itemObject(item)
+		case dirKeyCertificationKeyword:
+			c.certification, err = itemObject(item)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "parsing %q", item.Keyword)
+		}
+	}
+
+	switch {
+	case len(c.Fingerprint) == 0:
+		return nil, errors.Wrap(ErrKeyCertificateMalformed, "missing fingerprint")
+	case c.Published.IsZero() || c.Expires.IsZero():
+		return nil, errors.Wrap(ErrKeyCertificateMalformed, "missing validity times")
+	case c.IdentityKey == nil || c.SigningKey == nil:
+		return nil, errors.Wrap(ErrKeyCertificateMalformed, "missing keys")
+	case c.crosscert == nil:
+		return nil, errors.Wrap(ErrKeyCertificateMalformed, "missing cross-certification")
+	}
+
+	marker := []byte("\n" + dirKeyCertificationKeyword + "\n")
+	i := bytes.Index(b, marker)
+	if i < 0 {
+		return nil, errors.Wrap(ErrKeyCertificateMalformed, "missing certification")
+	}
+	c.signed = b[:i+len(marker)]
+
+	return c, nil
+}
+
+// Encode returns the certificate document.
+func (c *KeyCertificate) Encode() []byte {
+	return c.raw
+}
+
+// SigningKeyDigest returns the SHA-1 digest of the signing key.
+func (c *KeyCertificate) SigningKeyDigest() ([]byte, error) {
+	return torcrypto.Fingerprint(c.SigningKey)
+}
+
+// Verify checks the certificate is consistent, correctly signed, and not
+// expired at time now.
+//
+// Reference: https://github.com/torproject/torspec/blob/master/dir-spec.txt
+//
+//	    "dir-key-crosscert" NL CrossSignature NL
+//
+//	        [Exactly once.]
+//
+//	        CrossSignature is a signature, made using the certificate's signing
+//	        key, of the digest of the PKCS1-padded hash of the certificate's
+//	        identity key.  For backward compatibility with broken versions of the
+//	        parser, we wrap the base64-encoded signature in -----BEGIN ID
+//	        SIGNATURE---- and -----END ID SIGNATURE----- tags.  Implementations
+//	        MUST allow the "ID " portion to be omitted, however.
+//
+//	    "dir-key-certification" NL Signature NL
+//
+//	        [At end, exactly once.]
+//
+//	        A document signature as documented in section 1.3, using the
+//	        initial item "dir-key-certificate-version" and the final item
+//	        "dir-key-certification", signed with the authority identity key.
+//
+func (c *KeyCertificate) Verify(now time.Time) error {
+	fp, err := torcrypto.Fingerprint(c.IdentityKey)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(fp, c.Fingerprint) {
+		return ErrKeyCertificateFingerprintMismatch
+	}
+
+	if torcrypto.VerifyRSANoDigest(c.SigningKey, fp, c.crosscert) != nil {
+		return ErrKeyCertificateBadCrosscert
+	}
+
+	if torcrypto.VerifyRSASHA1(c.IdentityKey, c.signed, c.certification) != nil {
+		return ErrKeyCertificateBadSignature
+	}
+
+	if now.After(c.Expires) {
+		return ErrKeyCertificateExpired
+	}
+
+	return nil
+}
+
+// AuthorityKey returns the signing key certified by c.
+func (c *KeyCertificate) AuthorityKey() *AuthorityKey {
+	return &AuthorityKey{
+		Identity:   c.Fingerprint,
+		SigningKey: c.SigningKey,
+	}
+}
+
+// PinnedKeyCertificates returns the certificates that verify at time now and
+// belong to one of the given authorities, matched by v3 identity fingerprint.
+func PinnedKeyCertificates(certs []*KeyCertificate, auths []*Authority, now time.Time) []*KeyCertificate {
+	var pinned []*KeyCertificate
+	for _, c := range certs {
+		if isV3Authority(auths, c.Fingerprint) && c.Verify(now) == nil {
+			pinned = append(pinned, c)
+		}
+	}
+	return pinned
+}
+
+// PinnedAuthorityKeys returns the signing keys of the pinned certificates; see
+// PinnedKeyCertificates.
+func PinnedAuthorityKeys(certs []*KeyCertificate, auths []*Authority, now time.Time) []*AuthorityKey {
+	var keys []*AuthorityKey
+	for _, c := range PinnedKeyCertificates(certs, auths, now) {
+		keys = append(keys, c.AuthorityKey())
+	}
+	return keys
+}
+
+// VerifyAuthorities checks the consensus is signed by more than half of the
+// given v3 authorities, using signing keys from the certificates.
+func (c *Consensus) VerifyAuthorities(certs []*KeyCertificate, auths []*Authority, now time.Time) error {
+	keys := PinnedAuthorityKeys(certs, auths, now)
+	return c.Verify(keys, Quorum(len(V3Authorities(auths))), now)
+}
+
+// parseItemKey parses the RSA public key object of an item.
+func parseItemKey(item *Item) (*rsa.PublicKey, error) {
+	der, err := itemObject(item)
+	if err != nil {
+		return nil, err
+	}
+	return torcrypto.ParseRSAPublicKeyPKCS1DER(der)
+}
+
+// itemObject returns the object data of an item.
+func itemObject(item *Item) ([]byte, error) {
+	if item.Object == nil {
+		return nil, errors.New("missing object")
+	}
+	return item.Object.Bytes, nil
+}
@@ -0,0 +1,191 @@
+package tordir
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mmcloughlin/pearl/torcrypto"
+)
+
+var testKeyCertificateTime = time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestKeyCertificate certifies the signing key of a with a new identity
+// key, which becomes the identity of a.
+func newTestKeyCertificate(t *testing.T, a *testAuthority) *KeyCertificate {
+	identity, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	c, err := NewKeyCertificate(identity, a.key, testKeyCertificateTime, testKeyCertificateTime.AddDate(1, 0, 0))
+	require.NoError(t, err)
+	a.identity = c.Fingerprint
+	return c
+}
+
+func TestKeyCertificateRoundTrip(t *testing.T) {
+	identity, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	signing, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+
+	c, err := NewKeyCertificate(identity, signing, testKeyCertificateTime, testKeyCertificateTime.AddDate(1, 0, 0))
+	require.NoError(t, err)
+
+	fp, err := torcrypto.Fingerprint(&identity.PublicKey)
+	require.NoError(t, err)
+	assert.Equal(t, fp, c.Fingerprint)
+	assert.Equal(t, testKeyCertificateTime, c.Published)
+	assert.True(t, torcrypto.RSAPublicKeysEqual(&identity.PublicKey, c.IdentityKey))
+	assert.True(t, torcrypto.RSAPublicKeysEqual(&signing.PublicKey, c.SigningKey))
+
+	sk, err := c.SigningKeyDigest()
+	require.NoError(t, err)
+	expect, err := torcrypto.Fingerprint(&signing.PublicKey)
+	require.NoError(t, err)
+	assert.Equal(t, expect, sk)
+
+	assert.NoError(t, c.Verify(testKeyCertificateTime))
+
+	p, err := ParseKeyCertificate(c.Encode())
+	require.NoError(t, err)
+	assert.NoError(t, p.Verify(testKeyCertificateTime))
+}
+
+func TestKeyCertificateVerifyErrors(t *testing.T) {
+	identity, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	signing, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	c, err := NewKeyCertificate(identity, signing, testKeyCertificateTime, testKeyCertificateTime.AddDate(1, 0, 0))
+	require.NoError(t, err)
+
+	assert.Equal(t, ErrKeyCertificateExpired, c.Verify(testKeyCertificateTime.AddDate(2, 0, 0)))
+
+	// Altering the expiry invalidates the certification.
+	b := bytes.Replace(c.Encode(), []byte("dir-key-expires 2019"), []byte("dir-key-expires 2029"), 1)
+	p, err := ParseKeyCertificate(b)
+	require.NoError(t, err)
+	assert.Equal(t, ErrKeyCertificateBadSignature, p.Verify(testKeyCertificateTime))
+
+	// Claiming another identity.
+	other := hex.EncodeToString(make([]byte, 20))
+	b = bytes.Replace(c.Encode(), []byte(strings.ToUpper(hex.EncodeToString(c.Fingerprint))), []byte(other), 1)
+	p, err = ParseKeyCertificate(b)
+	require.NoError(t, err)
+	assert.Equal(t, ErrKeyCertificateFingerprintMismatch, p.Verify(testKeyCertificateTime))
+
+	// Cross-certificate from a different signing key.
+	d, err := NewKeyCertificate(identity, identity, testKeyCertificateTime, testKeyCertificateTime.AddDate(1, 0, 0))
+	require.NoError(t, err)
+	c.crosscert = d.crosscert
+	assert.Equal(t, ErrKeyCertificateBadCrosscert, c.Verify(testKeyCertificateTime))
+}
+
+func TestParseKeyCertificateErrors(t *testing.T) {
+	identity, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	c, err := NewKeyCertificate(identity, identity, testKeyCertificateTime, testKeyCertificateTime.AddDate(1, 0, 0))
+	require.NoError(t, err)
+	doc := string(c.Encode())
+
+	for _, b := range []string{
+		"",
+		"fingerprint 00\n",
+		"dir-key-certificate-version 2\ndir-key-certification\n",
+		doc[:bytes.Index(c.Encode(), []byte("dir-key-certification"))],
+		"dir-key-certificate-version 3\ndir-key-published 2018-03-01 00:00:00\ndir-key-certification\n",
+	} {
+		_, err := ParseKeyCertificate([]byte(b))
+		assert.Error(t, err)
+	}
+}
+
+func TestParseKeyCertificates(t *testing.T) {
+	var b []byte
+	var fps [][]byte
+	for i := 0; i < 3; i++ {
+		a := newTestAuthority(t)
+		c := newTestKeyCertificate(t, a)
+		b = append(b, c.Encode()...)
+		b = append(b, '\n')
+		fps = append(fps, c.Fingerprint)
+	}
+
+	certs, err := ParseKeyCertificates(b)
+	require.NoError(t, err)
+	require.Len(t, certs, 3)
+	for i, c := range certs {
+		assert.Equal(t, fps[i], c.Fingerprint)
+		assert.NoError(t, c.Verify(testKeyCertificateTime))
+	}
+
+	certs, err = ParseKeyCertificates(nil)
+	require.NoError(t, err)
+	assert.Len(t, certs, 0)
+}
+
+func TestConsensusVerifyAuthorities(t *testing.T) {
+	var auths []*Authority
+	var certs []*KeyCertificate
+	var signers []*testAuthority
+	for i := 0; i < 3; i++ {
+		a := newTestAuthority(t)
+		c := newTestKeyCertificate(t, a)
+		certs = append(certs, c)
+		auths = append(auths, &Authority{V3Identity: strings.ToUpper(hex.EncodeToString(c.Fingerprint))})
+		signers = append(signers, a)
+	}
+	// Bridge authorities do not count towards the quorum.
+	auths = append(auths, &Authority{Nickname: "bridge"})
+
+	c, err := ParseConsensus(signTestConsensus(t, testConsensusBody, signers[0], signers[1]))
+	require.NoError(t, err)
+	assert.NoError(t, c.VerifyAuthorities(certs, auths, c.ValidAfter))
+
+	// Certificates not pinned to a known authority are ignored.
+	assert.Error(t, c.VerifyAuthorities(certs, auths[1:], c.ValidAfter))
+
+	// Expired certificates are ignored.
+	assert.Error(t, c.VerifyAuthorities(certs, auths, testKeyCertificateTime.AddDate(2, 0, 0)))
+}
+
+func TestGenerateKeyCertificate(t *testing.T) {
+	identity, err := torcrypto.GenerateRSA()
+	require.NoError(t, err)
+	a, err := GenerateKeyCertificate(identity, testKeyCertificateTime, testKeyCertificateTime.AddDate(1, 0, 0))
+	require.NoError(t, err)
+	b, err := GenerateKeyCertificate(identity, testKeyCertificateTime, testKeyCertificateTime.AddDate(1, 0, 0))
+	require.NoError(t, err)
+
+	assert.Equal(t, a.Fingerprint, b.Fingerprint)
+	assert.False(t, torcrypto.RSAPublicKeysEqual(a.SigningKey, b.SigningKey))
+	assert.NoError(t, a.Verify(testKeyCertificateTime))
+	assert.NoError(t, b.Verify(testKeyCertificateTime))
+}
+
+// TestKeyCertificateRealVectors checks certificates of the real directory
+// authorities, saved from /tor/keys/all on a directory cache. Each must be
+// pinned to one of the default authorities.
+func TestKeyCertificateRealVectors(t *testing.T) {
+	certs, err := ParseKeyCertificates(readTestVector(t, "cached-certs"))
+	require.NoError(t, err)
+	require.NotEmpty(t, certs)
+	for _, c := range certs {
+		assert.True(t, isV3Authority(DefaultAuthorities, c.Fingerprint), hex.EncodeToString(c.Fingerprint))
+		assert.NoError(t, c.Verify(c.Published))
+	}
+
+	// Every v3 authority in DefaultAuthorities has a certificate.
+	keys := PinnedAuthorityKeys(certs, DefaultAuthorities, certs[0].Published)
+	for _, a := range V3Authorities(DefaultAuthorities) {
+		found := false
+		for _, k := range keys {
+			found = found || strings.EqualFold(hex.EncodeToString(k.Identity), a.V3Identity)
+		}
+		assert.True(t, found, a.Nickname)
+	}
+}
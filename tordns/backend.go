@@ -0,0 +1,83 @@
+package tordns
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNotFound is returned by a Backend when a name or address definitively
+// does not exist. Such answers are cached as negative results.
+var ErrNotFound = errors.New("name not found")
+
+// Answer is the result of a successful lookup.
+type Answer struct {
+	IPs   []net.IP // Addresses, for forward lookups
+	Names []string // Hostnames, for reverse lookups
+	TTL   time.Duration
+}
+
+// Backend performs uncached DNS lookups.
+type Backend interface {
+	// LookupHost returns the IPv4 and IPv6 addresses of host.
+	LookupHost(ctx context.Context, host string) (*Answer, error)
+
+	// LookupAddr returns the hostnames for ip.
+	LookupAddr(ctx context.Context, ip net.IP) (*Answer, error)
+}
+
+// DefaultSystemTTL is the TTL assigned to answers from the system resolver,
+// which does not report record TTLs.
+const DefaultSystemTTL = 5 * time.Minute
+
+// SystemBackend resolves names with a net.Resolver.
+type SystemBackend struct {
+	Resolver *net.Resolver // Defaults to net.DefaultResolver
+	TTL      time.Duration // Defaults to DefaultSystemTTL
+}
+
+// LookupHost returns the addresses of host.
+func (b SystemBackend) LookupHost(ctx context.Context, host string) (*Answer, error) {
+	addrs, err := b.resolver().LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, b.convertError(err)
+	}
+	a := &Answer{TTL: b.ttl()}
+	for _, addr := range addrs {
+		a.IPs = append(a.IPs, addr.IP)
+	}
+	return a, nil
+}
+
+// LookupAddr returns the hostnames for ip.
+func (b SystemBackend) LookupAddr(ctx context.Context, ip net.IP) (*Answer, error) {
+	names, err := b.resolver().LookupAddr(ctx, ip.String())
+	if err != nil {
+		return nil, b.convertError(err)
+	}
+	return &Answer{Names: names, TTL: b.ttl()}, nil
+}
+
+func (b SystemBackend) resolver() *net.Resolver {
+	if b.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return b.Resolver
+}
+
+func (b SystemBackend) ttl() time.Duration {
+	if b.TTL == 0 {
+		return DefaultSystemTTL
+	}
+	return b.TTL
+}
+
+// convertError maps definitive lookup failures to ErrNotFound.
+func (b SystemBackend) convertError(err error) error {
+	if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+		return ErrNotFound
+	}
+	return err
+}
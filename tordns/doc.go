@@ -0,0 +1,2 @@
+// Package tordns implements hostname resolution for exit relays.
+package tordns
@@ -0,0 +1,154 @@
+package tordns
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bounds on the TTL of answers. These match the limits applied by tor, which
+// avoid revealing precise TTLs from the upstream resolver.
+const (
+	MinTTL = 5 * time.Minute
+	MaxTTL = time.Hour
+)
+
+// NegativeTTL is how long failed lookups are cached.
+const NegativeTTL = time.Minute
+
+// DefaultCacheSize is the default number of cached lookups.
+const DefaultCacheSize = 4096
+
+// ClampTTL restricts ttl to the range from MinTTL to MaxTTL.
+func ClampTTL(ttl time.Duration) time.Duration {
+	switch {
+	case ttl < MinTTL:
+		return MinTTL
+	case ttl > MaxTTL:
+		return MaxTTL
+	default:
+		return ttl
+	}
+}
+
+// Resolver is a caching resolver. Successful answers are cached for their
+// clamped TTL, and ErrNotFound results for NegativeTTL. Other errors are
+// considered transient and are not cached.
+type Resolver struct {
+	backend Backend
+	size    int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	key     string
+	answer  *Answer
+	err     error
+	expires time.Time
+}
+
+// NewResolver builds a resolver around b caching at most size lookups.
+func NewResolver(b Backend, size int) *Resolver {
+	return &Resolver{
+		backend: b,
+		size:    size,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// LookupHost returns the addresses of host. The TTL of the answer is clamped.
+func (r *Resolver) LookupHost(ctx context.Context, host string) (*Answer, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return r.lookup("host:"+host, func() (*Answer, error) {
+		return r.backend.LookupHost(ctx, host)
+	})
+}
+
+// LookupAddr returns the hostnames for ip. The TTL of the answer is clamped.
+func (r *Resolver) LookupAddr(ctx context.Context, ip net.IP) (*Answer, error) {
+	return r.lookup("addr:"+ip.String(), func() (*Answer, error) {
+		return r.backend.LookupAddr(ctx, ip)
+	})
+}
+
+func (r *Resolver) lookup(key string, fetch func() (*Answer, error)) (*Answer, error) {
+	if e, ok := r.get(key); ok {
+		return e.answer, e.err
+	}
+
+	a, err := fetch()
+	switch {
+	case err == ErrNotFound:
+		r.put(&cacheEntry{key: key, err: err, expires: r.now().Add(NegativeTTL)})
+	case err != nil:
+		return nil, err
+	default:
+		a = &Answer{
+			IPs:   a.IPs,
+			Names: a.Names,
+			TTL:   ClampTTL(a.TTL),
+		}
+		r.put(&cacheEntry{key: key, answer: a, expires: r.now().Add(a.TTL)})
+	}
+
+	return a, err
+}
+
+// get returns the unexpired cache entry for key, if any.
+func (r *Resolver) get(key string) (*cacheEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	elem, ok := r.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*cacheEntry)
+	if !r.now().Before(e.expires) {
+		r.lru.Remove(elem)
+		delete(r.entries, key)
+		return nil, false
+	}
+	r.lru.MoveToFront(elem)
+	return e, true
+}
+
+// put adds e to the cache, evicting the least recently used entries if the
+// cache is full.
+func (r *Resolver) put(e *cacheEntry) {
+	if r.size <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if elem, ok := r.entries[e.key]; ok {
+		elem.Value = e
+		r.lru.MoveToFront(elem)
+		return
+	}
+
+	for r.lru.Len() >= r.size {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*cacheEntry).key)
+	}
+	r.entries[e.key] = r.lru.PushFront(e)
+}
+
+// Len returns the number of cached lookups.
+func (r *Resolver) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lru.Len()
+}
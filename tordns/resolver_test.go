@@ -0,0 +1,148 @@
+package tordns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubBackend answers lookups from in-memory tables.
+type stubBackend struct {
+	hosts map[string]*Answer
+	addrs map[string]*Answer
+	err   error
+	calls int
+}
+
+func (b *stubBackend) LookupHost(ctx context.Context, host string) (*Answer, error) {
+	b.calls++
+	if b.err != nil {
+		return nil, b.err
+	}
+	a, ok := b.hosts[host]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return a, nil
+}
+
+func (b *stubBackend) LookupAddr(ctx context.Context, ip net.IP) (*Answer, error) {
+	b.calls++
+	if b.err != nil {
+		return nil, b.err
+	}
+	a, ok := b.addrs[ip.String()]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return a, nil
+}
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time          { return c.t }
+func (c *fakeClock) Advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestResolver(b Backend, size int) (*Resolver, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1500000000, 0)}
+	r := NewResolver(b, size)
+	r.now = clock.Now
+	return r, clock
+}
+
+func TestClampTTL(t *testing.T) {
+	assert.Equal(t, MinTTL, ClampTTL(0))
+	assert.Equal(t, MinTTL, ClampTTL(time.Second))
+	assert.Equal(t, 30*time.Minute, ClampTTL(30*time.Minute))
+	assert.Equal(t, MaxTTL, ClampTTL(24*time.Hour))
+}
+
+func TestResolverLookupHostCached(t *testing.T) {
+	b := &stubBackend{hosts: map[string]*Answer{
+		"example.com": {IPs: []net.IP{net.IPv4(192, 0, 2, 1)}, TTL: time.Second},
+	}}
+	r, clock := newTestResolver(b, 10)
+	ctx := context.Background()
+
+	a, err := r.LookupHost(ctx, "Example.COM.")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.IPv4(192, 0, 2, 1)}, a.IPs)
+	assert.Equal(t, MinTTL, a.TTL)
+
+	_, err = r.LookupHost(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 1, b.calls)
+
+	clock.Advance(MinTTL)
+	_, err = r.LookupHost(ctx, "example.com")
+	require.NoError(t, err)
+	assert.Equal(t, 2, b.calls)
+}
+
+func TestResolverNegativeCache(t *testing.T) {
+	b := &stubBackend{}
+	r, clock := newTestResolver(b, 10)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := r.LookupHost(ctx, "missing.example")
+		assert.Equal(t, ErrNotFound, err)
+	}
+	assert.Equal(t, 1, b.calls)
+
+	clock.Advance(NegativeTTL)
+	_, err := r.LookupHost(ctx, "missing.example")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, 2, b.calls)
+}
+
+func TestResolverTransientErrorNotCached(t *testing.T) {
+	b := &stubBackend{err: errors.New("server failure")}
+	r, _ := newTestResolver(b, 10)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		_, err := r.LookupHost(ctx, "example.com")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 2, b.calls)
+	assert.Equal(t, 0, r.Len())
+}
+
+func TestResolverLookupAddr(t *testing.T) {
+	b := &stubBackend{addrs: map[string]*Answer{
+		"192.0.2.1": {Names: []string{"host.example."}, TTL: 2 * time.Hour},
+	}}
+	r, _ := newTestResolver(b, 10)
+
+	a, err := r.LookupAddr(context.Background(), net.IPv4(192, 0, 2, 1))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"host.example."}, a.Names)
+	assert.Equal(t, MaxTTL, a.TTL)
+}
+
+func TestResolverEviction(t *testing.T) {
+	b := &stubBackend{}
+	r, _ := newTestResolver(b, 2)
+	ctx := context.Background()
+
+	for _, host := range []string{"a", "b", "a", "c"} {
+		_, _ = r.LookupHost(ctx, host)
+	}
+	assert.Equal(t, 2, r.Len())
+	assert.Equal(t, 3, b.calls)
+
+	// "b" was least recently used and should have been evicted.
+	_, _ = r.LookupHost(ctx, "a")
+	assert.Equal(t, 3, b.calls)
+	_, _ = r.LookupHost(ctx, "b")
+	assert.Equal(t, 4, b.calls)
+}
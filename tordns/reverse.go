@@ -0,0 +1,80 @@
+package tordns
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Reverse lookup domains.
+const (
+	ReverseIPv4Suffix = ".in-addr.arpa"
+	ReverseIPv6Suffix = ".ip6.arpa"
+)
+
+// ParseReverseName extracts the address from an in-addr.arpa or ip6.arpa
+// name. The boolean result reports whether name was a valid reverse name.
+func ParseReverseName(name string) (net.IP, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	switch {
+	case strings.HasSuffix(name, ReverseIPv4Suffix):
+		return parseReverseIPv4(strings.TrimSuffix(name, ReverseIPv4Suffix))
+	case strings.HasSuffix(name, ReverseIPv6Suffix):
+		return parseReverseIPv6(strings.TrimSuffix(name, ReverseIPv6Suffix))
+	default:
+		return nil, false
+	}
+}
+
+func parseReverseIPv4(s string) (net.IP, bool) {
+	labels := strings.Split(s, ".")
+	if len(labels) != net.IPv4len {
+		return nil, false
+	}
+	ip := make(net.IP, net.IPv4len)
+	for i, label := range labels {
+		b, err := strconv.ParseUint(label, 10, 8)
+		if err != nil {
+			return nil, false
+		}
+		ip[net.IPv4len-1-i] = byte(b)
+	}
+	return net.IPv4(ip[0], ip[1], ip[2], ip[3]), true
+}
+
+func parseReverseIPv6(s string) (net.IP, bool) {
+	labels := strings.Split(s, ".")
+	if len(labels) != 2*net.IPv6len {
+		return nil, false
+	}
+	ip := make(net.IP, net.IPv6len)
+	for i, label := range labels {
+		n, err := strconv.ParseUint(label, 16, 4)
+		if err != nil || len(label) != 1 {
+			return nil, false
+		}
+		j := len(labels) - 1 - i
+		if j%2 == 0 {
+			ip[j/2] |= byte(n) << 4
+		} else {
+			ip[j/2] |= byte(n)
+		}
+	}
+	return ip, true
+}
+
+// ReverseName returns the in-addr.arpa or ip6.arpa name for ip.
+func ReverseName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.Itoa(int(ip4[3])) + "." + strconv.Itoa(int(ip4[2])) + "." +
+			strconv.Itoa(int(ip4[1])) + "." + strconv.Itoa(int(ip4[0])) + ReverseIPv4Suffix
+	}
+
+	const hexdigits = "0123456789abcdef"
+	ip = ip.To16()
+	labels := make([]string, 0, 2*net.IPv6len)
+	for i := net.IPv6len - 1; i >= 0; i-- {
+		labels = append(labels, string(hexdigits[ip[i]&0xf]), string(hexdigits[ip[i]>>4]))
+	}
+	return strings.Join(labels, ".") + ReverseIPv6Suffix
+}
@@ -0,0 +1,50 @@
+package tordns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseReverseName(t *testing.T) {
+	cases := []struct {
+		Name string
+		IP   net.IP
+	}{
+		{"1.2.0.192.in-addr.arpa", net.ParseIP("192.0.2.1")},
+		{"1.2.0.192.IN-ADDR.ARPA.", net.ParseIP("192.0.2.1")},
+		{
+			"b.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa",
+			net.ParseIP("4321:0:1:2:3:4:567:89ab"),
+		},
+	}
+	for _, c := range cases {
+		ip, ok := ParseReverseName(c.Name)
+		assert.True(t, ok, c.Name)
+		assert.True(t, c.IP.Equal(ip), c.Name)
+	}
+}
+
+func TestReverseNameRoundTrip(t *testing.T) {
+	for _, s := range []string{"192.0.2.1", "2001:db8::1", "::"} {
+		ip := net.ParseIP(s)
+		got, ok := ParseReverseName(ReverseName(ip))
+		assert.True(t, ok, s)
+		assert.True(t, ip.Equal(got), s)
+	}
+	assert.Equal(t, "1.2.0.192.in-addr.arpa", ReverseName(net.ParseIP("192.0.2.1")))
+}
+
+func TestParseReverseNameInvalid(t *testing.T) {
+	for _, name := range []string{
+		"example.com",
+		"2.0.192.in-addr.arpa",
+		"256.2.0.192.in-addr.arpa",
+		"1.2.ip6.arpa",
+		"bb.a.9.8.7.6.5.0.4.0.0.0.3.0.0.0.2.0.0.0.1.0.0.0.0.0.0.0.1.2.3.4.ip6.arpa",
+	} {
+		_, ok := ParseReverseName(name)
+		assert.False(t, ok, name)
+	}
+}
@@ -0,0 +1,126 @@
+package torexitpolicy
+
+import "net"
+
+// defaultPolicyRules is tor's default exit policy, which blocks ports
+// commonly associated with abuse.
+const defaultPolicyRules = "reject *:25,reject *:119,reject *:135-139,reject *:445," +
+	"reject *:563,reject *:1214,reject *:4661-4666," +
+	"reject *:6346-6429,reject *:6699,reject *:6881-6999,accept *:*"
+
+// reducedPolicyRules is tor's ReducedExitPolicy, which accepts a list of
+// common ports and rejects everything else.
+const reducedPolicyRules = "accept *:20-23,accept *:43,accept *:53,accept *:79-81,accept *:88," +
+	"accept *:110,accept *:143,accept *:194,accept *:220,accept *:389," +
+	"accept *:443,accept *:464,accept *:465,accept *:531,accept *:543-544," +
+	"accept *:554,accept *:563,accept *:587,accept *:636,accept *:706," +
+	"accept *:749,accept *:873,accept *:902-904,accept *:981,accept *:989-995," +
+	"accept *:1194,accept *:1220,accept *:1293,accept *:1500,accept *:1533," +
+	"accept *:1677,accept *:1723,accept *:1755,accept *:1863," +
+	"accept *:2082-2083,accept *:2086-2087,accept *:2095-2096," +
+	"accept *:2102-2104,accept *:3128,accept *:3389,accept *:3690," +
+	"accept *:4321,accept *:4643,accept *:5050,accept *:5190," +
+	"accept *:5222-5223,accept *:5228,accept *:5900,accept *:6660-6669," +
+	"accept *:6679,accept *:6697,accept *:8000,accept *:8008,accept *:8074," +
+	"accept *:8080,accept *:8082,accept *:8087-8088,accept *:8232-8233," +
+	"accept *:8332-8333,accept *:8443,accept *:8888,accept *:9418," +
+	"accept *:9999,accept *:10000,accept *:11371,accept *:19294," +
+	"accept *:19638,accept *:50002,accept *:64738,reject *:*"
+
+// PrivateNetworks are the networks matched by the "private" address in torrc
+// exit policies.
+var PrivateNetworks = mustParseNetworks(
+	"0.0.0.0/8", "169.254.0.0/16",
+	"127.0.0.0/8", "192.168.0.0/16", "10.0.0.0/8", "172.16.0.0/12",
+	"::/8",
+	"fc00::/7", "fe80::/10", "fec0::/10", "ff00::/8", "::/127",
+)
+
+// DefaultPolicy is the policy appended to configured exit policies that do
+// not end with a catch-all rule.
+var DefaultPolicy = mustParseTorrcPolicy(defaultPolicyRules)
+
+// ReducedPolicy permits exit traffic only to common ports.
+var ReducedPolicy = mustParseTorrcPolicy(reducedPolicyRules)
+
+// RejectPrivatePolicy rejects traffic to PrivateNetworks, and accepts all
+// other traffic.
+var RejectPrivatePolicy = mustParseTorrcPolicy("reject private:*")
+
+// TorrcOptions are the torrc options that determine an exit policy.
+type TorrcOptions struct {
+	// Rules from ExitPolicy lines, in order.
+	Rules []Rule
+
+	// RejectPrivate corresponds to ExitPolicyRejectPrivate. Traffic to
+	// private networks and the relay's own Addresses is rejected.
+	RejectPrivate bool
+
+	// Reduced corresponds to ReducedExitPolicy.
+	Reduced bool
+
+	// Addresses are the relay's own public addresses.
+	Addresses []net.IP
+}
+
+// Policy builds the exit policy described by the options, following tor's
+// rules. A relay with neither Rules nor Reduced set is not an exit, so all
+// traffic is rejected. Otherwise private networks are rejected first (if
+// requested), then Rules apply; if they do not end with a catch-all rule the
+// reduced policy (if requested) or DefaultPolicy follows.
+func (o TorrcOptions) Policy() *Policy {
+	if len(o.Rules) == 0 && !o.Reduced {
+		return RejectAllPolicy
+	}
+
+	var rules []Rule
+	if o.RejectPrivate {
+		rules = append(rules, RejectPrivatePolicy.rules...)
+		for _, ip := range o.Addresses {
+			rules = append(rules, Rule{Action: Reject, Pattern: hostPattern(ip)})
+		}
+	}
+
+	rules = append(rules, o.Rules...)
+	if n := len(rules); n == 0 || !matchesAll(rules[n-1].Pattern) {
+		tail := DefaultPolicy
+		if o.Reduced {
+			tail = ReducedPolicy
+		}
+		rules = append(rules, tail.Rules()...)
+	}
+
+	return NewPolicyFromRules(rules)
+}
+
+// hostPattern matches all ports on the single address ip.
+func hostPattern(ip net.IP) *AddressPattern {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	bits := 8 * len(ip)
+	return &AddressPattern{
+		Network: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)},
+		Ports:   AllPorts,
+	}
+}
+
+func mustParseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = n
+	}
+	return networks
+}
+
+func mustParseTorrcPolicy(s string) *Policy {
+	rules, err := ParseTorrcRules(s)
+	if err != nil {
+		panic(err)
+	}
+	return NewPolicyFromRules(rules)
+}
@@ -0,0 +1,58 @@
+package torexitpolicy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReducedPolicy(t *testing.T) {
+	ip := net.ParseIP("93.184.216.34")
+	assert.True(t, ReducedPolicy.Allow(ip, 443))
+	assert.True(t, ReducedPolicy.Allow(ip, 6667))
+	assert.False(t, ReducedPolicy.Allow(ip, 25))
+	assert.False(t, ReducedPolicy.Allow(ip, 31337))
+}
+
+func TestRejectPrivatePolicy(t *testing.T) {
+	for _, s := range []string{"127.0.0.1", "10.1.2.3", "192.168.1.1", "::1", "fe80::1"} {
+		assert.False(t, RejectPrivatePolicy.Allow(net.ParseIP(s), 80), s)
+	}
+	assert.True(t, RejectPrivatePolicy.Allow(net.ParseIP("93.184.216.34"), 80))
+}
+
+func TestTorrcOptionsNonExit(t *testing.T) {
+	assert.Equal(t, RejectAllPolicy, TorrcOptions{RejectPrivate: true}.Policy())
+}
+
+func TestTorrcOptionsDefaultAppended(t *testing.T) {
+	rules, err := ParseTorrcRules("accept *:6660-6667")
+	require.NoError(t, err)
+	self := net.ParseIP("93.184.216.34")
+	p := TorrcOptions{
+		Rules:         rules,
+		RejectPrivate: true,
+		Addresses:     []net.IP{self},
+	}.Policy()
+
+	other := net.ParseIP("198.51.100.7")
+	assert.True(t, p.Allow(other, 6667))
+	assert.True(t, p.Allow(other, 80))
+	assert.False(t, p.Allow(other, 25))
+	assert.False(t, p.Allow(self, 80))
+	assert.False(t, p.Allow(net.ParseIP("10.0.0.1"), 80))
+}
+
+func TestTorrcOptionsCatchAll(t *testing.T) {
+	rules, err := ParseTorrcRules("accept *:443,reject *:*")
+	require.NoError(t, err)
+	p := TorrcOptions{Rules: rules, Reduced: true}.Policy()
+	assert.Equal(t, "accept 443", p.Summary().String())
+}
+
+func TestTorrcOptionsReduced(t *testing.T) {
+	p := TorrcOptions{Reduced: true}.Policy()
+	assert.Equal(t, ReducedPolicy.Summary(), p.Summary())
+}
@@ -0,0 +1,137 @@
+package torexitpolicy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseRule parses a policy line such as "accept 1.2.3.0/24:80-443", as found
+// in server descriptors. The torrc keywords "accept6" and "reject6" are also
+// recognized; they restrict the rule to IPv6 addresses.
+func ParseRule(s string) (Rule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return Rule{}, errors.Errorf("malformed policy rule %q", s)
+	}
+	keyword, spec := strings.ToLower(fields[0]), fields[1]
+
+	var a Action
+	switch keyword {
+	case "accept", "accept6":
+		a = Accept
+	case "reject", "reject6":
+		a = Reject
+	default:
+		return Rule{}, errors.Errorf("unknown policy action %q", fields[0])
+	}
+
+	pat, err := ParsePattern(spec)
+	if err != nil {
+		return Rule{}, err
+	}
+
+	if strings.HasSuffix(keyword, "6") {
+		switch {
+		case pat.Network == nil:
+			pat.Network = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)}
+		case pat.IsIPv4():
+			return Rule{}, errors.Errorf("%s rule with IPv4 address", keyword)
+		}
+	}
+
+	return Rule{Action: a, Pattern: pat}, nil
+}
+
+// ParseTorrcRules parses the value of a torrc ExitPolicy option: a comma
+// separated list of rules. The address "private" is expanded to one rule for
+// each of the PrivateNetworks.
+func ParseTorrcRules(s string) ([]Rule, error) {
+	var rules []Rule
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		fields := strings.Fields(entry)
+		if len(fields) == 2 && strings.HasPrefix(fields[1], "private:") {
+			private, err := privateRules(fields[0], strings.TrimPrefix(fields[1], "private:"))
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, private...)
+			continue
+		}
+
+		r, err := ParseRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// privateRules expands a rule for the "private" address into rules for each
+// private network.
+func privateRules(keyword, portspec string) ([]Rule, error) {
+	// Parse a rule with a wildcard address to validate the keyword and ports.
+	base, err := ParseRule(keyword + " *:" + portspec)
+	if err != nil {
+		return nil, err
+	}
+	ports := base.Pattern.(*AddressPattern).Ports
+	ipv6Only := strings.HasSuffix(keyword, "6")
+
+	var rules []Rule
+	for _, n := range PrivateNetworks {
+		if ipv6Only && len(n.IP) == net.IPv4len {
+			continue
+		}
+		rules = append(rules, Rule{
+			Action:  base.Action,
+			Pattern: &AddressPattern{Network: n, Ports: ports},
+		})
+	}
+	return rules, nil
+}
+
+// NewPolicyFromRules builds a policy from rules in order. If the last rule
+// matches all addresses and ports it becomes the default action, otherwise
+// unmatched addresses are accepted, as they are in server descriptors.
+func NewPolicyFromRules(rules []Rule) *Policy {
+	p := NewPolicyWithDefault(Accept)
+	if n := len(rules); n > 0 && matchesAll(rules[n-1].Pattern) {
+		p.defaultAction = rules[n-1].Action
+		rules = rules[:n-1]
+	}
+	for _, r := range rules {
+		p.AddRule(r)
+	}
+	return p
+}
+
+// ParsePolicy parses policy lines, as they appear in server descriptors, into
+// a policy.
+func ParsePolicy(lines []string) (*Policy, error) {
+	rules := make([]Rule, 0, len(lines))
+	for _, line := range lines {
+		r, err := ParseRule(line)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return NewPolicyFromRules(rules), nil
+}
+
+// matchesAll reports whether pat matches every address and port.
+func matchesAll(pat Pattern) bool {
+	if pat == AllPattern {
+		return true
+	}
+	a, ok := pat.(*AddressPattern)
+	return ok && a.Network == nil && a.Ports.IsAll()
+}
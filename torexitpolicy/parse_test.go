@@ -0,0 +1,88 @@
+package torexitpolicy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func describeRules(rules []Rule) []string {
+	lines := []string{}
+	for _, r := range rules {
+		lines = append(lines, r.Action.Describe()+" "+r.Pattern.Describe())
+	}
+	return lines
+}
+
+func TestParseRule(t *testing.T) {
+	r, err := ParseRule("accept 1.2.3.0/24:80-443")
+	require.NoError(t, err)
+	assert.Equal(t, Accept, r.Action)
+	assert.Equal(t, "1.2.3.0/24:80-443", r.Pattern.Describe())
+
+	r, err = ParseRule("reject6 [::1]:*")
+	require.NoError(t, err)
+	assert.Equal(t, Reject, r.Action)
+	assert.Equal(t, "[::1]:*", r.Pattern.Describe())
+
+	r, err = ParseRule("accept6 *:80")
+	require.NoError(t, err)
+	assert.True(t, r.Pattern.Matches(net.ParseIP("::1"), 80))
+	assert.False(t, r.Pattern.Matches(net.ParseIP("1.2.3.4"), 80))
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"accept",
+		"allow *:*",
+		"accept *:* extra",
+		"accept6 1.2.3.4:80",
+		"reject private:*",
+	} {
+		_, err := ParseRule(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestParseTorrcRules(t *testing.T) {
+	rules, err := ParseTorrcRules("accept *:80, accept *:443,reject *:*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"accept *:80", "accept *:443", "reject *:*"}, describeRules(rules))
+}
+
+func TestParseTorrcRulesPrivate(t *testing.T) {
+	rules, err := ParseTorrcRules("reject private:*")
+	require.NoError(t, err)
+	require.Len(t, rules, len(PrivateNetworks))
+	assert.Equal(t, "reject 0.0.0.0/8:*", describeRules(rules)[0])
+
+	rules, err = ParseTorrcRules("reject6 private:25")
+	require.NoError(t, err)
+	for _, r := range rules {
+		assert.True(t, r.Pattern.(*AddressPattern).IsIPv6())
+		assert.Equal(t, PortRange{25, 25}, r.Pattern.(*AddressPattern).Ports)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	p, err := ParsePolicy([]string{
+		"reject 10.0.0.0/8:*",
+		"accept *:80",
+		"reject *:*",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"reject 10.0.0.0/8:*", "accept *:80", "reject *:*"}, describeRules(p.Rules()))
+	assert.True(t, p.Allow(net.ParseIP("1.2.3.4"), 80))
+	assert.False(t, p.Allow(net.ParseIP("10.1.2.3"), 80))
+	assert.False(t, p.Allow(net.ParseIP("1.2.3.4"), 443))
+}
+
+func TestParsePolicyDefaultAccept(t *testing.T) {
+	p, err := ParsePolicy([]string{"reject *:25"})
+	require.NoError(t, err)
+	assert.True(t, p.Allow(net.ParseIP("1.2.3.4"), 80))
+	assert.False(t, p.Allow(net.ParseIP("1.2.3.4"), 25))
+}
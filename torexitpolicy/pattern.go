@@ -0,0 +1,235 @@
+package torexitpolicy
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Min uint16
+	Max uint16
+}
+
+// AllPorts is the range of all valid ports.
+var AllPorts = PortRange{Min: 1, Max: 65535}
+
+// Contains reports whether port is in the range.
+func (r PortRange) Contains(port uint16) bool {
+	return r.Min <= port && port <= r.Max
+}
+
+// IsAll reports whether the range covers all valid ports.
+func (r PortRange) IsAll() bool {
+	return r.Min <= 1 && r.Max == 65535
+}
+
+// String formats the range as a single port or "min-max".
+func (r PortRange) String() string {
+	if r.Min == r.Max {
+		return strconv.Itoa(int(r.Min))
+	}
+	return strconv.Itoa(int(r.Min)) + "-" + strconv.Itoa(int(r.Max))
+}
+
+// ParsePortRange parses a portspec: "*", a single port or a "min-max" range.
+func ParsePortRange(s string) (PortRange, error) {
+	if s == "*" {
+		return AllPorts, nil
+	}
+
+	lo, hi := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		lo, hi = s[:i], s[i+1:]
+	}
+
+	min, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return PortRange{}, errors.Wrap(err, "invalid port")
+	}
+	max, err := strconv.ParseUint(hi, 10, 16)
+	if err != nil {
+		return PortRange{}, errors.Wrap(err, "invalid port")
+	}
+	if min > max {
+		return PortRange{}, errors.New("invalid port range")
+	}
+
+	return PortRange{Min: uint16(min), Max: uint16(max)}, nil
+}
+
+// AddressPattern matches addresses in a network and ports in a range.
+type AddressPattern struct {
+	// Network containing matched addresses. Nil matches any IPv4 or IPv6
+	// address.
+	Network *net.IPNet
+	Ports   PortRange
+}
+
+// Matches reports whether ip and port are matched by the pattern.
+func (a *AddressPattern) Matches(ip net.IP, port uint16) bool {
+	if !a.Ports.Contains(port) {
+		return false
+	}
+	return a.Network == nil || a.Network.Contains(ip)
+}
+
+// Describe formats the pattern in exitpattern syntax.
+func (a *AddressPattern) Describe() string {
+	ports := "*"
+	if !a.Ports.IsAll() {
+		ports = a.Ports.String()
+	}
+	return a.describeAddress() + ":" + ports
+}
+
+func (a *AddressPattern) describeAddress() string {
+	if a.Network == nil {
+		return "*"
+	}
+
+	ones, bits := a.Network.Mask.Size()
+	if bits == 8*net.IPv4len {
+		switch ones {
+		case 0:
+			return "*"
+		case bits:
+			return a.Network.IP.String()
+		default:
+			return a.Network.String()
+		}
+	}
+
+	addr := "[" + a.Network.IP.String() + "]"
+	if ones == bits {
+		return addr
+	}
+	return addr + "/" + strconv.Itoa(ones)
+}
+
+// IsIPv4 reports whether the pattern only matches IPv4 addresses.
+func (a *AddressPattern) IsIPv4() bool {
+	return a.Network != nil && len(a.Network.IP) == net.IPv4len
+}
+
+// IsIPv6 reports whether the pattern only matches IPv6 addresses.
+func (a *AddressPattern) IsIPv6() bool {
+	return a.Network != nil && len(a.Network.IP) == net.IPv6len
+}
+
+// IsWildcard reports whether the pattern matches every address of the
+// families it applies to.
+func (a *AddressPattern) IsWildcard() bool {
+	if a.Network == nil {
+		return true
+	}
+	ones, _ := a.Network.Mask.Size()
+	return ones == 0
+}
+
+// ParsePattern parses an exitpattern, in the grammar given in the Pattern
+// documentation. The torrc wildcards "*4" and "*6" are also accepted, matching
+// all IPv4 and all IPv6 addresses respectively.
+func ParsePattern(s string) (*AddressPattern, error) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return nil, errors.Errorf("missing port in pattern %q", s)
+	}
+	addrspec, portspec := s[:i], s[i+1:]
+
+	ports, err := ParsePortRange(portspec)
+	if err != nil {
+		return nil, err
+	}
+
+	network, err := parseAddrSpec(addrspec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AddressPattern{
+		Network: network,
+		Ports:   ports,
+	}, nil
+}
+
+func parseAddrSpec(s string) (*net.IPNet, error) {
+	switch s {
+	case "*":
+		return nil, nil
+	case "*4":
+		return &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 8*net.IPv4len)}, nil
+	case "*6":
+		return &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 8*net.IPv6len)}, nil
+	}
+
+	if strings.HasPrefix(s, "[") {
+		return parseIPv6Spec(s)
+	}
+	return parseIPv4Spec(s)
+}
+
+func parseIPv4Spec(s string) (*net.IPNet, error) {
+	addr, mask := s, ""
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		addr, mask = s[:i], s[i+1:]
+	}
+
+	ip := net.ParseIP(addr).To4()
+	if ip == nil || strings.Contains(addr, ":") {
+		return nil, errors.Errorf("invalid IPv4 address %q", addr)
+	}
+
+	m := net.CIDRMask(8*net.IPv4len, 8*net.IPv4len)
+	switch {
+	case mask == "":
+	case strings.Contains(mask, "."):
+		mip := net.ParseIP(mask).To4()
+		if mip == nil {
+			return nil, errors.Errorf("invalid IPv4 mask %q", mask)
+		}
+		m = net.IPv4Mask(mip[0], mip[1], mip[2], mip[3])
+		if ones, _ := m.Size(); ones == 0 && !mip.Equal(net.IPv4zero) {
+			return nil, errors.Errorf("non-contiguous IPv4 mask %q", mask)
+		}
+	default:
+		n, err := strconv.ParseUint(mask, 10, 8)
+		if err != nil || n > 8*net.IPv4len {
+			return nil, errors.Errorf("invalid IPv4 mask bits %q", mask)
+		}
+		m = net.CIDRMask(int(n), 8*net.IPv4len)
+	}
+
+	return &net.IPNet{IP: ip.Mask(m), Mask: m}, nil
+}
+
+func parseIPv6Spec(s string) (*net.IPNet, error) {
+	end := strings.IndexByte(s, ']')
+	if end < 0 {
+		return nil, errors.Errorf("unterminated IPv6 address %q", s)
+	}
+	addr, rest := s[1:end], s[end+1:]
+
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil && !strings.Contains(addr, ":") {
+		return nil, errors.Errorf("invalid IPv6 address %q", addr)
+	}
+	ip = ip.To16()
+
+	m := net.CIDRMask(8*net.IPv6len, 8*net.IPv6len)
+	if rest != "" {
+		if rest[0] != '/' {
+			return nil, errors.Errorf("invalid IPv6 address spec %q", s)
+		}
+		n, err := strconv.ParseUint(rest[1:], 10, 8)
+		if err != nil || n > 8*net.IPv6len {
+			return nil, errors.Errorf("invalid IPv6 mask bits %q", rest[1:])
+		}
+		m = net.CIDRMask(int(n), 8*net.IPv6len)
+	}
+
+	return &net.IPNet{IP: ip.Mask(m), Mask: m}, nil
+}
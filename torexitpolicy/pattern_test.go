@@ -0,0 +1,102 @@
+package torexitpolicy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePortRange(t *testing.T) {
+	cases := []struct {
+		Input  string
+		Expect PortRange
+	}{
+		{"*", AllPorts},
+		{"80", PortRange{80, 80}},
+		{"80-443", PortRange{80, 443}},
+		{"0-65535", PortRange{0, 65535}},
+	}
+	for _, c := range cases {
+		r, err := ParsePortRange(c.Input)
+		require.NoError(t, err, c.Input)
+		assert.Equal(t, c.Expect, r, c.Input)
+	}
+}
+
+func TestParsePortRangeErrors(t *testing.T) {
+	for _, s := range []string{"", "http", "65536", "443-80", "1-2-3", "-1"} {
+		_, err := ParsePortRange(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestParsePatternDescribe(t *testing.T) {
+	cases := []struct {
+		Input    string
+		Describe string
+	}{
+		{"*:*", "*:*"},
+		{"*:80", "*:80"},
+		{"*4:80", "*:80"},
+		{"*6:80", "[::]/0:80"},
+		{"1.2.3.4:*", "1.2.3.4:*"},
+		{"1.2.3.0/24:80-443", "1.2.3.0/24:80-443"},
+		{"1.2.3.4/24:80", "1.2.3.0/24:80"},
+		{"10.0.0.0/255.0.0.0:22", "10.0.0.0/8:22"},
+		{"[::1]:*", "[::1]:*"},
+		{"[2001:db8::]/32:443", "[2001:db8::]/32:443"},
+	}
+	for _, c := range cases {
+		p, err := ParsePattern(c.Input)
+		require.NoError(t, err, c.Input)
+		assert.Equal(t, c.Describe, p.Describe(), c.Input)
+	}
+}
+
+func TestParsePatternErrors(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"1.2.3.4",
+		"1.2.3.4:",
+		"1.2.3:80",
+		"1.2.3.4/33:80",
+		"1.2.3.4/255.0.255.0:80",
+		"::1:80",
+		"[::1:80",
+		"[::1]/129:80",
+		"[1.2.3.4]:80",
+		"example.com:80",
+	} {
+		_, err := ParsePattern(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestAddressPatternMatches(t *testing.T) {
+	cases := []struct {
+		Pattern string
+		IP      string
+		Port    uint16
+		Expect  bool
+	}{
+		{"*:*", "1.2.3.4", 80, true},
+		{"*:*", "::1", 80, true},
+		{"*4:*", "1.2.3.4", 80, true},
+		{"*4:*", "::1", 80, false},
+		{"*6:*", "::1", 80, true},
+		{"*6:*", "1.2.3.4", 80, false},
+		{"1.2.3.0/24:80-443", "1.2.3.99", 80, true},
+		{"1.2.3.0/24:80-443", "1.2.3.99", 443, true},
+		{"1.2.3.0/24:80-443", "1.2.3.99", 444, false},
+		{"1.2.3.0/24:80-443", "1.2.4.1", 80, false},
+		{"[2001:db8::]/32:*", "2001:db8::1", 22, true},
+		{"[2001:db8::]/32:*", "2001:db9::1", 22, false},
+	}
+	for _, c := range cases {
+		p, err := ParsePattern(c.Pattern)
+		require.NoError(t, err)
+		assert.Equal(t, c.Expect, p.Matches(net.ParseIP(c.IP), c.Port), "%s %s:%d", c.Pattern, c.IP, c.Port)
+	}
+}
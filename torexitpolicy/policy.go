@@ -135,6 +135,20 @@ func (p Policy) Rules() []Rule {
 	return append(p.rules, Rule{Action: p.defaultAction, Pattern: AllPattern})
 }
 
+// RejectsAll reports whether the policy rejects exit traffic to every address
+// and port.
+func (p Policy) RejectsAll() bool {
+	for _, r := range p.Rules() {
+		if r.Action == Accept {
+			return false
+		}
+		if matchesAll(r.Pattern) {
+			break
+		}
+	}
+	return true
+}
+
 // Allow determines whether the pollicy allows exist traffic to the given
 // addr:port.
 func (p Policy) Allow(ip net.IP, port uint16) bool {
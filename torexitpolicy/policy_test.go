@@ -52,6 +52,18 @@ func TestAcceptAllPolicy(t *testing.T) {
 	}
 }
 
+func TestPolicyRejectsAll(t *testing.T) {
+	assert.True(t, RejectAllPolicy.RejectsAll())
+	assert.False(t, AcceptAllPolicy.RejectsAll())
+	assert.False(t, ReducedPolicy.RejectsAll())
+	assert.False(t, mustParseTorrcPolicy("reject private:*,accept *:443,reject *:*").RejectsAll())
+
+	p := NewPolicyWithDefault(Accept)
+	p.Reject(AllPattern)
+	p.Accept(AllPattern)
+	assert.True(t, p.RejectsAll())
+}
+
 func TestPolicyAllow(t *testing.T) {
 	ip, port := RandIPPort()
 
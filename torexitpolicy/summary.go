@@ -0,0 +1,201 @@
+package torexitpolicy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Summary is a compact description of the ports a policy allows exit traffic
+// to, as used in consensus documents and microdescriptors.
+//
+// Reference: https://github.com/torproject/torspec/blob/4074b891e53e8df951fc596ac6758d74da290c60/dir-spec.txt#L2537-L2547
+//
+//	    "p" SP ("accept" / "reject") SP PortList NL
+//
+//	        [At most once.]
+//
+//	        PortList = PortOrRange
+//	        PortList = PortList "," PortOrRange
+//	        PortOrRange = INT "-" INT / INT
+//
+//	        A list of those ports that this router supports (if 'accept')
+//	        or does not support (if 'reject') for exit to "most
+//	        addresses".
+//
+type Summary struct {
+	Action Action
+	Ports  []PortRange
+}
+
+// String formats the summary as it appears after the "p" keyword.
+func (s Summary) String() string {
+	ports := make([]string, len(s.Ports))
+	for i, r := range s.Ports {
+		ports[i] = r.String()
+	}
+	return s.Action.Describe() + " " + strings.Join(ports, ",")
+}
+
+// Allow reports whether the summary permits exit traffic to port.
+func (s Summary) Allow(port uint16) bool {
+	for _, r := range s.Ports {
+		if r.Contains(port) {
+			return bool(s.Action)
+		}
+	}
+	return !bool(s.Action)
+}
+
+// ParseSummary parses a summary such as "accept 80,443,8000-8100".
+func ParseSummary(s string) (Summary, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return Summary{}, errors.Errorf("malformed policy summary %q", s)
+	}
+
+	var summary Summary
+	switch fields[0] {
+	case "accept":
+		summary.Action = Accept
+	case "reject":
+		summary.Action = Reject
+	default:
+		return Summary{}, errors.Errorf("unknown policy summary action %q", fields[0])
+	}
+
+	for _, p := range strings.Split(fields[1], ",") {
+		r, err := ParsePortRange(p)
+		if err != nil || p == "*" {
+			return Summary{}, errors.Errorf("invalid port list %q", fields[1])
+		}
+		summary.Ports = append(summary.Ports, r)
+	}
+
+	return summary, nil
+}
+
+// Thresholds above which rejected addresses count as rejecting "most
+// addresses". Following tor, IPv4 rejects count once they cover more than a
+// /7, and IPv6 rejects once they cover more than a /15 (counted in /64s).
+const (
+	rejectCutoffIPv4 = uint64(1) << 25
+	rejectCutoffIPv6 = uint64(1) << 49
+)
+
+// Summary summarizes the IPv4 exit policy.
+func (p *Policy) Summary() Summary {
+	return p.summarize(false)
+}
+
+// SummaryIPv6 summarizes the IPv6 exit policy.
+func (p *Policy) SummaryIPv6() Summary {
+	return p.summarize(true)
+}
+
+// summarize determines, for every port, whether the policy accepts traffic to
+// most addresses of one family. Rules for private networks and accept rules
+// for specific networks are ignored.
+func (p *Policy) summarize(ipv6 bool) Summary {
+	const numPorts = 1 << 16
+	var (
+		decided  = make([]bool, numPorts)
+		accepted = make([]bool, numPorts)
+		rejected = make([]uint64, numPorts)
+	)
+
+	cutoff := rejectCutoffIPv4
+	if ipv6 {
+		cutoff = rejectCutoffIPv6
+	}
+
+	for _, r := range p.Rules() {
+		var (
+			ports    = AllPorts
+			wildcard = true
+			size     uint64
+		)
+		if a, ok := r.Pattern.(*AddressPattern); ok {
+			if (ipv6 && a.IsIPv4()) || (!ipv6 && a.IsIPv6()) {
+				continue
+			}
+			ports = a.Ports
+			wildcard = a.IsWildcard()
+			if !wildcard {
+				if r.Action == Accept || isPrivate(a.Network) {
+					continue
+				}
+				size = networkSize(a.Network)
+			}
+		} else if r.Pattern != AllPattern {
+			continue
+		}
+
+		for port := int(ports.Min); port <= int(ports.Max); port++ {
+			if decided[port] {
+				continue
+			}
+			if wildcard {
+				decided[port] = true
+				accepted[port] = bool(r.Action)
+				continue
+			}
+			rejected[port] += size
+			if rejected[port] >= cutoff {
+				decided[port] = true
+			}
+		}
+	}
+
+	accepts := Summary{Action: Accept}
+	rejects := Summary{Action: Reject}
+	for port := 1; port < numPorts; port++ {
+		s := &rejects
+		if accepted[port] {
+			s = &accepts
+		}
+		n := len(s.Ports)
+		if n > 0 && int(s.Ports[n-1].Max) == port-1 {
+			s.Ports[n-1].Max = uint16(port)
+			continue
+		}
+		s.Ports = append(s.Ports, PortRange{Min: uint16(port), Max: uint16(port)})
+	}
+
+	switch {
+	case len(accepts.Ports) == 0:
+		return rejects
+	case len(rejects.Ports) == 0:
+		return accepts
+	case len(accepts.String()) <= len(rejects.String()):
+		return accepts
+	default:
+		return rejects
+	}
+}
+
+// networkSize returns the number of addresses in an IPv4 network, or the
+// number of /64 networks in an IPv6 network.
+func networkSize(n *net.IPNet) uint64 {
+	ones, bits := n.Mask.Size()
+	if bits == 8*net.IPv6len {
+		bits = 64
+	}
+	if ones >= bits {
+		return 1
+	}
+	return uint64(1) << uint(bits-ones)
+}
+
+// isPrivate reports whether n is contained in one of the PrivateNetworks.
+func isPrivate(n *net.IPNet) bool {
+	ones, bits := n.Mask.Size()
+	for _, priv := range PrivateNetworks {
+		pones, pbits := priv.Mask.Size()
+		if pbits == bits && pones <= ones && priv.Contains(n.IP) {
+			return true
+		}
+	}
+	return false
+}
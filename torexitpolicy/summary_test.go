@@ -0,0 +1,70 @@
+package torexitpolicy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicySummary(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Policy *Policy
+		Expect string
+	}{
+		{"RejectAll", RejectAllPolicy, "reject 1-65535"},
+		{"AcceptAll", AcceptAllPolicy, "accept 1-65535"},
+		{"Default", DefaultPolicy, "reject 25,119,135-139,445,563,1214,4661-4666,6346-6429,6699,6881-6999"},
+		{"RejectPrivate", RejectPrivatePolicy, "accept 1-65535"},
+	}
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			assert.Equal(t, c.Expect, c.Policy.Summary().String())
+		})
+	}
+}
+
+func TestPolicySummaryIgnoresSpecificNetworks(t *testing.T) {
+	p, err := ParsePolicy([]string{
+		"accept 1.2.3.4:22",
+		"reject 18.0.0.0/8:80",
+		"reject 0.0.0.0/7:443",
+		"accept *:80",
+		"accept *:443",
+		"reject *:*",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "accept 80", p.Summary().String())
+}
+
+func TestPolicySummaryIPv6(t *testing.T) {
+	rules, err := ParseTorrcRules("accept6 *:443,reject6 *:*,accept *:80,reject *:*")
+	require.NoError(t, err)
+	p := NewPolicyFromRules(rules)
+	assert.Equal(t, "accept 80", p.Summary().String())
+	assert.Equal(t, "accept 443", p.SummaryIPv6().String())
+}
+
+func TestParseSummary(t *testing.T) {
+	s, err := ParseSummary("accept 80,443,8000-8100")
+	require.NoError(t, err)
+	assert.Equal(t, Summary{
+		Action: Accept,
+		Ports:  []PortRange{{80, 80}, {443, 443}, {8000, 8100}},
+	}, s)
+	assert.Equal(t, "accept 80,443,8000-8100", s.String())
+	assert.True(t, s.Allow(8080))
+	assert.False(t, s.Allow(22))
+
+	s, err = ParseSummary("reject 1-65535")
+	require.NoError(t, err)
+	assert.False(t, s.Allow(80))
+}
+
+func TestParseSummaryErrors(t *testing.T) {
+	for _, s := range []string{"", "accept", "allow 80", "accept *", "accept 80,,443", "accept 80 443"} {
+		_, err := ParseSummary(s)
+		assert.Error(t, err, s)
+	}
+}
@@ -16,3 +16,9 @@ func NewFingerprintFromBytes(b []byte) (Fingerprint, error) {
 type Fingerprinted interface {
 	Fingerprint() (Fingerprint, error)
 }
+
+// Ed25519Identified is something that may specify an Ed25519 identity key.
+// Ed25519Identity returns nil if there is none.
+type Ed25519Identified interface {
+	Ed25519Identity() []byte
+}